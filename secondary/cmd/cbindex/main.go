@@ -44,6 +44,9 @@ func usage(fset *flag.FlagSet) {
     Index And 1 Replica:
     cbindex -auth user:pass -type move -index 'def_airportname' -bucket default -with '{"nodes":["10.17.6.32:8091","10.17.6.33:8091"]}'
     (Move Index supports moving only 1 index (and its replicas) at a time)
+
+- Check Replicas
+    cbindex -auth user:pass -type checkReplicas -index 'def_airportname' -bucket default
     `)
 }
 
@@ -12,6 +12,7 @@ package main
 import (
 	"flag"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/couchbase/cbauth"
@@ -51,6 +52,8 @@ func main() {
 	keyFile := fset.String("keyFile", "", "Index https cert key file")
 	isEnterprise := fset.Bool("isEnterprise", true, "Enterprise Edition")
 	isIPv6 := fset.Bool("ipv6", false, "IPV6 cluster")
+	topologyFile := fset.String("standaloneTopology", "", "Topology file of a standalone node, run without cluster manager")
+	metakvFile := fset.String("standaloneMetakv", "", "Metakv file of a standalone node, defaults to metakv.json next to the topology file")
 
 	for i := 1; i < len(os.Args); i++ {
 		if err := fset.Parse(os.Args[i : i+1]); err != nil {
@@ -65,8 +68,20 @@ func main() {
 	logging.SetLogLevel(logging.Level(*logLevel))
 	forestdb.Log = &logging.SystemLogger
 
+	if *topologyFile != "" {
+		common.SetIpv6(*isIPv6)
+		if *metakvFile == "" {
+			*metakvFile = filepath.Join(filepath.Dir(*topologyFile), "metakv.json")
+		}
+		if err := common.SetupStandalone(*topologyFile, *metakvFile); err != nil {
+			logging.Fatalf("Failed to setup standalone mode: %v", err)
+			common.CrashOnError(err)
+		}
+		*cluster = common.GetStandaloneTopology().ClusterAddr()
+	}
+
 	// setup cbauth
-	if *auth != "" {
+	if *auth != "" && !common.IsStandalone() {
 		up := strings.Split(*auth, ":")
 		logging.Tracef("Initializing cbauth with user %v for cluster %v\n", logging.TagUD(up[0]), *cluster)
 		if _, err := cbauth.InternalRetryDefaultInit(*cluster, up[0], up[1]); err != nil {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/couchbase/cbauth"
@@ -26,6 +27,9 @@ var options struct {
 	loglevel    string
 	diagDir     string
 	isIPv6      bool
+
+	topologyFile string
+	metakvFile   string
 }
 
 func argParse() string {
@@ -39,6 +43,8 @@ func argParse() string {
 	fset.StringVar(&options.auth, "auth", "", "Auth user and password")
 	fset.StringVar(&options.diagDir, "diagDir", "./", "Directory for writing projector diagnostic information")
 	fset.BoolVar(&options.isIPv6, "ipv6", false, "IPV6 cluster")
+	fset.StringVar(&options.topologyFile, "standaloneTopology", "", "Topology file of a standalone node, run without cluster manager")
+	fset.StringVar(&options.metakvFile, "standaloneMetakv", "", "Metakv file of a standalone node, defaults to metakv.json next to the topology file")
 
 	logging.Infof("Parsing the args")
 
@@ -53,7 +59,10 @@ func argParse() string {
 	}
 
 	args := fset.Args()
-	if len(args) == 0 {
+	if len(args) == 0 && options.topologyFile != "" {
+		// cluster address is the one of the standalone topology
+		return ""
+	} else if len(args) == 0 {
 		usage()
 		os.Exit(1)
 	}
@@ -74,6 +83,20 @@ func main() {
 
 	cluster := argParse() // eg. "localhost:9000"
 
+	if options.topologyFile != "" {
+		c.SetIpv6(options.isIPv6)
+		if options.metakvFile == "" {
+			options.metakvFile = filepath.Join(filepath.Dir(options.topologyFile), "metakv.json")
+		}
+		if err := c.SetupStandalone(options.topologyFile, options.metakvFile); err != nil {
+			logging.Fatalf("Failed to setup standalone mode: %v", err)
+			c.CrashOnError(err)
+		}
+		if cluster == "" {
+			cluster = c.GetStandaloneTopology().ClusterAddr()
+		}
+	}
+
 	config := c.SystemConfig.Clone()
 	logging.SetLogLevel(logging.Level(options.loglevel))
 
@@ -92,7 +115,7 @@ func main() {
 	}
 
 	// setup cbauth
-	if options.auth != "" {
+	if options.auth != "" && !c.IsStandalone() {
 		up := strings.Split(options.auth, ":")
 		if _, err := cbauth.InternalRetryDefaultInit(cluster, up[0], up[1]); err != nil {
 			logging.Fatalf("Failed to initialize cbauth: %s", err)
@@ -8,6 +8,7 @@ import "strconv"
 
 // error codes
 var ErrorSuffixDecoding = errors.New("collatejson.suffixDecoding")
+var ErrorInvalidNumber = errors.New("collatejson.invalidNumber")
 
 // Constants used in text representation of basic data types.
 const (
@@ -221,7 +222,12 @@ func EncodeFloat(text, code []byte) []byte {
 		code = append(code, ZERO)
 		return code
 	}
+	return encodeScientific(text, code)
+}
 
+// local function called by EncodeFloat and EncodeDecimal, text is a non-zero
+// number in scientific notation.
+func encodeScientific(text, code []byte) []byte {
 	prefix, text := signPrefix(text)
 	code = append(code, prefix)
 
@@ -257,8 +263,153 @@ func EncodeFloat(text, code []byte) []byte {
 	return code
 }
 
+// number of digits in the largest int64 value.
+const maxInt64Digits = 19
+
+// EncodeDecimal encodes a JSON number of arbitrary precision, like
+// 12345678901234567890 or 0.10000000000000000001, without converting it to
+// float64. Integers are encoded like int64 values and other numbers like
+// float64 values, hence they collate with each other.
+func EncodeDecimal(text, code []byte) ([]byte, error) {
+	sci, err := decimalToScientific(text)
+	if err != nil {
+		return nil, err
+	} else if sci == nil {
+		code = append(code, ZERO)
+		return code, nil
+	}
+	return encodeScientific(sci, code), nil
+}
+
+// local function that converts a JSON number to scientific notation, as
+// formatted by Integer.ConvertToScientificNotation for integers and by
+// strconv.FormatFloat(f, 'e', -1, 64) for other numbers. Returns nil if
+// text is zero.
+func decimalToScientific(text []byte) ([]byte, error) {
+	if len(text) == 0 {
+		return nil, ErrorInvalidNumber
+	}
+
+	var sign []byte
+	if text[0] == PLUS || text[0] == MINUS {
+		sign, text = text[:1], text[1:]
+	}
+
+	// collect the digits and the position of decimal point.
+	digits := make([]byte, 0, len(text))
+	point, exp := -1, 0
+	for i, x := range text {
+		if x >= '0' && x <= '9' {
+			digits = append(digits, x)
+		} else if x == DOT && point < 0 {
+			point = len(digits)
+		} else if x == 'e' || x == 'E' {
+			e, err := strconv.Atoi(string(text[i+1:]))
+			if err != nil {
+				return nil, ErrorInvalidNumber
+			}
+			exp = e
+			break
+		} else {
+			return nil, ErrorInvalidNumber
+		}
+	}
+	if len(digits) == 0 {
+		return nil, ErrorInvalidNumber
+	} else if point < 0 {
+		point = len(digits)
+	}
+	point += exp
+
+	for len(digits) > 0 && digits[0] == ZERO {
+		digits, point = digits[1:], point-1
+	}
+	if len(digits) == 0 {
+		return nil, nil
+	}
+
+	// trailing zeros are dropped, except for integers in the range of
+	// int64, to have the same encoding as int64 values.
+	n := len(digits)
+	for n > 1 && digits[n-1] == ZERO && (n > point || point > maxInt64Digits) {
+		n--
+	}
+	digits = digits[:n]
+
+	sci := make([]byte, 0, len(sign)+len(digits)+maxInt64Digits+24)
+	sci = append(sci, sign...)
+	sci = append(sci, digits[0], DOT)
+	sci = append(sci, digits[1:]...)
+	if point <= maxInt64Digits {
+		for i := len(digits); i < point; i++ {
+			sci = append(sci, ZERO)
+		}
+	}
+	sci = append(sci, 'e')
+	if point > 0 {
+		sci = append(sci, PLUS)
+	}
+	sci = strconv.AppendInt(sci, int64(point-1), 10)
+	return sci, nil
+}
+
 var flipmap = map[byte]byte{PLUS: MINUS, MINUS: PLUS}
 
+// numbers with a larger exponent are decoded in scientific notation.
+const maxDecimalExponent = 400
+
+// local function that converts the output of DecodeFloat, like +0.1025e+2,
+// to a JSON number without exponent, like 10.25.
+func scientificToDecimal(text []byte) []byte {
+	e := bytes.IndexByte(text, 'e')
+	if e < 0 { // zero
+		return text
+	}
+	exp, err := strconv.Atoi(string(text[e+1:]))
+	if err != nil || abs(exp) > maxDecimalExponent {
+		return text
+	}
+
+	var sign []byte
+	mantissa := text[:e]
+	if mantissa[0] == PLUS || mantissa[0] == MINUS {
+		sign, mantissa = mantissa[:1], mantissa[1:]
+	}
+	if len(mantissa) < 3 || mantissa[0] != ZERO || mantissa[1] != DOT {
+		return text
+	}
+	digits := mantissa[2:]
+
+	out := make([]byte, 0, len(digits)+len(sign)+abs(exp)+2)
+	if len(sign) > 0 && sign[0] == MINUS {
+		out = append(out, MINUS)
+	}
+	if exp <= 0 {
+		out = append(out, ZERO, DOT)
+		for i := exp; i < 0; i++ {
+			out = append(out, ZERO)
+		}
+		return append(out, digits...)
+	}
+	if exp >= len(digits) {
+		out = append(out, digits...)
+		for i := len(digits); i < exp; i++ {
+			out = append(out, ZERO)
+		}
+		return out
+	}
+	out = append(out, digits[:exp]...)
+	out = append(out, DOT)
+	return append(out, digits[exp:]...)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
 // DecodeFloat complements EncodeFloat, it returns `exponent` and `mantissa`
 // in text format.
 func DecodeFloat(code, text []byte) []byte {
@@ -84,15 +84,8 @@ type Codec struct {
 	doMissing         bool        // if true, handle missing values (for N1QL)
 	numberType        interface{} // "float64" | "int64" | "decimal"
 	//-- unicode
-	//backwards        bool
-	//hiraganaQ        bool
-	//caseLevel        bool
-	//numeric          bool
-	//nfkd              bool
-	//utf8              bool
-	//strength          colltab.Level
-	//alternate         collate.AlternateHandling
-	//language          language.Tag
+	collation *Collation // if not nil, sort strings by collation key
+	bound     Bound      // encode collated strings as scan bounds
 }
 
 // NewCodec creates a new codec object and returns a reference to it.
@@ -128,6 +121,8 @@ func (codec *Codec) UseMissing(what bool) {
 
 // NumberType chooses type of encoding / decoding for JSON
 // numbers. Can be "float64", "int64", "decimal".
+// With "decimal", numbers are encoded and decoded without
+// loss of precision, big integers and decimals included.
 // Default is "float64"
 func (codec *Codec) NumberType(what string) {
 	switch what {
@@ -151,7 +146,13 @@ func (codec *Codec) Encode(text, code []byte) ([]byte, error) {
 		return code, nil
 	}
 	var m interface{}
-	if err := json.Unmarshal(text, &m); err != nil {
+	if _, ok := codec.numberType.(string); ok {
+		dec := json.NewDecoder(bytes.NewReader(text))
+		dec.UseNumber()
+		if err := dec.Decode(&m); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(text, &m); err != nil {
 		return nil, err
 	}
 	return codec.json2code(m, code)
@@ -207,6 +208,14 @@ func (codec *Codec) json2code(val interface{}, code []byte) ([]byte, error) {
 			code = append(code, Terminator)
 		}
 
+	case json.Number:
+		code = append(code, TypeNumber)
+		cs, err = EncodeDecimal([]byte(value), code[1:])
+		if err == nil {
+			code = code[:len(code)+len(cs)]
+			code = append(code, Terminator)
+		}
+
 	case int:
 		code = append(code, TypeNumber)
 		cs = EncodeInt([]byte(strconv.Itoa(value)), code[1:])
@@ -223,6 +232,8 @@ func (codec *Codec) json2code(val interface{}, code []byte) ([]byte, error) {
 		if codec.doMissing && MissingLiteral.Equal(value) {
 			code = append(code, TypeMissing)
 			code = append(code, Terminator)
+		} else if codec.collation != nil {
+			code, err = codec.encodeCollatedString([]byte(value), code)
 		} else {
 			code = append(code, TypeString)
 			cs = suffixEncodeString([]byte(value), code[1:])
@@ -333,7 +344,15 @@ func (codec *Codec) code2json(code, text []byte) ([]byte, []byte, error) {
 	case TypeString:
 		var strb []byte
 		tmp := bufPool.Get().(*[]byte)
-		strb, remaining, err = suffixDecodeString(code[1:], (*tmp)[:0])
+		if isCollated(code) {
+			// skip the collation key
+			_, remaining, err = suffixDecodeString(code[3:], (*tmp)[:0])
+			if err == nil {
+				strb, remaining, err = suffixDecodeString(remaining, (*tmp)[:0])
+			}
+		} else {
+			strb, remaining, err = suffixDecodeString(code[1:], (*tmp)[:0])
+		}
 		if err == nil {
 			text, err = encodeString(strb, text)
 			bufPool.Put(tmp)
@@ -481,22 +500,16 @@ func (codec *Codec) normalizeFloat(value float64, code []byte) ([]byte, error) {
 }
 
 func (codec *Codec) denormalizeFloat(text []byte) ([]byte, error) {
-	var err error
-	var f float64
-
 	switch codec.numberType.(type) {
 	case float64:
 		return text, nil
 
 	case int64:
-		f, err = strconv.ParseFloat(string(text), 64)
+		f, _ := strconv.ParseFloat(string(text), 64)
 		return []byte(strconv.Itoa(int(f))), nil
 
 	case string:
-		f, err = strconv.ParseFloat(string(text), 64)
-		if err == nil {
-			return []byte(strconv.FormatFloat(f, 'f', -1, 64)), nil
-		}
+		return scientificToDecimal(text), nil
 
 	default:
 		return text, nil
@@ -539,14 +552,20 @@ func (codec *Codec) n1ql2code(val n1ql.Value, code []byte) ([]byte, error) {
 			var number Integer
 			intStr, err = number.ConvertToScientificNotation(act.(int64))
 			cs = EncodeFloat([]byte(intStr), code[1:])
+		case fmt.Stringer: // arbitrary precision, like json.Number
+			cs, err = EncodeDecimal([]byte(act.(fmt.Stringer).String()), code[1:])
 		}
 		if err == nil {
 			code = code[:len(code)+len(cs)]
 			code = append(code, Terminator)
 		}
 	case n1ql.STRING:
-		code = append(code, TypeString)
 		act := val.ActualForIndex().(string)
+		if codec.collation != nil {
+			code, err = codec.encodeCollatedString([]byte(act), code)
+			break
+		}
+		code = append(code, TypeString)
 		cs = suffixEncodeString([]byte(act), code[1:])
 		code = code[:len(code)+len(cs)]
 		code = append(code, Terminator)
@@ -51,6 +51,8 @@ func getEncodedString(code []byte) ([]byte, []byte, error) {
 					return nil, nil, nil
 				}
 				return code[:i+1], code[i+1:], nil
+			case 1, ^byte(1): // escaped zero byte
+				continue
 			default:
 				return nil, nil, ErrorSuffixDecoding
 			}
@@ -60,6 +62,20 @@ func getEncodedString(code []byte) ([]byte, []byte, error) {
 	return nil, nil, ErrorSuffixDecoding
 }
 
+// get the encoded collated string, made of the collation key and the
+// original string, each terminated like a string.
+func getEncodedCollatedString(code []byte) ([]byte, []byte, error) {
+	key, remaining, err := getEncodedString(code[3:])
+	if err != nil {
+		return nil, nil, err
+	}
+	str, remaining, err := getEncodedString(remaining)
+	if err != nil {
+		return nil, nil, err
+	}
+	return code[:3+len(key)+len(str)], remaining, nil
+}
+
 //extracts a given field from the encoded byte stream
 func (codec *Codec) extractEncodedField(code []byte, fieldPos int) ([]byte, []byte, error) {
 	if len(code) == 0 {
@@ -94,7 +110,11 @@ func (codec *Codec) extractEncodedField(code []byte, fieldPos int) ([]byte, []by
 		datum, remaining = getEncodedDatum(code)
 
 	case TypeString, ^TypeString:
-		datum, remaining, err = getEncodedString(code)
+		if isCollated(code) {
+			datum, remaining, err = getEncodedCollatedString(code)
+		} else {
+			datum, remaining, err = getEncodedString(code)
+		}
 
 	case TypeArray, ^TypeArray:
 		var l, currField, currFieldStart int
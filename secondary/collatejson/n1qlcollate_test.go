@@ -2,12 +2,117 @@
 
 package collatejson
 
+import "bytes"
 import "encoding/json"
 import "reflect"
 import "testing"
 
 import qv "github.com/couchbase/query/value"
 
+func TestN1QLDecimalCollate(t *testing.T) {
+	// in ascending order, float64 values are encoded with float64 codec.
+	var samples = []struct {
+		text    string
+		float64 bool
+	}{
+		{"-123456789012345678901234567890", false},
+		{"-1.5e20", true},
+		{"-9223372036854775809", false},
+		{"-1.5", false},
+		{"-0.10000000000000000001", false},
+		{"-0.1", true},
+		{"0", false},
+		{"0.1", false},
+		{"0.10000000000000000001", false},
+		{"10", false},
+		{"10.25", false},
+		{"9.007199254740992e15", true},
+		{"9007199254740993", false},
+		{"9.007199254740994e15", true},
+		{"9223372036854775807", false},
+		{"9223372036854775808", false},
+		{"12345678901234567890", false},
+		{"1.3e19", true},
+		{"100000000000000000000000000001", false},
+	}
+
+	decimal, float := NewCodec(16), NewCodec(16)
+	decimal.NumberType("decimal")
+	var prev []byte
+	for _, sample := range samples {
+		codec := decimal
+		if sample.float64 {
+			codec = float
+		}
+		code, err := codec.Encode([]byte(sample.text), make([]byte, 0, 1024))
+		if err != nil {
+			t.Fatalf("encoding %v: %v", sample.text, err)
+		}
+		if prev != nil && bytes.Compare(prev, code) >= 0 {
+			t.Errorf("expected %v to sort after the previous number", sample.text)
+		}
+		prev = code
+
+		if sample.float64 {
+			continue
+		}
+		text, err := decimal.Decode(code, make([]byte, 0, 1024))
+		if err != nil {
+			t.Fatalf("decoding %v: %v", sample.text, err)
+		} else if string(text) != sample.text {
+			t.Errorf("expected %v, got %v", sample.text, string(text))
+		}
+	}
+}
+
+func TestN1QLBigInteger(t *testing.T) {
+	codec := NewCodec(16)
+	codec.NumberType("decimal")
+
+	for _, text := range []string{`9007199254740993`, `[-9223372036854775807,1]`} {
+		var value interface{}
+		dec := json.NewDecoder(bytes.NewReader([]byte(text)))
+		dec.UseNumber()
+		if err := dec.Decode(&value); err != nil {
+			t.Fatal(err)
+		}
+		value = toInt64(value)
+
+		n1qlcode, err := codec.EncodeN1QLValue(qv.NewValue(value), make([]byte, 0, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := codec.Encode([]byte(text), make([]byte, 0, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(code, n1qlcode) {
+			t.Errorf("expected %q, got %q", code, n1qlcode)
+		}
+
+		out, err := codec.Decode(n1qlcode, make([]byte, 0, 1024))
+		if err != nil {
+			t.Fatal(err)
+		} else if string(out) != text {
+			t.Errorf("expected %v, got %v", text, string(out))
+		}
+	}
+}
+
+// convert json.Number to int64, for n1ql values.
+func toInt64(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		i, _ := v.Int64()
+		return i
+	case []interface{}:
+		for i, x := range v {
+			v[i] = toInt64(x)
+		}
+	}
+	return value
+}
+
 func BenchmarkN1QLValue(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		qv.NewValue(testcases[0].text)
@@ -0,0 +1,460 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+
+package collatejson
+
+import "bytes"
+import "errors"
+import "io"
+import "sort"
+import "strconv"
+import "sync"
+
+import json "github.com/couchbase/indexing/secondary/common/json"
+
+// ErrorJSONToken means input JSON text has an unexpected token.
+var ErrorJSONToken = errors.New("collatejson.jsonToken")
+
+// ErrorInvalidCode means input is not a valid collatejson encoding.
+var ErrorInvalidCode = errors.New("collatejson.invalidCode")
+
+// Encoder encodes JSON text to its binary representation, like
+// Codec.Encode, straight from the tokens of JSON text without
+// unmarshaling it into golang values. Unlike Codec.Encode, output buffer
+// is grown if it is not large enough.
+//
+// An Encoder reuses its buffers across calls and is not safe for
+// concurrent use.
+type Encoder struct {
+	codec   *Codec
+	w       io.Writer
+	tokens  json.Tokenizer
+	code    []byte       // output buffer when writing to w
+	numbuf  []byte       // scratch buffer for numbers and lengths
+	objbuf  []byte       // scratch buffer to sort object properties
+	members []objectItem // stack of object properties being encoded
+}
+
+// property of an object, start and end are offsets in output buffer.
+type objectItem struct {
+	key        []byte
+	start, end int
+}
+
+type byItemKey []objectItem
+
+func (items byItemKey) Len() int           { return len(items) }
+func (items byItemKey) Swap(i, j int)      { items[i], items[j] = items[j], items[i] }
+func (items byItemKey) Less(i, j int) bool { return bytes.Compare(items[i].key, items[j].key) < 0 }
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		return &Encoder{}
+	},
+}
+
+var decoderPool = sync.Pool{
+	New: func() interface{} {
+		return &Decoder{}
+	},
+}
+
+// NewEncoder returns an encoder that writes the binary representation of
+// JSON text to w.
+func (codec *Codec) NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{codec: codec, w: w}
+}
+
+// EncodeJSON encodes JSON text to its binary representation and appends
+// it to `code`, with the same output as Encode. Buffer `code` is grown if
+// needed.
+func (codec *Codec) EncodeJSON(text, code []byte) ([]byte, error) {
+	enc := encoderPool.Get().(*Encoder)
+	enc.codec = codec
+	code, err := enc.Append(text, code)
+	enc.codec, enc.members = nil, enc.members[:0]
+	enc.tokens.Reset(nil)
+	encoderPool.Put(enc)
+	return code, err
+}
+
+// Encode JSON text and write its binary representation to the writer.
+func (enc *Encoder) Encode(text []byte) error {
+	code, err := enc.Append(text, enc.code[:0])
+	if err != nil {
+		return err
+	}
+	enc.code = code
+	_, err = enc.w.Write(code)
+	return err
+}
+
+// Append encodes JSON text and appends its binary representation to
+// `code`, buffer is grown if needed.
+func (enc *Encoder) Append(text, code []byte) ([]byte, error) {
+	if len(text) == 0 {
+		return code, nil
+	}
+
+	enc.tokens.Reset(text)
+	enc.members = enc.members[:0]
+	kind, literal, err := enc.tokens.Next()
+	if err != nil {
+		return nil, err
+	}
+	if code, err = enc.value(kind, literal, code); err != nil {
+		return nil, err
+	}
+	if kind, _, err = enc.tokens.Next(); err != nil {
+		return nil, err
+	} else if kind != json.TokenEOF {
+		return nil, ErrorJSONToken
+	}
+	return code, nil
+}
+
+func (enc *Encoder) value(kind json.TokenKind, literal, code []byte) ([]byte, error) {
+	switch kind {
+	case json.TokenNull:
+		code = append(code, TypeNull, Terminator)
+
+	case json.TokenTrue:
+		code = append(code, TypeTrue, Terminator)
+
+	case json.TokenFalse:
+		code = append(code, TypeFalse, Terminator)
+
+	case json.TokenNumber:
+		return enc.number(literal, code)
+
+	case json.TokenString:
+		s, ok := json.UnquoteBytes(literal)
+		if !ok {
+			return nil, ErrorJSONToken
+		}
+		return enc.str(s, code), nil
+
+	case json.TokenBeginArray:
+		return enc.array(code)
+
+	case json.TokenBeginObject:
+		return enc.object(code)
+
+	default:
+		return nil, ErrorJSONToken
+	}
+	return code, nil
+}
+
+// numbers are encoded like json2code encodes the output of json.Unmarshal,
+// that is int64 if the number is an integer in its range, float64
+// otherwise.
+func (enc *Encoder) number(literal, code []byte) ([]byte, error) {
+	var err error
+
+	codec := enc.codec
+	if _, ok := codec.numberType.(string); ok {
+		enc.numbuf, err = EncodeDecimal(literal, enc.numbuf[:0])
+
+	} else if _, e := strconv.ParseInt(string(literal), 10, 64); e == nil {
+		// same encoding as Integer.ConvertToScientificNotation
+		enc.numbuf, err = EncodeDecimal(literal, enc.numbuf[:0])
+
+	} else {
+		var f float64
+		if f, err = strconv.ParseFloat(string(literal), 64); err == nil {
+			enc.numbuf, err = codec.normalizeFloat(f, enc.numbuf[:0])
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	code = append(code, TypeNumber)
+	code = append(code, enc.numbuf...)
+	code = append(code, Terminator)
+	return code, nil
+}
+
+func (enc *Encoder) str(s, code []byte) []byte {
+	codec := enc.codec
+	if codec.doMissing && string(s) == string(MissingLiteral) {
+		return append(code, TypeMissing, Terminator)
+
+	} else if codec.collation != nil {
+		key, value := codec.collatedKey(s)
+		return appendCollatedString(key, value, code)
+	}
+
+	code = append(code, TypeString)
+	code = suffixEncodeString(s, code)
+	code = append(code, Terminator)
+	return code
+}
+
+func (enc *Encoder) length(n int, code []byte) []byte {
+	var text [24]byte
+	enc.numbuf = EncodeInt(strconv.AppendInt(text[:0], int64(n), 10), enc.numbuf[:0])
+	code = append(code, TypeLength)
+	code = append(code, enc.numbuf...)
+	code = append(code, Terminator)
+	return code
+}
+
+func (enc *Encoder) array(code []byte) ([]byte, error) {
+	code = append(code, TypeArray)
+	start := len(code)
+
+	n := 0
+	for {
+		kind, literal, err := enc.tokens.Next()
+		if err != nil {
+			return nil, err
+		} else if kind == json.TokenEndArray {
+			break
+		}
+		if code, err = enc.value(kind, literal, code); err != nil {
+			return nil, err
+		}
+		n++
+	}
+
+	if enc.codec.arrayLenPrefix {
+		// insert length before the items.
+		end := len(code)
+		code = enc.length(n, code)
+		l := len(code) - end
+		enc.numbuf = append(enc.numbuf[:0], code[end:]...)
+		copy(code[start+l:], code[start:end])
+		copy(code[start:], enc.numbuf)
+	}
+	code = append(code, Terminator)
+	return code, nil
+}
+
+func (enc *Encoder) object(code []byte) ([]byte, error) {
+	code = append(code, TypeObj)
+	start := len(code)
+	base := len(enc.members)
+
+	for {
+		kind, literal, err := enc.tokens.Next()
+		if err != nil {
+			return nil, err
+		} else if kind == json.TokenEndObject {
+			break
+		} else if kind != json.TokenString {
+			return nil, ErrorJSONToken
+		}
+
+		key, ok := json.UnquoteBytes(literal)
+		if !ok {
+			return nil, ErrorJSONToken
+		}
+		item := objectItem{key: key, start: len(code)}
+		code = enc.str(key, code)
+
+		if kind, literal, err = enc.tokens.Next(); err != nil {
+			return nil, err
+		}
+		if code, err = enc.value(kind, literal, code); err != nil {
+			return nil, err
+		}
+		item.end = len(code)
+		enc.members = append(enc.members, item)
+	}
+
+	items := enc.members[base:]
+	sorted := true
+	for i := 1; i < len(items) && sorted; i++ {
+		sorted = bytes.Compare(items[i-1].key, items[i].key) < 0
+	}
+
+	if !sorted {
+		// same order as sortProps, for duplicate keys last one wins.
+		sort.Stable(byItemKey(items))
+		n := 0
+		for i, item := range items {
+			if i+1 < len(items) && bytes.Equal(item.key, items[i+1].key) {
+				continue
+			}
+			items[n] = item
+			n++
+		}
+		items = items[:n]
+	}
+
+	if !sorted || enc.codec.propertyLenPrefix {
+		enc.objbuf = append(enc.objbuf[:0], code[start:]...)
+		code = code[:start]
+		if enc.codec.propertyLenPrefix {
+			code = enc.length(len(items), code)
+		}
+		for _, item := range items {
+			code = append(code, enc.objbuf[item.start-start:item.end-start]...)
+		}
+	}
+	enc.members = enc.members[:base]
+
+	code = append(code, Terminator)
+	return code, nil
+}
+
+// Decoder decodes binary representation to JSON text, like Codec.Decode.
+// Unlike Codec.Decode, output buffer is grown if it is not large enough.
+//
+// A Decoder reuses its buffers across calls and is not safe for
+// concurrent use.
+type Decoder struct {
+	codec  *Codec
+	w      io.Writer
+	text   []byte // output buffer when writing to w
+	numbuf []byte // scratch buffer for numbers and lengths
+	strbuf []byte // scratch buffer for strings
+}
+
+// NewDecoder returns a decoder that writes JSON text to w.
+func (codec *Codec) NewDecoder(w io.Writer) *Decoder {
+	return &Decoder{codec: codec, w: w}
+}
+
+// DecodeJSON decodes binary representation to JSON text and appends it to
+// `text`, with the same output as Decode. Buffer `text` is grown if
+// needed.
+func (codec *Codec) DecodeJSON(code, text []byte) ([]byte, error) {
+	dec := decoderPool.Get().(*Decoder)
+	dec.codec = codec
+	text, err := dec.Append(code, text)
+	dec.codec = nil
+	decoderPool.Put(dec)
+	return text, err
+}
+
+// Decode binary representation and write its JSON text to the writer.
+func (dec *Decoder) Decode(code []byte) error {
+	text, err := dec.Append(code, dec.text[:0])
+	if err != nil {
+		return err
+	}
+	dec.text = text
+	_, err = dec.w.Write(text)
+	return err
+}
+
+// Append decodes binary representation and appends its JSON text to
+// `text`, buffer is grown if needed.
+func (dec *Decoder) Append(code, text []byte) ([]byte, error) {
+	if len(code) == 0 {
+		return text, nil
+	}
+	text, _, err := dec.value(code, text)
+	return text, err
+}
+
+func (dec *Decoder) value(code, text []byte) ([]byte, []byte, error) {
+	var datum, remaining []byte
+	var err error
+
+	switch code[0] {
+	case TypeMissing:
+		_, remaining = getDatum(code)
+		text = append(text, '"')
+		text = append(text, MissingLiteral...)
+		text = append(text, '"')
+
+	case TypeNull:
+		_, remaining = getDatum(code)
+		text = append(text, null...)
+
+	case TypeTrue:
+		_, remaining = getDatum(code)
+		text = append(text, boolTrue...)
+
+	case TypeFalse:
+		_, remaining = getDatum(code)
+		text = append(text, boolFalse...)
+
+	case TypeLength:
+		datum, remaining = getDatum(code)
+		_, dec.numbuf = DecodeInt(datum[1:], dec.numbuf[:0])
+		text = append(text, dec.numbuf...)
+
+	case TypeNumber:
+		datum, remaining = getDatum(code)
+		dec.numbuf = DecodeFloat(datum[1:], dec.numbuf[:0])
+		var ts []byte
+		if ts, err = dec.codec.denormalizeFloat(dec.numbuf); err != nil {
+			return nil, nil, err
+		}
+		ts = bytes.TrimLeft(ts, "+")
+		var number Integer
+		text = append(text, number.TryConvertFromScientificNotation(ts)...)
+
+	case TypeString:
+		if isCollated(code) {
+			// skip the collation key
+			if _, code, err = suffixDecodeString(code[3:], dec.strbuf[:0]); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			code = code[1:]
+		}
+		dec.strbuf, remaining, err = suffixDecodeString(code, dec.strbuf[:0])
+		if err != nil {
+			return nil, nil, err
+		}
+		if text, err = encodeString(dec.strbuf, text); err != nil {
+			return nil, nil, err
+		}
+
+	case TypeArray:
+		text = append(text, '[')
+		text, remaining, err = dec.items(code[1:], text, dec.codec.arrayLenPrefix, false)
+		text = append(text, ']')
+
+	case TypeObj:
+		text = append(text, '{')
+		text, remaining, err = dec.items(code[1:], text, dec.codec.propertyLenPrefix, true)
+		text = append(text, '}')
+
+	default:
+		return nil, nil, ErrorInvalidCode
+	}
+	return text, remaining, err
+}
+
+// decode items of an array, or properties of an object, until Terminator.
+func (dec *Decoder) items(code, text []byte, lenPrefix, object bool) ([]byte, []byte, error) {
+	var err error
+
+	if lenPrefix {
+		// number of items is implied by Terminator.
+		if len(code) == 0 || code[0] != TypeLength {
+			return nil, nil, ErrorInvalidCode
+		}
+		_, code = getDatum(code)
+	}
+
+	for i := 0; ; i++ {
+		if len(code) == 0 {
+			return nil, nil, ErrorInvalidCode
+		} else if code[0] == Terminator {
+			return text, code[1:], nil
+		}
+
+		if i > 0 {
+			text = append(text, ',')
+		}
+		if text, code, err = dec.value(code, text); err != nil {
+			return nil, nil, err
+		}
+		if object {
+			if len(code) == 0 {
+				return nil, nil, ErrorInvalidCode
+			}
+			text = append(text, ':')
+			if text, code, err = dec.value(code, text); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
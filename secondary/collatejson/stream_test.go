@@ -0,0 +1,182 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+
+package collatejson
+
+import "bytes"
+import "path/filepath"
+import "testing"
+
+var streamSamples = []string{
+	`null`, `true`, `false`, `0`, `-0`, `10`, `-10.25`, `1e-7`, `123456789012`,
+	`12345678901234567890`, `0.10000000000000000001`, `""`, `"hello"`,
+	`"a\u0000b\n\"\\"`, `"~[]{}falsenilNA~"`, `[]`, `{}`, ` [ 1 , "x" , null ] `,
+	`[[],[[]],{}]`, `{"b":1,"a":2}`, `{"a":1,"a":[2,3]}`,
+	`{"z":{"y":{"x":1,"w":[true,false]},"v":null},"u":"t"}`,
+	testcases[0].text, testcases[1].text,
+}
+
+func streamCodecs() map[string]*Codec {
+	codecs := make(map[string]*Codec)
+	codecs["default"] = NewCodec(16)
+	codecs["lenprefix"] = NewCodec(16)
+	codecs["lenprefix"].SortbyArrayLen(true)
+	codecs["nolenprefix"] = NewCodec(16)
+	codecs["nolenprefix"].SortbyPropertyLen(false)
+	codecs["decimal"] = NewCodec(16)
+	codecs["decimal"].NumberType("decimal")
+	codecs["nomissing"] = NewCodec(16)
+	codecs["nomissing"].UseMissing(false)
+	return codecs
+}
+
+func streamTexts(t *testing.T) [][]byte {
+	var texts [][]byte
+	for _, sample := range streamSamples {
+		texts = append(texts, []byte(sample))
+	}
+	files, _ := filepath.Glob(filepath.Join(testData, "*"))
+	for _, file := range files {
+		if filepath.Ext(file) != ".ref" {
+			texts = append(texts, readLines(file, t)...)
+		}
+	}
+	return texts
+}
+
+func TestEncodeJSON(t *testing.T) {
+	texts := streamTexts(t)
+	for name, codec := range streamCodecs() {
+		for _, text := range texts {
+			ref, err := codec.Encode(text, make([]byte, 0, 3*len(text)+MinBufferSize))
+			if err != nil {
+				continue
+			}
+			// small output buffer is grown.
+			code, err := codec.EncodeJSON(text, make([]byte, 0, 1))
+			if err != nil {
+				t.Errorf("%v: encoding %s: %v", name, text, err)
+			} else if !bytes.Equal(code, ref) {
+				t.Errorf("%v: encoding %s, expected %q, got %q", name, text, ref, code)
+			}
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	texts := streamTexts(t)
+	for name, codec := range streamCodecs() {
+		for _, text := range texts {
+			code, err := codec.Encode(text, make([]byte, 0, 3*len(text)+MinBufferSize))
+			if err != nil {
+				continue
+			}
+			ref, err := codec.Decode(code, make([]byte, 0, 3*len(code)+MinBufferSize))
+			if err != nil {
+				continue
+			}
+			out, err := codec.DecodeJSON(code, make([]byte, 0, 1))
+			if err != nil {
+				t.Errorf("%v: decoding %s: %v", name, text, err)
+			} else if !bytes.Equal(out, ref) {
+				t.Errorf("%v: decoding %s, expected %s, got %s", name, text, ref, out)
+			}
+		}
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	var code, text bytes.Buffer
+
+	codec := NewCodec(16)
+	enc, dec := codec.NewEncoder(&code), codec.NewDecoder(&text)
+	for _, sample := range streamSamples {
+		code.Reset()
+		text.Reset()
+		if err := enc.Encode([]byte(sample)); err != nil {
+			t.Fatalf("encoding %s: %v", sample, err)
+		}
+		ref, _ := codec.Encode([]byte(sample), make([]byte, 0, 1024))
+		if !bytes.Equal(code.Bytes(), ref) {
+			t.Errorf("encoding %s, expected %q, got %q", sample, ref, code.Bytes())
+		}
+		if err := dec.Decode(code.Bytes()); err != nil {
+			t.Fatalf("decoding %s: %v", sample, err)
+		}
+		out, _ := codec.Decode(ref, make([]byte, 0, 1024))
+		if !bytes.Equal(text.Bytes(), out) {
+			t.Errorf("decoding %s, expected %s, got %s", sample, out, text.Bytes())
+		}
+	}
+}
+
+func TestEncodeJSONInvalid(t *testing.T) {
+	codec := NewCodec(16)
+	for _, text := range []string{`{`, `[1,]`, `{"a"}`, `1 2`, `"abc`, `tru`, `1e400`} {
+		if _, err := codec.EncodeJSON([]byte(text), nil); err == nil {
+			t.Errorf("expected error for %s", text)
+		}
+	}
+	for _, code := range [][]byte{{TypeArray}, {TypeObj, TypeNull, Terminator}, {42}} {
+		if _, err := codec.DecodeJSON(code, nil); err == nil {
+			t.Errorf("expected error for %q", code)
+		}
+	}
+}
+
+func BenchmarkEncodeJSON(b *testing.B) {
+	codec := NewCodec(128)
+	codec.NumberType("decimal")
+	code := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		codec.EncodeJSON([]byte(testcases[0].text), code[:0])
+	}
+}
+
+func BenchmarkEncodeUnmarshal(b *testing.B) {
+	codec := NewCodec(128)
+	codec.NumberType("decimal")
+	code := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		codec.Encode([]byte(testcases[0].text), code[:0])
+	}
+}
+
+func BenchmarkEncoderWriter(b *testing.B) {
+	var buf bytes.Buffer
+	enc := NewCodec(128).NewEncoder(&buf)
+	text := []byte(testcases[0].text)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		enc.Encode(text)
+	}
+}
+
+func BenchmarkDecodeJSON(b *testing.B) {
+	codec := NewCodec(128)
+	codec.NumberType("decimal")
+	code, _ := codec.Encode([]byte(testcases[0].text), make([]byte, 0, 1024))
+	text := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		codec.DecodeJSON(code, text[:0])
+	}
+}
+
+func BenchmarkDecodeCode2JSON(b *testing.B) {
+	codec := NewCodec(128)
+	codec.NumberType("decimal")
+	code, _ := codec.Encode([]byte(testcases[0].text), make([]byte, 0, 1024))
+	text := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		codec.Decode(code, text[:0])
+	}
+}
@@ -1,62 +1,211 @@
 //  Copyright (c) 2013 Couchbase, Inc.
 
-// +build ignore
-
 package collatejson
 
-//import "code.google.com/p/go.text/collate"
-//import "code.google.com/p/go.text/collate/colltab"
-//import "code.google.com/p/go.text/language"
-//import "code.google.com/p/go.text/unicode/norm"
-
-// UnicodeCollationPriority sets collate.Collator properties for unicode
-// collation.
-func (codec *Codec) UnicodeCollationPriority(
-	strength colltab.Level, alternate collate.AlternateHandling,
-	backwards, hiraganaQ, caseLevel, numeric bool) {
-	codec.strength = strength
-	codec.alternate = alternate
-	codec.backwards = backwards
-	codec.hiraganaQ = hiraganaQ
-	codec.caseLevel = caseLevel
-	codec.numeric = numeric
-}
-
-// SetLanguage uses language tag while doing unicode collation.
-func (codec *Codec) SetLanguage(l language.Tag) {
-	codec.language = l
-}
-
-// EncodeUnicodeString encodes string in utf8 encoding to binary sequence based
-// on UTF8, NFKD or go.text/collate algorithms.
-func (codec *Codec) EncodeUnicodeString(value string) (code []byte) {
-	bs := []byte(value)
-	if codec.utf8 {
-		code = []byte(bs)
-	} else if codec.nfkd {
-		code = norm.NFKD.Bytes([]byte(bs)) // canonical decomposed
-	} else {
-		// TODO: Try to understand the performance implication of collate.Buffer
-		// object
-		buf := &collate.Buffer{}
-		c := collate.New(codec.language)
-		c.Strength = codec.strength
-		c.Alternate = codec.alternate
-		c.Backwards = codec.backwards
-		c.HiraganaQuaternary = codec.hiraganaQ
-		c.CaseLevel = codec.caseLevel
-		c.Numeric = codec.numeric
-		code = c.Key(buf, []byte(bs))
+import "errors"
+import "sync"
+
+import "golang.org/x/text/collate"
+import "golang.org/x/text/language"
+
+// ErrorCollationStrength means configured strength is not supported.
+var ErrorCollationStrength = errors.New("collatejson.collationStrength")
+
+// A collated string is encoded as,
+//
+//     TypeString Terminator collatedString <collation-key> <string>
+//
+// where both collation-key and string are suffix encoded. A plain string
+// never starts with Terminator followed by collatedString, hence collated
+// strings can be decoded without knowing the collation of the codec.
+const collatedString byte = 2
+
+// Bound is used while encoding scan keys for an index with collated strings.
+// Strings that are equal under the collation can differ in their bytes, the
+// bound picks the first or the last of them.
+type Bound byte
+
+const (
+	// NoBound encodes the string itself.
+	NoBound Bound = iota
+	// LowBound sorts before every string with the same collation key.
+	LowBound
+	// HighBound sorts after every string with the same collation key.
+	HighBound
+)
+
+// CollatedBufferFactor is the size of the output buffer, relative to the
+// input JSON text, to encode with collated strings.
+const CollatedBufferFactor = 16
+
+// placeholders for the original string of a bound, "\xfe" is never part of
+// a valid utf8 string.
+var lowBoundString = []byte("")
+var highBoundString = []byte("\xfe")
+
+// Collation orders strings by their unicode collation key for a locale.
+type Collation struct {
+	language  language.Tag
+	strength  string
+	caseLevel bool
+	pool      *sync.Pool // collate.Collator is not safe for concurrent use
+}
+
+type collator struct {
+	c   *collate.Collator
+	buf collate.Buffer
+}
+
+// NewCollation creates a unicode collation for locale, like "de" or "ja".
+// Strength can be "primary" (ignore accents and case), "secondary" (ignore
+// case) or "tertiary". If caseLevel is true, case is significant even with
+// primary strength.
+func NewCollation(locale, strength string, caseLevel bool) (*Collation, error) {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return nil, err
 	}
-	return code
+
+	levels := map[string]string{
+		"primary":   "level1",
+		"secondary": "level2",
+		"tertiary":  "level3",
+	}
+	if strength == "" {
+		strength = "tertiary"
+	}
+	level, ok := levels[strength]
+	if !ok {
+		return nil, ErrorCollationStrength
+	}
+	if tag, err = tag.SetTypeForKey("ks", level); err != nil {
+		return nil, err
+	}
+	if caseLevel {
+		if tag, err = tag.SetTypeForKey("kc", "true"); err != nil {
+			return nil, err
+		}
+	}
+
+	coll := &Collation{language: tag, strength: strength, caseLevel: caseLevel}
+	coll.pool = &sync.Pool{
+		New: func() interface{} {
+			return &collator{c: collate.New(tag, collate.OptionsFromTag(tag))}
+		},
+	}
+	return coll, nil
+}
+
+type collationKey struct {
+	locale    string
+	strength  string
+	caseLevel bool
+}
+
+// collations created by GetCollation, shared by all its callers.
+var collationsLock sync.Mutex
+var collations = make(map[collationKey]*Collation)
+
+// GetCollation is like NewCollation, but returns the same collation for
+// the same arguments, creating it only once.
+func GetCollation(locale, strength string, caseLevel bool) (*Collation, error) {
+	collationsLock.Lock()
+	defer collationsLock.Unlock()
+
+	key := collationKey{locale: locale, strength: strength, caseLevel: caseLevel}
+	if coll, ok := collations[key]; ok {
+		return coll, nil
+	}
+	coll, err := NewCollation(locale, strength, caseLevel)
+	if err != nil {
+		return nil, err
+	}
+	collations[key] = coll
+	return coll, nil
+}
+
+// Key returns the collation key of utf8 string s.
+func (coll *Collation) Key(s []byte) []byte {
+	c := coll.pool.Get().(*collator)
+	key := append([]byte(nil), c.c.Key(&c.buf, s)...)
+	c.buf.Reset()
+	coll.pool.Put(c)
+	return key
+}
+
+// String returns the locale, strength and case level of collation.
+func (coll *Collation) String() string {
+	s := coll.language.String() + "/" + coll.strength
+	if coll.caseLevel {
+		s += "/caselevel"
+	}
+	return s
+}
+
+// SortbyCollation orders strings by their collation key instead of their
+// utf8 bytes. The string itself is encoded after the key, so it can still be
+// decoded. Use nil to order by utf8 bytes.
+// Default is nil.
+func (codec *Codec) SortbyCollation(coll *Collation) {
+	codec.collation = coll
+}
+
+// CollationBound encodes strings as the low or high bound of all strings
+// with the same collation key. To be used for scan keys only.
+// Default is NoBound.
+func (codec *Codec) CollationBound(bound Bound) {
+	codec.bound = bound
 }
 
-// SortbyNFKD will enable an alternate collation using NFKD unicode standard.
-func (codec *Codec) SortbyNFKD(what bool) {
-	codec.nfkd = what
+// EncodeUnicodeString returns the collation key of string, or the string as
+// is, if codec has no collation.
+func (codec *Codec) EncodeUnicodeString(value string) []byte {
+	if codec.collation == nil {
+		return []byte(value)
+	}
+	return codec.collation.Key([]byte(value))
 }
 
-// SortbyUTF8 will do plain binary comparision for strings.
-func (codec *Codec) SortbyUTF8(what bool) {
-	codec.utf8 = what
+// encode string to code with its collation key. `code` is expected to have
+// enough capacity, it is not reallocated.
+func (codec *Codec) encodeCollatedString(value []byte, code []byte) ([]byte, error) {
+	key, value := codec.collatedKey(value)
+
+	// each byte can be escaped into two, plus type and terminators.
+	if cap(code)-len(code) < 2*(len(key)+len(value))+7 {
+		return nil, ErrorOutputLen
+	}
+	return appendCollatedString(key, value, code), nil
+}
+
+// return the collation key of value and the string to be encoded after it.
+func (codec *Codec) collatedKey(value []byte) ([]byte, []byte) {
+	key := codec.collation.Key(value)
+
+	switch codec.bound {
+	case LowBound:
+		value = lowBoundString
+	case HighBound:
+		value = highBoundString
+	}
+	return key, value
+}
+
+func appendCollatedString(key, value []byte, code []byte) []byte {
+	code = append(code, TypeString, Terminator, collatedString)
+	code = suffixEncodeString(key, code)
+	code = append(code, Terminator)
+	code = suffixEncodeString(value, code)
+	code = append(code, Terminator)
+	return code
+}
+
+// isCollated checks whether code is an encoded collated string, code may
+// be reversed for descending keys.
+func isCollated(code []byte) bool {
+	if len(code) < 3 {
+		return false
+	}
+	return (code[1] == Terminator && code[2] == collatedString) ||
+		(code[1] == ^Terminator && code[2] == ^collatedString)
 }
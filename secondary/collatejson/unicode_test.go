@@ -1,31 +1,114 @@
 //  Copyright (c) 2013 Couchbase, Inc.
 
-// +build ignore
-
 package collatejson
 
-func BenchmarkUtf8(b *testing.B) {
-	s := "prográmming"
-	codec := NewCodec()
-	codec.SortbyUTF8(true)
-	for i := 0; i < b.N; i++ {
-		codec.EncodeUnicodeString(s)
+import (
+	"bytes"
+	"testing"
+)
+
+func encodeCollated(t *testing.T, coll *Collation, bound Bound, text string) []byte {
+	codec := NewCodec(16)
+	codec.SortbyCollation(coll)
+	codec.CollationBound(bound)
+	code, err := codec.Encode([]byte(text), make([]byte, 0, 1024))
+	if err != nil {
+		t.Fatalf("encoding %v: %v", text, err)
 	}
+	return append([]byte(nil), code...)
 }
 
-func BenchmarkNFKD(b *testing.B) {
-	s := "prográmming"
-	codec := NewCodec()
-	codec.SortbyNFKD(true)
-	for i := 0; i < b.N; i++ {
-		codec.EncodeUnicodeString(s)
+func TestCollationPrimary(t *testing.T) {
+	coll, err := NewCollation("de", "primary", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// equal under primary strength, but not byte-wise.
+	a := encodeCollated(t, coll, LowBound, `["muller"]`)
+	b := encodeCollated(t, coll, NoBound, `["Müller"]`)
+	c := encodeCollated(t, coll, HighBound, `["MULLER"]`)
+	if !(bytes.Compare(a, b) < 0 && bytes.Compare(b, c) < 0) {
+		t.Errorf("expected %v < %v < %v", a, b, c)
+	}
+
+	// ordered by collation key, not by utf8 bytes.
+	x := encodeCollated(t, coll, NoBound, `["apfel"]`)
+	y := encodeCollated(t, coll, NoBound, `["Birne"]`)
+	if bytes.Compare(x, y) >= 0 {
+		t.Errorf("expected apfel < Birne")
+	}
+}
+
+func TestCollationDecode(t *testing.T) {
+	coll, err := NewCollation("ja", "secondary", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{`["Müller",10,"東京"]`, `[""]`, `[{"name":"Ärger"}]`} {
+		code := encodeCollated(t, coll, NoBound, text)
+
+		// decoding does not need the collation
+		out, err := NewCodec(16).Decode(code, make([]byte, 0, 1024))
+		if err != nil {
+			t.Fatalf("decoding %v: %v", text, err)
+		}
+		ref, _ := NewCodec(16).Encode([]byte(text), make([]byte, 0, 1024))
+		outref, _ := NewCodec(16).Decode(ref, make([]byte, 0, 1024))
+		if string(out) != string(outref) {
+			t.Errorf("expected %v, got %v", string(outref), string(out))
+		}
+	}
+}
+
+func TestCollationReverse(t *testing.T) {
+	coll, err := NewCollation("de", "primary", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codec := NewCodec(16)
+	code := encodeCollated(t, coll, NoBound, `["Straße","x"]`)
+	ref := append([]byte(nil), code...)
+
+	codec.ReverseCollate(code, []bool{true, false})
+	if bytes.Equal(code, ref) {
+		t.Fatalf("expected reversed field")
+	}
+	codec.ReverseCollate(code, []bool{true, false})
+	if !bytes.Equal(code, ref) {
+		t.Errorf("expected %v, got %v", ref, code)
+	}
+}
+
+func TestCollationStrength(t *testing.T) {
+	if _, err := NewCollation("de", "quinary", false); err != ErrorCollationStrength {
+		t.Errorf("expected %v, got %v", ErrorCollationStrength, err)
 	}
 }
 
 func BenchmarkStringCollate(b *testing.B) {
-	s := "prográmming"
-	codec := NewCodec()
+	coll, _ := NewCollation("de", "tertiary", false)
+	codec := NewCodec(16)
+	codec.SortbyCollation(coll)
 	for i := 0; i < b.N; i++ {
-		codec.EncodeUnicodeString(s)
+		codec.EncodeUnicodeString("prográmming")
+	}
+}
+
+func TestGetCollation(t *testing.T) {
+	c1, err := GetCollation("de", "primary", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2, err := GetCollation("de", "primary", false); err != nil || c2 != c1 {
+		t.Errorf("expected the same collation, received %p %v", c2, err)
+	}
+	if c3, err := GetCollation("de", "secondary", false); err != nil || c3 == c1 {
+		t.Errorf("expected a different collation, received %p %v", c3, err)
+	}
+	if _, err := GetCollation("de", "quaternary", false); err != ErrorCollationStrength {
+		t.Errorf("expected %v, received %v", ErrorCollationStrength, err)
 	}
 }
@@ -127,6 +127,10 @@ func (c *ClusterInfoCache) SetServicePorts(portMap map[string]string) {
 
 func (c *ClusterInfoCache) Fetch() error {
 
+	if IsStandalone() {
+		return c.fetchStandalone()
+	}
+
 	fn := func(r int, err error) error {
 		if r > 0 {
 			logging.Infof("%vError occured during cluster info update (%v) .. Retrying(%d)",
@@ -324,6 +328,13 @@ func (c *ClusterInfoCache) GetNewIndexerNodes() (nodes []couchbase.Node) {
 }
 
 func (c *ClusterInfoCache) GetNodesByBucket(bucket string) (nids []NodeId, err error) {
+	if IsStandalone() {
+		if _, err = standaloneTopology.bucket(bucket); err != nil {
+			return
+		}
+		return []NodeId{0}, nil
+	}
+
 	b, berr := c.pool.GetBucket(bucket)
 	if berr != nil {
 		err = berr
@@ -346,6 +357,13 @@ func (c *ClusterInfoCache) GetNodesByBucket(bucket string) (nids []NodeId, err e
 //
 func (c *ClusterInfoCache) GetBucketUUID(bucket string) (uuid string) {
 
+	if IsStandalone() {
+		if b, err := standaloneTopology.bucket(bucket); err == nil {
+			return b.UUID
+		}
+		return BUCKET_UUID_NIL
+	}
+
 	// This function retuns an error if bucket not found
 	b, err := c.pool.GetBucket(bucket)
 	if err != nil {
@@ -367,6 +385,14 @@ func (c *ClusterInfoCache) GetBucketUUID(bucket string) (uuid string) {
 }
 
 func (c *ClusterInfoCache) IsEphemeral(bucket string) (bool, error) {
+	if IsStandalone() {
+		b, err := standaloneTopology.bucket(bucket)
+		if err != nil {
+			return false, err
+		}
+		return strings.EqualFold(b.Type, "ephemeral"), nil
+	}
+
 	b, err := c.pool.GetBucket(bucket)
 	if err != nil {
 		return false, err
@@ -434,6 +460,10 @@ func (c *ClusterInfoCache) GetServiceAddress(nid NodeId, srvc string) (addr stri
 }
 
 func (c *ClusterInfoCache) GetVBuckets(nid NodeId, bucket string) (vbs []uint32, err error) {
+	if IsStandalone() {
+		return c.getStandaloneVBuckets(nid, bucket)
+	}
+
 	b, berr := c.pool.GetBucket(bucket)
 	if berr != nil {
 		err = berr
@@ -358,6 +358,15 @@ var SystemConfig = Config{
 		false,      // mutable
 		false,      // case-insensitive
 	},
+	"projector.dataport.flowControlTimeout": ConfigValue{
+		120 * 1000,
+		"timeout in milliseconds, after which endpoint will close itself " +
+			"if remote has not granted any flow control credit, " +
+			"also refer to indexer.dataport.flowControlWindow.",
+		120 * 1000, //120s
+		false,      // mutable
+		false,      // case-insensitive
+	},
 	"projector.dataport.maxPayload": ConfigValue{
 		1024 * 1024,
 		"maximum payload length, in bytes, for transmission data from " +
@@ -380,6 +389,14 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"projector.jsTimeout": ConfigValue{
+		100,
+		"time limit, in milliseconds, for a call to JavaScript expression " +
+			"of an index, memory used by a call is not limited",
+		100,
+		false, // mutable
+		false, // case-insensitive
+	},
 	// projector's adminport client, can be used by manager
 	"manager.projectorclient.retryInterval": ConfigValue{
 		16,
@@ -431,6 +448,15 @@ var SystemConfig = Config{
 		true,        // immutable
 		false,       // case-insensitive
 	},
+	"indexer.dataport.flowControlWindow": ConfigValue{
+		0,
+		"number of packets a projector endpoint can send on a connection " +
+			"before it is handed over to indexer, 0 disables flow control, " +
+			"does not affect existing connections.",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.dataport.tcpReadDeadline": ConfigValue{
 		300 * 1000,
 		"timeout, in milliseconds, while reading from socket, " +
@@ -549,6 +575,14 @@ var SystemConfig = Config{
 		true,  // immutable
 		false, // case-insensitive
 	},
+	"queryport.client.retryScanResume": ConfigValue{
+		3,
+		"number of times to resume a scan with continuation from its " +
+			"last continuation token, when the connection to indexer is lost",
+		3,
+		true,  // immutable
+		false, // case-insensitive
+	},
 	"queryport.client.servicesNotifierRetryTm": ConfigValue{
 		1000,
 		"wait, in milliseconds, before restarting the ServicesNotifier",
@@ -631,6 +665,28 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"queryport.client.scan.hedge_percentile": ConfigValue{
+		0.0,
+		"Percentile of first response latency of an index after which a scan request " +
+			"is also sent to another replica. Use 0 to disable hedging.",
+		0.0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"queryport.client.scan.hedge_min_delay": ConfigValue{
+		5,
+		"Minimum time, in milliseconds, to wait for the first response before hedging a scan request.",
+		5,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"queryport.client.scan.hedge_budget": ConfigValue{
+		5.0,
+		"Maximum number of hedged scan requests, as a percentage of scan requests.",
+		5.0,
+		false, // mutable
+		false, // case-insensitive
+	},
 	// projector's adminport client, can be used by indexer.
 	"indexer.projectorclient.retryInterval": ConfigValue{
 		16,
@@ -1283,6 +1339,23 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.mutation_queue.spill.enabled": ConfigValue{
+		false,
+		"spill mutations to disk, instead of blocking the stream, " +
+			"when mutation queue memory is exhausted. Applies to " +
+			"queues created after the change.",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.mutation_queue.spill.dir": ConfigValue{
+		"",
+		"directory for mutation queue spill files, " +
+			"defaults to <storage_dir>/mutation_queue",
+		"",
+		false, // mutable
+		true,  // case-sensitive
+	},
 	"indexer.memstatTick": ConfigValue{
 		60, // in second
 		"in second, periodically log runtime memory-stats.",
@@ -1306,6 +1379,47 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.high_disk_mark": ConfigValue{
+		0.95,
+		"Fraction of the storage_dir filesystem in use above which Indexer " +
+			"stops flushing mutations. Scans are served from existing snapshots.",
+		0.95,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.low_disk_mark": ConfigValue{
+		0.85,
+		"Fraction of the storage_dir filesystem in use above which Indexer " +
+			"compacts forestdb indexes, skips disk snapshots and releases " +
+			"snapshots retained for as-of scans. Flushing paused by " +
+			"high_disk_mark resumes only after usage goes below this fraction",
+		0.85,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.disk_usage_check_interval": ConfigValue{
+		30,
+		"Time interval in seconds after which Indexer will check the disk " +
+			"usage of storage_dir against low_disk_mark and high_disk_mark. " +
+			"Set to 0 to disable the check.",
+		30,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.encryption.key_file": ConfigValue{
+		"",
+		"Path of the local key file index data files and snapshots are " +
+			"encrypted with. Keys are rotated by changing the active key in " +
+			"the file, files are re-encrypted on next compaction or snapshot. " +
+			"Re-encrypting a forestdb file drops its rollback points older " +
+			"than the last snapshot. The indexer meta file is re-encrypted " +
+			"when opened. Plasma files and the metadata repository of the " +
+			"index manager are not encrypted yet. " +
+			"Empty to disable encryption.",
+		"",
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.pause_if_memory_full": ConfigValue{
 		true,
 		"Indexer goes to Paused when memory_quota is exhausted(moi only)",
@@ -1521,6 +1635,14 @@ var SystemConfig = Config{
 		true,  // immutable
 		false, // case-insensitive
 	},
+	"indexer.settings.scan_continuation_lease": ConfigValue{
+		60000,
+		"duration, in milliseconds, for which the snapshot of a scan " +
+			"returning continuation tokens is retained after its last use",
+		60000,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.settings.max_array_seckey_size": ConfigValue{
 		10240,
 		"Maximum size of secondary index key size for array index",
@@ -1638,6 +1760,22 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.settings.warmup.priority": ConfigValue{
+		"",
+		"Comma separated list of bucket:index (or index, for any bucket) " +
+			"to be warmed up first on indexer restart, in the order listed. " +
+			"Other indexes are warmed up in decreasing order of their scan rate",
+		"",
+		true,  // immutable
+		false, // case-insensitive
+	},
+	"indexer.settings.warmup.parallelism": ConfigValue{
+		2,
+		"Number of indexes warmed up in parallel on indexer restart",
+		2,
+		true,  // immutable
+		false, // case-insensitive
+	},
 	"indexer.settings.max_writer_lock_prob": ConfigValue{
 		20,
 		"Controls the write rate for compaction to catch up",
@@ -1837,6 +1975,30 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.settings.build.max_init_streams": ConfigValue{
+		0,
+		"When performing background index build, specify the maximum number of buckets " +
+			"with an initial index build (INIT_STREAM) in progress on this node.  Use 0 for no limit.",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.build.max_indexes_per_bucket": ConfigValue{
+		0,
+		"When performing background index build, specify the maximum number of index " +
+			"built together in the INIT_STREAM of a bucket.  Use 0 for no limit.",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.build.window": ConfigValue{
+		"",
+		"Comma separated list of time windows, in local time, when background index " +
+			"build can be started, e.g. 01:00-05:00.  Empty for no restriction.",
+		"",
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.build.background.disable": ConfigValue{
 		false,
 		"Disable background index build, except during upgrade",
@@ -1865,6 +2027,74 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.scan.admission.max_concurrent": ConfigValue{
+		0,
+		"Maximum number of index scans processed concurrently by the indexer, " +
+			"excess scans are queued. 0 for no limit.",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.admission.max_concurrent_per_bucket": ConfigValue{
+		0,
+		"Maximum number of index scans of a bucket processed concurrently by the indexer, " +
+			"excess scans are queued. 0 for no limit.",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.admission.bucket_weights": ConfigValue{
+		"",
+		"Comma separated list of bucket:weight. Queued scans are admitted in proportion " +
+			"to the weight of their bucket, buckets not listed have weight 1.",
+		"",
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.admission.queue_timeout": ConfigValue{
+		5000,
+		"Maximum time, in milliseconds, a scan waits in the queue before it is rejected",
+		5000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.admission.max_queued": ConfigValue{
+		10000,
+		"Maximum number of scans queued, scans beyond this are rejected",
+		10000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.subrange.max_parallelism": ConfigValue{
+		4,
+		"Maximum number of ranges scanned concurrently by a scan, a large range " +
+			"of a partition is split into sub-ranges up to this limit. 1 disables splitting",
+		4,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.subrange.min_entries": ConfigValue{
+		100000,
+		"Minimum estimated number of index entries in each sub-range of a scan",
+		100000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.subrange.queue_size": ConfigValue{
+		5000,
+		"Number of rows read ahead from each sub-range of a scan",
+		5000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.intersect.max_docids": ConfigValue{
+		1000000,
+		"Maximum number of document ids held in memory by an intersect or union scan, " +
+			"scans exceeding this are rejected. 0 for no limit.",
+		1000000,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.planner.timeout": ConfigValue{
 		20,
 		"timeout (sec) on planner",
@@ -49,6 +49,10 @@ var ErrClientCancel = errors.New("Client requested cancel")
 
 var ErrIndexerInBootstrap = errors.New("Indexer In Warmup State. Please retry the request later.")
 
+// Scan rejected by the admission control of indexer
+var ErrScanQueueFull = errors.New("Too many index scans queued in indexer. Please retry the request later.")
+var ErrScanQueueTimeout = errors.New("Index scan timed out waiting in indexer queue. Please retry the request later.")
+
 const INDEXER_45_VERSION = 1
 const INDEXER_50_VERSION = 2
 const INDEXER_55_VERSION = 3
@@ -21,6 +21,21 @@ type Evaluator interface {
 	StreamEndData(vbno uint16, vbuuid, seqno uint64) (data interface{})
 
 	// TransformRoute will transform document consumable by
-	// downstream, returns data to be published to endpoints.
-	TransformRoute(vbuuid uint64, m *mc.DcpEvent, data map[string]interface{}, encodeBuf []byte) ([]byte, error)
+	// downstream, returns data to be published to endpoints. Evaluation
+	// context `context`, if not nil, is shared by the evaluators of all
+	// the engines of a bucket for the same mutation.
+	TransformRoute(vbuuid uint64, m *mc.DcpEvent, data map[string]interface{}, encodeBuf []byte, context EvalContext) ([]byte, error)
+
+	// Statistics of the evaluator, safe to be called concurrently with
+	// TransformRoute.
+	Statistics() map[string]interface{}
+}
+
+// EvalContext is the context of a mutation evaluated by several
+// evaluators, to share its parsed document and the values of common
+// expressions.
+type EvalContext interface {
+	// Reset the context for mutation `m`, before it is transformed
+	// by the evaluators.
+	Reset(m *mc.DcpEvent)
 }
@@ -169,6 +169,13 @@ const (
 	// and make sure to return a stable data-set that is atleast as
 	// recent as the timestamp-vector.
 	QueryConsistency
+
+	// BoundedStalenessConsistency indexer would accept a maximum
+	// staleness and return data from a snapshot that includes all
+	// the mutations received by the indexer until that long ago.
+	// Unlike SessionConsistency it does not query KV for the latest
+	// timestamp.
+	BoundedStalenessConsistency
 )
 
 func (cons Consistency) String() string {
@@ -179,11 +186,62 @@ func (cons Consistency) String() string {
 		return "SESSION_CONSISTENCY"
 	case QueryConsistency:
 		return "QUERY_CONSISTENCY"
+	case BoundedStalenessConsistency:
+		return "BOUNDED_STALENESS_CONSISTENCY"
 	default:
 		return "UNKNOWN_CONSISTENCY"
 	}
 }
 
+// ScanPriority is the class of service requested for an index scan.
+// When scans of a bucket are queued by the indexer for admission, scans
+// of a higher class are admitted first.
+type ScanPriority byte
+
+const (
+	// NormalScanPriority is the default, used when the client does
+	// not specify any priority.
+	NormalScanPriority ScanPriority = iota
+
+	// HighScanPriority for latency sensitive lookups.
+	HighScanPriority
+
+	// LowScanPriority for analytical or background scans.
+	LowScanPriority
+)
+
+func (p ScanPriority) String() string {
+	switch p {
+	case NormalScanPriority:
+		return "NORMAL"
+	case HighScanPriority:
+		return "HIGH"
+	case LowScanPriority:
+		return "LOW"
+	default:
+		return "UNKNOWN_PRIORITY"
+	}
+}
+
+//IndexCollation is the unicode collation used to order
+//string keys of an index, instead of their utf8 bytes
+type IndexCollation struct {
+	Locale    string `json:"locale,omitempty"`
+	Strength  string `json:"strength,omitempty"` // primary | secondary | tertiary
+	CaseLevel bool   `json:"caseLevel,omitempty"`
+}
+
+func (c IndexCollation) String() string {
+	return fmt.Sprintf("%v/%v/caseLevel=%v", c.Locale, c.Strength, c.CaseLevel)
+}
+
+func (c *IndexCollation) Equal(other *IndexCollation) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+	return *c == *other
+}
+
 //IndexDefn represents the index definition as specified
 //during CREATE INDEX
 type IndexDefn struct {
@@ -209,6 +267,15 @@ type IndexDefn struct {
 	PartitionKeys      []string   `json:"partitionKeys,omitempty"`
 	RetainDeletedXATTR bool       `json:"retainDeletedXATTR,omitempty"`
 	HashScheme         HashScheme `json:"hashScheme,omitempty"`
+	SnapshotRetention  uint64     `json:"snapshotRetention,omitempty"` // in seconds
+	BuildPriority      int        `json:"buildPriority,omitempty"`
+
+	// String keys are ordered by unicode collation, if set
+	Collation *IndexCollation `json:"collation,omitempty"`
+
+	// WHERE clause is only on fields that do not change once the document
+	// is created, a document that does not match it was never indexed.
+	ImmutableWhere bool `json:"immutableWhere,omitempty"`
 
 	// Sizing info
 	NumDoc        uint64  `json:"numDoc,omitempty"`
@@ -244,6 +311,7 @@ type IndexInst struct {
 	StorageMode    string
 	OldStorageMode string
 	RealInstId     IndexInstId
+	Paused         bool
 }
 
 //IndexInstMap is a map from IndexInstanceId to IndexInstance
@@ -265,6 +333,14 @@ func (idx IndexDefn) String() string {
 	str += fmt.Sprintf("PartitionKeys: %v ", idx.PartitionKeys)
 	str += fmt.Sprintf("WhereExpr: %v ", logging.TagUD(idx.WhereExpr))
 	str += fmt.Sprintf("RetainDeletedXATTR: %v ", idx.RetainDeletedXATTR)
+	str += fmt.Sprintf("SnapshotRetention: %v ", idx.SnapshotRetention)
+	str += fmt.Sprintf("BuildPriority: %v ", idx.BuildPriority)
+	if idx.Collation != nil {
+		str += fmt.Sprintf("Collation: %v ", idx.Collation)
+	}
+	if idx.ImmutableWhere {
+		str += fmt.Sprintf("ImmutableWhere: %v ", idx.ImmutableWhere)
+	}
 	return str
 
 }
@@ -292,6 +368,10 @@ func (idx IndexDefn) Clone() *IndexDefn {
 		IsArrayIndex:       idx.IsArrayIndex,
 		NumReplica:         idx.NumReplica,
 		RetainDeletedXATTR: idx.RetainDeletedXATTR,
+		SnapshotRetention:  idx.SnapshotRetention,
+		BuildPriority:      idx.BuildPriority,
+		Collation:          idx.Collation,
+		ImmutableWhere:     idx.ImmutableWhere,
 		NumDoc:             idx.NumDoc,
 		SecKeySize:         idx.SecKeySize,
 		DocKeySize:         idx.DocKeySize,
@@ -312,6 +392,12 @@ func (idx *IndexDefn) HasDescending() bool {
 
 }
 
+//IsJavaScript returns true if expressions of the index
+//are JavaScript functions, instead of N1QL expressions
+func (idx *IndexDefn) IsJavaScript() bool {
+	return strings.EqualFold(string(idx.ExprType), string(JavaScript))
+}
+
 func (idx IndexInst) IsProxy() bool {
 	return idx.RealInstId != 0
 }
@@ -324,6 +410,7 @@ func (idx IndexInst) String() string {
 	str += fmt.Sprintf("\tState: %v\n", idx.State)
 	str += fmt.Sprintf("\tRState: %v\n", idx.RState)
 	str += fmt.Sprintf("\tStream: %v\n", idx.Stream)
+	str += fmt.Sprintf("\tPaused: %v\n", idx.Paused)
 	str += fmt.Sprintf("\tVersion: %v\n", idx.Version)
 	str += fmt.Sprintf("\tReplicaId: %v\n", idx.ReplicaId)
 	str += fmt.Sprintf("\tPartitionContainer: %v", idx.Pc)
@@ -551,7 +638,9 @@ func IsEquivalentIndex(d1, d2 *IndexDefn) bool {
 		d1.PartitionScheme != d2.PartitionScheme ||
 		d1.HashScheme != d2.HashScheme ||
 		d1.WhereExpr != d2.WhereExpr ||
-		d1.RetainDeletedXATTR != d2.RetainDeletedXATTR {
+		d1.RetainDeletedXATTR != d2.RetainDeletedXATTR ||
+		!d1.Collation.Equal(d2.Collation) ||
+		d1.ImmutableWhere != d2.ImmutableWhere {
 
 		return false
 	}
@@ -0,0 +1,117 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+// TokenKind is the kind of a token returned by Tokenizer.
+type TokenKind int
+
+const (
+	TokenEOF TokenKind = iota // end of input
+	TokenBeginObject
+	TokenEndObject
+	TokenBeginArray
+	TokenEndArray
+	TokenString // quoted string, object keys included
+	TokenNumber
+	TokenTrue
+	TokenFalse
+	TokenNull
+)
+
+// A Tokenizer splits JSON text into tokens, using the same scanner as
+// Unmarshal, without converting them into Go values. Literal tokens are
+// returned as slices of the input, strings are still quoted and can be
+// converted with UnquoteBytes.
+//
+// A Tokenizer can be reused by calling Reset.
+type Tokenizer struct {
+	data []byte
+	off  int
+	scan scanner
+}
+
+// NewTokenizer returns a new tokenizer that reads data.
+func NewTokenizer(data []byte) *Tokenizer {
+	t := &Tokenizer{}
+	t.Reset(data)
+	return t
+}
+
+// Reset prepares the tokenizer to read data.
+func (t *Tokenizer) Reset(data []byte) {
+	t.data, t.off = data, 0
+	t.scan.reset()
+	t.scan.bytes = 0
+}
+
+// Next returns the kind of the next token and, for literals, its text.
+// It returns TokenEOF after the top-level value and a *SyntaxError if
+// data is not valid JSON.
+func (t *Tokenizer) Next() (TokenKind, []byte, error) {
+	start := -1
+	for i := t.off; i < len(t.data); i++ {
+		t.scan.bytes = int64(i) + 1
+		op := t.scan.step(&t.scan, t.data[i])
+
+		if start >= 0 && op != scanContinue {
+			// end of literal is known only after the following byte.
+			if op == scanError {
+				return TokenEOF, nil, t.scan.err
+			}
+			if op != scanEnd {
+				t.scan.undo(op)
+			}
+			t.off = i
+			return literalKind(t.data[start]), t.data[start:i], nil
+		}
+
+		switch op {
+		case scanBeginLiteral:
+			start = i
+		case scanBeginObject:
+			t.off = i + 1
+			return TokenBeginObject, nil, nil
+		case scanEndObject:
+			t.off = i + 1
+			return TokenEndObject, nil, nil
+		case scanBeginArray:
+			t.off = i + 1
+			return TokenBeginArray, nil, nil
+		case scanEndArray:
+			t.off = i + 1
+			return TokenEndArray, nil, nil
+		case scanError:
+			return TokenEOF, nil, t.scan.err
+		}
+	}
+	t.off = len(t.data)
+
+	if t.scan.eof() == scanError {
+		return TokenEOF, nil, t.scan.err
+	} else if start >= 0 {
+		return literalKind(t.data[start]), t.data[start:], nil
+	}
+	return TokenEOF, nil, nil
+}
+
+func literalKind(c byte) TokenKind {
+	switch c {
+	case '"':
+		return TokenString
+	case 't':
+		return TokenTrue
+	case 'f':
+		return TokenFalse
+	case 'n':
+		return TokenNull
+	}
+	return TokenNumber
+}
+
+// UnquoteBytes converts a quoted JSON string literal s into the string
+// it represents. Returned slice refers to s if s has no escape sequences.
+func UnquoteBytes(s []byte) ([]byte, bool) {
+	return unquoteBytes(s)
+}
@@ -0,0 +1,65 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"reflect"
+	"testing"
+)
+
+type tokenTest struct {
+	kind    TokenKind
+	literal string
+}
+
+func TestTokenizer(t *testing.T) {
+	text := ` {"a" : [1, -2.5e3 ,"x\"y"], "b":{}, "c":[true,false,null]} `
+	expected := []tokenTest{
+		{TokenBeginObject, ""}, {TokenString, `"a"`}, {TokenBeginArray, ""},
+		{TokenNumber, "1"}, {TokenNumber, "-2.5e3"}, {TokenString, `"x\"y"`},
+		{TokenEndArray, ""}, {TokenString, `"b"`}, {TokenBeginObject, ""},
+		{TokenEndObject, ""}, {TokenString, `"c"`}, {TokenBeginArray, ""},
+		{TokenTrue, "true"}, {TokenFalse, "false"}, {TokenNull, "null"},
+		{TokenEndArray, ""}, {TokenEndObject, ""}, {TokenEOF, ""},
+	}
+
+	var tokens []tokenTest
+	tokenizer := NewTokenizer([]byte(text))
+	for {
+		kind, literal, err := tokenizer.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tokenTest{kind, string(literal)})
+		if kind == TokenEOF {
+			break
+		}
+	}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("expected %v, got %v", expected, tokens)
+	}
+
+	for _, text := range []string{`12`, ` "abc" `} {
+		tokenizer.Reset([]byte(text))
+		kind, literal, err := tokenizer.Next()
+		if err != nil || kind == TokenEOF || string(literal) == "" {
+			t.Errorf("%s: unexpected token %v %q %v", text, kind, literal, err)
+		}
+		if kind, _, err = tokenizer.Next(); kind != TokenEOF || err != nil {
+			t.Errorf("%s: expected end of input, got %v %v", text, kind, err)
+		}
+	}
+
+	for _, text := range []string{``, `[1,]`, `{"a" 1}`, `1 2`, `[1`, `"abc`} {
+		tokenizer.Reset([]byte(text))
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			_, _, err = tokenizer.Next()
+		}
+		if err == nil {
+			t.Errorf("%s: expected syntax error", text)
+		}
+	}
+}
@@ -17,7 +17,7 @@ package common
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/couchbase/cbauth/metakv"
+	"github.com/couchbase/indexing/secondary/common/metakv"
 	"github.com/couchbase/indexing/secondary/logging"
 	"strconv"
 	"strings"
@@ -0,0 +1,255 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package metakv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// interval at which observers reload the file for changes made by
+// other processes.
+var filePollInterval = time.Second
+
+// fileStore keeps metakv in a JSON file. The file is re-read on every
+// operation, so that the processes sharing it see each other's updates;
+// updates are written to a temporary file which is renamed over the
+// store. Updates of a process are serialized, but concurrent updates
+// from several processes may be lost, so only one process is expected
+// to update a given path.
+type fileStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+type fileData struct {
+	// revision of the store, incremented by every update
+	Rev     uint64                `json:"rev"`
+	Entries map[string]*fileEntry `json:"entries"`
+}
+
+type fileEntry struct {
+	Value []byte `json:"value"`
+	Rev   uint64 `json:"rev"`
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	s := &fileStore{path: path}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileStore) load() (*fileData, error) {
+	data := &fileData{Entries: make(map[string]*fileEntry)}
+
+	buf, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return data, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, data); err != nil {
+		return nil, err
+	}
+	if data.Entries == nil {
+		data.Entries = make(map[string]*fileEntry)
+	}
+	return data, nil
+}
+
+// update applies fn to the content of the store and saves it if fn
+// made any change.
+func (s *fileStore) update(fn func(*fileData) (bool, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	changed, err := fn(data)
+	if err != nil || !changed {
+		return err
+	}
+
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *fileStore) get(path string) ([]byte, interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if e, ok := data.Entries[path]; ok {
+		return e.Value, e.Rev, nil
+	}
+	return nil, nil, nil
+}
+
+func (s *fileStore) set(path string, value []byte, rev interface{}, create bool) error {
+	return s.update(func(data *fileData) (bool, error) {
+		e, ok := data.Entries[path]
+		if create && ok {
+			return false, ErrRevMismatch
+		}
+		if rev != nil && (!ok || !sameRev(e.Rev, rev)) {
+			return false, ErrRevMismatch
+		}
+
+		data.Rev++
+		data.Entries[path] = &fileEntry{Value: value, Rev: data.Rev}
+		return true, nil
+	})
+}
+
+func (s *fileStore) delete(path string, rev interface{}) error {
+	return s.update(func(data *fileData) (bool, error) {
+		e, ok := data.Entries[path]
+		if rev != nil && (!ok || !sameRev(e.Rev, rev)) {
+			return false, ErrRevMismatch
+		}
+		if !ok {
+			return false, nil
+		}
+
+		data.Rev++
+		delete(data.Entries, path)
+		return true, nil
+	})
+}
+
+func (s *fileStore) recursiveDelete(dirpath string) error {
+	return s.update(func(data *fileData) (bool, error) {
+		changed := false
+		for path := range data.Entries {
+			if strings.HasPrefix(path, dirpath) {
+				delete(data.Entries, path)
+				changed = true
+			}
+		}
+		if changed {
+			data.Rev++
+		}
+		return changed, nil
+	})
+}
+
+func (s *fileStore) list(dirpath string) ([]KVEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return children(data, dirpath), nil
+}
+
+func (s *fileStore) observe(dirpath string, callback Callback, cancel <-chan struct{}) error {
+
+	seen := make(map[string]uint64)
+	var storeRev uint64
+	first := true
+
+	ticker := time.NewTicker(filePollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		data, err := s.load()
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		if first || data.Rev != storeRev {
+			storeRev = data.Rev
+			first = false
+
+			current := make(map[string]bool)
+			for _, e := range children(data, dirpath) {
+				rev := e.Rev.(uint64)
+				current[e.Path] = true
+				if r, ok := seen[e.Path]; ok && r == rev {
+					continue
+				}
+				seen[e.Path] = rev
+				if err := callback(e.Path, e.Value, e.Rev); err != nil {
+					return err
+				}
+			}
+
+			for path := range seen {
+				if !current[path] {
+					delete(seen, path)
+					if err := callback(path, nil, nil); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		select {
+		case <-cancel:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// children returns the entries under dirpath, sorted by path.
+func children(data *fileData, dirpath string) []KVEntry {
+	var entries []KVEntry
+	for path, e := range data.Entries {
+		if strings.HasPrefix(path, dirpath) {
+			entries = append(entries, KVEntry{Path: path, Value: e.Value, Rev: e.Rev})
+		}
+	}
+
+	sort.Sort(kvEntries(entries))
+	return entries
+}
+
+type kvEntries []KVEntry
+
+func (e kvEntries) Len() int           { return len(e) }
+func (e kvEntries) Less(i, j int) bool { return e[i].Path < e[j].Path }
+func (e kvEntries) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+func sameRev(current uint64, rev interface{}) bool {
+	r, ok := rev.(uint64)
+	return ok && r == current
+}
@@ -0,0 +1,157 @@
+package metakv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) (*fileStore, func()) {
+	dir, err := ioutil.TempDir("", "metakv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newFileStore(filepath.Join(dir, "metakv.json"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestFileStoreSetGet(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if v, rev, err := s.get("/a"); v != nil || rev != nil || err != nil {
+		t.Fatalf("Expected missing entry, received %v %v %v", v, rev, err)
+	}
+
+	if err := s.set("/a", []byte("1"), nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.set("/a", []byte("2"), nil, true); err != ErrRevMismatch {
+		t.Errorf("Expected ErrRevMismatch for add of an existing entry, received %v", err)
+	}
+
+	v, rev, err := s.get("/a")
+	if err != nil || string(v) != "1" {
+		t.Fatalf("Expected 1, received %s %v", v, err)
+	}
+
+	if err := s.set("/a", []byte("2"), rev, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.set("/a", []byte("3"), rev, false); err != ErrRevMismatch {
+		t.Errorf("Expected ErrRevMismatch for a stale revision, received %v", err)
+	}
+	if err := s.delete("/a", rev); err != ErrRevMismatch {
+		t.Errorf("Expected ErrRevMismatch for a stale revision, received %v", err)
+	}
+
+	//another store on the same file sees the updates
+	s2, err := newFileStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := s2.get("/a"); string(v) != "2" {
+		t.Errorf("Expected 2, received %s", v)
+	}
+
+	if err := s.delete("/a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := s2.get("/a"); v != nil {
+		t.Errorf("Expected deleted entry, received %s", v)
+	}
+}
+
+func TestFileStoreChildren(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	for _, path := range []string{"/dir/b", "/dir/a", "/dir/sub/c", "/other"} {
+		if err := s.set(path, []byte(path), nil, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := s.list("/dir/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/dir/a", "/dir/b", "/dir/sub/c"}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %v, received %v", expected, entries)
+	}
+	for i, e := range entries {
+		if e.Path != expected[i] || string(e.Value) != expected[i] {
+			t.Errorf("Expected %v, received %v", expected[i], e)
+		}
+	}
+
+	if err := s.recursiveDelete("/dir/"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := s.list("/"); len(entries) != 1 || entries[0].Path != "/other" {
+		t.Errorf("Expected /other, received %v", entries)
+	}
+}
+
+func TestFileStoreObserve(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	filePollInterval = 10 * time.Millisecond
+
+	if err := s.set("/dir/a", []byte("1"), nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	type change struct {
+		path  string
+		value string
+	}
+	changes := make(chan change, 10)
+	callback := func(path string, value []byte, rev interface{}) error {
+		changes <- change{path, string(value)}
+		return nil
+	}
+
+	cancel := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- s.observe("/dir/", callback, cancel)
+	}()
+
+	expect := func(c change) {
+		select {
+		case received := <-changes:
+			if received != c {
+				t.Errorf("Expected %v, received %v", c, received)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for %v", c)
+		}
+	}
+
+	expect(change{"/dir/a", "1"})
+
+	s.set("/other", []byte("x"), nil, false)
+	s.set("/dir/b", []byte("2"), nil, false)
+	expect(change{"/dir/b", "2"})
+
+	s.delete("/dir/a", nil)
+	expect(change{"/dir/a", ""})
+
+	close(cancel)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("Unexpected change %v", <-changes)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Package metakv provides the metakv API of cbauth, backed either by the
+// cluster manager or, when running standalone, by a local file.
+package metakv
+
+import (
+	"github.com/couchbase/cbauth/metakv"
+)
+
+// ErrRevMismatch is returned when the revision of an update doesn't
+// match the current revision of the entry.
+var ErrRevMismatch = metakv.ErrRevMismatch
+
+// KVEntry is an entry of metakv.
+type KVEntry struct {
+	Path  string
+	Value []byte
+	Rev   interface{}
+}
+
+// Callback is called with the entries observed by RunObserveChildren.
+// Value is nil for deleted entries.
+type Callback func(path string, value []byte, rev interface{}) error
+
+// store is the file backing metakv, nil when metakv is backed by the
+// cluster manager.
+var store *fileStore
+
+// UseFile keeps metakv in the file at path instead of the cluster
+// manager. It must be called before any other function of the package.
+func UseFile(path string) error {
+	s, err := newFileStore(path)
+	if err != nil {
+		return err
+	}
+	store = s
+	return nil
+}
+
+// Get returns the value and revision of path, nil if path doesn't exist.
+func Get(path string) ([]byte, interface{}, error) {
+	if store != nil {
+		return store.get(path)
+	}
+	return metakv.Get(path)
+}
+
+// Set updates path to value. A non-nil rev must match the current
+// revision of path.
+func Set(path string, value []byte, rev interface{}) error {
+	if store != nil {
+		return store.set(path, value, rev, false)
+	}
+	return metakv.Set(path, value, rev)
+}
+
+// Add creates path, it fails with ErrRevMismatch if path exists.
+func Add(path string, value []byte) error {
+	if store != nil {
+		return store.set(path, value, nil, true)
+	}
+	return metakv.Add(path, value)
+}
+
+// Delete removes path. A non-nil rev must match the current revision of
+// path.
+func Delete(path string, rev interface{}) error {
+	if store != nil {
+		return store.delete(path, rev)
+	}
+	return metakv.Delete(path, rev)
+}
+
+// RecursiveDelete removes all the entries under dirpath, which must end
+// with '/'.
+func RecursiveDelete(dirpath string) error {
+	if store != nil {
+		return store.recursiveDelete(dirpath)
+	}
+	return metakv.RecursiveDelete(dirpath)
+}
+
+// ListAllChildren returns all the entries under dirpath, which must end
+// with '/'.
+func ListAllChildren(dirpath string) ([]KVEntry, error) {
+	if store != nil {
+		return store.list(dirpath)
+	}
+
+	entries, err := metakv.ListAllChildren(dirpath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]KVEntry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, KVEntry{Path: e.Path, Value: e.Value, Rev: e.Rev})
+	}
+	return result, nil
+}
+
+// RunObserveChildren calls callback with all the entries under dirpath,
+// and then with every change of the entries, until cancel is closed or
+// callback returns an error.
+func RunObserveChildren(dirpath string, callback Callback, cancel <-chan struct{}) error {
+	if store != nil {
+		return store.observe(dirpath, callback, cancel)
+	}
+	return metakv.RunObserveChildren(dirpath, metakv.Callback(callback), cancel)
+}
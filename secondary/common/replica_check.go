@@ -0,0 +1,174 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// Replica check compares the replicas of an index at the same timestamp.
+// A timestamp ahead of the flush of the bucket on every node hosting a
+// replica is chosen, and every node takes a snapshot at that timestamp
+// while the flush goes on. The contents of the snapshots are compared:
+// entries are partitioned by their hash, digests of the hash ranges are
+// compared and mismatching ranges are split until they are small enough
+// to compare the entries.
+
+// Replica snapshot operations.
+const (
+	ReplicaSnapshotTs    = "ts"
+	ReplicaSnapshotOpen  = "open"
+	ReplicaSnapshotClose = "close"
+)
+
+// ReplicaSnapshotRequest is the request of /replicaCheck/snapshot. Ts
+// returns a timestamp the flush of the bucket has not reached yet. Open
+// waits up to Timeout for the snapshots of the index instances at Ts,
+// and leases them to the check. Close releases the leases, which
+// otherwise expire when they are not used.
+type ReplicaSnapshotRequest struct {
+	Bucket   string        `json:"bucket"`
+	Op       string        `json:"op"`
+	Ts       *TsVbuuid     `json:"ts,omitempty"`
+	InstIds  []IndexInstId `json:"instIds,omitempty"`
+	LeaseIds []uint64      `json:"leaseIds,omitempty"`
+	Timeout  int64         `json:"timeout,omitempty"` // milliseconds
+}
+
+// ReplicaSnapshotResponse returns the timestamp of the snapshots, and
+// the lease of the snapshot of each requested index instance.
+type ReplicaSnapshotResponse struct {
+	Ts       *TsVbuuid `json:"ts,omitempty"`
+	LeaseIds []uint64  `json:"leaseIds,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// HashRange is an inclusive range of entry hashes.
+type HashRange struct {
+	Low  uint64 `json:"low"`
+	High uint64 `json:"high"`
+}
+
+// FullHashRange covers all the entries of an index.
+var FullHashRange = HashRange{Low: 0, High: math.MaxUint64}
+
+// RangeDigest summarizes the entries of a hash range. It doesn't depend
+// on the order the entries are read in. Hash is the XOR of the SHA-256
+// of the entries, truncated to 128 bits. Entries of an index are unique,
+// so that they don't cancel out.
+type RangeDigest struct {
+	Count uint64    `json:"count"`
+	Hash  [2]uint64 `json:"hash"`
+}
+
+// Add an entry to the digest.
+func (d *RangeDigest) Add(entry []byte) {
+	h := sha256.Sum256(entry)
+	d.Count++
+	d.Hash[0] ^= binary.BigEndian.Uint64(h[0:8])
+	d.Hash[1] ^= binary.BigEndian.Uint64(h[8:16])
+}
+
+// ReplicaDigestRequest is the request of /replicaCheck/digest and
+// /replicaCheck/entries, for a partition of an index instance in the
+// snapshot leased by /replicaCheck/snapshot. Ranges must be sorted and
+// must not overlap.
+type ReplicaDigestRequest struct {
+	LeaseId uint64      `json:"leaseId"`
+	DefnId  IndexDefnId `json:"defnId"`
+	InstId  IndexInstId `json:"instId"`
+	PartnId PartitionId `json:"partnId"`
+	Ranges  []HashRange `json:"ranges"`
+}
+
+// ReplicaDigestResponse returns a digest for each requested range.
+type ReplicaDigestResponse struct {
+	Digests []RangeDigest `json:"digests,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// ReplicaEntry is an index entry returned by /replicaCheck/entries.
+type ReplicaEntry struct {
+	Raw   []byte `json:"raw"`
+	Key   string `json:"key,omitempty"` // JSON encoded
+	DocId string `json:"docid"`
+}
+
+// ReplicaEntriesResponse returns the entries of the requested ranges.
+type ReplicaEntriesResponse struct {
+	Entries []ReplicaEntry `json:"entries,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// ReplicaDiff is an entry missing from some of the replicas.
+type ReplicaDiff struct {
+	PartnId  PartitionId `json:"partnId"`
+	Key      string      `json:"key,omitempty"`
+	DocId    string      `json:"docid"`
+	Replicas []int       `json:"replicas"` // replicas having the entry
+}
+
+// ReplicaCheckReport is the result of a replica check.
+type ReplicaCheckReport struct {
+	DefnId     IndexDefnId   `json:"defnId"`
+	Bucket     string        `json:"bucket"`
+	Name       string        `json:"name"`
+	Replicas   []int         `json:"replicas"`
+	Ts         *TsVbuuid     `json:"ts"`
+	Partitions int           `json:"partitions"`
+	Consistent bool          `json:"consistent"`
+	Diffs      []ReplicaDiff `json:"diffs,omitempty"`
+	Truncated  bool          `json:"truncated,omitempty"`
+	Skipped    []string      `json:"skipped,omitempty"`
+}
+
+// EntryHash returns the hash of a raw index entry, which selects its
+// hash range.
+func EntryHash(entry []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(entry)
+	return h.Sum64()
+}
+
+// SplitHashRange splits r into at most n ranges of equal size.
+func SplitHashRange(r HashRange, n int) []HashRange {
+	if n < 2 || r.Low == r.High {
+		return []HashRange{r}
+	}
+
+	// ceil((High-Low+1)/n), without overflow for the full range
+	step := (r.High-r.Low)/uint64(n) + 1
+
+	ranges := make([]HashRange, 0, n)
+	for low := r.Low; ; low += step {
+		if r.High-low < step {
+			ranges = append(ranges, HashRange{Low: low, High: r.High})
+			break
+		}
+		ranges = append(ranges, HashRange{Low: low, High: low + step - 1})
+	}
+	return ranges
+}
+
+// FindHashRange returns the index of the range holding h in sorted,
+// non-overlapping ranges, or -1 if none holds it.
+func FindHashRange(ranges []HashRange, h uint64) int {
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].High >= h
+	})
+	if i < len(ranges) && ranges[i].Low <= h {
+		return i
+	}
+	return -1
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSplitHashRange(t *testing.T) {
+	check := func(r HashRange, n int, expected int) {
+		ranges := SplitHashRange(r, n)
+		if len(ranges) != expected {
+			t.Fatalf("%v/%v: expected %v ranges, received %v", r, n, expected, ranges)
+		}
+		if ranges[0].Low != r.Low || ranges[len(ranges)-1].High != r.High {
+			t.Fatalf("%v/%v: ranges %v don't cover the range", r, n, ranges)
+		}
+		for i := 1; i < len(ranges); i++ {
+			if ranges[i].Low != ranges[i-1].High+1 || ranges[i].Low > ranges[i].High {
+				t.Fatalf("%v/%v: invalid ranges %v", r, n, ranges)
+			}
+		}
+	}
+
+	check(FullHashRange, 16, 16)
+	check(FullHashRange, 3, 3)
+	check(HashRange{Low: 10, High: 19}, 4, 4)
+	check(HashRange{Low: 10, High: 12}, 16, 3)
+	check(HashRange{Low: 7, High: 7}, 16, 1)
+	check(HashRange{Low: math.MaxUint64 - 1, High: math.MaxUint64}, 2, 2)
+}
+
+func TestFindHashRange(t *testing.T) {
+	ranges := []HashRange{{0, 9}, {20, 29}, {30, math.MaxUint64}}
+
+	samples := map[uint64]int{
+		0:              0,
+		9:              0,
+		10:             -1,
+		19:             -1,
+		20:             1,
+		30:             2,
+		math.MaxUint64: 2,
+	}
+	for h, expected := range samples {
+		if i := FindHashRange(ranges, h); i != expected {
+			t.Errorf("%v: expected %v, received %v", h, expected, i)
+		}
+	}
+
+	if i := FindHashRange(nil, 1); i != -1 {
+		t.Errorf("expected -1, received %v", i)
+	}
+}
+
+func TestRangeDigest(t *testing.T) {
+	entries := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+
+	var d1, d2 RangeDigest
+	for i := range entries {
+		d1.Add(entries[i])
+		d2.Add(entries[len(entries)-1-i])
+	}
+	if d1 != d2 {
+		t.Errorf("digest depends on order: %v != %v", d1, d2)
+	}
+
+	d2.Add([]byte("d"))
+	if d1 == d2 {
+		t.Errorf("expected digests to differ")
+	}
+
+	// same count, different entries
+	var d3 RangeDigest
+	for _, e := range [][]byte{[]byte("a"), []byte("b"), []byte("e")} {
+		d3.Add(e)
+	}
+	if d1.Count != d3.Count || d1 == d3 {
+		t.Errorf("expected digests to differ: %v %v", d1, d3)
+	}
+}
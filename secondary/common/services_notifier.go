@@ -148,6 +148,18 @@ func NewServicesChangeNotifier(clusterUrl, pool string) (*ServicesChangeNotifier
 	defer singletonServicesContainer.Unlock()
 	id := clusterUrl + "-" + pool
 
+	// topology of a standalone node never changes, so there is no
+	// notification to observe
+	if _, ok := singletonServicesContainer.notifiers[id]; !ok && IsStandalone() {
+		singletonServicesContainer.notifiers[id] = &serviceNotifierInstance{
+			id:         id,
+			clusterUrl: clusterUrl,
+			pool:       pool,
+			valid:      true,
+			waiters:    make(map[int]chan Notification),
+		}
+	}
+
 	if _, ok := singletonServicesContainer.notifiers[id]; !ok {
 		client, err := couchbase.Connect(clusterUrl)
 		if err != nil {
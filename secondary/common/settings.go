@@ -13,7 +13,7 @@ import (
 	"os"
 	"time"
 
-	"github.com/couchbase/cbauth/metakv"
+	"github.com/couchbase/indexing/secondary/common/metakv"
 	"github.com/couchbase/indexing/secondary/logging"
 )
 
@@ -0,0 +1,213 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	"github.com/couchbase/indexing/secondary/common/metakv"
+	"github.com/couchbase/indexing/secondary/dcp"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// Standalone mode runs the indexer and the projector on a single node,
+// without the cluster manager:
+// - metakv is kept in a local file shared by the processes,
+// - the cluster topology is read from a static file, and served by
+//   ClusterInfoCache,
+// - incoming requests are not authenticated, and the credentials of the
+//   topology, if any, are passed through to the KV source.
+
+var ErrStandaloneBucketNotFound = errors.New("Bucket not found in standalone topology")
+
+// cluster compatibility of the standalone node, 5.5
+const standaloneClusterCompatibility = 5*65536 + 5
+
+const standaloneServerGroup = "Group 1"
+
+// StandaloneTopology is the static topology of the standalone node.
+type StandaloneTopology struct {
+	// host of the node
+	Host string `json:"host"`
+	// ports of the services of the node, by service name, eg.
+	// mgmt, kv, projector, indexAdmin, indexScan, indexHttp. The mgmt
+	// port is the REST port of the KV source, which serves the buckets.
+	Services    map[string]int `json:"services"`
+	ServerGroup string         `json:"serverGroup,omitempty"`
+
+	// credentials passed through to the KV source
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	Buckets []*StandaloneBucket `json:"buckets"`
+}
+
+// StandaloneBucket is a bucket of the standalone node, all its vbuckets
+// are on the node.
+type StandaloneBucket struct {
+	Name        string `json:"name"`
+	UUID        string `json:"uuid"`
+	Type        string `json:"type,omitempty"` // membase or ephemeral
+	NumVbuckets int    `json:"numVbuckets"`
+}
+
+var standaloneTopology *StandaloneTopology
+
+// SetupStandalone switches the process to standalone mode, with the
+// topology read from topologyFile and metakv kept in metakvFile. It must
+// be called before any cluster information is fetched.
+func SetupStandalone(topologyFile, metakvFile string) error {
+
+	buf, err := ioutil.ReadFile(topologyFile)
+	if err != nil {
+		return err
+	}
+
+	t := &StandaloneTopology{}
+	if err := json.Unmarshal(buf, t); err != nil {
+		return fmt.Errorf("Invalid standalone topology %v: %v", topologyFile, err)
+	}
+
+	if t.Host == "" {
+		t.Host = GetLocalIpAddr(IsIpv6())
+	}
+	if _, ok := t.Services["mgmt"]; !ok {
+		return fmt.Errorf("Invalid standalone topology %v: missing mgmt port", topologyFile)
+	}
+	if t.ServerGroup == "" {
+		t.ServerGroup = standaloneServerGroup
+	}
+	for _, b := range t.Buckets {
+		if b.Name == "" || b.NumVbuckets <= 0 {
+			return fmt.Errorf("Invalid standalone topology %v: invalid bucket %v",
+				topologyFile, b.Name)
+		}
+		if b.Type == "" {
+			b.Type = "membase"
+		}
+	}
+
+	if err := metakv.UseFile(metakvFile); err != nil {
+		return err
+	}
+
+	standaloneTopology = t
+	logging.Infof("Standalone mode with topology %v and metakv %v", topologyFile, metakvFile)
+	return nil
+}
+
+// IsStandalone returns true if the process runs without the cluster
+// manager.
+func IsStandalone() bool {
+	return standaloneTopology != nil
+}
+
+// GetStandaloneTopology returns the topology of the standalone node, nil
+// if the process isn't standalone.
+func GetStandaloneTopology() *StandaloneTopology {
+	return standaloneTopology
+}
+
+// ClusterAddr returns the address of the cluster, which is the mgmt
+// address of the node.
+func (t *StandaloneTopology) ClusterAddr() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Services["mgmt"]))
+}
+
+func (t *StandaloneTopology) bucket(name string) (*StandaloneBucket, error) {
+	for _, b := range t.Buckets {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return nil, ErrStandaloneBucketNotFound
+}
+
+// fetchStandalone fills the cluster information from the standalone
+// topology.
+func (c *ClusterInfoCache) fetchStandalone() error {
+
+	t := standaloneTopology
+
+	var services []string
+	hasIndex := false
+	for srvc := range t.Services {
+		switch srvc {
+		case "kv", "n1ql", "fts":
+			services = append(services, srvc)
+		case INDEX_ADMIN_SERVICE, INDEX_SCAN_SERVICE, INDEX_HTTP_SERVICE:
+			if !hasIndex {
+				services = append(services, "index")
+				hasIndex = true
+			}
+		}
+	}
+
+	c.nodes = []couchbase.Node{{
+		ClusterCompatibility: standaloneClusterCompatibility,
+		ClusterMembership:    "active",
+		Hostname:             t.ClusterAddr(),
+		Status:               "healthy",
+		ThisNode:             true,
+		Services:             services,
+	}}
+	c.nodesvs = []couchbase.NodeServices{{
+		Services: t.Services,
+		Hostname: t.Host,
+		ThisNode: true,
+	}}
+	c.failedNodes = nil
+	c.addNodes = nil
+	c.node2group = map[NodeId]string{0: t.ServerGroup}
+	c.version = standaloneClusterCompatibility / 65536
+	c.minorVersion = standaloneClusterCompatibility % 65536
+	return nil
+}
+
+func (c *ClusterInfoCache) getStandaloneVBuckets(nid NodeId, bucket string) ([]uint32, error) {
+	b, err := standaloneTopology.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if nid != 0 {
+		return nil, ErrInvalidNodeId
+	}
+
+	vbs := make([]uint32, 0, b.NumVbuckets)
+	for vb := 0; vb < b.NumVbuckets; vb++ {
+		vbs = append(vbs, uint32(vb))
+	}
+	return vbs, nil
+}
+
+// standaloneCreds are the credentials of requests in standalone mode,
+// which are allowed everything.
+type standaloneCreds struct{}
+
+func (c *standaloneCreds) Name() string {
+	return "standalone"
+}
+
+func (c *standaloneCreds) Source() string {
+	return "standalone"
+}
+
+func (c *standaloneCreds) Domain() string {
+	return "standalone"
+}
+
+func (c *standaloneCreds) IsAllowed(permission string) (bool, error) {
+	return true, nil
+}
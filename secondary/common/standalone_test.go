@@ -0,0 +1,75 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStandaloneClusterInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "standalone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	topology := `{
+		"host": "127.0.0.1",
+		"services": {"mgmt": 9000, "kv": 12000, "projector": 9999,
+			"indexAdmin": 9100, "indexScan": 9101, "indexHttp": 9102},
+		"buckets": [{"name": "default", "uuid": "abcd", "numVbuckets": 8},
+			{"name": "eph", "uuid": "efgh", "type": "ephemeral", "numVbuckets": 4}]
+	}`
+	topologyFile := filepath.Join(dir, "topology.json")
+	if err := ioutil.WriteFile(topologyFile, []byte(topology), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetupStandalone(topologyFile, filepath.Join(dir, "metakv.json")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { standaloneTopology = nil }()
+
+	if addr := GetStandaloneTopology().ClusterAddr(); addr != "127.0.0.1:9000" {
+		t.Errorf("Expected cluster address 127.0.0.1:9000, received %v", addr)
+	}
+
+	cinfo, err := FetchNewClusterInfoCache(GetStandaloneTopology().ClusterAddr(), "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nodes := cinfo.GetActiveIndexerNodes(); len(nodes) != 1 {
+		t.Errorf("Expected an indexer node, received %v", nodes)
+	}
+
+	addr, err := cinfo.GetLocalServiceAddress(INDEX_HTTP_SERVICE)
+	if err != nil || addr != "127.0.0.1:9102" {
+		t.Errorf("Expected 127.0.0.1:9102, received %v %v", addr, err)
+	}
+
+	if uuid := cinfo.GetBucketUUID("default"); uuid != "abcd" {
+		t.Errorf("Expected bucket uuid abcd, received %v", uuid)
+	}
+	if uuid := cinfo.GetBucketUUID("missing"); uuid != BUCKET_UUID_NIL {
+		t.Errorf("Expected no bucket uuid, received %v", uuid)
+	}
+
+	if ephemeral, err := cinfo.IsEphemeral("eph"); err != nil || !ephemeral {
+		t.Errorf("Expected ephemeral bucket, received %v %v", ephemeral, err)
+	}
+
+	vbs, err := cinfo.GetVBuckets(cinfo.GetCurrentNode(), "default")
+	if err != nil || len(vbs) != 8 {
+		t.Errorf("Expected 8 vbuckets, received %v %v", vbs, err)
+	}
+
+	creds, valid, err := IsAuthValid(nil)
+	if err != nil || !valid {
+		t.Fatalf("Expected valid credentials, received %v %v", valid, err)
+	}
+	if allowed, _ := creds.IsAllowed("cluster.bucket[default].n1ql.index!create"); !allowed {
+		t.Errorf("Expected standalone credentials to be allowed")
+	}
+}
@@ -33,6 +33,7 @@ type TsVbuuid struct {
 	LargeSnap    bool
 	SnapAligned  bool
 	DisableAlign bool
+	GenTime      int64 // unix nano time at which timekeeper generated the ts
 }
 
 // NewTsVbuuid returns reference to new instance of TsVbuuid.
@@ -72,6 +73,7 @@ func NewTsVbuuidCached(bucket string, numVbuckets int) *TsVbuuid {
 		ts.Snapshots[i][1] = 0
 		ts.Crc64 = 0
 	}
+	ts.GenTime = 0
 	ts.Bucket = bucket
 	return ts
 }
@@ -233,6 +235,7 @@ func (ts *TsVbuuid) Copy() *TsVbuuid {
 	newTs.LargeSnap = ts.LargeSnap
 	newTs.SnapAligned = ts.SnapAligned
 	newTs.Crc64 = ts.Crc64
+	newTs.GenTime = ts.GenTime
 	return newTs
 }
 
@@ -244,6 +247,7 @@ func (ts *TsVbuuid) CopyFrom(src *TsVbuuid) {
 	ts.LargeSnap = src.LargeSnap
 	ts.SnapAligned = src.SnapAligned
 	ts.Crc64 = src.Crc64
+	ts.GenTime = src.GenTime
 }
 
 // Equal returns whether `ts` and `other` compare equal.
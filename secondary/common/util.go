@@ -228,6 +228,10 @@ type CbAuthHandler struct {
 
 func (ah *CbAuthHandler) GetCredentials() (string, string) {
 
+	if t := GetStandaloneTopology(); t != nil {
+		return t.User, t.Password
+	}
+
 	var u, p string
 
 	fn := func(r int, err error) error {
@@ -250,6 +254,16 @@ func (ah *CbAuthHandler) GetCredentials() (string, string) {
 
 func (ah *CbAuthHandler) AuthenticateMemcachedConn(host string, conn *memcached.Client) error {
 
+	if t := GetStandaloneTopology(); t != nil {
+		if t.User != "" {
+			if _, err := conn.Auth(t.User, t.Password); err != nil {
+				return err
+			}
+		}
+		_, err := conn.SelectBucket(ah.Bucket)
+		return err
+	}
+
 	var u, p string
 
 	fn := func(r int, err error) error {
@@ -415,6 +429,14 @@ func ClusterAuthUrl(cluster string) (string, error) {
 		cluster = u.Host
 	}
 
+	if t := GetStandaloneTopology(); t != nil {
+		clusterUrl := url.URL{Scheme: "http", Host: cluster}
+		if t.User != "" {
+			clusterUrl.User = url.UserPassword(t.User, t.Password)
+		}
+		return clusterUrl.String(), nil
+	}
+
 	adminUser, adminPasswd, err := cbauth.GetHTTPServiceAuth(cluster)
 	if err != nil {
 		return "", err
@@ -578,6 +600,10 @@ func BucketTs(bucket *couchbase.Bucket, maxvb int) (seqnos, vbuuids []uint64, er
 
 func IsAuthValid(r *http.Request) (cbauth.Creds, bool, error) {
 
+	if IsStandalone() {
+		return &standaloneCreds{}, true, nil
+	}
+
 	creds, err := cbauth.AuthWebCreds(r)
 	if err != nil {
 		if strings.Contains(err.Error(), cbauthimpl.ErrNoAuth.Error()) {
@@ -589,6 +615,20 @@ func IsAuthValid(r *http.Request) (cbauth.Creds, bool, error) {
 	return creds, true, nil
 }
 
+// SetRequestAuth sets the credentials of a request to another service of
+// the cluster.
+func SetRequestAuth(req *http.Request) error {
+
+	if t := GetStandaloneTopology(); t != nil {
+		if t.User != "" {
+			req.SetBasicAuth(t.User, t.Password)
+		}
+		return nil
+	}
+
+	return cbauth.SetRequestAuthVia(req, nil)
+}
+
 func SetNumCPUs(percent int) int {
 	ncpu := percent / 100
 	if ncpu == 0 {
@@ -657,6 +697,23 @@ func IndexStatement(def IndexDefn, printNodes bool) string {
 		withExpr += " \"retain_deleted_xattr\":true"
 	}
 
+	if def.SnapshotRetention != 0 {
+		if len(withExpr) != 0 {
+			withExpr += ","
+		}
+
+		withExpr += fmt.Sprintf(" \"snapshot_retention\":%v", def.SnapshotRetention)
+	}
+
+	if def.Collation != nil {
+		if len(withExpr) != 0 {
+			withExpr += ","
+		}
+
+		withExpr += fmt.Sprintf(" \"collation\":{\"locale\":%q, \"strength\":%q, \"caseLevel\":%v}",
+			def.Collation.Locale, def.Collation.Strength, def.Collation.CaseLevel)
+	}
+
 	if printNodes && len(def.Nodes) != 0 {
 		if len(withExpr) != 0 {
 			withExpr += ","
@@ -795,7 +852,7 @@ func Console(clusterAddr string, format string, v ...interface{}) error {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	cbauth.SetRequestAuthVia(req, nil)
+	SetRequestAuth(req)
 
 	client := http.Client{Timeout: time.Duration(10 * time.Second)}
 	_, err = client.Do(req)
@@ -7,8 +7,10 @@
 //                            |
 //                            |  (flushTick || > bufferSize)
 //        Ping() -----*----> run -------------------------------> TCP
-//                    |       ^
+//                    |       ^                                 |
 //        Send() -----*       | endpoint routine buffers messages,
+//                    |       | credits                         |
+//                    |       *------- receiveCredits() <-------*
 //                    |       | batches them based on timeout and
 //       Close() -----*       | message-count and periodically flushes
 //                            | them out via dataport-client.
@@ -20,6 +22,7 @@ package dataport
 
 import "fmt"
 import "net"
+import "sync/atomic"
 import "time"
 import "strconv"
 import "strings"
@@ -44,6 +47,11 @@ type RouterEndpoint struct {
 	bufferTm   time.Duration // timeout to flush endpoint-buffer
 	harakiriTm time.Duration // timeout after which endpoint commits harakiri
 	statTick   time.Duration // timeout for logging statistics
+	flowTm     time.Duration // timeout to wait for flow control credits
+	// flow control
+	credits     int64 // credits granted by remote, not yet consumed
+	flowControl int32 // remote has granted credits
+	creditch    chan bool
 	// gen-server
 	ch    chan []interface{} // carries control commands
 	finch chan bool
@@ -61,6 +69,10 @@ type RouterEndpoint struct {
 	snapCount   int64
 	flushCount  int64
 	prjLatency  *Average
+	// flow control statistics
+	starvedCount int64         // number of times endpoint ran out of credits
+	starvedTime  time.Duration // total time spent waiting for credits
+	starvedSince time.Time     // zero value if not starved
 }
 
 // NewRouterEndpoint instantiate a new RouterEndpoint
@@ -85,6 +97,8 @@ func NewRouterEndpoint(
 		statTick:   time.Duration(config["statTick"].Int()),
 		bufferTm:   time.Duration(config["bufferTimeout"].Int()),
 		harakiriTm: time.Duration(config["harakiriTimeout"].Int()),
+		flowTm:     time.Duration(config["flowControlTimeout"].Int()),
+		creditch:   make(chan bool, 1),
 		prjLatency: &Average{},
 	}
 	endpoint.ch = make(chan []interface{}, endpoint.keyChSize)
@@ -99,12 +113,14 @@ func NewRouterEndpoint(
 	endpoint.statTick *= time.Millisecond
 	endpoint.bufferTm *= time.Millisecond
 	endpoint.harakiriTm *= time.Millisecond
+	endpoint.flowTm *= time.Millisecond
 
 	endpoint.logPrefix = fmt.Sprintf(
 		"ENDP[<-(%v,%4x)<-%v #%v]",
 		endpoint.raddr, uint16(endpoint.timestamp), cluster, topic)
 
 	go endpoint.run(endpoint.ch)
+	go endpoint.receiveCredits()
 	logging.Infof("%v started ...\n", endpoint.logPrefix)
 	return endpoint, nil
 }
@@ -192,7 +208,7 @@ func (endpoint *RouterEndpoint) run(ch chan []interface{}) {
 	}()
 
 	statSince := time.Now()
-	var stitems [14]string
+	var stitems [17]string
 	logstats := func() {
 		prjLatency := endpoint.prjLatency
 		stitems[0] = `"topic":"` + endpoint.topic + `"`
@@ -209,6 +225,11 @@ func (endpoint *RouterEndpoint) run(ch chan []interface{}) {
 		stitems[11] = `"latency.min":` + strconv.Itoa(int(prjLatency.Min()))
 		stitems[12] = `"latency.max":` + strconv.Itoa(int(prjLatency.Max()))
 		stitems[13] = `"latency.avg":` + strconv.Itoa(int(prjLatency.Mean()))
+		credits := atomic.LoadInt64(&endpoint.credits)
+		starvedMs := int64(endpoint.getStarvedTime() / time.Millisecond)
+		stitems[14] = `"credits":` + strconv.Itoa(int(credits))
+		stitems[15] = `"starvedCount":` + strconv.Itoa(int(endpoint.starvedCount))
+		stitems[16] = `"starvedTime":` + strconv.Itoa(int(starvedMs))
 		statjson := strings.Join(stitems[:], ",")
 		fmsg := "%v stats {%v}\n"
 		logging.Infof(fmsg, endpoint.logPrefix, statjson)
@@ -220,6 +241,27 @@ func (endpoint *RouterEndpoint) run(ch chan []interface{}) {
 
 	messageCount := 0
 	flushBuffers := func() (err error) {
+		if time.Since(statSince) > endpoint.statTick {
+			logstats()
+			statSince = time.Now()
+		}
+		if messageCount > 0 && !endpoint.takeCredit() {
+			// keep buffering till remote grants credits.
+			if endpoint.starvedSince.IsZero() {
+				endpoint.starvedSince = time.Now()
+				endpoint.starvedCount++
+			} else if time.Since(endpoint.starvedSince) > endpoint.flowTm {
+				fmsg := "%v no credits from %q for %v\n"
+				starvedTm := time.Since(endpoint.starvedSince)
+				logging.Errorf(fmsg, endpoint.logPrefix, raddr, starvedTm)
+				return ErrorEndpointStarved
+			}
+			return nil
+		}
+		if !endpoint.starvedSince.IsZero() {
+			endpoint.starvedTime += time.Since(endpoint.starvedSince)
+			endpoint.starvedSince = time.Time{}
+		}
 		fmsg := "%v sent %v mutations to %q\n"
 		logging.Tracef(fmsg, endpoint.logPrefix, messageCount, raddr)
 		if messageCount > 0 {
@@ -230,13 +272,21 @@ func (endpoint *RouterEndpoint) run(ch chan []interface{}) {
 			endpoint.flushCount++
 		}
 		messageCount = 0
-		if time.Since(statSince) > endpoint.statTick {
-			logstats()
-			statSince = time.Now()
-		}
 		return
 	}
 
+	// drop the endpoint, instead of blocking upstream, once keyChSize
+	// entries are buffered for want of credits. Feed will delete this
+	// endpoint and remote can repair it.
+	checkStarved := func() error {
+		if endpoint.starvedSince.IsZero() || messageCount <= endpoint.keyChSize {
+			return nil
+		}
+		fmsg := "%v buffered %v mutations for want of credits from %q\n"
+		logging.Errorf(fmsg, endpoint.logPrefix, messageCount, raddr)
+		return ErrorEndpointStarved
+	}
+
 loop:
 	for {
 		select {
@@ -265,6 +315,9 @@ loop:
 						break loop
 					}
 				}
+				if err := checkStarved(); err != nil {
+					break loop
+				}
 
 				lastActiveTime = time.Now()
 
@@ -287,6 +340,10 @@ loop:
 					flushTick.Stop()
 					flushTick = time.NewTicker(endpoint.bufferTm)
 				}
+				if cv, ok := config["flowControlTimeout"]; ok {
+					endpoint.flowTm = time.Duration(cv.Int())
+					endpoint.flowTm *= time.Millisecond
+				}
 				if cv, ok := config["harakiriTimeout"]; ok {
 					endpoint.harakiriTm = time.Duration(cv.Int())
 					endpoint.harakiriTm *= time.Millisecond
@@ -299,7 +356,7 @@ loop:
 				respch := msg[2].(chan []interface{})
 				respch <- []interface{}{nil}
 
-			case endpCmdGetStatistics: // TODO: this is defunct now.
+			case endpCmdGetStatistics:
 				respch := msg[1].(chan []interface{})
 				stats := endpoint.newStats()
 				respch <- []interface{}{map[string]interface{}(stats)}
@@ -311,6 +368,13 @@ loop:
 				break loop
 			}
 
+		case <-endpoint.creditch:
+			if !endpoint.starvedSince.IsZero() { // flush what was held back
+				if err := flushBuffers(); err != nil {
+					break loop
+				}
+			}
+
 		case <-flushTick.C:
 			if err := flushBuffers(); err != nil {
 				break loop
@@ -334,8 +398,56 @@ loop:
 	logstats()
 }
 
+// takeCredit to send a packet to remote, always succeeds if remote has
+// not granted any credit.
+func (endpoint *RouterEndpoint) takeCredit() bool {
+	if atomic.LoadInt32(&endpoint.flowControl) == 0 {
+		return true
+	}
+	if atomic.AddInt64(&endpoint.credits, -1) >= 0 {
+		return true
+	}
+	atomic.AddInt64(&endpoint.credits, 1)
+	return false
+}
+
+// receiveCredits from remote, till the connection is closed.
+func (endpoint *RouterEndpoint) receiveCredits() {
+	for {
+		credits, err := readCredits(endpoint.conn)
+		if err != nil {
+			fmsg := "%v receiveCredits() exit: %v\n"
+			logging.Tracef(fmsg, endpoint.logPrefix, err)
+			return
+		}
+		atomic.AddInt64(&endpoint.credits, int64(credits))
+		if atomic.CompareAndSwapInt32(&endpoint.flowControl, 0, 1) {
+			fmsg := "%v flow control enabled by %q with %v credits\n"
+			logging.Infof(fmsg, endpoint.logPrefix, endpoint.raddr, credits)
+		}
+		select {
+		case endpoint.creditch <- true:
+		default:
+		}
+	}
+}
+
+// getStarvedTime including the time spent waiting for credits so far.
+func (endpoint *RouterEndpoint) getStarvedTime() time.Duration {
+	starvedTime := endpoint.starvedTime
+	if !endpoint.starvedSince.IsZero() {
+		starvedTime += time.Since(endpoint.starvedSince)
+	}
+	return starvedTime
+}
+
 func (endpoint *RouterEndpoint) newStats() c.Statistics {
 	m := map[string]interface{}{}
 	stats, _ := c.NewStatistics(m)
+	starvedMs := int64(endpoint.getStarvedTime() / time.Millisecond)
+	stats.Set("credits", float64(atomic.LoadInt64(&endpoint.credits)))
+	stats.Set("starvedCount", float64(endpoint.starvedCount))
+	stats.Set("starvedTime", float64(starvedMs))
+	stats.Set("starved", !endpoint.starvedSince.IsZero())
 	return stats
 }
@@ -0,0 +1,124 @@
+// Credit based flow control between dataport server and router endpoint.
+//
+// Credits are counted in packets, each packet carrying a batch of
+// []*VbKeyVersions sent by RouterEndpoint. On accepting a connection,
+// dataport server grants an initial window of credits to the endpoint and
+// grants one credit back for every packet of mutations handed over to the
+// application. Credits flow on the same TCP connection in the reverse
+// direction, as frames of,
+//
+//      { uint32(credits) }
+//
+// RouterEndpoint consumes a credit for every packet it sends, and enforces
+// flow control only after receiving the first grant, so that endpoints and
+// servers without flow control can talk to each other.
+//
+// When an endpoint runs out of credits it keeps buffering mutations, without
+// blocking its upstream. If it has buffered more than `keyChanSize` entries,
+// or does not get a credit within `flowControlTimeout`, the endpoint closes
+// itself, so that the feed can repair it, instead of stalling all the
+// vbuckets routed through it. Starved counts are available as endpoint
+// statistics.
+
+package dataport
+
+import "encoding/binary"
+import "errors"
+import "io"
+import "net"
+import "sync/atomic"
+import "time"
+
+import "github.com/couchbase/indexing/secondary/logging"
+
+// ErrorEndpointStarved
+var ErrorEndpointStarved = errors.New("dataport.endpointStarved")
+
+const creditFrameSize = 4
+
+func writeCredits(conn net.Conn, credits uint32) error {
+	var frame [creditFrameSize]byte
+	binary.BigEndian.PutUint32(frame[:], credits)
+	_, err := conn.Write(frame[:])
+	return err
+}
+
+func readCredits(conn net.Conn) (uint32, error) {
+	var frame [creditFrameSize]byte
+	if _, err := io.ReadFull(conn, frame[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(frame[:]), nil
+}
+
+// creditSender grants credits to remote endpoint of a connection, without
+// blocking the caller. Credits granted while a frame is being written are
+// coalesced into the next frame.
+type creditSender struct {
+	logPrefix    string
+	conn         net.Conn
+	writeTimeout time.Duration
+	pending      uint32 // credits yet to be sent
+	kickch       chan bool
+	finch        chan bool
+}
+
+func newCreditSender(
+	prefix string, conn net.Conn, window int,
+	writeTimeout time.Duration) *creditSender {
+
+	cs := &creditSender{
+		logPrefix:    prefix,
+		conn:         conn,
+		writeTimeout: writeTimeout,
+		pending:      uint32(window),
+		kickch:       make(chan bool, 1),
+		finch:        make(chan bool),
+	}
+	go cs.run()
+	cs.kick()
+	return cs
+}
+
+// grant `n` credits to the remote endpoint.
+func (cs *creditSender) grant(n uint32) {
+	atomic.AddUint32(&cs.pending, n)
+	cs.kick()
+}
+
+func (cs *creditSender) kick() {
+	select {
+	case cs.kickch <- true:
+	default:
+	}
+}
+
+// close the sender, connection is closed by the caller.
+func (cs *creditSender) close() {
+	close(cs.finch)
+}
+
+func (cs *creditSender) run() {
+	raddr := cs.conn.RemoteAddr().String()
+loop:
+	for {
+		select {
+		case <-cs.kickch:
+			credits := atomic.SwapUint32(&cs.pending, 0)
+			if credits == 0 {
+				continue
+			}
+			// remote endpoints that do not read credits shall not block us.
+			cs.conn.SetWriteDeadline(time.Now().Add(cs.writeTimeout))
+			if err := writeCredits(cs.conn, credits); err != nil {
+				fmsg := "%v credits for %q stopped: %v\n"
+				logging.Errorf(fmsg, cs.logPrefix, raddr, err)
+				break loop
+			}
+			logging.Tracef("%v granted %v credits to %q\n", cs.logPrefix, credits, raddr)
+
+		case <-cs.finch:
+			break loop
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package dataport
+
+import "sync/atomic"
+import "testing"
+import "time"
+
+import "github.com/couchbase/indexing/secondary/logging"
+import c "github.com/couchbase/indexing/secondary/common"
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/data"
+
+func startFlowControl(
+	t *testing.T, raddr string, window, timeout, keyChanSize int,
+	appch chan interface{}) (*Server, *RouterEndpoint) {
+
+	dconfig := c.SystemConfig.SectionConfig("indexer.dataport.", true /*trim*/)
+	dconfig.SetValue("flowControlWindow", window)
+	daemon, err := NewServer(raddr, 16, dconfig, appch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := c.SystemConfig.SectionConfig("projector.dataport.", true /*trim*/)
+	config.SetValue("bufferSize", 0) // a packet for every Send()
+	config.SetValue("flowControlTimeout", timeout)
+	config.SetValue("keyChanSize", keyChanSize)
+	endp, err := NewRouterEndpoint("clust", "topic", raddr, 16, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the initial window
+	for i := 0; atomic.LoadInt32(&endp.flowControl) == 0; i++ {
+		if i > 100 {
+			t.Fatal("flow control not enabled by server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return daemon, endp
+}
+
+func sendStreamBegin(t *testing.T, endp *RouterEndpoint, vbno uint16) {
+	kv := c.NewKeyVersions(0, []byte("Bourne"), 1, 0)
+	kv.AddStreamBegin()
+	dkv := &c.DataportKeyVersions{
+		Bucket: "default", Vbno: vbno, Vbuuid: 1234, Kv: kv,
+	}
+	if err := endp.Send(dkv); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	appch := make(chan interface{}) // packets are held till consumed
+	daemon, endp := startFlowControl(t, "localhost:8890", 1, 10000, 10000, appch)
+
+	for vbno := uint16(0); vbno < 3; vbno++ {
+		sendStreamBegin(t, endp, vbno)
+	}
+	// mutations held back for want of credits are batched in a packet.
+	for n := 0; n < 3; {
+		select {
+		case msg := <-appch:
+			vbs, ok := msg.([]*protobuf.VbKeyVersions)
+			if !ok {
+				t.Fatalf("unexpected message %T", msg)
+			}
+			n += len(vbs)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected vbucket %v after returning credits", n)
+		}
+	}
+	if !endp.Ping() {
+		t.Fatal("expected endpoint to be active")
+	}
+
+	endp.Close()
+	daemon.Close()
+}
+
+func TestFlowControlStarved(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	appch := make(chan interface{})
+	daemon, endp := startFlowControl(t, "localhost:8891", 1, 200, 10000, appch)
+
+	// application does not consume, second packet has no credit.
+	sendStreamBegin(t, endp, 0)
+	sendStreamBegin(t, endp, 1)
+
+	exitch := make(chan error, 1)
+	go func() { exitch <- endp.WaitForExit() }()
+	select {
+	case <-exitch:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected starved endpoint to close")
+	}
+
+	daemon.Close()
+}
+
+func TestFlowControlStarvedStats(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	appch := make(chan interface{})
+	daemon, endp := startFlowControl(t, "localhost:8892", 1, 10000, 10000, appch)
+
+	sendStreamBegin(t, endp, 0)
+	sendStreamBegin(t, endp, 1)
+
+	// wait for the endpoint to flush the second packet.
+	time.Sleep(100 * time.Millisecond)
+	stats := endp.GetStatistics()
+	if stats["starved"] != true || stats["starvedCount"].(float64) != 1 {
+		t.Fatalf("expected starved endpoint, got %v", stats)
+	}
+	if !endp.Ping() {
+		t.Fatal("expected endpoint to be active")
+	}
+
+	endp.Close()
+	daemon.Close()
+}
+
+func TestFlowControlStarvedOverflow(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	appch := make(chan interface{})
+	daemon, endp := startFlowControl(t, "localhost:8893", 1, 10000, 4, appch)
+
+	// upstream is not blocked while the endpoint is starved, endpoint
+	// closes itself once keyChanSize mutations are held back.
+	exitch := make(chan error, 1)
+	go func() { exitch <- endp.WaitForExit() }()
+	for vbno := uint16(0); vbno < 16; vbno++ {
+		kv := c.NewKeyVersions(0, []byte("Bourne"), 1, 0)
+		kv.AddStreamBegin()
+		dkv := &c.DataportKeyVersions{
+			Bucket: "default", Vbno: vbno, Vbuuid: 1234, Kv: kv,
+		}
+		if err := endp.Send(dkv); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-exitch:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected starved endpoint to close")
+	}
+
+	daemon.Close()
+}
@@ -120,6 +120,8 @@ type netConn struct {
 	worker chan interface{}
 	active bool
 	tpkt   *transport.TransportPacket
+	// flow control, nil if disabled
+	credits *creditSender
 }
 
 // Server handles an active dataport server of mutation for all vbuckets.
@@ -139,6 +141,7 @@ type Server struct {
 	genChSize    int           // channel size for genServer routine
 	maxPayload   int           // maximum payload length from router
 	readDeadline time.Duration // timeout, in millisecond, reading from socket
+	window       int           // flow control credits per connection
 	logPrefix    string
 }
 
@@ -165,6 +168,7 @@ func NewServer(
 		genChSize:    genChSize,
 		maxPayload:   config["maxPayload"].Int(),
 		readDeadline: time.Duration(config["tcpReadDeadline"].Int()),
+		window:       config["flowControlWindow"].Int(),
 	}
 	s.logPrefix = fmt.Sprintf("DATP[->dataport %q]", laddr)
 	if s.lis, err = net.Listen("tcp", laddr); err != nil {
@@ -300,10 +304,15 @@ func (s *Server) genServer(reqch, datach chan []interface{}) {
 
 			} else { // connection accepted
 				worker := make(chan interface{}, s.maxVbuckets)
-				s.conns[raddr] = &netConn{
+				nc := &netConn{
 					conn: conn, worker: worker,
 					tpkt: newTransportPkt(s.maxPayload),
 				}
+				if s.window > 0 {
+					timeout := s.readDeadline * time.Millisecond
+					nc.credits = newCreditSender(s.logPrefix, conn, s.window, timeout)
+				}
+				s.conns[raddr] = nc
 				n := len(s.conns)
 				fmsg := "%v new connection %q +%d\n"
 				logging.Infof(fmsg, s.logPrefix, raddr, n)
@@ -353,6 +362,10 @@ loop:
 
 			case serverCmdVbKeyVersions:
 				nicetoapp(parseVbs(msg))
+				// packet is consumed, return the credit to remote.
+				if nc, ok := s.conns[msg.raddr]; ok && nc.credits != nil {
+					nc.credits.grant(1)
+				}
 
 			case serverCmdError:
 				var g interface{}
@@ -490,6 +503,9 @@ func closeConnection(prefix, raddr string, nc *netConn) {
 		}
 	}()
 	close(nc.worker)
+	if nc.credits != nil {
+		nc.credits.close()
+	}
 	nc.conn.Close()
 	logging.Infof("%v connection %q closed !\n", prefix, raddr)
 }
@@ -0,0 +1,119 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Package encryption provides encryption at rest for index data files.
+//
+// Keys are obtained from a KeyProvider. Every encrypted file records the
+// id of the key it was written with, so that files written before a key
+// rotation stay readable as long as the provider still knows the old key.
+// Files are re-encrypted with the active key whenever they are rewritten,
+// i.e. on the next snapshot or compaction.
+//
+// Memdb snapshot files, forestdb index files and the forestdb meta file
+// of the indexer are encrypted. Plasma log-structured files and the
+// metadata repository of the index manager are not encrypted yet: they
+// are opened by plasma and gometa, which take no encryption key.
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// KeySize is the size of AES-256 keys.
+const KeySize = 32
+
+var (
+	ErrKeyNotFound = errors.New("encryption: key not found")
+	ErrInvalidKey  = errors.New("encryption: invalid key")
+	ErrNoProvider  = errors.New("encryption: no key provider")
+	ErrCorrupted   = errors.New("encryption: corrupted data")
+)
+
+// Key is an AES-256 data encryption key.
+type Key struct {
+	Id    string
+	Bytes []byte
+}
+
+func (k *Key) validate() error {
+	if k == nil || k.Id == "" || len(k.Id) > 255 || len(k.Bytes) != KeySize {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// String does not print the key material.
+func (k *Key) String() string {
+	return fmt.Sprintf("Key{%v}", k.Id)
+}
+
+// KeyProvider supplies the keys used to encrypt and decrypt files.
+type KeyProvider interface {
+	// ActiveKey returns the key new files are encrypted with.
+	ActiveKey() (*Key, error)
+
+	// GetKey returns the key with the given id, used to decrypt files
+	// written with an older active key.
+	GetKey(id string) (*Key, error)
+}
+
+var (
+	mu       sync.RWMutex
+	provider KeyProvider
+)
+
+// SetKeyProvider installs the process-wide key provider. Encryption is
+// disabled while no provider is installed.
+func SetKeyProvider(p KeyProvider) {
+	mu.Lock()
+	defer mu.Unlock()
+	provider = p
+}
+
+// GetKeyProvider returns the process-wide key provider, nil if
+// encryption is disabled.
+func GetKeyProvider() KeyProvider {
+	mu.RLock()
+	defer mu.RUnlock()
+	return provider
+}
+
+// ActiveKey returns the active key of p, or nil if p is nil.
+func ActiveKey(p KeyProvider) (*Key, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	key, err := p.ActiveKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// GetKey returns the key with the given id from p.
+func GetKey(p KeyProvider, id string) (*Key, error) {
+	if p == nil {
+		return nil, ErrNoProvider
+	}
+
+	key, err := p.GetKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
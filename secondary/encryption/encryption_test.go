@@ -0,0 +1,208 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testKey(id string, b byte) *Key {
+	return &Key{Id: id, Bytes: bytes.Repeat([]byte{b}, KeySize)}
+}
+
+type testProvider struct {
+	active string
+	keys   map[string]*Key
+}
+
+func (p *testProvider) ActiveKey() (*Key, error) {
+	return p.GetKey(p.active)
+}
+
+func (p *testProvider) GetKey(id string) (*Key, error) {
+	if k, ok := p.keys[id]; ok {
+		return k, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+func encrypt(t *testing.T, key *Key, data []byte) []byte {
+	var out bytes.Buffer
+	w, err := NewWriter(&out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	p := &testProvider{active: "k1", keys: map[string]*Key{"k1": testKey("k1", 1)}}
+
+	for _, n := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+
+		enc := encrypt(t, p.keys["k1"], data)
+		if n > 16 && bytes.Contains(enc, data[:16]) {
+			t.Errorf("size %v: plaintext found in encrypted stream", n)
+		}
+
+		br := bufio.NewReader(bytes.NewReader(enc))
+		if !IsEncrypted(br) {
+			t.Fatalf("size %v: stream not detected as encrypted", n)
+		}
+		r, err := NewReader(br, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %v: %v", n, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("size %v: decrypted data mismatch", n)
+		}
+	}
+
+	if IsEncrypted(bufio.NewReader(bytes.NewReader([]byte("plain data")))) {
+		t.Errorf("plain data detected as encrypted")
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	p := &testProvider{active: "k1", keys: map[string]*Key{"k1": testKey("k1", 1)}}
+	enc := encrypt(t, p.keys["k1"], bytes.Repeat([]byte("x"), 2*chunkSize+10))
+
+	read := func(data []byte) error {
+		r, err := NewReader(bytes.NewReader(data), p)
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(r)
+		return err
+	}
+
+	flipped := append([]byte(nil), enc...)
+	flipped[len(flipped)/2] ^= 1
+	if err := read(flipped); err != ErrCorrupted {
+		t.Errorf("Expected %v, received %v", ErrCorrupted, err)
+	}
+
+	// drop the last chunk
+	truncated := enc[:len(magic)+1+2+noncePrefixLen+2*(4+chunkSize+16)]
+	if err := read(truncated); err != ErrTruncated {
+		t.Errorf("Expected %v, received %v", ErrTruncated, err)
+	}
+
+	p.keys = map[string]*Key{"k2": testKey("k2", 2)}
+	if err := read(enc); err != ErrKeyNotFound {
+		t.Errorf("Expected %v, received %v", ErrKeyNotFound, err)
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+	write := func(kf KeyFile) {
+		bs, _ := json.Marshal(kf)
+		if err := ioutil.WriteFile(path, bs, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	k1 := base64.StdEncoding.EncodeToString(testKey("k1", 1).Bytes)
+	k2 := base64.StdEncoding.EncodeToString(testKey("k2", 2).Bytes)
+	write(KeyFile{Active: "k1", Keys: map[string]string{"k1": k1}})
+
+	p, err := NewFileKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := encrypt(t, mustActive(t, p, "k1"), []byte("data"))
+
+	// rotate
+	write(KeyFile{Active: "k2", Keys: map[string]string{"k1": k1, "k2": k2, "k3": k2}})
+	mustActive(t, p, "k2")
+
+	r, err := NewReader(bytes.NewReader(enc), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := ioutil.ReadAll(r); err != nil || string(out) != "data" {
+		t.Errorf("Expected data, received %s %v", out, err)
+	}
+
+	write(KeyFile{Active: "k4", Keys: map[string]string{"k1": k1}})
+	if _, err := NewFileKeyProvider(path); err == nil {
+		t.Errorf("Expected error for missing active key")
+	}
+}
+
+func mustActive(t *testing.T, p KeyProvider, id string) *Key {
+	key, err := ActiveKey(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Id != id {
+		t.Fatalf("Expected active key %v, received %v", id, key.Id)
+	}
+	return key
+}
+
+func TestKeyIds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	check := func(expected ...string) {
+		ids, err := ReadKeyIds(dir)
+		if err != nil || !reflect.DeepEqual(ids, expected) {
+			t.Errorf("Expected %q, received %q %v", expected, ids, err)
+		}
+	}
+
+	check("")
+	if err := WriteKeyIds(dir, "k2", ""); err != nil {
+		t.Fatal(err)
+	}
+	check("k2", "")
+	if err := WriteKeyIds(dir, "k2"); err != nil {
+		t.Fatal(err)
+	}
+	check("k2")
+	if err := WriteKeyIds(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	check("")
+
+	// key ids of a single file
+	path := filepath.Join(dir, "meta."+KeyIdFile)
+	if err := WriteKeyIdsFile(path, "k3", "k2"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := ReadKeyIdsFile(path); err != nil || !reflect.DeepEqual(ids, []string{"k3", "k2"}) {
+		t.Errorf("Expected %q, received %q %v", []string{"k3", "k2"}, ids, err)
+	}
+	check("")
+}
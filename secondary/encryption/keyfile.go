@@ -0,0 +1,173 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package encryption
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyFile is the format of the file read by the local key file provider:
+//
+//   {
+//     "active": "k2",
+//     "keys": {"k1": "<base64 key>", "k2": "<base64 key>"}
+//   }
+//
+// A key is rotated by adding a new key and making it active. Old keys
+// must be kept until no file written with them is left.
+type KeyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+type fileKeyProvider struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	active  *Key
+	keys    map[string]*Key
+}
+
+// NewFileKeyProvider returns a provider reading keys from a local key
+// file. The file is read again whenever it is modified, so that keys can
+// be rotated without a restart. Meant for tests and development setups,
+// the key file is as sensitive as the data itself.
+func NewFileKeyProvider(path string) (KeyProvider, error) {
+	p := &fileKeyProvider{path: path}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *fileKeyProvider) reload() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	if p.keys != nil && fi.ModTime().Equal(p.modTime) && fi.Size() == p.size {
+		return nil
+	}
+
+	bs, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+
+	var kf KeyFile
+	if err := json.Unmarshal(bs, &kf); err != nil {
+		return fmt.Errorf("encryption: invalid key file %v: %v", p.path, err)
+	}
+
+	keys := make(map[string]*Key)
+	for id, s := range kf.Keys {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("encryption: invalid key %v in %v: %v", id, p.path, err)
+		}
+		key := &Key{Id: id, Bytes: b}
+		if err := key.validate(); err != nil {
+			return fmt.Errorf("encryption: invalid key %v in %v: %v", id, p.path, err)
+		}
+		keys[id] = key
+	}
+
+	active, ok := keys[kf.Active]
+	if !ok {
+		return fmt.Errorf("encryption: active key %q not found in %v", kf.Active, p.path)
+	}
+
+	p.modTime, p.size = fi.ModTime(), fi.Size()
+	p.active = active
+	p.keys = keys
+	return nil
+}
+
+func (p *fileKeyProvider) ActiveKey() (*Key, error) {
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active, nil
+}
+
+func (p *fileKeyProvider) GetKey(id string) (*Key, error) {
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// KeyIdFile is the name of the file recording the key the data files
+// of a directory are encrypted with, for storage formats which don't
+// record it themselves.
+const KeyIdFile = "encryption_key_id"
+
+// ReadKeyIds returns the ids of the keys the data files in dir may be
+// encrypted with, most likely first. An empty id stands for unencrypted
+// files. More than one id is recorded while the files are re-encrypted.
+func ReadKeyIds(dir string) ([]string, error) {
+	return ReadKeyIdsFile(filepath.Join(dir, KeyIdFile))
+}
+
+// WriteKeyIds records the ids of the keys the data files in dir may be
+// encrypted with, most likely first.
+func WriteKeyIds(dir string, ids ...string) error {
+	return WriteKeyIdsFile(filepath.Join(dir, KeyIdFile), ids...)
+}
+
+// ReadKeyIdsFile is like ReadKeyIds, for key ids recorded in path
+// instead of the KeyIdFile of a directory.
+func ReadKeyIdsFile(path string) ([]string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return []string{""}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(bs), "\n"), nil
+}
+
+// WriteKeyIdsFile is like WriteKeyIds, for key ids recorded in path.
+func WriteKeyIdsFile(path string, ids ...string) error {
+	if len(ids) == 0 || len(ids) == 1 && ids[0] == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(ids, "\n")), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Encrypted streams are made of a header followed by chunks sealed with
+// AES-256-GCM:
+//
+//   header: magic[8] | keyIdLen[1] | keyId | noncePrefix[8]
+//   chunk:  flags|len[4] | ciphertext[len]
+//
+// Nonce of a chunk is noncePrefix followed by the chunk number. The last
+// chunk is flagged, and the flag is authenticated, so that a truncated
+// stream is detected.
+
+var magic = []byte("IDXENC\x00\x01")
+
+const (
+	noncePrefixLen = 8
+	chunkSize      = 64 * 1024
+	lastChunkFlag  = 1 << 31
+)
+
+var ErrTruncated = errors.New("encryption: truncated stream")
+
+func newAEAD(key *Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsEncrypted reports whether the stream read by r starts with the header
+// of an encrypted stream. It does not consume any input.
+func IsEncrypted(r *bufio.Reader) bool {
+	b, err := r.Peek(len(magic))
+	return err == nil && bytes.Equal(b, magic)
+}
+
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	seq    uint32
+	buf    []byte
+	sealed []byte
+	err    error
+}
+
+// NewWriter returns a writer encrypting data with key and writing it to w.
+// Close must be called to write the last chunk, it does not close w.
+func NewWriter(w io.Writer, key *Key) (io.WriteCloser, error) {
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ew := &writer{
+		w:     w,
+		aead:  aead,
+		nonce: make([]byte, aead.NonceSize()),
+		buf:   make([]byte, 0, chunkSize),
+	}
+
+	if _, err := io.ReadFull(rand.Reader, ew.nonce[:noncePrefixLen]); err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, 0, len(magic)+1+len(key.Id)+noncePrefixLen)
+	hdr = append(hdr, magic...)
+	hdr = append(hdr, byte(len(key.Id)))
+	hdr = append(hdr, key.Id...)
+	hdr = append(hdr, ew.nonce[:noncePrefixLen]...)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	return ew, nil
+}
+
+func (ew *writer) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 && ew.err == nil {
+		if len(ew.buf) == chunkSize {
+			ew.err = ew.seal(false)
+			continue
+		}
+
+		m := copy(ew.buf[len(ew.buf):chunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, ew.err
+}
+
+func (ew *writer) seal(last bool) error {
+	binary.BigEndian.PutUint32(ew.nonce[noncePrefixLen:], ew.seq)
+	ew.seq++
+
+	hdr := uint32(len(ew.buf) + ew.aead.Overhead())
+	ad := []byte{0}
+	if last {
+		hdr |= lastChunkFlag
+		ad[0] = 1
+	}
+
+	ew.sealed = append(ew.sealed[:0], 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(ew.sealed, hdr)
+	ew.sealed = ew.aead.Seal(ew.sealed, ew.nonce, ew.buf, ad)
+	ew.buf = ew.buf[:0]
+
+	_, err := ew.w.Write(ew.sealed)
+	return err
+}
+
+func (ew *writer) Close() error {
+	if ew.err == nil {
+		ew.err = ew.seal(true)
+		if ew.err == nil {
+			ew.err = errors.New("encryption: write to closed writer")
+			return nil
+		}
+	}
+	return ew.err
+}
+
+type reader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	seq   uint32
+	buf   []byte
+	plain []byte
+	eof   bool
+}
+
+// NewReader returns a reader decrypting the stream read from r, using the
+// key recorded in the stream header, obtained from p.
+func NewReader(r io.Reader, p KeyProvider) (io.Reader, error) {
+	hdr := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, ErrCorrupted
+	}
+	if !bytes.Equal(hdr[:len(magic)], magic) {
+		return nil, ErrCorrupted
+	}
+
+	keyId := make([]byte, int(hdr[len(magic)]))
+	if _, err := io.ReadFull(r, keyId); err != nil {
+		return nil, ErrCorrupted
+	}
+
+	key, err := GetKey(p, string(keyId))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dr := &reader{
+		r:     r,
+		aead:  aead,
+		nonce: make([]byte, aead.NonceSize()),
+	}
+	if _, err := io.ReadFull(r, dr.nonce[:noncePrefixLen]); err != nil {
+		return nil, ErrCorrupted
+	}
+
+	return dr, nil
+}
+
+func (dr *reader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.eof {
+			return 0, io.EOF
+		}
+		if err := dr.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+func (dr *reader) open() error {
+	var lenbuf [4]byte
+	if _, err := io.ReadFull(dr.r, lenbuf[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+
+	hdr := binary.BigEndian.Uint32(lenbuf[:])
+	last := hdr&lastChunkFlag != 0
+	l := int(hdr &^ lastChunkFlag)
+	if l < dr.aead.Overhead() || l > chunkSize+dr.aead.Overhead() {
+		return ErrCorrupted
+	}
+
+	if cap(dr.buf) < l {
+		dr.buf = make([]byte, l)
+	}
+	dr.buf = dr.buf[:l]
+	if _, err := io.ReadFull(dr.r, dr.buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+
+	binary.BigEndian.PutUint32(dr.nonce[noncePrefixLen:], dr.seq)
+	dr.seq++
+
+	ad := []byte{0}
+	if last {
+		ad[0] = 1
+	}
+
+	plain, err := dr.aead.Open(dr.buf[:0], dr.nonce, dr.buf, ad)
+	if err != nil {
+		return ErrCorrupted
+	}
+
+	dr.plain = plain
+	dr.eof = last
+	return nil
+}
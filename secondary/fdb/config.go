@@ -207,6 +207,25 @@ func (c *Config) SetBlockReuseThreshold(s uint8) {
 	c.config.block_reusing_threshold = C.size_t(s)
 }
 
+// SetEncryptionKey sets the 32 byte AES-256 key the database file is
+// encrypted with. A nil key disables encryption.
+func (c *Config) SetEncryptionKey(key []byte) {
+	c.config.encryption_key = newEncryptionKey(key)
+}
+
+func newEncryptionKey(key []byte) C.fdb_encryption_key {
+	var ekey C.fdb_encryption_key
+	if key == nil {
+		ekey.algorithm = C.FDB_ENCRYPTION_NONE
+	} else {
+		ekey.algorithm = C.FDB_ENCRYPTION_AES256
+		for i := range ekey.bytes {
+			ekey.bytes[i] = C.uint8_t(key[i])
+		}
+	}
+	return ekey
+}
+
 // DefaultConfig gets the default ForestDB config
 func DefaultConfig() *Config {
 	Log.Tracef("fdb_get_default_config call")
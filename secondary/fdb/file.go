@@ -118,6 +118,21 @@ func (f *File) CompactUpto(newfilename string, sm *SnapMarker) error {
 	return nil
 }
 
+// Rekey compacts the current database file into a new file encrypted
+// with the given key. A nil key writes an unencrypted file.
+func (f *File) Rekey(key []byte) error {
+	f.Lock()
+	defer f.Unlock()
+
+	Log.Tracef("fdb_rekey call f:%p dbfile:%v", f, f.dbfile)
+	errNo := C.fdb_rekey(f.dbfile, newEncryptionKey(key))
+	Log.Tracef("fdb_rekey retn f:%p errNo:%v", f, errNo)
+	if errNo != RESULT_SUCCESS {
+		return Error(errNo)
+	}
+	return nil
+}
+
 //CancelCompact cancels in-progress compaction
 func (f *File) CancelCompact() error {
 	f.Lock()
@@ -5,9 +5,12 @@ import "strings"
 import re "regexp"
 import "path/filepath"
 import "fmt"
+import "sync"
 
 import log "github.com/couchbase/indexing/secondary/logging"
 import c "github.com/couchbase/indexing/secondary/common"
+import json "github.com/couchbase/indexing/secondary/common/json"
+import qclient "github.com/couchbase/indexing/secondary/queryport/client"
 import "github.com/couchbase/cbauth"
 
 type target struct {
@@ -21,6 +24,10 @@ type target struct {
 
 type restServer struct {
 	statsMgr *statsManager
+	cluster  string
+
+	clientMu sync.Mutex
+	client   *qclient.GsiClient // created on first replica check
 }
 
 type request struct {
@@ -42,11 +49,12 @@ func initHandlers(api *restServer) {
 	versionRx = re.MustCompile("v\\d+")
 	staticRoutes = make(map[string]reqHandler)
 	staticRoutes["stats"] = api.statsHandler
+	staticRoutes["checkReplicas"] = api.checkReplicasHandler
 }
 
 func NewRestServer(cluster string, stMgr *statsManager) (*restServer, Message) {
 	log.Infof("%v starting RESTful services", cluster)
-	restapi := &restServer{statsMgr: stMgr}
+	restapi := &restServer{statsMgr: stMgr, cluster: cluster}
 	initHandlers(restapi)
 	http.HandleFunc("/api/", restapi.routeRequest)
 	return restapi, nil
@@ -162,6 +170,83 @@ func (api *restServer) statsHandler(req request) {
 	}
 }
 
+func (api *restServer) checkReplicasHandler(req request) {
+	// Example: _/api/checkReplicas/bucket/index (_ is a blank)
+	if req.r.Method != "POST" {
+		http.Error(req.w, "Unsupported method", 405)
+		return
+	}
+
+	segs := strings.Split(req.url, "/")
+	if len(segs) != 5 {
+		http.Error(req.w, req.r.URL.Path, 404)
+		return
+	}
+	bucket, name := segs[3], segs[4]
+
+	permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!alter", bucket)
+	if !c.IsAllowed(req.creds, []string{permission}, req.w) {
+		return
+	}
+
+	client, err := api.getClient()
+	if err != nil {
+		http.Error(req.w, err.Error(), 500)
+		return
+	}
+
+	indexes, _, _, err := client.Refresh()
+	if err != nil {
+		http.Error(req.w, err.Error(), 500)
+		return
+	}
+
+	var defnID uint64
+	for _, index := range indexes {
+		if index.Definition.Bucket == bucket && index.Definition.Name == name {
+			defnID = uint64(index.Definition.DefnId)
+			break
+		}
+	}
+	if defnID == 0 {
+		http.Error(req.w, req.r.URL.Path, 404)
+		return
+	}
+
+	report, err := client.CheckReplicas(defnID)
+	if err != nil {
+		log.Errorf("restServer::checkReplicasHandler %v/%v: %v", bucket, name, err)
+		api.writeError(req.w, err)
+		return
+	}
+
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		http.Error(req.w, err.Error(), 500)
+		return
+	}
+	req.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	req.w.WriteHeader(200)
+	req.w.Write(bytes)
+}
+
+func (api *restServer) getClient() (*qclient.GsiClient, error) {
+	api.clientMu.Lock()
+	defer api.clientMu.Unlock()
+
+	if api.client == nil {
+		config, err := c.GetSettingsConfig(c.SystemConfig)
+		if err != nil {
+			return nil, err
+		}
+		qconf := config.SectionConfig("queryport.client.", true /*trim*/)
+		if api.client, err = qclient.NewGsiClient(api.cluster, qconf); err != nil {
+			return nil, err
+		}
+	}
+	return api.client, nil
+}
+
 func (api *restServer) authorizeStats(req request, t *target) bool {
 
 	permissions := ([]string)(nil)
@@ -31,6 +31,7 @@ type compactionManager struct {
 
 type compactionDaemon struct {
 	quitch       chan bool
+	urgentch     chan bool
 	started      bool
 	timer        *time.Timer
 	msgch        MsgChannel
@@ -57,6 +58,17 @@ func (cd *compactionDaemon) Stop() {
 	}
 }
 
+// CompactUrgent requests a compaction of all the fragmented indexes
+// without waiting for the compaction interval, when running low on
+// disk space. Only forestdb indexes are compacted by the daemon, other
+// storage compacts itself in the background.
+func (cd *compactionDaemon) CompactUrgent() {
+	select {
+	case cd.urgentch <- true:
+	default:
+	}
+}
+
 func (cd *compactionDaemon) ResetConfig(c common.Config) {
 	last_config := cd.config.Load()
 	cd.config.Store(c)
@@ -226,10 +238,7 @@ loop:
 			if common.GetStorageMode() == common.FORESTDB {
 
 				if ok {
-					replych := make(chan []IndexStorageStats)
-					statReq := &MsgIndexStorageStats{respch: replych}
-					cd.msgch <- statReq
-					stats = <-replych
+					stats = cd.getStorageStats()
 
 					// each compaction interval cannot go over 24 hours if specified.
 					abortTime := time.Now().Add(time.Duration(24) * time.Hour)
@@ -255,30 +264,7 @@ loop:
 						needUpgrade := is.Stats.NeedUpgrade
 						if needUpgrade || cd.needsCompaction(is, conf, checkTime, abortTime) {
 							hasStartedToday = true
-
-							errch := make(chan error)
-							compactReq := &MsgIndexCompact{
-								instId:    is.InstId,
-								errch:     errch,
-								abortTime: abortTime,
-							}
-							logging.Infof("CompactionDaemon: Compacting index instance:%v", is.InstId)
-							if needUpgrade {
-								common.Console(cd.clusterAddr, "Compacting index %v.%v for upgrade", is.Bucket, is.Name)
-							}
-							cd.msgch <- compactReq
-							err := <-errch
-							if err == nil {
-								logging.Infof("CompactionDaemon: Finished compacting index instance:%v", is.InstId)
-								if needUpgrade {
-									common.Console(cd.clusterAddr, "Finished compacting index %v.%v for upgrade", is.Bucket, is.Name)
-								}
-							} else {
-								logging.Errorf("CompactionDaemon: Index instance:%v Compaction failed with reason - %v", is.InstId, err)
-								if needUpgrade {
-									common.Console(cd.clusterAddr, "Compaction for index %v.%v failed with reason - %v", is.Bucket, is.Name, err)
-								}
-							}
+							cd.compact(is, abortTime, needUpgrade)
 						}
 					}
 				}
@@ -287,6 +273,22 @@ loop:
 			dur := time.Second * time.Duration(conf["check_period"].Int())
 			cd.timer.Reset(dur)
 
+		case <-cd.urgentch:
+
+			// running low on disk space, compact irrespective of
+			// compaction interval and days of week.
+			if common.GetStorageMode() == common.FORESTDB {
+				abortTime := time.Now().Add(time.Duration(24) * time.Hour)
+				for _, is := range cd.getStorageStats() {
+					conf := cd.config.Load()
+					if is.GetFragmentation() >= float64(conf["min_frag"].Int()) {
+						logging.Infof("CompactionDaemon: Urgent compaction for index instance:%v "+
+							"on low disk space", is.InstId)
+						cd.compact(is, abortTime, false)
+					}
+				}
+			}
+
 		case <-cd.quitch:
 			cd.quitch <- true
 			break loop
@@ -294,6 +296,39 @@ loop:
 	}
 }
 
+func (cd *compactionDaemon) getStorageStats() []IndexStorageStats {
+	replych := make(chan []IndexStorageStats)
+	statReq := &MsgIndexStorageStats{respch: replych}
+	cd.msgch <- statReq
+	return <-replych
+}
+
+func (cd *compactionDaemon) compact(is IndexStorageStats, abortTime time.Time, needUpgrade bool) {
+	errch := make(chan error)
+	compactReq := &MsgIndexCompact{
+		instId:    is.InstId,
+		errch:     errch,
+		abortTime: abortTime,
+	}
+	logging.Infof("CompactionDaemon: Compacting index instance:%v", is.InstId)
+	if needUpgrade {
+		common.Console(cd.clusterAddr, "Compacting index %v.%v for upgrade", is.Bucket, is.Name)
+	}
+	cd.msgch <- compactReq
+	err := <-errch
+	if err == nil {
+		logging.Infof("CompactionDaemon: Finished compacting index instance:%v", is.InstId)
+		if needUpgrade {
+			common.Console(cd.clusterAddr, "Finished compacting index %v.%v for upgrade", is.Bucket, is.Name)
+		}
+	} else {
+		logging.Errorf("CompactionDaemon: Index instance:%v Compaction failed with reason - %v", is.InstId, err)
+		if needUpgrade {
+			common.Console(cd.clusterAddr, "Compaction for index %v.%v failed with reason - %v", is.Bucket, is.Name, err)
+		}
+	}
+}
+
 func NewCompactionManager(supvCmdCh MsgChannel, supvMsgCh MsgChannel,
 	config common.Config) (CompactionManager, Message) {
 	cm := &compactionManager{
@@ -325,6 +360,17 @@ loop:
 					cfg := fullConfig.SectionConfig("settings.compaction.", true)
 					cd.ResetConfig(cfg)
 					cm.supvCmdCh <- &MsgSuccess{}
+				} else if cmd.GetMsgType() == STORAGE_DISK_STATE {
+					if cmd.(*MsgDiskState).GetState() != DISK_OK {
+						if common.GetStorageMode() == common.FORESTDB {
+							logging.Infof("%v: Running low on disk space, compacting indexes", cm.logPrefix)
+							cd.CompactUrgent()
+						} else {
+							logging.Infof("%v: Running low on disk space, no urgent compaction "+
+								"for storage mode %v", cm.logPrefix, common.GetStorageMode())
+						}
+					}
+					cm.supvCmdCh <- &MsgSuccess{}
 				}
 			} else {
 				break loop
@@ -340,6 +386,7 @@ func (cm *compactionManager) newCompactionDaemon() *compactionDaemon {
 	clusterAddr := cm.config["clusterAddr"].String()
 	cd := &compactionDaemon{
 		quitch:       make(chan bool),
+		urgentch:     make(chan bool, 1),
 		started:      false,
 		msgch:        cm.supvMsgCh,
 		clusterAddr:  clusterAddr,
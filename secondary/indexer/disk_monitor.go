@@ -0,0 +1,167 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/platform"
+)
+
+var ErrDiskFull = errors.New("Indexer storage is out of disk space")
+
+//
+// DiskState is the state of the filesystem holding storage_dir, as seen
+// against the low_disk_mark and high_disk_mark settings.
+//
+type DiskState int32
+
+const (
+	//below low_disk_mark
+	DISK_OK DiskState = iota
+	//above low_disk_mark, indexes are compacted and disk snapshots skipped
+	DISK_LOW
+	//above high_disk_mark, mutations are not flushed until usage goes
+	//below low_disk_mark
+	DISK_FULL
+)
+
+func (d DiskState) String() string {
+
+	switch d {
+	case DISK_OK:
+		return "Normal"
+	case DISK_LOW:
+		return "LowSpace"
+	case DISK_FULL:
+		return "Full"
+	default:
+		return "Invalid"
+	}
+}
+
+func (s *storageMgr) getDiskState() DiskState {
+	return DiskState(atomic.LoadInt32(&s.diskState))
+}
+
+func (s *storageMgr) setDiskState(state DiskState) {
+	atomic.StoreInt32(&s.diskState, int32(state))
+}
+
+//nextDiskState returns the new state for the used fraction of the disk.
+//Once full, the disk is considered full until usage goes below low mark.
+func nextDiskState(curr DiskState, usedFrac, lowMark, highMark float64) DiskState {
+
+	switch {
+	case usedFrac >= highMark:
+		return DISK_FULL
+	case usedFrac >= lowMark:
+		if curr == DISK_FULL {
+			return DISK_FULL
+		}
+		return DISK_LOW
+	default:
+		return DISK_OK
+	}
+}
+
+//monitorDiskUsage periodically checks the usage of the filesystem holding
+//storage_dir and notifies the supervisor whenever the disk state changes.
+//It runs until diskMonitorStopCh is closed on shutdown of the storage
+//manager.
+func (s *storageMgr) monitorDiskUsage() {
+
+	monitorInterval := s.config["disk_usage_check_interval"].Int()
+	if monitorInterval <= 0 {
+		logging.Infof("StorageMgr::monitorDiskUsage Disabled")
+		return
+	}
+
+	storageDir := s.config["storage_dir"].String()
+	lowMark := s.config["low_disk_mark"].Float64()
+	highMark := s.config["high_disk_mark"].Float64()
+	clusterAddr := s.config["clusterAddr"].String()
+
+	logging.Infof("StorageMgr::monitorDiskUsage started for %v LowMark %v HighMark %v",
+		storageDir, lowMark, highMark)
+
+	for {
+
+		total, avail, err := platform.DiskUsage(storageDir)
+		if err != nil {
+			logging.Errorf("StorageMgr::monitorDiskUsage Error reading disk usage "+
+				"of %v. Error %v", storageDir, err)
+		} else if total > 0 {
+
+			usedFrac := float64(total-avail) / float64(total)
+			if stats := s.stats.Get(); stats != nil {
+				stats.diskUsedPercent.Set(int64(usedFrac * 100))
+			}
+
+			curr := s.getDiskState()
+			state := nextDiskState(curr, usedFrac, lowMark, highMark)
+
+			if state != curr {
+				logging.Warnf("StorageMgr::monitorDiskUsage Disk state of %v changed "+
+					"from %v to %v. Used %.2f%% Available %v bytes", storageDir,
+					curr, state, usedFrac*100, avail)
+
+				if state == DISK_FULL {
+					common.Console(clusterAddr, "Indexer storage %v is %.0f%% full. Index "+
+						"maintenance is paused until disk space is freed.", storageDir, usedFrac*100)
+				} else if curr == DISK_FULL {
+					common.Console(clusterAddr, "Indexer storage %v is %.0f%% full. Index "+
+						"maintenance is resumed.", storageDir, usedFrac*100)
+				}
+
+				s.setDiskState(state)
+				if state != DISK_OK {
+					s.releaseRetainedSnapshots(state)
+				}
+
+				select {
+				case s.supvRespch <- &MsgDiskState{state: state, usedFrac: usedFrac}:
+				case <-s.diskMonitorStopCh:
+					return
+				}
+			}
+		}
+
+		select {
+		case <-time.After(time.Second * time.Duration(monitorInterval)):
+		case <-s.diskMonitorStopCh:
+			logging.Infof("StorageMgr::monitorDiskUsage stopped for %v", storageDir)
+			return
+		}
+	}
+}
+
+//releaseRetainedSnapshots destroys the retained snapshots of all indexes
+//to free up the disk space held by them. As-of scans of these snapshots
+//fail from now on.
+func (s *storageMgr) releaseRetainedSnapshots(state DiskState) {
+
+	s.muSnap.Lock()
+	defer s.muSnap.Unlock()
+
+	if len(s.retainedSnapMap) != 0 {
+		logging.Warnf("StorageMgr::releaseRetainedSnapshots Disk state %v. Releasing the "+
+			"retained snapshots of %v indexes, snapshots are not retained until the "+
+			"disk state is back to %v", state, len(s.retainedSnapMap), DISK_OK)
+	}
+
+	for instId := range s.retainedSnapMap {
+		s.destroyRetainedSnapshots(instId)
+	}
+}
@@ -0,0 +1,57 @@
+package indexer
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func TestNextDiskState(t *testing.T) {
+	testcases := []struct {
+		curr     DiskState
+		usedFrac float64
+		next     DiskState
+	}{
+		{DISK_OK, 0.5, DISK_OK},
+		{DISK_OK, 0.85, DISK_LOW},
+		{DISK_OK, 0.97, DISK_FULL},
+		{DISK_LOW, 0.9, DISK_LOW},
+		{DISK_LOW, 0.95, DISK_FULL},
+		{DISK_LOW, 0.8, DISK_OK},
+		{DISK_FULL, 0.9, DISK_FULL},
+		{DISK_FULL, 0.84, DISK_OK},
+	}
+
+	for _, tc := range testcases {
+		if next := nextDiskState(tc.curr, tc.usedFrac, 0.85, 0.95); next != tc.next {
+			t.Errorf("State %v used %v: expected %v, received %v",
+				tc.curr, tc.usedFrac, tc.next, next)
+		}
+	}
+}
+
+func TestMonitorDiskUsageStop(t *testing.T) {
+	config := common.SystemConfig.SectionConfig("indexer.", true)
+	config.SetValue("storage_dir", os.TempDir())
+	config.SetValue("disk_usage_check_interval", 1)
+
+	s := &storageMgr{
+		config:            config,
+		supvRespch:        make(MsgChannel),
+		diskMonitorStopCh: make(chan bool),
+	}
+	donech := make(chan bool)
+	go func() {
+		s.monitorDiskUsage()
+		close(donech)
+	}()
+
+	close(s.diskMonitorStopCh)
+	select {
+	case <-donech:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected disk monitor to stop")
+	}
+}
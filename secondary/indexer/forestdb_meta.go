@@ -0,0 +1,174 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"os"
+
+	"github.com/couchbase/indexing/secondary/encryption"
+	forestdb "github.com/couchbase/indexing/secondary/fdb"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//forestdb file of the indexer metadata, used when the manager is
+//not enabled
+const META_FILE = "meta"
+
+//openMetaFile opens the forestdb file holding the indexer metadata,
+//encrypted with the active key. The ids of the keys the file may be
+//encrypted with are recorded next to it. A file encrypted with another
+//key is re-encrypted with the active key when opened.
+func openMetaFile(filename string) (*forestdb.File, error) {
+
+	keyIdFile := filename + "." + encryption.KeyIdFile
+	keyIds, err := metaEncryptionKeyIds(filename, keyIdFile)
+	if err != nil {
+		return nil, err
+	}
+
+	//while a re-encryption is in progress, the file may be encrypted
+	//with any of the recorded keys
+	var dbfile *forestdb.File
+	var keyId string
+	for _, keyId = range keyIds {
+		if dbfile, err = openMetaFileWithKey(filename, keyId); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		logging.Errorf("Indexer::openMetaFile Error opening %v with keys %v. Error %v",
+			filename, keyIds, err)
+		return nil, err
+	}
+
+	if len(keyIds) > 1 {
+		if err = encryption.WriteKeyIdsFile(keyIdFile, keyId); err != nil {
+			dbfile.Close()
+			return nil, err
+		}
+	}
+
+	key, err := encryption.ActiveKey(encryption.GetKeyProvider())
+	if err != nil {
+		dbfile.Close()
+		return nil, err
+	}
+
+	var activeKeyId string
+	if key != nil {
+		activeKeyId = key.Id
+	}
+	if activeKeyId == keyId {
+		return dbfile, nil
+	}
+
+	logging.Infof("Indexer::openMetaFile Re-encrypting %v with key %q (was %q)",
+		filename, activeKeyId, keyId)
+
+	if err = rekeyMetaFile(dbfile, filename, keyIdFile, activeKeyId, keyId); err != nil {
+		return nil, err
+	}
+	return openMetaFileWithKey(filename, activeKeyId)
+}
+
+func openMetaFileWithKey(filename, keyId string) (*forestdb.File, error) {
+
+	key, err := fdbEncryptionKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	config := forestdb.DefaultConfig()
+	config.SetEncryptionKey(key)
+	return forestdb.Open(filename, config)
+}
+
+//metaEncryptionKeyIds returns the ids of the keys the metadata file may
+//be encrypted with. A new file is encrypted with the active key.
+func metaEncryptionKeyIds(filename, keyIdFile string) ([]string, error) {
+
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		key, err := encryption.ActiveKey(encryption.GetKeyProvider())
+		if err != nil {
+			return nil, err
+		}
+
+		var keyId string
+		if key != nil {
+			keyId = key.Id
+		}
+		if err := encryption.WriteKeyIdsFile(keyIdFile, keyId); err != nil {
+			return nil, err
+		}
+		return []string{keyId}, nil
+	}
+
+	return encryption.ReadKeyIdsFile(keyIdFile)
+}
+
+//rekeyMetaFile rewrites the metadata file encrypted with the key newKeyId,
+//and closes dbfile. The metadata is copied to a new file which then
+//replaces the old one, both keys are recorded until it is replaced.
+func rekeyMetaFile(dbfile *forestdb.File, filename, keyIdFile,
+	newKeyId, oldKeyId string) error {
+
+	tmpfile := filename + ".rekey"
+	if err := os.Remove(tmpfile); err != nil && !os.IsNotExist(err) {
+		dbfile.Close()
+		return err
+	}
+
+	newfile, err := openMetaFileWithKey(tmpfile, newKeyId)
+	if err != nil {
+		dbfile.Close()
+		return err
+	}
+
+	err = copyMetaFile(dbfile, newfile)
+	if err == nil {
+		err = newfile.Commit(forestdb.COMMIT_MANUAL_WAL_FLUSH)
+	}
+	newfile.Close()
+	dbfile.Close()
+	if err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+
+	if err := encryption.WriteKeyIdsFile(keyIdFile, newKeyId, oldKeyId); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpfile, filename); err != nil {
+		return err
+	}
+	return encryption.WriteKeyIdsFile(keyIdFile, newKeyId)
+}
+
+//copyMetaFile copies the documents of the default kvstore, the only one
+//used for the indexer metadata.
+func copyMetaFile(from, to *forestdb.File) error {
+
+	kvconfig := forestdb.DefaultKVStoreConfig()
+	src, err := from.OpenKVStore("default", kvconfig)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := to.OpenKVStore("default", kvconfig)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return fdbForEach(src, func(key, value []byte) error {
+		return dst.SetKV(key, value)
+	})
+}
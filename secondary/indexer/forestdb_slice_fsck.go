@@ -0,0 +1,372 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/encryption"
+	"github.com/couchbase/indexing/secondary/fdb"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//Fsck checks the main index against the back index of the slice, at
+//snapshot s. The back index has no in-memory snapshot, so the latest
+//persisted snapshot is checked if s is not persisted. With repair, the
+//writer of the slice rewrites the back index entries not matching the
+//main index, unless they have been mutated after the snapshot. The
+//repair is persisted by the next snapshot of the slice.
+func (fdb *fdbSlice) Fsck(s Snapshot, repair bool) (*FsckReport, error) {
+
+	c, err := newFsckChecker(&fdb.idxDefn)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := s.(*fdbSnapshot)
+	if !snap.committed {
+		infos, err := fdb.GetSnapshots()
+		if err != nil {
+			return nil, err
+		}
+		info := NewSnapshotInfoContainer(infos).GetLatest()
+		if info == nil {
+			return nil, ErrSnapNotAvailable
+		}
+
+		ps, err := fdb.OpenSnapshot(info)
+		if err != nil {
+			return nil, err
+		}
+		defer ps.Close()
+		snap = ps.(*fdbSnapshot)
+	}
+
+	var back *forestdb.KVStore
+	if !fdb.isPrimary {
+		if back, err = fdb.back[0].SnapshotOpen(snap.backSeqNum); err != nil {
+			return nil, err
+		}
+		defer back.Close()
+	}
+
+	report := &FsckReport{SliceId: fdb.id}
+	affected, err := fsckForestDB(report, c, snap.main, back)
+	if err != nil {
+		return nil, err
+	}
+
+	if repair && len(affected) > 0 {
+		repairs, err := fdbBackIndexRepairs(c, snap.main, back, affected)
+		if err != nil {
+			return nil, err
+		}
+
+		errch := make(chan error, 1)
+		fdb.cmdCh <- sliceWriterCall(func(workerId int) {
+			var err error
+			report.Repaired, err = fdbApplyRepairs(fdb.back[workerId], repairs)
+			if report.Repaired > 0 {
+				fdb.isDirty = true
+			}
+			errch <- err
+		})
+		if err := <-errch; err != nil {
+			return nil, err
+		}
+
+		logging.Infof("ForestDBSlice::Fsck SliceId %v IndexInstId %v Repaired %v "+
+			"back index entries", fdb.id, fdb.idxInstId, report.Repaired)
+	}
+
+	return report, nil
+}
+
+//fsckForestDB checks the main index against the back index, which is
+//nil for primary indexes. It returns the docids whose back index entry
+//doesn't match the main index.
+func fsckForestDB(r *FsckReport, c *fsckChecker,
+	main, back *forestdb.KVStore) (map[string]bool, error) {
+
+	affected := make(map[string]bool)
+
+	//every main index entry must be referred to by the back index
+	err := fdbForEach(main, func(key, value []byte) error {
+		docid := c.checkMainEntry(r, key)
+		if docid == nil || c.isPrimary {
+			return nil
+		}
+
+		has, err := fdbBackIndexHas(c, back, docid, key)
+		if err != nil {
+			return err
+		}
+		if !has {
+			r.addError(&r.MissingBack, "Main index entry of docid %q is not in the back index", docid)
+			affected[string(docid)] = true
+		}
+		return nil
+	})
+	if err != nil || c.isPrimary {
+		return affected, err
+	}
+
+	//every main index entry the back index refers to must exist
+	err = fdbForEach(back, func(docid, value []byte) error {
+		r.BackEntries++
+
+		entries, err := c.backEntries(docid, value)
+		if err != nil {
+			r.addError(&r.FormatErrors, "%v", err)
+			affected[string(docid)] = true
+			return nil
+		}
+
+		for _, entry := range entries {
+			if _, err := main.GetKV(entry); err == forestdb.FDB_RESULT_KEY_NOT_FOUND {
+				r.addError(&r.MissingMain, "Back index entry of docid %q refers to "+
+					"entry %q missing from the main index", docid, entry)
+				affected[string(docid)] = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return affected, err
+}
+
+//fdbBackIndexHas checks whether the back index entry of docid refers to
+//the main index entry.
+func fdbBackIndexHas(c *fsckChecker, back *forestdb.KVStore,
+	docid, entry []byte) (bool, error) {
+
+	value, err := back.GetKV(docid)
+	if err == forestdb.FDB_RESULT_KEY_NOT_FOUND {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if !c.isArray {
+		return bytes.Equal(value, entry), nil
+	}
+
+	entries, err := c.arrayEntries(value, docid)
+	if err != nil {
+		return false, nil
+	}
+	for _, e := range entries {
+		if bytes.Equal(e, entry) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//fdbBackIndexRepair is the rewrite of the back index entry of a docid,
+//from value old to value new. A nil value is a missing entry.
+type fdbBackIndexRepair struct {
+	docid []byte
+	old   []byte
+	new   []byte
+}
+
+//fdbBackIndexRepairs returns the rewrites of the back index entries of
+//the affected docids from their main index entries.
+func fdbBackIndexRepairs(c *fsckChecker, main, back *forestdb.KVStore,
+	affected map[string]bool) ([]fdbBackIndexRepair, error) {
+
+	entries := make(map[string][][]byte)
+	err := fdbForEach(main, func(key, value []byte) error {
+		docid, ok := fsckEntryDocId(key)
+		if ok && affected[string(docid)] {
+			entries[string(docid)] = append(entries[string(docid)], key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	repairs := make([]fdbBackIndexRepair, 0, len(affected))
+	for docid := range affected {
+		repair := fdbBackIndexRepair{docid: []byte(docid)}
+
+		repair.old, err = back.GetKV(repair.docid)
+		if err == forestdb.FDB_RESULT_KEY_NOT_FOUND {
+			repair.old = nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if es := entries[docid]; len(es) > 0 {
+			if c.isArray {
+				repair.new, err = c.arrayKey(es, repair.docid)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				//an entry per docid, keep the last one if there are more
+				repair.new = es[len(es)-1]
+			}
+		}
+		repairs = append(repairs, repair)
+	}
+	return repairs, nil
+}
+
+//fdbApplyRepairs rewrites the back index entries of the repairs whose
+//current value is still the old one.
+func fdbApplyRepairs(back *forestdb.KVStore, repairs []fdbBackIndexRepair) (uint64, error) {
+
+	var count uint64
+	for _, repair := range repairs {
+		value, err := back.GetKV(repair.docid)
+		if err == forestdb.FDB_RESULT_KEY_NOT_FOUND {
+			value, err = nil, nil
+		} else if err != nil {
+			return count, err
+		}
+
+		//mutated after the check
+		if (value == nil) != (repair.old == nil) || !bytes.Equal(value, repair.old) {
+			continue
+		}
+
+		if repair.new == nil {
+			if value != nil {
+				err = back.DeleteKV(repair.docid)
+			}
+		} else {
+			err = back.SetKV(repair.docid, repair.new)
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+//fdbForEach calls callb with every key and value of the kvstore, in key
+//order, until callb returns an error.
+func fdbForEach(kv *forestdb.KVStore, callb func(key, value []byte) error) error {
+
+	itr, err := kv.IteratorInit([]byte{}, nil, forestdb.ITR_NONE|forestdb.ITR_NO_DELETES)
+	if err == forestdb.FDB_RESULT_ITERATOR_FAIL {
+		//empty kvstore
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	for {
+		doc, err := itr.Get()
+		if err != nil {
+			return err
+		}
+
+		err = callb(doc.Key(), doc.Body())
+		doc.Close()
+		if err != nil {
+			return err
+		}
+
+		if err := itr.Next(); err == forestdb.FDB_RESULT_ITERATOR_FAIL {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+//FsckForestDBFile checks the forestdb file of a slice of the index defn,
+//stored in dir. The slice must not be in use. With repair, back index
+//entries not matching the main index are rewritten and committed.
+func FsckForestDBFile(dir string, defn common.IndexDefn, repair bool) (*FsckReport, error) {
+
+	c, err := newFsckChecker(&defn)
+	if err != nil {
+		return nil, err
+	}
+
+	filepath := newFdbFile(dir, false)
+	if _, err := os.Stat(filepath); err != nil {
+		return nil, err
+	}
+
+	keyIds, err := encryption.ReadKeyIds(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	config := forestdb.DefaultConfig()
+	if !repair {
+		config.SetOpenFlags(forestdb.OPEN_FLAG_RDONLY)
+	}
+
+	var dbfile *forestdb.File
+	for _, keyId := range keyIds {
+		key, err1 := fdbEncryptionKey(keyId)
+		if err1 != nil {
+			return nil, err1
+		}
+		config.SetEncryptionKey(key)
+		if dbfile, err = forestdb.Open(filepath, config); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer dbfile.Close()
+
+	kvconfig := forestdb.DefaultKVStoreConfig()
+	main, err := dbfile.OpenKVStore("main", kvconfig)
+	if err != nil {
+		return nil, err
+	}
+	defer main.Close()
+
+	var back *forestdb.KVStore
+	if !defn.IsPrimary {
+		if back, err = dbfile.OpenKVStore("back", kvconfig); err != nil {
+			return nil, err
+		}
+		defer back.Close()
+	}
+
+	report := &FsckReport{}
+	affected, err := fsckForestDB(report, c, main, back)
+	if err != nil {
+		return nil, err
+	}
+
+	if repair && len(affected) > 0 {
+		repairs, err := fdbBackIndexRepairs(c, main, back, affected)
+		if err != nil {
+			return nil, err
+		}
+		if report.Repaired, err = fdbApplyRepairs(back, repairs); err != nil {
+			return nil, err
+		}
+	}
+
+	if report.Repaired > 0 {
+		if err := dbfile.Commit(forestdb.COMMIT_MANUAL_WAL_FLUSH); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
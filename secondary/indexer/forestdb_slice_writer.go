@@ -24,6 +24,7 @@ import (
 
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/common/queryutil"
+	"github.com/couchbase/indexing/secondary/encryption"
 	"github.com/couchbase/indexing/secondary/fdb"
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/natsort"
@@ -85,9 +86,35 @@ func NewForestDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 
 	kvconfig := forestdb.DefaultKVStoreConfig()
 
+	var keyIds []string
+
 retry:
-	if slice.dbfile, err = forestdb.Open(filepath, config); err != nil {
+	if keyIds, err = fdbEncryptionKeyIds(path, filepath); err != nil {
+		return nil, err
+	}
+
+	//while a re-encryption is in progress, the file may be encrypted
+	//with any of the recorded keys
+	for _, keyId := range keyIds {
+		if slice.encKey, err = fdbEncryptionKey(keyId); err != nil {
+			return nil, err
+		}
+		config.SetEncryptionKey(slice.encKey)
+		if slice.dbfile, err = forestdb.Open(filepath, config); err == nil {
+			slice.encKeyId = keyId
+			break
+		}
+	}
+
+	if err != nil {
 		if err == forestdb.FDB_RESULT_NO_DB_HEADERS {
+			//a wrong key can't be told apart from missing headers, never
+			//reset the file while encryption is enabled
+			if encryption.GetKeyProvider() != nil || len(keyIds) != 1 || keyIds[0] != "" {
+				logging.Errorf("NewForestDBSlice(): Open failed with no_db_header error for %v "+
+					"with keys %v. The file may be encrypted with an unknown key.", filepath, keyIds)
+				return nil, err
+			}
 			logging.Warnf("NewForestDBSlice(): Open failed with no_db_header error...Resetting the forestdb file")
 			os.Remove(filepath)
 			goto retry
@@ -95,6 +122,12 @@ retry:
 		return nil, err
 	}
 
+	if len(keyIds) > 1 {
+		if err = encryption.WriteKeyIds(path, slice.encKeyId); err != nil {
+			return nil, err
+		}
+	}
+
 	slice.config = config
 	slice.sysconf = sysconf
 
@@ -141,10 +174,12 @@ retry:
 	slice.idxDefn = idxDefn
 	slice.id = sliceId
 
-	// Array related initialization
-	_, slice.isArrayDistinct, slice.arrayExprPosition, err = queryutil.GetArrayExpressionPosition(idxDefn.SecExprs)
-	if err != nil {
-		return nil, err
+	// Array related initialization, JavaScript expressions are not array keys
+	if !idxDefn.IsJavaScript() {
+		_, slice.isArrayDistinct, slice.arrayExprPosition, err = queryutil.GetArrayExpressionPosition(idxDefn.SecExprs)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	sliceBufSize := sysconf["settings.sliceBufSize"].Uint64()
@@ -211,6 +246,10 @@ type fdbSlice struct {
 
 	config *forestdb.Config
 
+	//key the forestdb file is encrypted with, nil if unencrypted
+	encKeyId string
+	encKey   []byte
+
 	idxDefn   common.IndexDefn
 	idxDefnId common.IndexDefnId
 	idxInstId common.IndexInstId
@@ -328,6 +367,11 @@ loop:
 				elapsed = time.Since(start)
 				fdb.totalFlushTime += elapsed
 
+			case sliceWriterCall:
+				//not a mutation, not counted in the stats
+				c.(sliceWriterCall)(workerId)
+				continue loop
+
 			default:
 				logging.Errorf("ForestDBSlice::handleCommandsWorker \n\tSliceId %v IndexInstId %v Received "+
 					"Unknown Command %v", fdb.id, fdb.idxInstId, logging.TagUD(c))
@@ -920,6 +964,7 @@ func (fdb *fdbSlice) OpenSnapshot(info SnapshotInfo) (Snapshot, error) {
 			main:       fdb.main[0],
 			ts:         snapInfo.Timestamp(),
 			mainSeqNum: snapInfo.MainSeq,
+			backSeqNum: snapInfo.BackSeq,
 			committed:  info.IsCommitted(),
 		}
 	}
@@ -1297,6 +1342,11 @@ func (fdb *fdbSlice) Compact(abortTime time.Time) error {
 		return nil
 	}
 
+	//re-encrypt the file if the active key has been rotated
+	if rekeyed, err := fdb.rekey(abortTime); err != nil || rekeyed {
+		return err
+	}
+
 	//get oldest snapshot upto which compaction can be done
 	infos, err := fdb.getSnapshotsMeta()
 	if err != nil {
@@ -1367,17 +1417,9 @@ snaploop:
 
 	fdb.currfile = newpath
 
-	config := forestdb.DefaultConfig()
-	config.SetOpenFlags(forestdb.OPEN_FLAG_RDONLY)
-
-	fdb.statFdLock.Lock()
-	fdb.statFd.Close()
-	if fdb.statFd, err = forestdb.Open(fdb.currfile, config); err != nil {
+	if err = fdb.reopenStatFd(); err != nil {
 		return err
 	}
-	fdb.fileVersion = fdb.statFd.GetFileVersion()
-	logging.Infof("ForestDBSlice::Compact(): after compaction, file version %v", forestdb.FdbFileVersionToString(fdb.fileVersion))
-	fdb.statFdLock.Unlock()
 
 	/*
 		FIXME: Use correct accounting of extra snapshots size
@@ -1394,6 +1436,82 @@ snaploop:
 	return err
 }
 
+//reopenStatFd opens the stats file handle on the current file, after
+//compaction has switched to a new file.
+func (fdb *fdbSlice) reopenStatFd() error {
+
+	config := forestdb.DefaultConfig()
+	config.SetOpenFlags(forestdb.OPEN_FLAG_RDONLY)
+	config.SetEncryptionKey(fdb.encKey)
+
+	fdb.statFdLock.Lock()
+	defer fdb.statFdLock.Unlock()
+
+	var err error
+	fdb.statFd.Close()
+	if fdb.statFd, err = forestdb.Open(fdb.currfile, config); err != nil {
+		return err
+	}
+	fdb.fileVersion = fdb.statFd.GetFileVersion()
+	logging.Infof("ForestDBSlice::Compact(): after compaction, file version %v", forestdb.FdbFileVersionToString(fdb.fileVersion))
+	return nil
+}
+
+//rekey rewrites the forestdb file encrypted with the active key, if it
+//differs from the key the file is encrypted with. Unlike regular
+//compaction, the whole file is rewritten and older rollback points are
+//lost. Returns true if the file has been rewritten.
+func (fdb *fdbSlice) rekey(abortTime time.Time) (bool, error) {
+
+	key, err := encryption.ActiveKey(encryption.GetKeyProvider())
+	if err != nil {
+		return false, err
+	}
+
+	var keyId string
+	var keyBytes []byte
+	if key != nil {
+		keyId, keyBytes = key.Id, key.Bytes
+	}
+
+	if keyId == fdb.encKeyId {
+		return false, nil
+	}
+
+	logging.Infof("ForestDBSlice::Compact Re-encrypting with key %q (was %q). Rollback "+
+		"points older than the last snapshot are dropped. Slice Id %v, IndexInstId %v, "+
+		"IndexDefnId %v", keyId, fdb.encKeyId, fdb.id, fdb.idxInstId, fdb.idxDefnId)
+
+	//record both keys so that the file can be opened if the indexer
+	//restarts before the new file is complete
+	if err := encryption.WriteKeyIds(fdb.path, keyId, fdb.encKeyId); err != nil {
+		return false, err
+	}
+
+	donech := make(chan bool)
+	defer close(donech)
+	go fdb.cancelCompactionIfExpire(abortTime, donech)
+
+	if err := fdb.compactFd.Rekey(keyBytes); err != nil {
+		return false, err
+	}
+
+	info, err := fdb.compactFd.Info()
+	if err != nil {
+		return true, err
+	}
+
+	fdb.currfile = info.Filename()
+	fdb.encKeyId, fdb.encKey = keyId, keyBytes
+	fdb.config.SetEncryptionKey(keyBytes)
+
+	if err := encryption.WriteKeyIds(fdb.path, keyId); err != nil {
+		return true, err
+	}
+
+	return true, fdb.reopenStatFd()
+}
+
 func (fdb *fdbSlice) Statistics() (StorageStatistics, error) {
 	var sts StorageStatistics
 
@@ -1563,6 +1681,44 @@ func tryCloseFdbSlice(fdb *fdbSlice) {
 	fdb.dbfile.Close()
 }
 
+//fdbEncryptionKeyIds returns the ids of the keys the forestdb file may be
+//encrypted with. A new file is encrypted with the active key.
+func fdbEncryptionKeyIds(path, filepath string) ([]string, error) {
+
+	if _, err := os.Stat(filepath); os.IsNotExist(err) {
+		key, err := encryption.ActiveKey(encryption.GetKeyProvider())
+		if err != nil {
+			return nil, err
+		}
+
+		var keyId string
+		if key != nil {
+			keyId = key.Id
+		}
+		if err := encryption.WriteKeyIds(path, keyId); err != nil {
+			return nil, err
+		}
+		return []string{keyId}, nil
+	}
+
+	return encryption.ReadKeyIds(path)
+}
+
+//fdbEncryptionKey returns the key with the given id, nil for the
+//empty id of unencrypted files.
+func fdbEncryptionKey(keyId string) ([]byte, error) {
+
+	if keyId == "" {
+		return nil, nil
+	}
+
+	key, err := encryption.GetKey(encryption.GetKeyProvider(), keyId)
+	if err != nil {
+		return nil, err
+	}
+	return key.Bytes, nil
+}
+
 func newFdbFile(dirpath string, newVersion bool) string {
 	var version int = 0
 
@@ -1698,6 +1854,7 @@ func (fdb *fdbSlice) cancelCompact() {
 
 	//open a separate file handle for cancel compaction
 	config := forestdb.DefaultConfig()
+	config.SetEncryptionKey(fdb.encKey)
 	if tempFd, err = forestdb.Open(fdb.currfile, config); err != nil {
 		logging.Errorf("ForestDBSlice::cancelCompact Error Opening DB %v %v", err,
 			fdb.idxInstId)
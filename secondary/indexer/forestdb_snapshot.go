@@ -49,6 +49,7 @@ type fdbSnapshot struct {
 
 	main       *forestdb.KVStore // handle for forward index
 	mainSeqNum forestdb.SeqNum
+	backSeqNum forestdb.SeqNum
 
 	idxDefnId common.IndexDefnId //index definition id
 	idxInstId common.IndexInstId //index instance id
@@ -30,6 +30,15 @@ func (s *fdbSnapshot) StatCountTotal() (uint64, error) {
 	return c, nil
 }
 
+func (s *fdbSnapshot) NewReaderContext() IndexReaderContext {
+	return s.slice.GetReaderContext()
+}
+
+// Iterator reuses the document buffer for every entry
+func (s *fdbSnapshot) ReusesEntryBuffer() bool {
+	return true
+}
+
 func (s *fdbSnapshot) CountTotal(ctx IndexReaderContext, stopch StopChannel) (uint64, error) {
 	return s.CountRange(ctx, MinIndexKey, MaxIndexKey, Both, stopch)
 }
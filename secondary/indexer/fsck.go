@@ -0,0 +1,455 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/common/queryutil"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// Fsck checks that the main index and the back index of a slice agree
+// with each other: every back index entry must refer to main index
+// entries that exist, and every main index entry must be referred to by
+// the back index entry of its docid. Main index entries are also checked
+// for their format, key order and array entry count. With repair, the
+// back index entries of the docids found inconsistent are rewritten from
+// the main index entries.
+//
+// On a live indexer, the slices are checked at their latest snapshot
+// while mutations keep being applied. Entries inserted or deleted after
+// the snapshot are not reported. Repairs are applied by the writers of
+// the slice, between mutations, and skip the docids mutated after the
+// snapshot. The standalone checks work on the files of a slice which is
+// not in use.
+
+var ErrFsckNotSupported = errors.New("Fsck is not supported for the storage mode of the index")
+
+// maximum number of errors described in a report
+const fsckMaxErrors = 100
+
+// FsckReport is the result of the check of a slice.
+type FsckReport struct {
+	IndexInstId common.IndexInstId `json:"instId,omitempty"`
+	PartnId     common.PartitionId `json:"partnId"`
+	SliceId     SliceId            `json:"sliceId"`
+
+	MainEntries uint64 `json:"mainEntries"`
+	BackEntries uint64 `json:"backEntries"`
+
+	// back index entries referring to missing main index entries
+	MissingMain uint64 `json:"missingMain"`
+	// main index entries not referred to by the back index
+	MissingBack uint64 `json:"missingBack"`
+
+	OrderErrors  uint64 `json:"orderErrors"`
+	CountErrors  uint64 `json:"countErrors"`
+	FormatErrors uint64 `json:"formatErrors"`
+
+	// back index entries rewritten or removed by repair
+	Repaired uint64 `json:"repaired,omitempty"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (r *FsckReport) IsConsistent() bool {
+	return r.MissingMain == 0 && r.MissingBack == 0 && r.OrderErrors == 0 &&
+		r.CountErrors == 0 && r.FormatErrors == 0
+}
+
+func (r *FsckReport) addError(counter *uint64, format string, args ...interface{}) {
+	*counter++
+	if len(r.Errors) < fsckMaxErrors {
+		r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *FsckReport) String() string {
+	return fmt.Sprintf("Main %v Back %v MissingMain %v MissingBack %v "+
+		"OrderErrors %v CountErrors %v FormatErrors %v Repaired %v",
+		r.MainEntries, r.BackEntries, r.MissingMain, r.MissingBack,
+		r.OrderErrors, r.CountErrors, r.FormatErrors, r.Repaired)
+}
+
+//sliceChecker is implemented by the slices supporting fsck. s is a
+//snapshot of the slice, which can be mutated meanwhile.
+type sliceChecker interface {
+	Fsck(s Snapshot, repair bool) (*FsckReport, error)
+}
+
+//sliceWriterCall is queued to a writer of a slice, which calls it
+//between mutations with its worker id.
+type sliceWriterCall func(workerId int)
+
+//fsckChecker checks the main index entries of a slice
+type fsckChecker struct {
+	isPrimary       bool
+	isArray         bool
+	isArrayDistinct bool
+	arrayPos        int
+	numKeys         int
+	desc            []bool
+
+	prev []byte
+}
+
+func newFsckChecker(defn *common.IndexDefn) (*fsckChecker, error) {
+
+	c := &fsckChecker{
+		isPrimary: defn.IsPrimary,
+		isArray:   defn.IsArrayIndex,
+		numKeys:   len(defn.SecExprs),
+		desc:      defn.Desc,
+	}
+
+	if c.isArray {
+		var err error
+		_, c.isArrayDistinct, c.arrayPos, err = queryutil.GetArrayExpressionPosition(defn.SecExprs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+//checkMainEntry checks the format, key order and count of a main index
+//entry. It returns the docid of the entry, nil if the entry is malformed.
+func (c *fsckChecker) checkMainEntry(r *FsckReport, entry []byte) []byte {
+
+	r.MainEntries++
+
+	if c.prev != nil && bytes.Compare(c.prev, entry) >= 0 {
+		r.addError(&r.OrderErrors, "Main index entry %q is not after %q", entry, c.prev)
+	}
+	c.prev = append(c.prev[:0], entry...)
+
+	if c.isPrimary {
+		if len(entry) == 0 || isDocIdLarge(entry) {
+			r.addError(&r.FormatErrors, "Invalid primary index entry %q", entry)
+			return nil
+		}
+		return entry
+	}
+
+	docid, ok := fsckEntryDocId(entry)
+	if !ok {
+		r.addError(&r.FormatErrors, "Invalid main index entry %q", entry)
+		return nil
+	}
+
+	se := secondaryIndexEntry(entry)
+	if se.isCountEncoded() {
+		if !c.isArray || c.isArrayDistinct || se.Count() < 2 {
+			r.addError(&r.CountErrors, "Invalid count %v of main index entry of docid %q",
+				se.Count(), docid)
+		}
+	}
+	return docid
+}
+
+//fsckEntryDocId returns the docid of a secondary index entry, checking
+//the lengths encoded in the entry.
+func fsckEntryDocId(entry []byte) ([]byte, bool) {
+
+	if len(entry) < 2 {
+		return nil, false
+	}
+
+	se := secondaryIndexEntry(entry)
+	extra := 2
+	if se.isCountEncoded() {
+		extra = 4
+	}
+
+	docidlen := se.lenDocId()
+	if docidlen == 0 || len(entry) <= docidlen+extra {
+		return nil, false
+	}
+
+	offset := len(entry) - docidlen - extra
+	return entry[offset : offset+docidlen], true
+}
+
+//arrayEntries returns the main index entries of an array index for the
+//key of a document, as kept in the back index.
+func (c *fsckChecker) arrayEntries(key []byte, docid []byte) ([][]byte, error) {
+
+	key = append([]byte(nil), key...)
+
+	//get the key in original form
+	if c.desc != nil {
+		jsonEncoder.ReverseCollate(key, c.desc)
+	}
+
+	items, counts, _, err := ArrayIndexItems(key, c.arrayPos,
+		make([]byte, 0, len(key)*3), c.isArrayDistinct, false)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([][]byte, 0, len(items))
+	for i, item := range items {
+		buf := make([]byte, 0, len(item)+len(docid)+MAX_KEY_EXTRABYTES_LEN)
+		entry, err := GetIndexEntryBytes3(item, docid, false, false, counts[i], c.desc, buf)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+//arrayKey rebuilds the key of a document of an array index, in storage
+//format, from its main index entries. The order of the array items is
+//not preserved, which doesn't matter for maintaining the index.
+func (c *fsckChecker) arrayKey(entries [][]byte, docid []byte) ([]byte, error) {
+
+	var fields [][]byte
+	var items [][]byte
+
+	for _, entry := range entries {
+		se := secondaryIndexEntry(entry)
+		key := append([]byte(nil), entry[:se.lenKey()]...)
+
+		//get the key in original form
+		if c.desc != nil {
+			jsonEncoder.ReverseCollate(key, c.desc)
+		}
+
+		parts, err := jsonEncoder.ExplodeArray(key, make([]byte, 0, len(key)*3))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(parts) != c.numKeys && len(parts) != c.numKeys-1 {
+			return nil, fmt.Errorf("Invalid array index entry %q", entry)
+		}
+
+		//the entry of an empty or missing array has no array item
+		if len(parts) < c.numKeys {
+			if fields == nil {
+				fields = make([][]byte, 0, len(parts)+1)
+				fields = append(fields, parts[:c.arrayPos]...)
+				fields = append(fields, nil)
+				fields = append(fields, parts[c.arrayPos:]...)
+			}
+			continue
+		}
+
+		if fields == nil {
+			fields = parts
+		}
+		for i := 0; i < se.Count(); i++ {
+			items = append(items, parts[c.arrayPos])
+		}
+	}
+
+	if len(fields) != c.numKeys {
+		return nil, fmt.Errorf("Invalid array index entries of docid %q", docid)
+	}
+
+	array, err := jsonEncoder.JoinArray(items, nil)
+	if err != nil {
+		return nil, err
+	}
+	fields[c.arrayPos] = array
+
+	key, err := jsonEncoder.JoinArray(fields, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, len(key)+len(docid)+MAX_KEY_EXTRABYTES_LEN)
+	return NewSecondaryIndexEntry2(key, docid, true, 1, c.desc, buf, false)
+}
+
+//backEntries returns the main index entries the back index entry of a
+//docid refers to.
+func (c *fsckChecker) backEntries(docid, value []byte) ([][]byte, error) {
+
+	d, ok := fsckEntryDocId(value)
+	if !ok || !bytes.Equal(d, docid) {
+		return nil, fmt.Errorf("Invalid back index entry %q of docid %q", value, docid)
+	}
+
+	if c.isArray {
+		return c.arrayEntries(value, docid)
+	}
+	return [][]byte{value}, nil
+}
+
+func (s *scanCoordinator) initFsck() {
+	http.HandleFunc("/fsck", s.handleFsck)
+}
+
+//handleFsck checks the slices of an index hosted by this node, with
+//POST /fsck?bucket=<bucket>&index=<name>[&repair=true]
+func (s *scanCoordinator) handleFsck(w http.ResponseWriter, r *http.Request) {
+
+	creds, valid, err := common.IsAuthValid(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	} else if valid == false {
+		w.WriteHeader(401)
+		w.Write([]byte("401 Unauthorized\n"))
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Unsupported method", 405)
+		return
+	}
+
+	bucket := r.FormValue("bucket")
+	name := r.FormValue("index")
+	repair := r.FormValue("repair") == "true"
+	if bucket == "" || name == "" {
+		http.Error(w, "Missing bucket or index", http.StatusBadRequest)
+		return
+	}
+
+	permissions := []string{
+		fmt.Sprintf("cluster.bucket[%s].n1ql.index!alter", bucket),
+		fmt.Sprintf("cluster.bucket[%s].data.docs!read", bucket),
+	}
+	if !common.IsAllAllowed(creds, permissions, w) {
+		return
+	}
+
+	var resp struct {
+		Reports []*FsckReport `json:"reports,omitempty"`
+		Error   string        `json:"error,omitempty"`
+	}
+
+	if resp.Reports, err = s.fsckIndex(bucket, name, repair); err != nil {
+		resp.Error = err.Error()
+	}
+
+	bytes, err := json.Marshal(&resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+//fsckIndex checks the slices of all the instances of the index at their
+//latest snapshot.
+func (s *scanCoordinator) fsckIndex(bucket, name string, repair bool) ([]*FsckReport, error) {
+
+	insts := s.findFsckInsts(bucket, name)
+	if len(insts) == 0 {
+		return nil, common.ErrIndexNotFound
+	}
+
+	var reports []*FsckReport
+	for _, instId := range insts {
+		is := s.findFsckSnapshot(instId)
+		if is == nil {
+			return nil, ErrSnapNotAvailable
+		}
+
+		rs, err := s.fsckSnapshot(instId, is, repair)
+		DestroyIndexSnapshot(is)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, rs...)
+	}
+	return reports, nil
+}
+
+func (s *scanCoordinator) fsckSnapshot(instId common.IndexInstId,
+	is IndexSnapshot, repair bool) ([]*FsckReport, error) {
+
+	var reports []*FsckReport
+	for partnId, ps := range is.Partitions() {
+		for sliceId, ss := range ps.Slices() {
+			slice := s.findFsckSlice(instId, partnId, sliceId)
+			if slice == nil {
+				return nil, ErrNotMyPartition
+			}
+
+			checker, ok := slice.(sliceChecker)
+			if !ok {
+				return nil, ErrFsckNotSupported
+			}
+
+			t0 := time.Now()
+			report, err := checker.Fsck(ss.Snapshot(), repair)
+			if err != nil {
+				return nil, err
+			}
+			report.IndexInstId = instId
+			report.PartnId = partnId
+			report.SliceId = sliceId
+			reports = append(reports, report)
+
+			logging.Infof("%v::fsckSnapshot Index %v Partition %v Slice %v Repair %v "+
+				"Took %v %v", s.logPrefix, instId, partnId, sliceId, repair,
+				time.Since(t0), report)
+		}
+	}
+	return reports, nil
+}
+
+func (s *scanCoordinator) findFsckInsts(bucket, name string) []common.IndexInstId {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var insts []common.IndexInstId
+	for instId, inst := range s.indexInstMap {
+		if inst.Defn.Bucket == bucket && inst.Defn.Name == name &&
+			inst.State == common.INDEX_STATE_ACTIVE {
+			insts = append(insts, instId)
+		}
+	}
+	return insts
+}
+
+func (s *scanCoordinator) findFsckSlice(instId common.IndexInstId,
+	partnId common.PartitionId, sliceId SliceId) Slice {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	partition, ok := s.indexPartnMap[instId][partnId]
+	if !ok {
+		return nil
+	}
+	return partition.Sc.GetSliceById(sliceId)
+}
+
+//findFsckSnapshot returns a clone of the latest snapshot of the index
+//instance, nil if there is none.
+func (s *scanCoordinator) findFsckSnapshot(instId common.IndexInstId) IndexSnapshot {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if ss, ok := s.lastSnapshot[instId]; ok && ss != nil {
+		return CloneIndexSnapshot(ss)
+	}
+	return nil
+}
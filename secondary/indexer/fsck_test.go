@@ -0,0 +1,178 @@
+package indexer
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+
+	"github.com/couchbase/indexing/secondary/memdb"
+	"github.com/couchbase/indexing/secondary/memdb/nodetable"
+	"github.com/couchbase/indexing/secondary/memdb/skiplist"
+)
+
+func TestFsckMainEntry(t *testing.T) {
+	c := &fsckChecker{numKeys: 1}
+	r := &FsckReport{}
+
+	e1, _ := newSKEntry([]byte(`["a"]`), []byte("doc1"))
+	e2, _ := newSKEntry([]byte(`["b"]`), []byte("doc2"))
+
+	if docid := c.checkMainEntry(r, e1); string(docid) != "doc1" {
+		t.Errorf("Expected doc1, received %s", docid)
+	}
+	if docid := c.checkMainEntry(r, e2); string(docid) != "doc2" {
+		t.Errorf("Expected doc2, received %s", docid)
+	}
+	if !r.IsConsistent() || r.MainEntries != 2 {
+		t.Errorf("Unexpected report %v", r)
+	}
+
+	c.checkMainEntry(r, e1)
+	if r.OrderErrors != 1 {
+		t.Errorf("Expected an order error, received %v", r)
+	}
+
+	if docid := c.checkMainEntry(r, []byte{0xff}); docid != nil || r.FormatErrors != 1 {
+		t.Errorf("Expected a format error, received %v", r)
+	}
+
+	//array count on a non-array index
+	c = &fsckChecker{numKeys: 1}
+	e3, _ := NewSecondaryIndexEntry([]byte(`["c"]`), []byte("doc3"), true, 2, nil,
+		make([]byte, 0, 300))
+	c.checkMainEntry(r, e3)
+	if r.CountErrors != 1 {
+		t.Errorf("Expected a count error, received %v", r)
+	}
+	if len(r.Errors) != 3 {
+		t.Errorf("Expected 3 errors, received %v", r.Errors)
+	}
+}
+
+func TestFsckEntryDocId(t *testing.T) {
+	e, _ := newSKEntry([]byte(`["field1",10]`), []byte("doc-1"))
+	if docid, ok := fsckEntryDocId(e); !ok || string(docid) != "doc-1" {
+		t.Errorf("Expected doc-1, received %s", docid)
+	}
+
+	for _, entry := range [][]byte{nil, {0}, {'a', 10, 0}, {0, 0}} {
+		if _, ok := fsckEntryDocId(entry); ok {
+			t.Errorf("Expected invalid entry %v", entry)
+		}
+	}
+}
+
+func TestFsckArrayKey(t *testing.T) {
+	docid := []byte("doc-1")
+
+	keys := []string{
+		`[["x","y","x"],5]`,
+		`[[],5]`,
+		`[["x",["y"],{"z":1}],"abc"]`,
+	}
+
+	for _, desc := range [][]bool{nil, {true, false}} {
+		c := &fsckChecker{isArray: true, arrayPos: 0, numKeys: 2, desc: desc}
+
+		for _, k := range keys {
+			value, err := NewSecondaryIndexEntry2([]byte(k), docid, true, 1, desc,
+				make([]byte, 0, 300), false)
+			if err != nil {
+				t.Fatalf("Key %v: %v", k, err)
+			}
+
+			entries, err := c.backEntries(docid, value)
+			if err != nil {
+				t.Fatalf("Key %v: %v", k, err)
+			}
+
+			rebuilt, err := c.arrayKey(entries, docid)
+			if err != nil {
+				t.Fatalf("Key %v: %v", k, err)
+			}
+
+			entries2, err := c.arrayEntries(rebuilt, docid)
+			if err != nil {
+				t.Fatalf("Key %v: %v", k, err)
+			}
+
+			if len(entries) != len(entries2) {
+				t.Fatalf("Key %v: expected %v entries, received %v", k, len(entries), len(entries2))
+			}
+			for i := range entries {
+				if !bytes.Equal(entries[i], entries2[i]) {
+					t.Errorf("Key %v: expected entry %q, received %q", k, entries[i], entries2[i])
+				}
+			}
+		}
+	}
+
+	c := &fsckChecker{isArray: true, arrayPos: 0, numKeys: 2}
+	value, _ := NewSecondaryIndexEntry2([]byte(keys[0]), docid, true, 1, nil,
+		make([]byte, 0, 300), false)
+	if _, err := c.backEntries([]byte("doc-2"), value); err == nil {
+		t.Errorf("Expected an error for a mismatching docid")
+	}
+}
+
+func TestFsckMemDBSnapshot(t *testing.T) {
+	cfg := memdb.DefaultConfig()
+	cfg.SetKeyComparator(byteItemCompare)
+	store := memdb.NewWithConfig(cfg)
+	defer store.Close()
+
+	back := nodetable.New(hashDocId, nodeEquality)
+	defer back.Close()
+
+	w := store.NewWriter()
+	put := func(key, docid string, inBack bool) *skiplist.Node {
+		entry, _ := newSKEntry([]byte(key), []byte(docid))
+		node := w.Put2(entry)
+		if inBack {
+			memdbBackIndexAdd(back, node)
+		}
+		return node
+	}
+
+	n1 := put(`["a"]`, "doc1", true)
+	n2 := put(`["b"]`, "doc2", false)
+	put(`["c"]`, "doc3", true)
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	//mutations after the snapshot are not reported
+	put(`["d"]`, "doc4", false)
+	w.DeleteNode(n1)
+
+	itr := store.NewIterator(snap)
+	defer itr.Close()
+
+	c := &fsckChecker{numKeys: 1}
+	r := &FsckReport{}
+	refs := memdbBackIndexRefs(r, c, back, 0)
+	affected := fsckMemDB(r, c, itr, snap, refs)
+
+	if r.MainEntries != 3 || r.BackEntries != 2 || r.MissingBack != 1 || r.MissingMain != 0 {
+		t.Errorf("Unexpected report %v", r)
+	}
+	if table, ok := affected["doc2"]; len(affected) != 1 || !ok || table != -1 {
+		t.Errorf("Expected doc2 to be repaired, received %v", affected)
+	}
+
+	if !memdbRepairBackIndex(back, snap, []byte("doc2"), []*skiplist.Node{n2}) {
+		t.Errorf("Expected doc2 to be repaired")
+	}
+	if p := back.Get(entryBytesFromDocId([]byte("doc2"))); p != unsafe.Pointer(n2) {
+		t.Errorf("Expected back index entry of doc2 to be repaired")
+	}
+	if memdbRepairBackIndex(back, snap, []byte("doc1"), []*skiplist.Node{n1}) {
+		t.Errorf("Expected doc1 deleted after the snapshot not to be repaired")
+	}
+
+	c = &fsckChecker{numKeys: 1}
+	r = &FsckReport{}
+	fsckMemDB(r, c, itr, snap, memdbBackIndexRefs(r, c, back, 0))
+	if !r.IsConsistent() || r.BackEntries != 3 {
+		t.Errorf("Unexpected report after repair %v", r)
+	}
+}
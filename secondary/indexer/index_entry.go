@@ -136,7 +136,7 @@ func NewSecondaryIndexEntry2(key []byte, docid []byte, isArray bool,
 		} else if !allowLargeKeys && validateSize && isSecKeyLarge(key) {
 			return nil, ErrSecKeyTooLong
 		}
-		if buf, err = jsonEncoder.Encode(key, buf); err != nil {
+		if buf, err = jsonEncoder.EncodeJSON(key, buf[:0]); err != nil {
 			return nil, err
 		}
 	} else { // Encoded
@@ -352,7 +352,7 @@ func NewSecondaryKey(key []byte, buf []byte) (IndexKey, error) {
 	}
 
 	var err error
-	if buf, err = jsonEncoder.Encode(key, buf); err != nil {
+	if buf, err = jsonEncoder.EncodeJSON(key, buf[:0]); err != nil {
 		return nil, err
 	}
 
@@ -362,6 +362,37 @@ func NewSecondaryKey(key []byte, buf []byte) (IndexKey, error) {
 	return &k, nil
 }
 
+// Strings of an index with collation are encoded with their collation key.
+// Scan keys are encoded as the low or high bound of the strings equal to
+// them under the collation.
+func NewCollatedSecondaryKey(key []byte, coll *collatejson.Collation,
+	bound collatejson.Bound) (IndexKey, error) {
+
+	if isNilJsonKey(key) {
+		return &NilIndexKey{}, nil
+	}
+
+	if isSecKeyLarge(key) {
+		return nil, ErrSecKeyTooLong
+	}
+
+	codec := collatejson.NewCodec(16)
+	codec.SortbyCollation(coll)
+	codec.CollationBound(bound)
+
+	buf, err := codec.EncodeJSON(key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	k := secondaryKey(buf)
+	return &k, nil
+}
+
+func getCollation(c *common.IndexCollation) (*collatejson.Collation, error) {
+	return collatejson.GetCollation(c.Locale, c.Strength, c.CaseLevel)
+}
+
 func (k *secondaryKey) Compare(entry IndexEntry) int {
 	kbytes := []byte(*k)
 	klen := len(kbytes)
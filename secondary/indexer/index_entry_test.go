@@ -3,6 +3,9 @@ package indexer
 import (
 	"bytes"
 	"testing"
+
+	"github.com/couchbase/indexing/secondary/collatejson"
+	"github.com/couchbase/indexing/secondary/common"
 )
 
 func newSKEntry(key, docid []byte) (secondaryIndexEntry, error) {
@@ -186,3 +189,42 @@ func TestLongDocIdEntry(t *testing.T) {
 		t.Errorf("Expected lenght to be 258 but instead got ", e.lenDocId())
 	}
 }
+
+func TestCollatedSecondaryKey(t *testing.T) {
+	coll, err := getCollation(&common.IndexCollation{Locale: "de", Strength: "primary"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keys of collated indexes are encoded by projector
+	codec := collatejson.NewCodec(16)
+	codec.SortbyCollation(coll)
+	sk, err := codec.Encode([]byte(`["Müller"]`), make([]byte, 0, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := newSKEntry(sk, []byte("doc-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, _ := e.ReadSecKey(make([]byte, 0, 1024))
+	if string(buf) != `["Müller"]` {
+		t.Errorf("Expected %v, received %v", `["Müller"]`, string(buf))
+	}
+
+	low, _ := NewCollatedSecondaryKey([]byte(`["muller"]`), coll, collatejson.LowBound)
+	high, _ := NewCollatedSecondaryKey([]byte(`["MULLER"]`), coll, collatejson.HighBound)
+	if low.Compare(&e) >= 0 {
+		t.Errorf("Expected low bound to sort before entry")
+	}
+	if high.Compare(&e) <= 0 {
+		t.Errorf("Expected high bound to sort after entry")
+	}
+
+	other, _ := NewCollatedSecondaryKey([]byte(`["mueller"]`), coll, collatejson.HighBound)
+	if other.Compare(&e) >= 0 {
+		t.Errorf("Expected mismatch")
+	}
+}
@@ -68,6 +68,27 @@ type RangeCounter interface {
 		uint64, error)
 }
 
+// RangeSplitter is a class of algorithms that can pick entries splitting the
+// index into ranges of approximately equal number of entries
+type RangeSplitter interface {
+	RangeSplitEntries(n int) [][]byte
+}
+
+// ParallelReader is a class of algorithms that can scan multiple ranges of
+// the index concurrently.  NewReaderContext returns an initialized reader
+// context, or nil if no reader is available right away.  The context must
+// be released with Done.
+type ParallelReader interface {
+	NewReaderContext() IndexReaderContext
+}
+
+// EntryBufferReuser is a class of algorithms that reuse the buffer of an
+// entry once the entry callback returns.  Entries retained by the scan after
+// the callback must be copied.
+type EntryBufferReuser interface {
+	ReusesEntryBuffer() bool
+}
+
 type IndexReader interface {
 	Counter
 	Ranger
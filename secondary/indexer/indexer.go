@@ -31,6 +31,7 @@ import (
 
 	"github.com/couchbase/cbauth"
 	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/encryption"
 	"github.com/couchbase/indexing/secondary/fdb"
 	"github.com/couchbase/indexing/secondary/logging"
 	mc "github.com/couchbase/indexing/secondary/manager/common"
@@ -75,6 +76,8 @@ var (
 	ErrIndexerNotActive         = errors.New("Indexer Not Active")
 	ErrInvalidMetadata          = errors.New("Invalid Metadata")
 	ErrBucketEphemeral          = errors.New("Ephemeral Buckets Must Use MOI Storage")
+	ErrIndexPaused              = errors.New("Index Paused")
+	ErrIndexNotPaused           = errors.New("Index Not Paused")
 )
 
 type indexer struct {
@@ -250,6 +253,18 @@ func NewIndexer(config common.Config) (Indexer, Message) {
 	}
 	logging.Infof("Indexer::NewIndexer Build Mode Set %v", common.GetBuildMode())
 
+	if keyFile := idx.config["encryption.key_file"].String(); keyFile != "" {
+		provider, err := encryption.NewFileKeyProvider(keyFile)
+		if err != nil {
+			logging.Fatalf("Indexer::NewIndexer Error reading encryption key file %v. Error %v", keyFile, err)
+			return nil, &MsgError{err: Error{cause: err}}
+		}
+		encryption.SetKeyProvider(provider)
+		logging.Infof("Indexer::NewIndexer Encryption at rest enabled with key file %v", keyFile)
+		logging.Warnf("Indexer::NewIndexer Plasma files and the metadata repository " +
+			"of the index manager are not encrypted")
+	}
+
 	//Start Mutation Manager
 	idx.mutMgr, res = NewMutationManager(idx.mutMgrCmdCh, idx.wrkrRecvCh, idx.config)
 	if res.GetMsgType() != MSG_SUCCESS {
@@ -865,6 +880,10 @@ func (idx *indexer) handleWorkerMsgs(msg Message) {
 		idx.storageMgrCmdCh <- msg
 		<-idx.storageMgrCmdCh
 
+	case TK_FLUSH_BARRIER:
+		idx.tkCmdCh <- msg
+		<-idx.tkCmdCh
+
 	case CONFIG_SETTINGS_UPDATE:
 		idx.handleConfigUpdate(msg)
 
@@ -938,6 +957,9 @@ func (idx *indexer) handleWorkerMsgs(msg Message) {
 	case INDEXER_RESUME:
 		idx.handleIndexerResume(msg)
 
+	case STORAGE_DISK_STATE:
+		idx.handleDiskStateChange(msg)
+
 	case CLUST_MGR_SET_LOCAL:
 		idx.handleSetLocalMeta(msg)
 
@@ -959,6 +981,12 @@ func (idx *indexer) handleWorkerMsgs(msg Message) {
 	case INDEXER_CANCEL_MERGE_PARTITION:
 		idx.handleCancelMergePartition(msg)
 
+	case INDEXER_PAUSE_INDEX:
+		idx.handlePauseIndex(msg)
+
+	case INDEXER_RESUME_INDEX:
+		idx.handleResumeIndex(msg)
+
 	default:
 		logging.Fatalf("Indexer::handleWorkerMsgs Unknown Message %+v", msg)
 		common.CrashOnError(errors.New("Unknown Msg On Worker Channel"))
@@ -2248,10 +2276,12 @@ func (idx *indexer) handleDropIndex(msg Message) {
 	idx.stats.RemoveIndex(indexInst.InstId)
 
 	//if the index state is Created/Ready/Deleted, only data cleanup is
-	//required. No stream updates are required.
+	//required. No stream updates are required. A paused index is not
+	//in any stream either.
 	if indexInst.State == common.INDEX_STATE_CREATED ||
 		indexInst.State == common.INDEX_STATE_READY ||
-		indexInst.State == common.INDEX_STATE_DELETED {
+		indexInst.State == common.INDEX_STATE_DELETED ||
+		indexInst.Stream == common.NIL_STREAM {
 
 		idx.cleanupIndexData(indexInst, clientCh)
 		logging.Infof("Indexer::handleDropIndex Cleanup Successful for "+
@@ -3687,6 +3717,8 @@ func (idx *indexer) handleMergeInitStream(msg Message) {
 
 			index.State = common.INDEX_STATE_ACTIVE
 			index.Stream = common.MAINT_STREAM
+			//a resumed index is maintained again once merged
+			index.Paused = false
 			indexList = append(indexList, index)
 			bucketUUIDList = append(bucketUUIDList, index.Defn.BucketUUID)
 		}
@@ -4204,7 +4236,7 @@ func (idx *indexer) bootstrap(snapshotNotifych chan IndexSnapshot) (bool, error)
 	idx.recoverRebalanceState()
 
 	//recover indexes from local metadata
-	needsRestart, err := idx.initFromPersistedState()
+	warmSnapMap, needsRestart, err := idx.initFromPersistedState(snapshotNotifych)
 	if err != nil {
 		return needsRestart, err
 	}
@@ -4212,7 +4244,7 @@ func (idx *indexer) bootstrap(snapshotNotifych chan IndexSnapshot) (bool, error)
 	//Start Storage Manager
 	var res Message
 	idx.storageMgr, res = NewStorageManager(idx.storageMgrCmdCh, idx.wrkrRecvCh,
-		idx.indexPartnMap, idx.config, snapshotNotifych)
+		idx.indexPartnMap, warmSnapMap, idx.config, snapshotNotifych)
 	if res.GetMsgType() == MSG_ERROR {
 		err := res.(*MsgError).GetError()
 		logging.Fatalf("Indexer::NewIndexer Storage Manager Init Error %v", err)
@@ -4404,12 +4436,13 @@ func (idx *indexer) genIndexerId() {
 
 }
 
-func (idx *indexer) initFromPersistedState() (bool, error) {
+func (idx *indexer) initFromPersistedState(snapshotNotifych chan IndexSnapshot) (
+	IndexSnapMap, bool, error) {
 
 	err := idx.recoverIndexInstMap()
 	if err != nil {
 		logging.Fatalf("Indexer::initFromPersistedState Error Recovering IndexInstMap %v", err)
-		return false, err
+		return nil, false, err
 	}
 
 	logging.Infof("Indexer::initFromPersistedState Recovered IndexInstMap %v", idx.indexInstMap)
@@ -4430,19 +4463,15 @@ func (idx *indexer) initFromPersistedState() (bool, error) {
 				idx.stats.AddPartition(inst.InstId, inst.Defn.Bucket, inst.Defn.Name, inst.ReplicaId, partnDefn.GetPartitionId())
 			}
 		}
+	}
 
-		//allocate partition/slice
-		var partnInstMap PartitionInstMap
-		var err error
-		if partnInstMap, err = idx.initPartnInstance(inst, nil); err != nil {
-			return needsRestart, err
-		}
-
-		idx.indexInstMap[inst.InstId] = inst
-		idx.indexPartnMap[inst.InstId] = partnInstMap
+	//allocate partition/slice and open the latest snapshot
+	warmSnapMap, err := idx.warmupIndexes(snapshotNotifych)
+	if err != nil {
+		return nil, needsRestart, err
 	}
 
-	return needsRestart, nil
+	return warmSnapMap, needsRestart, nil
 
 }
 
@@ -4484,9 +4513,7 @@ func (idx *indexer) recoverInstMapFromFile() error {
 	var err error
 
 	//read indexer state and local state context
-	config := forestdb.DefaultConfig()
-
-	if dbfile, err = forestdb.Open("meta", config); err != nil {
+	if dbfile, err = openMetaFile(META_FILE); err != nil {
 		return err
 	}
 	defer dbfile.Close()
@@ -4927,6 +4954,40 @@ func (idx *indexer) makeRestartTs(streamId common.StreamId) map[string]*common.T
 	return restartTs
 }
 
+//makeRestartTsForIndexList returns the oldest timestamp of the latest
+//snapshots of the given indexes, nil if any of them has no snapshot.
+func (idx *indexer) makeRestartTsForIndexList(instIdList []common.IndexInstId) *common.TsVbuuid {
+
+	var restartTs *common.TsVbuuid
+
+	for _, instId := range instIdList {
+		for _, partnInst := range idx.indexPartnMap[instId] {
+
+			//there is only one slice for now
+			slice := partnInst.Sc.GetSliceById(0)
+
+			infos, err := slice.GetSnapshots()
+			if err != nil {
+				logging.Errorf("Indexer::makeRestartTsForIndexList Index %v Unable to "+
+					"read snapinfo. Err %v", instId, err)
+				return nil
+			}
+
+			s := NewSnapshotInfoContainer(infos)
+			latestSnapInfo := s.GetLatest()
+			if latestSnapInfo == nil {
+				return nil
+			}
+
+			ts := latestSnapInfo.Timestamp()
+			if restartTs == nil || !ts.AsRecent(restartTs) {
+				restartTs = ts
+			}
+		}
+	}
+	return restartTs
+}
+
 func (idx *indexer) closeAllStreams() {
 
 	respCh := make(MsgChannel)
@@ -5717,6 +5778,255 @@ func (idx *indexer) handleIndexerResume(msg Message) {
 
 }
 
+//handlePauseIndex stops the maintenance of an index, without pausing the
+//rest of the indexer. The index is removed from MAINT_STREAM and is served
+//at its last snapshot, only to the scans with any consistency. The pause
+//is not persisted, after a restart the index catches up from its last
+//snapshot during recovery.
+func (idx *indexer) handlePauseIndex(msg Message) {
+
+	bucket := msg.(*MsgPauseIndex).GetBucket()
+	name := msg.(*MsgPauseIndex).GetIndexName()
+	respCh := msg.(*MsgPauseIndex).GetResponseChannel()
+
+	logging.Infof("Indexer::handlePauseIndex Bucket %v Index %v", bucket, name)
+
+	instIdList, err := idx.checkPauseIndex(bucket, name, false)
+	if err != nil {
+		logging.Errorf("Indexer::handlePauseIndex Bucket %v Index %v Cannot Pause Index. "+
+			"Err %v", bucket, name, err)
+		respCh <- err
+		return
+	}
+
+	indexList := idx.pauseIndexInsts(instIdList)
+
+	//once workers have the updated map, no mutation gets flushed
+	//and no snapshot gets created for the paused index
+	msgUpdateIndexInstMap := idx.newIndexInstMsg(idx.indexInstMap)
+	if err := idx.distributeIndexMapsToWorkers(msgUpdateIndexInstMap, nil); err != nil {
+		respCh <- err
+		common.CrashOnError(err)
+	}
+
+	idx.removeIndexesFromStream(indexList, bucket, indexList[0].Defn.BucketUUID,
+		common.MAINT_STREAM, common.INDEX_STATE_ACTIVE, nil)
+
+	logging.Infof("Indexer::handlePauseIndex Paused Index %v Bucket %v RestartTs %v",
+		instIdList, bucket, idx.makeRestartTsForIndexList(instIdList))
+
+	respCh <- nil
+}
+
+//handleResumeIndex catches up a paused index from its last snapshot. If
+//MAINT_STREAM is running for the bucket, the index is built in INIT_STREAM
+//and gets merged to MAINT_STREAM once caught up, like an initial build.
+//Otherwise MAINT_STREAM is restarted for the index.
+func (idx *indexer) handleResumeIndex(msg Message) {
+
+	bucket := msg.(*MsgPauseIndex).GetBucket()
+	name := msg.(*MsgPauseIndex).GetIndexName()
+	respCh := msg.(*MsgPauseIndex).GetResponseChannel()
+
+	logging.Infof("Indexer::handleResumeIndex Bucket %v Index %v", bucket, name)
+
+	instIdList, err := idx.checkPauseIndex(bucket, name, true)
+	if err != nil {
+		logging.Errorf("Indexer::handleResumeIndex Bucket %v Index %v Cannot Resume Index. "+
+			"Err %v", bucket, name, err)
+		respCh <- err
+		return
+	}
+
+	streamId := common.MAINT_STREAM
+	state := common.INDEX_STATE_ACTIVE
+	if idx.checkBucketExistsInStream(bucket, common.MAINT_STREAM, false) {
+
+		//INIT_STREAM is used by the index build of the bucket
+		buildInProgress := idx.checkStreamRequestPending(common.INIT_STREAM, bucket)
+		for _, index := range idx.indexInstMap {
+			if index.Defn.Bucket == bucket &&
+				(index.State == common.INDEX_STATE_INITIAL ||
+					index.State == common.INDEX_STATE_CATCHUP) {
+				buildInProgress = true
+			}
+		}
+
+		if buildInProgress {
+			err := errors.New(fmt.Sprintf("Build Already In Progress. Bucket %v", bucket))
+			logging.Errorf("Indexer::handleResumeIndex Bucket %v Index %v Cannot Resume "+
+				"Index. Err %v", bucket, name, err)
+			respCh <- err
+			return
+		}
+
+		cluster := idx.config["clusterAddr"].String()
+		numVbuckets := idx.config["numVbuckets"].Int()
+		buildTs, err := GetCurrentKVTs(cluster, "default", bucket, numVbuckets)
+		if err != nil {
+			logging.Errorf("Indexer::handleResumeIndex Error Connecting KV %v Err %v",
+				cluster, err)
+			respCh <- err
+			return
+		}
+		idx.bucketBuildTs[bucket] = buildTs
+
+		streamId = common.INIT_STREAM
+		state = common.INDEX_STATE_INITIAL
+	}
+
+	restartTs := idx.makeRestartTsForIndexList(instIdList)
+
+	idx.resumeIndexInsts(instIdList, streamId, state)
+
+	msgUpdateIndexInstMap := idx.newIndexInstMsg(idx.indexInstMap)
+	if err := idx.distributeIndexMapsToWorkers(msgUpdateIndexInstMap, nil); err != nil {
+		respCh <- err
+		common.CrashOnError(err)
+	}
+
+	//an index being caught up in INIT_STREAM is recovered from its
+	//last snapshot after a restart
+	if idx.enableManager && streamId == common.INIT_STREAM {
+		if err := idx.updateMetaInfoForIndexList(instIdList, true,
+			true, false, false, false, false, false, false, nil); err != nil {
+			common.CrashOnError(err)
+		}
+	}
+
+	idx.stateLock.Lock()
+	if _, ok := idx.streamBucketStatus[streamId]; !ok {
+		idx.streamBucketStatus[streamId] = make(BucketStatus)
+	}
+	idx.stateLock.Unlock()
+
+	//stream is active once the stream request is done
+	idx.setStreamBucketState(streamId, bucket, STREAM_RECOVERY)
+
+	logging.Infof("Indexer::handleResumeIndex Resume Index %v Stream %v Bucket %v "+
+		"RestartTs %v", instIdList, streamId, bucket, restartTs)
+
+	idx.startBucketStream(streamId, bucket, restartTs)
+
+	respCh <- nil
+}
+
+//pauseIndexInsts removes the instances from their stream and marks them
+//paused. It returns the instances as they were before the pause.
+func (idx *indexer) pauseIndexInsts(instIdList []common.IndexInstId) []common.IndexInst {
+
+	var indexList []common.IndexInst
+	for _, instId := range instIdList {
+		indexInst := idx.indexInstMap[instId]
+		indexList = append(indexList, indexInst)
+
+		indexInst.Stream = common.NIL_STREAM
+		indexInst.Paused = true
+		idx.indexInstMap[instId] = indexInst
+	}
+	return indexList
+}
+
+//resumeIndexInsts moves paused instances to the stream they catch up in.
+func (idx *indexer) resumeIndexInsts(instIdList []common.IndexInstId,
+	streamId common.StreamId, state common.IndexState) {
+
+	for _, instId := range instIdList {
+		indexInst := idx.indexInstMap[instId]
+		indexInst.Stream = streamId
+		indexInst.State = state
+		//index restarted in MAINT_STREAM is no more stale for
+		//the scans waiting for a timestamp
+		indexInst.Paused = streamId != common.MAINT_STREAM
+		idx.indexInstMap[instId] = indexInst
+	}
+}
+
+//checkPauseIndex returns the instances of the index hosted by this node,
+//if they can be paused, or resumed if paused is true.
+func (idx *indexer) checkPauseIndex(bucket, name string,
+	paused bool) ([]common.IndexInstId, error) {
+
+	if is := idx.getIndexerState(); is != common.INDEXER_ACTIVE {
+		return nil, ErrIndexerNotActive
+	}
+
+	if idx.rebalanceRunning || idx.rebalanceToken != nil {
+		return nil, errors.New("Rebalance In Progress")
+	}
+
+	initState := idx.getStreamBucketState(common.INIT_STREAM, bucket)
+	maintState := idx.getStreamBucketState(common.MAINT_STREAM, bucket)
+	if initState == STREAM_RECOVERY ||
+		initState == STREAM_PREPARE_RECOVERY ||
+		maintState == STREAM_RECOVERY ||
+		maintState == STREAM_PREPARE_RECOVERY {
+		return nil, ErrIndexerInRecovery
+	}
+
+	//index build of the bucket needs MAINT_STREAM to merge
+	if !paused && idx.checkBucketExistsInStream(bucket, common.INIT_STREAM, false) {
+		return nil, errors.New(fmt.Sprintf("Build Already In Progress. Bucket %v", bucket))
+	}
+
+	var instIdList []common.IndexInstId
+	for instId, index := range idx.indexInstMap {
+		if index.Defn.Bucket != bucket || index.Defn.Name != name ||
+			index.State == common.INDEX_STATE_DELETED {
+			continue
+		}
+
+		if index.Paused != paused {
+			if paused {
+				return nil, ErrIndexNotPaused
+			}
+			return nil, ErrIndexPaused
+		}
+
+		if paused && index.Stream != common.NIL_STREAM {
+			return nil, errors.New("Index Resume In Progress")
+		} else if !paused && (index.State != common.INDEX_STATE_ACTIVE ||
+			index.Stream != common.MAINT_STREAM) {
+			return nil, errors.New(fmt.Sprintf("Index Not Active. State %v Stream %v",
+				index.State, index.Stream))
+		}
+
+		instIdList = append(instIdList, instId)
+	}
+
+	if len(instIdList) == 0 {
+		return nil, common.ErrIndexNotFound
+	}
+	return instIdList, nil
+}
+
+//handleDiskStateChange is called when the storage manager finds the
+//disk usage of storage_dir has crossed the low/high disk marks.
+//Compaction manager compacts indexes when running low on space,
+//timekeeper stops flushing mutations while the disk is full and
+//scan coordinator only serves scans which don't need a new snapshot.
+func (idx *indexer) handleDiskStateChange(msg Message) {
+
+	state := msg.(*MsgDiskState).GetState()
+
+	logging.Infof("Indexer::handleDiskStateChange Disk State %v", state)
+
+	idx.stats.diskState.Set(int64(state))
+
+	//Notify Scan Coordinator
+	idx.scanCoordCmdCh <- msg
+	<-idx.scanCoordCmdCh
+
+	//Notify Timekeeper
+	idx.tkCmdCh <- msg
+	<-idx.tkCmdCh
+
+	//Notify Compaction Manager
+	idx.compactMgrCmdCh <- msg
+	<-idx.compactMgrCmdCh
+
+}
+
 func (idx *indexer) doPrepareUnpause() {
 
 	ticker := time.NewTicker(time.Second * 1)
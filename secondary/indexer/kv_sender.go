@@ -1181,6 +1181,13 @@ func convertIndexDefnToProtobuf(indexDefn c.IndexDefn) *protobuf.IndexDefn {
 		HashScheme:         protobuf.HashScheme(indexDefn.HashScheme).Enum(),
 		WhereExpression:    proto.String(indexDefn.WhereExpr),
 		RetainDeletedXATTR: proto.Bool(indexDefn.RetainDeletedXATTR),
+		ImmutableWhere:     proto.Bool(indexDefn.ImmutableWhere),
+	}
+
+	if collation := indexDefn.Collation; collation != nil {
+		defn.CollationLocale = proto.String(collation.Locale)
+		defn.CollationStrength = proto.String(collation.Strength)
+		defn.CollationCaseLevel = proto.Bool(collation.CaseLevel)
 	}
 
 	return defn
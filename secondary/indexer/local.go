@@ -0,0 +1,294 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	projector "github.com/couchbase/indexing/secondary/protobuf/projector"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+)
+
+//Hooks of package localindex, which embeds an index in an application
+//without the indexer supervisor. Documents are evaluated by the
+//projector's evaluator and written to a slice of the index storage, and
+//snapshots of the slice are scanned by the same scan pipeline as the
+//indexer's.
+
+//NewLocalMutationMeta returns the metadata of a mutation of a local index.
+func NewLocalMutationMeta(bucket string, vbucket Vbucket, seqno Seqno) *MutationMeta {
+	meta := NewMutationMeta()
+	meta.bucket = bucket
+	meta.vbucket = vbucket
+	meta.seqno = seqno
+	return meta
+}
+
+//NewLocalIndexEvaluator returns the projector's evaluator of the
+//documents of index instance inst.
+func NewLocalIndexEvaluator(config common.Config,
+	inst common.IndexInst) (*projector.IndexEvaluator, error) {
+
+	protoDefn := convertIndexDefnToProtobuf(inst.Defn)
+	protoInst := convertIndexInstToProtobuf(config, inst, protoDefn)
+	return projector.NewIndexEvaluator(protoInst, projector.FeedVersion_watson)
+}
+
+//LocalScanner runs the scans of a local index on the snapshots of its
+//slice, without the scan coordinator.
+type LocalScanner struct {
+	inst   common.IndexInst
+	slice  Slice
+	config common.Config
+	stats  *IndexStats
+
+	reqCounter uint64
+}
+
+//NewLocalScanner returns the scanner of slice of index instance inst.
+//config is the indexer section of the system config.
+func NewLocalScanner(inst common.IndexInst, slice Slice, config common.Config,
+	stats *IndexStats) *LocalScanner {
+
+	return &LocalScanner{inst: inst, slice: slice, config: config, stats: stats}
+}
+
+//IndexSnapshot returns the index snapshot made of the snapshot snap of
+//the slice.
+func (ls *LocalScanner) IndexSnapshot(snap Snapshot) IndexSnapshot {
+	return &indexSnapshot{
+		instId: ls.inst.InstId,
+		ts:     snap.Timestamp(),
+		partns: map[common.PartitionId]PartitionSnapshot{
+			common.NON_PARTITION_ID: &partitionSnapshot{
+				id: common.NON_PARTITION_ID,
+				slices: map[SliceId]SliceSnapshot{
+					SliceId(0): &sliceSnapshot{id: SliceId(0), snap: snap},
+				},
+			},
+		},
+	}
+}
+
+//Scan runs a range, multi-scan or group aggregate scan request, or a scan
+//all request, on snapshot is and calls callback for each row with the
+//document id and the secondary key as a JSON array, which are valid only
+//during the call. Returning an error from callback stops the scan.
+func (ls *LocalScanner) Scan(is IndexSnapshot, protoReq interface{},
+	callback func(docid, key []byte) error) error {
+
+	r, err := ls.newScanRequest(protoReq)
+	if r != nil {
+		defer r.Done()
+	}
+	if err != nil {
+		return err
+	}
+	if r.ScanType != ScanReq && r.ScanType != ScanAllReq {
+		return ErrUnsupportedRequest
+	}
+
+	w := &localRowWriter{callback: callback, isPrimary: r.isPrimary,
+		decode: r.GroupAggr == nil}
+	scanPipeline := NewScanPipeline(r, w, is, ls.config)
+	cancelCb := NewCancelCallback(r, func(e error) {
+		scanPipeline.Cancel(e)
+	})
+	cancelCb.Run()
+	defer cancelCb.Done()
+
+	return scanPipeline.Execute()
+}
+
+//Count runs a count request on snapshot is.
+func (ls *LocalScanner) Count(is IndexSnapshot,
+	req *protobuf.CountRequest) (count uint64, err error) {
+
+	r, err := ls.newScanRequest(req)
+	if r != nil {
+		defer r.Done()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	stopch := make(StopChannel)
+	cancelCb := NewCancelCallback(r, func(e error) {
+		err = e
+		close(stopch)
+	})
+	cancelCb.Run()
+	defer cancelCb.Done()
+
+	snapshots, err := GetSliceSnapshots(is, r.PartitionIds)
+	if err != nil {
+		return 0, err
+	}
+
+	if r.ScanType == CountReq {
+		return scatterCount(r, snapshots, stopch)
+	}
+
+	previousRows := make([][]byte, len(snapshots))
+	for i := 0; i < len(previousRows); i++ {
+		buf := secKeyBufPool.Get()
+		r.keyBufList = append(r.keyBufList, buf)
+		previousRows[i] = (*buf)[:0]
+		r.Ctxs[i].SetCursorKey(&previousRows[i])
+	}
+	for _, scan := range r.Scans {
+		n, err := scatterMultiCount(r, scan, snapshots, previousRows, stopch)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+//newScanRequest prepares the scan request of a local index, the same way
+//NewScanRequest does for the scan coordinator.
+func (ls *LocalScanner) newScanRequest(protoReq interface{}) (r *ScanRequest, err error) {
+
+	r = new(ScanRequest)
+	r.ScanId = atomic.AddUint64(&ls.reqCounter, 1)
+	r.LogPrefix = fmt.Sprintf("LOCALSCAN##%d", r.ScanId)
+	r.projectPrimaryKey = true
+
+	timeout := time.Millisecond * time.Duration(ls.config["settings.scan_timeout"].Int())
+	if timeout != 0 {
+		r.ExpiredTime = time.Now().Add(timeout)
+		r.Timeout = time.NewTimer(timeout)
+	}
+
+	defn := ls.inst.Defn
+	r.DefnID = uint64(defn.DefnId)
+	r.IndexInstId = ls.inst.InstId
+	r.IndexName, r.Bucket = defn.Name, defn.Bucket
+	r.IndexInst = ls.inst
+	r.isPrimary = defn.IsPrimary
+	r.PartitionIds = []common.PartitionId{common.NON_PARTITION_ID}
+	r.Ctxs = []IndexReaderContext{ls.slice.GetReaderContext()}
+	r.Stats = ls.stats
+	if defn.Collation != nil && !r.isPrimary {
+		if r.collation, err = getCollation(defn.Collation); err != nil {
+			return
+		}
+	}
+
+	switch req := protoReq.(type) {
+	case *protobuf.CountRequest:
+		r.RequestId = req.GetRequestId()
+		r.ScanType = CountReq
+		r.Incl = Inclusion(req.GetSpan().GetRange().GetInclusion())
+		r.Sorted = true
+
+		err = r.fillRanges(
+			req.GetSpan().GetRange().GetLow(),
+			req.GetSpan().GetRange().GetHigh(),
+			req.GetSpan().GetEquals())
+		if err != nil {
+			return
+		}
+
+		if sc := req.GetScans(); len(sc) != 0 {
+			r.ScanType = MultiScanCountReq
+			r.Distinct = req.GetDistinct()
+			err = r.fillScans(sc)
+		}
+
+	case *protobuf.ScanRequest:
+		r.RequestId = req.GetRequestId()
+		r.ScanType = ScanReq
+		r.Incl = Inclusion(req.GetSpan().GetRange().GetInclusion())
+		r.Limit = req.GetLimit()
+		r.Sorted = req.GetSorted()
+		r.Reverse = req.GetReverse()
+		r.Offset = req.GetOffset()
+		proj := req.GetIndexprojection()
+		if proj == nil {
+			r.Distinct = req.GetDistinct()
+		} else if req.GetGroupAggr() == nil {
+			if r.Indexprojection, err = validateIndexProjection(proj, len(defn.SecExprs)); err != nil {
+				return
+			}
+			r.projectPrimaryKey = proj.GetPrimaryKey()
+		} else {
+			if r.Indexprojection, err = validateIndexProjectionGroupAggr(proj, req.GetGroupAggr()); err != nil {
+				return
+			}
+			r.projectPrimaryKey = false
+		}
+
+		err = r.fillRanges(
+			req.GetSpan().GetRange().GetLow(),
+			req.GetSpan().GetRange().GetHigh(),
+			req.GetSpan().GetEquals())
+		if err != nil {
+			return
+		}
+		if err = r.fillScans(req.GetScans()); err != nil {
+			return
+		}
+		err = r.fillGroupAggr(req.GetGroupAggr())
+
+	case *protobuf.ScanAllRequest:
+		r.RequestId = req.GetRequestId()
+		r.ScanType = ScanAllReq
+		r.Limit = req.GetLimit()
+		r.Scans = make([]Scan, 1)
+		r.Scans[0].ScanType = AllReq
+		r.Sorted = true
+
+	default:
+		err = ErrUnsupportedRequest
+	}
+
+	return
+}
+
+//localRowWriter is a ScanResponseWriter which passes the rows of a scan
+//pipeline to the callback of a local scan.
+type localRowWriter struct {
+	callback  func(docid, key []byte) error
+	isPrimary bool
+	decode    bool
+	buf       []byte
+}
+
+func (w *localRowWriter) Row(pk, sk []byte) error {
+	var key []byte
+	if !w.isPrimary {
+		key = sk
+		//rows of group aggregates are decoded by the pipeline
+		if w.decode {
+			if cap(w.buf) < len(sk)*3 {
+				w.buf = make([]byte, 0, len(sk)*3)
+			}
+			var err error
+			if key, err = jsonEncoder.Decode(sk, w.buf[:0]); err != nil {
+				return err
+			}
+		}
+	}
+	return w.callback(pk, key)
+}
+
+//Errors are returned by the scan pipeline
+func (w *localRowWriter) Error(err error) error                            { return nil }
+func (w *localRowWriter) Stats(rows, unique uint64, min, max []byte) error { return nil }
+func (w *localRowWriter) Count(count uint64) error                         { return nil }
+func (w *localRowWriter) RawBytes([]byte) error                            { return nil }
+func (w *localRowWriter) Cursor(cursor []byte) error                       { return nil }
+func (w *localRowWriter) Done() error                                      { return nil }
+func (w *localRowWriter) Helo() error                                      { return nil }
@@ -0,0 +1,344 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bytes"
+	"sync"
+	"unsafe"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/encryption"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/memdb"
+	"github.com/couchbase/indexing/secondary/memdb/nodetable"
+	"github.com/couchbase/indexing/secondary/memdb/skiplist"
+)
+
+//Fsck checks the main index at snapshot s against the back index. The
+//back index tables are read by the writers owning them, and entries
+//inserted or deleted after the snapshot are skipped. With repair, the
+//back index entries of the inconsistent docids are rewritten by their
+//writers from the main index entries at the snapshot.
+func (mdb *memdbSlice) Fsck(s Snapshot, repair bool) (*FsckReport, error) {
+
+	c, err := newFsckChecker(&mdb.idxDefn)
+	if err != nil {
+		return nil, err
+	}
+
+	mdb.IncrRef()
+	defer mdb.DecrRef()
+
+	//the iterator keeps the nodes deleted meanwhile from being freed
+	snap := s.(*memdbSnapshot).info.MainSnap
+	itr := mdb.mainstore.NewIterator(snap)
+	if itr == nil {
+		return nil, ErrSnapNotAvailable
+	}
+	defer itr.Close()
+
+	report := &FsckReport{SliceId: mdb.id}
+
+	var refs []memdbBackRef
+	if !mdb.isPrimary {
+		for i := 0; i < mdb.numWriters; i++ {
+			mdb.callWriter(i, func(workerId int) {
+				refs = append(refs, memdbBackIndexRefs(report, c, mdb.back[workerId], workerId)...)
+			})
+		}
+	}
+
+	affected := fsckMemDB(report, c, itr, snap, refs)
+
+	if repair && len(affected) > 0 {
+		report.Repaired = mdb.repairBackIndex(c, itr, snap, affected)
+		logging.Infof("MemDBSlice::Fsck SliceId %v IndexInstId %v Repaired %v "+
+			"back index entries", mdb.id, mdb.idxInstId, report.Repaired)
+	}
+
+	return report, nil
+}
+
+//callWriter queues call to the writer workerId and waits for it to be
+//called.
+func (mdb *memdbSlice) callWriter(workerId int, call sliceWriterCall) {
+
+	donech := make(chan bool)
+	mdb.cmdCh[workerId] <- indexMutation{
+		op: opCall,
+		call: func(workerId int) {
+			call(workerId)
+			close(donech)
+		},
+	}
+	<-donech
+}
+
+//repairBackIndex rewrites the back index entries of the affected docids
+//from their main index nodes at snap. The writer owning the entry of a
+//docid rewrites it, unless the docid has been mutated after snap.
+func (mdb *memdbSlice) repairBackIndex(c *fsckChecker, itr *memdb.Iterator,
+	snap *memdb.Snapshot, affected map[string]int) uint64 {
+
+	mdb.confLock.RLock()
+	numVbuckets := mdb.sysconf["numVbuckets"].Int()
+	mdb.confLock.RUnlock()
+
+	nodes := make(map[string][]*skiplist.Node)
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		docid, ok := fsckEntryDocId(itr.Get())
+		if !ok {
+			continue
+		}
+		if _, ok := affected[string(docid)]; ok {
+			nodes[string(docid)] = append(nodes[string(docid)], itr.GetNode())
+		}
+	}
+
+	repairs := make([]map[string][]*skiplist.Node, mdb.numWriters)
+	for docid, table := range affected {
+		ns := nodes[docid]
+		if len(ns) > 0 {
+			table = vbucketFromEntryBytes((*memdb.Item)(ns[0].Item()).Bytes(),
+				numVbuckets) % mdb.numWriters
+			//an entry per docid, keep the last one if there are more
+			if !c.isArray {
+				ns = ns[len(ns)-1:]
+			}
+		}
+		if table < 0 {
+			continue
+		}
+
+		if repairs[table] == nil {
+			repairs[table] = make(map[string][]*skiplist.Node)
+		}
+		repairs[table][docid] = ns
+	}
+
+	var count uint64
+	for i, rs := range repairs {
+		if len(rs) == 0 {
+			continue
+		}
+		mdb.callWriter(i, func(workerId int) {
+			for docid, ns := range rs {
+				if memdbRepairBackIndex(mdb.back[workerId], snap, []byte(docid), ns) {
+					count++
+				}
+			}
+		})
+	}
+	return count
+}
+
+//memdbRepairBackIndex replaces the back index entry of docid with the
+//main index nodes. It returns false if the docid has been mutated after
+//snap, in which case the entry is left as it is.
+func memdbRepairBackIndex(back *nodetable.NodeTable, snap *memdb.Snapshot,
+	docid []byte, nodes []*skiplist.Node) bool {
+
+	for _, node := range nodes {
+		if snap.ItemChanged((*memdb.Item)(node.Item())) {
+			return false
+		}
+	}
+
+	lookupentry := entryBytesFromDocId(docid)
+	head := (*skiplist.Node)(back.Get(lookupentry))
+	if head != nil && snap.ItemChanged((*memdb.Item)(head.Item())) {
+		return false
+	}
+
+	back.Remove(lookupentry)
+	for _, node := range nodes {
+		node.SetLink(nil)
+		memdbBackIndexAdd(back, node)
+	}
+	return true
+}
+
+//memdbBackIndexAdd adds a main index node to the back index entry of
+//its docid. It returns true if the docid already had an entry.
+func memdbBackIndexAdd(back *nodetable.NodeTable, node *skiplist.Node) bool {
+
+	entryBytes := (*memdb.Item)(node.Item()).Bytes()
+	updated, oldPtr := back.Update(entryBytes, unsafe.Pointer(node))
+	if updated {
+		oldNode := (*skiplist.Node)(oldPtr)
+		node.SetLink(oldNode)
+	}
+	return updated
+}
+
+//memdbBackRef is a main index node referred to by the back index entry
+//of a docid, nil if the entry is malformed.
+type memdbBackRef struct {
+	docid []byte
+	node  *skiplist.Node
+	table int
+}
+
+//memdbBackIndexRefs returns the main index nodes the back index table
+//refers to, and checks that they belong to the docid of their entry.
+func memdbBackIndexRefs(r *FsckReport, c *fsckChecker, back *nodetable.NodeTable,
+	table int) []memdbBackRef {
+
+	var refs []memdbBackRef
+	back.Range(func(p unsafe.Pointer) bool {
+		r.BackEntries++
+
+		node := (*skiplist.Node)(p)
+		if node == nil {
+			r.addError(&r.FormatErrors, "Empty back index entry")
+			return true
+		}
+
+		docid, ok := fsckEntryDocId((*memdb.Item)(node.Item()).Bytes())
+		if !ok {
+			r.addError(&r.FormatErrors, "Invalid back index entry")
+			return true
+		}
+		docid = append([]byte(nil), docid...)
+
+		for ; node != nil; node = node.GetLink() {
+			entry := (*memdb.Item)(node.Item()).Bytes()
+			if d, ok := fsckEntryDocId(entry); !ok || !bytes.Equal(d, docid) {
+				r.addError(&r.FormatErrors, "Back index entry of docid %q refers to "+
+					"entry %q", docid, entry)
+				refs = append(refs, memdbBackRef{docid: docid, table: table})
+			} else {
+				refs = append(refs, memdbBackRef{docid: docid, node: node, table: table})
+			}
+
+			if !c.isArray {
+				break
+			}
+		}
+		return true
+	})
+	return refs
+}
+
+//fsckMemDB checks the main index at snap, iterated by itr, against the
+//main index nodes the back index refers to. The nodes inserted or
+//deleted after snap are skipped. It returns the docids whose back index
+//entry doesn't match the main index, with the back index table of the
+//entry, -1 if the docid has none.
+func fsckMemDB(r *FsckReport, c *fsckChecker, itr *memdb.Iterator,
+	snap *memdb.Snapshot, refs []memdbBackRef) map[string]int {
+
+	affected := make(map[string]int)
+	if c.isPrimary {
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			c.checkMainEntry(r, itr.Get())
+		}
+		return affected
+	}
+
+	//every node the back index refers to must be in the main index
+	nodes := make(map[*skiplist.Node]bool, len(refs))
+	for _, ref := range refs {
+		if ref.node == nil {
+			affected[string(ref.docid)] = ref.table
+			continue
+		}
+
+		nodes[ref.node] = true
+		if snap.ItemChanged((*memdb.Item)(ref.node.Item())) {
+			continue
+		}
+		if !memdbHasNode(itr, ref.node) {
+			r.addError(&r.MissingMain, "Back index entry of docid %q refers to "+
+				"entry %q missing from the main index", ref.docid,
+				(*memdb.Item)(ref.node.Item()).Bytes())
+			affected[string(ref.docid)] = ref.table
+		}
+	}
+
+	//every main index entry must be referred to by the back index
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		docid := c.checkMainEntry(r, itr.Get())
+		if docid == nil {
+			continue
+		}
+
+		node := itr.GetNode()
+		if !nodes[node] && !snap.ItemChanged((*memdb.Item)(node.Item())) {
+			r.addError(&r.MissingBack, "Main index entry of docid %q is not in the back index", docid)
+			if _, ok := affected[string(docid)]; !ok {
+				affected[string(docid)] = -1
+			}
+		}
+	}
+
+	return affected
+}
+
+//memdbHasNode checks whether node is the main index node of its entry
+//in the snapshot itr iterates.
+func memdbHasNode(itr *memdb.Iterator, node *skiplist.Node) bool {
+	itr.Seek((*memdb.Item)(node.Item()).Bytes())
+	return itr.Valid() && itr.GetNode() == node
+}
+
+//FsckMemDBSnapshot checks the disk snapshot of a memdb slice of the index
+//defn, stored in dir. The back index isn't persisted, it is built from
+//the snapshot as when the slice is recovered, so that this checks the
+//entries of the main index and their docids.
+func FsckMemDBSnapshot(dir string, defn common.IndexDefn) (*FsckReport, error) {
+
+	c, err := newFsckChecker(&defn)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := memdb.DefaultConfig()
+	cfg.SetKeyComparator(byteItemCompare)
+	cfg.SetKeyProvider(encryption.GetKeyProvider())
+	store := memdb.NewWithConfig(cfg)
+	defer store.Close()
+
+	var table *nodetable.NodeTable
+	var callb memdb.ItemCallback
+	if !defn.IsPrimary {
+		var mu sync.Mutex
+		table = nodetable.New(hashDocId, nodeEquality)
+		defer table.Close()
+
+		callb = func(e *memdb.ItemEntry) {
+			mu.Lock()
+			defer mu.Unlock()
+			memdbBackIndexAdd(table, e.Node())
+		}
+	}
+
+	snap, err := store.LoadFromDisk(dir, 1, callb)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+
+	itr := store.NewIterator(snap)
+	if itr == nil {
+		return nil, ErrSnapNotAvailable
+	}
+	defer itr.Close()
+
+	report := &FsckReport{}
+
+	var refs []memdbBackRef
+	if table != nil {
+		refs = memdbBackIndexRefs(report, c, table, 0)
+	}
+	fsckMemDB(report, c, itr, snap, refs)
+	return report, nil
+}
@@ -29,6 +29,7 @@ import (
 
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/common/queryutil"
+	"github.com/couchbase/indexing/secondary/encryption"
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/memdb"
 	"github.com/couchbase/indexing/secondary/memdb/nodetable"
@@ -39,6 +40,7 @@ import (
 const (
 	opUpdate = iota
 	opDelete
+	opCall
 )
 
 const tmpDirName = ".tmp"
@@ -47,6 +49,7 @@ type indexMutation struct {
 	op    int
 	key   []byte
 	docid []byte
+	call  sliceWriterCall
 }
 
 func docIdFromEntryBytes(e []byte) []byte {
@@ -222,10 +225,12 @@ func NewMemDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 	slice.hasPersistence = hasPersistance
 	slice.initStores()
 
-	// Array related initialization
-	_, slice.isArrayDistinct, slice.arrayExprPosition, err = queryutil.GetArrayExpressionPosition(idxDefn.SecExprs)
-	if err != nil {
-		return nil, err
+	// Array related initialization, JavaScript expressions are not array keys
+	if !idxDefn.IsJavaScript() {
+		_, slice.isArrayDistinct, slice.arrayExprPosition, err = queryutil.GetArrayExpressionPosition(idxDefn.SecExprs)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	logging.Infof("MemDBSlice:NewMemDBSlice Created New Slice Id %v IndexInstId %v "+
@@ -252,6 +257,7 @@ func (slice *memdbSlice) initStores() {
 	}
 
 	cfg.SetKeyComparator(byteItemCompare)
+	cfg.SetKeyProvider(encryption.GetKeyProvider())
 	slice.mainstore = memdb.NewWithConfig(cfg)
 	slice.main = make([]*memdb.Writer, slice.numWriters)
 	for i := 0; i < slice.numWriters; i++ {
@@ -330,6 +336,11 @@ loop:
 				elapsed = time.Since(start)
 				mdb.totalFlushTime += elapsed
 
+			case opCall:
+				//not a mutation, not counted in the stats
+				icmd.call(workerId)
+				continue loop
+
 			default:
 				logging.Errorf("MemDBSlice::handleCommandsWorker \n\tSliceId %v IndexInstId %v Received "+
 					"Unknown Command %v", mdb.id, mdb.idxInstId, logging.TagUD(icmd))
@@ -667,7 +678,12 @@ func (mdb *memdbSlice) OpenSnapshot(info SnapshotInfo) (Snapshot, error) {
 	}
 
 	if s.info.MainSnap == nil {
-		err = mdb.loadSnapshot(s.info)
+		if err = mdb.loadSnapshot(s.info); err != nil {
+			//no memdb snapshot to close, only release the slice
+			s.slice.DecrRef()
+			return nil, err
+		}
+		s.ts = s.info.Timestamp()
 	}
 
 	if info.IsCommitted() {
@@ -864,16 +880,52 @@ func (mdb *memdbSlice) Rollback(info SnapshotInfo) error {
 	return nil
 }
 
+//loadSnapshot recovers the slice from the disk snapshot. A snapshot found
+//corrupted is removed and the next older snapshot is loaded instead, in
+//which case snapInfo is updated to the snapshot actually loaded. If the
+//slice cannot be recovered, the snapshot is removed and an error returned,
+//the indexer restarts and rebuilds the index.
 func (mdb *memdbSlice) loadSnapshot(snapInfo *memdbSnapshotInfo) (err error) {
 	defer func() {
-		if r := recover(); r != nil || err != nil {
-			logging.Errorf("MemDBSlice::loadSnapshot Slice Id %v, IndexInstId %v failed to recover from the snapshot %v (err=%v,%v)",
-				mdb.id, mdb.idxInstId, snapInfo.dataPath, r, err)
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		if err != nil {
+			logging.Errorf("MemDBSlice::loadSnapshot Slice Id %v, IndexInstId %v failed to recover from the snapshot %v (err=%v)",
+				mdb.id, mdb.idxInstId, snapInfo.dataPath, err)
 			os.RemoveAll(snapInfo.dataPath)
-			os.Exit(1)
 		}
 	}()
 
+	for {
+		if err = mdb.doLoadSnapshot(snapInfo); err != memdb.ErrCorruptSnapshot {
+			return
+		}
+
+		mdb.idxStats.numCorruptSnapshots.Add(1)
+		mdb.confLock.RLock()
+		clusterAddr := mdb.sysconf["clusterAddr"].String()
+		mdb.confLock.RUnlock()
+		common.Console(clusterAddr, "Index snapshot %v of index instance %v is corrupted "+
+			"and has been removed.", snapInfo.dataPath, mdb.idxInstId)
+
+		os.RemoveAll(snapInfo.dataPath)
+		mdb.resetStores()
+
+		infos, gerr := mdb.GetSnapshots()
+		if gerr != nil || len(infos) == 0 {
+			//no older snapshot left, index gets rebuilt after restart
+			return
+		}
+
+		logging.Warnf("MemDBSlice::loadSnapshot Slice Id %v, IndexInstId %v snapshot %v is "+
+			"corrupted. Falling back to snapshot %v", mdb.id, mdb.idxInstId, snapInfo.dataPath,
+			infos[0].(*memdbSnapshotInfo).dataPath)
+		*snapInfo = *infos[0].(*memdbSnapshotInfo)
+	}
+}
+
+func (mdb *memdbSlice) doLoadSnapshot(snapInfo *memdbSnapshotInfo) (err error) {
 	var wg sync.WaitGroup
 	var backIndexCallback memdb.ItemCallback
 	mdb.confLock.RLock()
@@ -894,11 +946,7 @@ func (mdb *memdbSlice) loadSnapshot(snapInfo *memdbSnapshotInfo) (err error) {
 				defer wg.Done()
 				for entry := range partShardCh[i] {
 					if !mdb.isPrimary {
-						entryBytes := entry.Item().Bytes()
-						if updated, oldPtr := mdb.back[i].Update(entryBytes, unsafe.Pointer(entry.Node())); updated {
-							oldNode := (*skiplist.Node)(oldPtr)
-							entry.Node().SetLink(oldNode)
-						}
+						memdbBackIndexAdd(mdb.back[i], entry.Node())
 					}
 				}
 			}(wId, &wg)
@@ -986,13 +1034,13 @@ func (mdb *memdbSlice) NewSnapshot(ts *common.TsVbuuid, commit bool) (SnapshotIn
 		common.CrashOnError(errors.New("Slice Invariant Violation - commit with pending mutations"))
 	}
 
-	mdb.isDirty = false
-
+	//memdb.ErrMaxSnapshotsLimitReached is returned to the caller, the
+	//indexer restarts on it
 	snap, err := mdb.mainstore.NewSnapshot()
-	if err == memdb.ErrMaxSnapshotsLimitReached {
-		logging.Warnf("Maximum snapshots limit reached for indexer. Restarting indexer...")
-		os.Exit(0)
+	if err != nil {
+		return nil, err
 	}
+	mdb.isDirty = false
 
 	newSnapshotInfo := &memdbSnapshotInfo{
 		Ts:        ts,
@@ -1001,7 +1049,7 @@ func (mdb *memdbSlice) NewSnapshot(ts *common.TsVbuuid, commit bool) (SnapshotIn
 	}
 	mdb.setCommittedCount()
 
-	return newSnapshotInfo, err
+	return newSnapshotInfo, nil
 }
 
 //checkAllWorkersDone return true if all workers have
@@ -1286,6 +1334,14 @@ func (s *memdbSnapshot) StatCountTotal() (uint64, error) {
 	return c, nil
 }
 
+func (s *memdbSnapshot) RangeSplitEntries(n int) [][]byte {
+	return s.info.MainSnap.GetRangeSplitItems(n)
+}
+
+func (s *memdbSnapshot) NewReaderContext() IndexReaderContext {
+	return s.slice.GetReaderContext()
+}
+
 func (s *memdbSnapshot) CountTotal(ctx IndexReaderContext, stopch StopChannel) (uint64, error) {
 	return uint64(s.info.MainSnap.Count()), nil
 }
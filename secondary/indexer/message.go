@@ -59,6 +59,7 @@ const (
 	TK_MERGE_STREAM
 	TK_MERGE_STREAM_ACK
 	TK_GET_BUCKET_HWT
+	TK_FLUSH_BARRIER
 
 	//STORAGE_MANAGER
 	STORAGE_MGR_SHUTDOWN
@@ -68,6 +69,7 @@ const (
 	STORAGE_SNAP_DONE
 	STORAGE_INDEX_MERGE_SNAPSHOT
 	STORAGE_INDEX_PRUNE_SNAPSHOT
+	STORAGE_DISK_STATE
 
 	//KVSender
 	KV_SENDER_SHUTDOWN
@@ -126,6 +128,8 @@ const (
 	INDEXER_UPDATE_RSTATE
 	INDEXER_MERGE_PARTITION
 	INDEXER_CANCEL_MERGE_PARTITION
+	INDEXER_PAUSE_INDEX
+	INDEXER_RESUME_INDEX
 
 	//SCAN COORDINATOR
 	SCAN_COORD_SHUTDOWN
@@ -781,6 +785,42 @@ func (m *MsgCancelMergePartition) GetString() string {
 	return str
 }
 
+//INDEXER_PAUSE_INDEX
+//INDEXER_RESUME_INDEX
+//Pauses or resumes the maintenance of an index hosted by this node.
+//The result of the request is sent on respCh.
+type MsgPauseIndex struct {
+	mType  MsgType
+	bucket string
+	name   string
+	respCh chan error
+}
+
+func (m *MsgPauseIndex) GetMsgType() MsgType {
+	return m.mType
+}
+
+func (m *MsgPauseIndex) GetBucket() string {
+	return m.bucket
+}
+
+func (m *MsgPauseIndex) GetIndexName() string {
+	return m.name
+}
+
+func (m *MsgPauseIndex) GetResponseChannel() chan error {
+	return m.respCh
+}
+
+func (m *MsgPauseIndex) String() string {
+
+	str := "\n\tMessage: MsgPauseIndex"
+	str += fmt.Sprintf("\n\tType: %v", m.mType)
+	str += fmt.Sprintf("\n\tBucket: %v", m.bucket)
+	str += fmt.Sprintf("\n\tIndex: %v", m.name)
+	return str
+}
+
 // CLUST_MGR_DROP_INSTANCE
 type MsgClustMgrDropInstance struct {
 	defn common.IndexDefn
@@ -1032,6 +1072,72 @@ func (m *MsgBucketHWT) String() string {
 
 }
 
+type FlushBarrierOp int
+
+const (
+	FLUSH_BARRIER_GET_TS FlushBarrierOp = iota
+	FLUSH_BARRIER_SET
+	FLUSH_BARRIER_RELEASE
+)
+
+func (op FlushBarrierOp) String() string {
+	switch op {
+	case FLUSH_BARRIER_GET_TS:
+		return "getTs"
+	case FLUSH_BARRIER_SET:
+		return "set"
+	case FLUSH_BARRIER_RELEASE:
+		return "release"
+	default:
+		return "unknown"
+	}
+}
+
+//TK_FLUSH_BARRIER
+//Gets a ts for, sets or releases the flush barrier of a bucket in
+//MAINT_STREAM. The ts or an error is sent on respch.
+type MsgFlushBarrier struct {
+	op      FlushBarrierOp
+	bucket  string
+	ts      *common.TsVbuuid
+	timeout time.Duration
+	respch  chan interface{}
+}
+
+func (m *MsgFlushBarrier) GetMsgType() MsgType {
+	return TK_FLUSH_BARRIER
+}
+
+func (m *MsgFlushBarrier) GetOp() FlushBarrierOp {
+	return m.op
+}
+
+func (m *MsgFlushBarrier) GetBucket() string {
+	return m.bucket
+}
+
+func (m *MsgFlushBarrier) GetTS() *common.TsVbuuid {
+	return m.ts
+}
+
+func (m *MsgFlushBarrier) GetTimeout() time.Duration {
+	return m.timeout
+}
+
+func (m *MsgFlushBarrier) GetReplyChannel() chan interface{} {
+	return m.respch
+}
+
+func (m *MsgFlushBarrier) String() string {
+
+	str := "\n\tMessage: MsgFlushBarrier"
+	str += fmt.Sprintf("\n\tOp: %v", m.op)
+	str += fmt.Sprintf("\n\tBucket: %v", m.bucket)
+	str += fmt.Sprintf("\n\tTS: %v", m.ts)
+	return str
+
+}
+
 //KV_SENDER_RESTART_VBUCKETS
 type MsgRestartVbuckets struct {
 	streamId   common.StreamId
@@ -1192,6 +1298,10 @@ type MsgIndexSnapRequest struct {
 	idxInstId   common.IndexInstId
 	expiredTime time.Time
 
+	// Request a retained snapshot
+	asOfTime int64
+	asOfTs   *common.TsVbuuid
+
 	// Send error or index snapshot
 	respch chan interface{}
 }
@@ -1220,6 +1330,18 @@ func (m *MsgIndexSnapRequest) GetIndexId() common.IndexInstId {
 	return m.idxInstId
 }
 
+func (m *MsgIndexSnapRequest) GetAsOfTime() int64 {
+	return m.asOfTime
+}
+
+func (m *MsgIndexSnapRequest) GetAsOfTS() *common.TsVbuuid {
+	return m.asOfTs
+}
+
+func (m *MsgIndexSnapRequest) IsAsOf() bool {
+	return m.asOfTime != 0 || m.asOfTs != nil
+}
+
 type MsgIndexMergeSnapshot struct {
 	srcInstId  common.IndexInstId
 	tgtInstId  common.IndexInstId
@@ -1259,6 +1381,24 @@ func (m *MsgIndexPruneSnapshot) GetPartitions() []common.PartitionId {
 	return m.partitions
 }
 
+//STORAGE_DISK_STATE
+type MsgDiskState struct {
+	state    DiskState
+	usedFrac float64
+}
+
+func (m *MsgDiskState) GetMsgType() MsgType {
+	return STORAGE_DISK_STATE
+}
+
+func (m *MsgDiskState) GetState() DiskState {
+	return m.state
+}
+
+func (m *MsgDiskState) GetUsedFraction() float64 {
+	return m.usedFrac
+}
+
 type MsgIndexStorageStats struct {
 	respch chan []IndexStorageStats
 }
@@ -1575,6 +1715,8 @@ func (m MsgType) String() string {
 		return "TK_MERGE_STREAM_ACK"
 	case TK_GET_BUCKET_HWT:
 		return "TK_GET_BUCKET_HWT"
+	case TK_FLUSH_BARRIER:
+		return "TK_FLUSH_BARRIER"
 	case REPAIR_ABORT:
 		return "REPAIR_ABORT"
 
@@ -1633,6 +1775,10 @@ func (m MsgType) String() string {
 		return "INDEXER_MERGE_PARTITION"
 	case INDEXER_CANCEL_MERGE_PARTITION:
 		return "INDEXER_CANCEL_MERGE_PARTITION"
+	case INDEXER_PAUSE_INDEX:
+		return "INDEXER_PAUSE_INDEX"
+	case INDEXER_RESUME_INDEX:
+		return "INDEXER_RESUME_INDEX"
 
 	case SCAN_COORD_SHUTDOWN:
 		return "SCAN_COORD_SHUTDOWN"
@@ -1710,6 +1856,8 @@ func (m MsgType) String() string {
 		return "STORAGE_INDEX_MERGE_SNAPSHOT"
 	case STORAGE_INDEX_PRUNE_SNAPSHOT:
 		return "STORAGE_INDEX_PRUNE_SNAPSHOT"
+	case STORAGE_DISK_STATE:
+		return "STORAGE_DISK_STATE"
 
 	case CONFIG_SETTINGS_UPDATE:
 		return "CONFIG_SETTINGS_UPDATE"
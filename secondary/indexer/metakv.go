@@ -16,7 +16,7 @@ package indexer
 
 import (
 	"encoding/json"
-	"github.com/couchbase/cbauth/metakv"
+	"github.com/couchbase/indexing/secondary/common/metakv"
 	"github.com/couchbase/indexing/secondary/logging"
 )
 
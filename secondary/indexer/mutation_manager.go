@@ -11,6 +11,8 @@ package indexer
 
 import (
 	"errors"
+	"fmt"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 
@@ -33,6 +35,8 @@ type mutationMgr struct {
 	memUsed   int64 //memory used by queue
 	maxMemory int64 //max memory to be used
 
+	spillStats QueueSpillStats //stats of queue spill files
+
 	streamBucketQueueMap map[common.StreamId]BucketQueueMap
 	streamIndexQueueMap  map[common.StreamId]IndexQueueMap
 
@@ -366,7 +370,7 @@ func (m *mutationMgr) handleOpenStream(cmd Message) {
 		if _, ok := bucketQueueMap[i.Defn.Bucket]; !ok {
 			//init mutation queue
 			var queue MutationQueue
-			if queue = NewAtomicMutationQueue(i.Defn.Bucket, m.numVbuckets, &m.maxMemory, &m.memUsed, m.config); queue == nil {
+			if queue = m.newMutationQueue(streamId, i.Defn.Bucket); queue == nil {
 				m.supvCmdch <- &MsgError{
 					err: Error{code: ERROR_MUTATION_QUEUE_INIT,
 						severity: FATAL,
@@ -441,6 +445,29 @@ func (m *mutationMgr) handleAddIndexListToStream(cmd Message) {
 
 }
 
+//newMutationQueue creates the mutation queue of a bucket for the stream,
+//with spill to disk if enabled in config
+func (m *mutationMgr) newMutationQueue(streamId common.StreamId,
+	bucket string) *atomicMutationQueue {
+
+	queue := NewAtomicMutationQueue(bucket, m.numVbuckets, &m.maxMemory, &m.memUsed, m.config)
+	if queue == nil || !m.config["mutation_queue.spill.enabled"].Bool() {
+		return queue
+	}
+
+	dir := m.config["mutation_queue.spill.dir"].String()
+	if dir == "" {
+		dir = filepath.Join(m.config["storage_dir"].String(), "mutation_queue")
+	}
+	dir = filepath.Join(dir, fmt.Sprintf("%v_%v", streamId, bucket))
+
+	if err := queue.EnableSpill(dir, &m.spillStats); err != nil {
+		logging.Errorf("MutationMgr::newMutationQueue Error Enabling Spill "+
+			"Stream %v Bucket %v Dir %v. Err %v", streamId, bucket, dir, err)
+	}
+	return queue
+}
+
 func (m *mutationMgr) addIndexListToExistingStream(streamId common.StreamId,
 	indexList []common.IndexInst, bucketFilter map[string]*common.TsVbuuid) Message {
 
@@ -453,7 +480,7 @@ func (m *mutationMgr) addIndexListToExistingStream(streamId common.StreamId,
 		if _, ok := bucketQueueMap[i.Defn.Bucket]; !ok {
 			//init mutation queue
 			var queue MutationQueue
-			if queue = NewAtomicMutationQueue(i.Defn.Bucket, m.numVbuckets, &m.maxMemory, &m.memUsed, m.config); queue == nil {
+			if queue = m.newMutationQueue(streamId, i.Defn.Bucket); queue == nil {
 				return &MsgError{
 					err: Error{code: ERROR_MUTATION_QUEUE_INIT,
 						severity: FATAL,
@@ -870,6 +897,8 @@ func (m *mutationMgr) persistMutationQueue(q IndexerMutationQueue,
 		}()
 
 		stats.memoryUsedQueue.Set(atomic.LoadInt64(&m.memUsed))
+		stats.spilledBytesQueue.Set(m.spillStats.SpilledBytes())
+		stats.diskUsedQueue.Set(m.spillStats.DiskUsed())
 
 		//send the response to supervisor
 		if msg.GetMsgType() == MSG_SUCCESS {
@@ -82,6 +82,10 @@ type atomicMutationQueue struct {
 	isDestroyed bool
 
 	bucket string
+
+	spill      []*vbSpill //spill file per vbucket queue, nil if not enabled
+	spillDir   string
+	spillStats *QueueSpillStats
 }
 
 //NewAtomicMutationQueue allocates a new Atomic Mutation Queue and initializes it
@@ -141,8 +145,21 @@ func (q *atomicMutationQueue) Enqueue(mutation *MutationKeys,
 		return nil
 	}
 
-	//create a new node
-	n := q.allocNode(vbucket, appch)
+	//create a new node, or spill the mutation if memory is not available
+	var n *node
+	if q.spill != nil {
+		var spilled bool
+		if n, spilled = q.allocOrSpill(mutation, vbucket); spilled {
+			atomic.AddInt64(&q.size[vbucket], 1)
+			return nil
+		}
+		if n == nil && !q.waitSpillDrain(vbucket, appch) {
+			return nil
+		}
+	}
+	if n == nil {
+		n = q.allocNode(vbucket, appch)
+	}
 	if n == nil {
 		return nil
 	}
@@ -198,19 +215,10 @@ func (q *atomicMutationQueue) dequeueUptoSeqno(vbucket Vbucket, seqno Seqno,
 					q.bucket, vbucket, totalWait, dequeueSeq)
 			}
 		}
-		for atomic.LoadPointer(&q.head[vbucket]) !=
-			atomic.LoadPointer(&q.tail[vbucket]) { //if queue is nonempty
+		for m := q.peekNext(vbucket); m != nil; m = q.peekNext(vbucket) { //if queue is nonempty
 
-			head := (*node)(atomic.LoadPointer(&q.head[vbucket]))
-			//copy the mutation pointer
-			m := head.next.mutation
 			if seqno >= m.meta.seqno {
-				//free mutation pointer
-				head.next.mutation = nil
-				//move head to next
-				atomic.StorePointer(&q.head[vbucket], unsafe.Pointer(head.next))
-				atomic.AddInt64(&q.size[vbucket], -1)
-				atomic.AddInt64(q.memUsed, -m.Size())
+				q.DequeueSingleElement(vbucket)
 				//send mutation to caller
 				dequeueSeq = m.meta.seqno
 				datach <- m
@@ -275,6 +283,22 @@ func (q *atomicMutationQueue) dequeue(vbucket Vbucket, datach chan *MutationKeys
 
 }
 
+//peekNext returns reference to the mutation that will be dequeued next,
+//without dequeue. Returns nil in case of empty queue.
+func (q *atomicMutationQueue) peekNext(vbucket Vbucket) *MutationKeys {
+
+	if atomic.LoadPointer(&q.head[vbucket]) !=
+		atomic.LoadPointer(&q.tail[vbucket]) { //if queue is nonempty
+
+		head := (*node)(atomic.LoadPointer(&q.head[vbucket]))
+		return head.next.mutation
+	}
+	if q.spill != nil {
+		return q.peekSpill(vbucket)
+	}
+	return nil
+}
+
 //DequeueSingleElement dequeues a single element and returns.
 //Returns nil in case of empty queue.
 func (q *atomicMutationQueue) DequeueSingleElement(vbucket Vbucket) *MutationKeys {
@@ -293,11 +317,20 @@ func (q *atomicMutationQueue) DequeueSingleElement(vbucket Vbucket) *MutationKey
 		atomic.AddInt64(q.memUsed, -m.Size())
 		return m
 	}
+	//spilled mutations are newer than the ones in memory
+	if q.spill != nil {
+		return q.dequeueSpill(vbucket)
+	}
 	return nil
 }
 
 //PeekTail returns reference to a vbucket's mutation at tail of queue without dequeue
 func (q *atomicMutationQueue) PeekTail(vbucket Vbucket) *MutationKeys {
+	if q.spill != nil {
+		if m := q.peekSpillTail(vbucket); m != nil {
+			return m
+		}
+	}
 	if atomic.LoadPointer(&q.head[vbucket]) !=
 		atomic.LoadPointer(&q.tail[vbucket]) { //if queue is nonempty
 		tail := (*node)(atomic.LoadPointer(&q.tail[vbucket]))
@@ -313,6 +346,9 @@ func (q *atomicMutationQueue) PeekHead(vbucket Vbucket) *MutationKeys {
 		head := (*node)(atomic.LoadPointer(&q.head[vbucket]))
 		return head.mutation
 	}
+	if q.spill != nil {
+		return q.peekSpill(vbucket)
+	}
 	return nil
 }
 
@@ -426,6 +462,11 @@ func (q *atomicMutationQueue) Destroy() {
 		close(q.stopch[i])
 	}
 
+	//spilled mutations are not read back
+	if q.spill != nil {
+		q.destroySpill()
+	}
+
 	//dequeue all the items in the queue and free
 	for i = 0; i < q.numVbuckets; i++ {
 		mutch := make(chan *MutationKeys)
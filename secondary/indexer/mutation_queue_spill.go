@@ -0,0 +1,398 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package indexer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//Mutation queue overflow to disk.
+//
+//When the queue memory is exhausted, instead of blocking the stream reader,
+//mutations of a vbucket are appended to a spill file of the vbucket. Once a
+//vbucket has spilled, all its following mutations are spilled as well, till
+//the reader has dequeued all the spilled mutations. Mutations in memory are
+//always older than the spilled ones, so the reader dequeues from memory first
+//and then from the spill file, in the order they were enqueued.
+//
+//Each spilled mutation is a record of
+//    len(payload) uint32 | crc32(payload) uint32 | payload
+//and the file is truncated whenever all its records have been dequeued.
+
+var errSpillCorrupted = errors.New("mutation queue spill file is corrupted")
+
+//QueueSpillStats are the stats of spill files, shared by all the mutation
+//queues of the mutation manager
+type QueueSpillStats struct {
+	spilledBytes int64 //bytes spilled to disk since start
+	diskUsed     int64 //bytes spilled to disk, not yet dequeued
+}
+
+func (s *QueueSpillStats) SpilledBytes() int64 {
+	return atomic.LoadInt64(&s.spilledBytes)
+}
+
+func (s *QueueSpillStats) DiskUsed() int64 {
+	return atomic.LoadInt64(&s.diskUsed)
+}
+
+//vbSpill is the spill file of a vbucket queue. It is accessed by the
+//single writer and reader of the vbucket queue under a lock.
+type vbSpill struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File //opened on first spill
+	woff  int64    //offset of next record to write
+	roff  int64    //offset of next record to read
+	count int64    //records written and not yet dequeued
+
+	head *MutationKeys //next record, read but not yet dequeued
+	hoff int64         //offset after head record
+	tail *MutationKeys //meta of last record written, for PeekTail
+
+	wbuf []byte
+	rbuf []byte
+}
+
+//EnableSpill enables overflow of the queue to spill files in directory dir,
+//removing any file left over from a previous run
+func (q *atomicMutationQueue) EnableSpill(dir string, stats *QueueSpillStats) error {
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	q.spill = make([]*vbSpill, q.numVbuckets)
+	for i := range q.spill {
+		q.spill[i] = &vbSpill{path: filepath.Join(dir, fmt.Sprintf("vb_%v.spill", i))}
+	}
+	q.spillDir = dir
+	q.spillStats = stats
+
+	logging.Infof("Indexer::MutationQueue Spill Enabled Bucket %v Dir %v", q.bucket, dir)
+	return nil
+}
+
+//allocOrSpill returns a node for the mutation if the vbucket has not spilled
+//and memory is available, else it spills the mutation and returns true.
+//Returns false without a node if the mutation could not be spilled.
+func (q *atomicMutationQueue) allocOrSpill(mutation *MutationKeys,
+	vbucket Vbucket) (*node, bool) {
+
+	s := q.spill[vbucket]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.count == 0 {
+		if n := q.checkMemAndAlloc(vbucket); n != nil {
+			return n, false
+		}
+	}
+
+	n, err := s.write(mutation)
+	if err != nil {
+		logging.Errorf("Indexer::MutationQueue Error Spilling Mutation Bucket %v "+
+			"Vbucket %v Path %v. Err %v", q.bucket, vbucket, s.path, err)
+		return nil, false
+	}
+
+	atomic.AddInt64(&q.spillStats.spilledBytes, n)
+	atomic.AddInt64(&q.spillStats.diskUsed, n)
+	mutation.Free()
+	return nil, true
+}
+
+//waitSpillDrain waits till all the spilled mutations of the vbucket are
+//dequeued, so that a mutation which failed to spill can be queued in memory
+//without reordering. Returns false if the queue is destroyed.
+func (q *atomicMutationQueue) waitSpillDrain(vbucket Vbucket, appch StopChannel) bool {
+
+	s := q.spill[vbucket]
+
+	ticker := time.NewTicker(time.Millisecond * time.Duration(q.allocPollInterval))
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		count := s.count
+		s.mu.Unlock()
+		if count == 0 {
+			return true
+		}
+
+		select {
+		case <-ticker.C:
+		case <-q.stopch[vbucket]:
+			return false
+		case <-appch:
+			//caller no longer wants to wait
+			return true
+		}
+	}
+}
+
+//peekSpill returns the next spilled mutation of the vbucket, without
+//dequeuing it. Returns nil if there is no spilled mutation.
+func (q *atomicMutationQueue) peekSpill(vbucket Vbucket) *MutationKeys {
+
+	s := q.spill[vbucket]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return q.readSpillHead(vbucket, s)
+}
+
+//dequeueSpill dequeues the next spilled mutation of the vbucket. Returns nil
+//if there is no spilled mutation.
+func (q *atomicMutationQueue) dequeueSpill(vbucket Vbucket) *MutationKeys {
+
+	s := q.spill[vbucket]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := q.readSpillHead(vbucket, s)
+	if m == nil {
+		return nil
+	}
+
+	atomic.AddInt64(&q.spillStats.diskUsed, -(s.hoff - s.roff))
+	s.head, s.roff = nil, s.hoff
+	s.count--
+	atomic.AddInt64(&q.size[vbucket], -1)
+
+	if s.count == 0 {
+		//all records are dequeued, reclaim the disk space
+		if err := s.file.Truncate(0); err != nil {
+			logging.Errorf("Indexer::MutationQueue Error Truncating Spill File %v. Err %v",
+				s.path, err)
+		} else {
+			s.woff, s.roff, s.hoff = 0, 0, 0
+		}
+		s.tail = nil
+	}
+	return m
+}
+
+func (q *atomicMutationQueue) readSpillHead(vbucket Vbucket, s *vbSpill) *MutationKeys {
+
+	if s.count == 0 || s.head != nil {
+		return s.head
+	}
+
+	m, off, err := s.read(q.bucket, vbucket)
+	if err != nil {
+		//mutations cannot be skipped, the stream has to be restarted
+		logging.Fatalf("Indexer::MutationQueue Error Reading Spill File %v "+
+			"Offset %v. Err %v", s.path, s.roff, err)
+		common.CrashOnError(err)
+	}
+	s.head, s.hoff = m, off
+	return m
+}
+
+//peekSpillTail returns the meta of the last spilled mutation of the vbucket,
+//nil if there is no spilled mutation
+func (q *atomicMutationQueue) peekSpillTail(vbucket Vbucket) *MutationKeys {
+
+	s := q.spill[vbucket]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tail
+}
+
+//destroySpill removes all spill files of the queue
+func (q *atomicMutationQueue) destroySpill() {
+
+	for i, s := range q.spill {
+		s.mu.Lock()
+		if s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+		atomic.AddInt64(&q.spillStats.diskUsed, -(s.woff - s.roff))
+		atomic.AddInt64(&q.size[i], -s.count)
+		s.count, s.woff, s.roff, s.head, s.tail = 0, 0, 0, nil, nil
+		s.mu.Unlock()
+	}
+
+	if err := os.RemoveAll(q.spillDir); err != nil {
+		logging.Errorf("Indexer::MutationQueue Error Removing Spill Dir %v. Err %v",
+			q.spillDir, err)
+	}
+}
+
+//write appends the mutation to the spill file and returns the bytes written
+func (s *vbSpill) write(mk *MutationKeys) (int64, error) {
+
+	if s.file == nil {
+		file, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+	}
+
+	buf := append(s.wbuf[:0], make([]byte, 8)...)
+	buf = encodeSpilledMutation(buf, mk)
+	payload := buf[8:]
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	s.wbuf = buf
+
+	if _, err := s.file.WriteAt(buf, s.woff); err != nil {
+		return 0, err
+	}
+
+	s.woff += int64(len(buf))
+	s.count++
+	s.tail = &MutationKeys{meta: mk.meta.Clone()}
+	return int64(len(buf)), nil
+}
+
+//read decodes the record at read offset, and returns the offset after it
+func (s *vbSpill) read(bucket string, vbucket Vbucket) (*MutationKeys, int64, error) {
+
+	var hdr [8]byte
+	if _, err := s.file.ReadAt(hdr[:], s.roff); err != nil {
+		return nil, 0, err
+	}
+
+	size := int(binary.BigEndian.Uint32(hdr[0:4]))
+	if cap(s.rbuf) < size {
+		s.rbuf = make([]byte, size)
+	}
+	payload := s.rbuf[:size]
+	if _, err := s.file.ReadAt(payload, s.roff+8); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, 0, errSpillCorrupted
+	}
+
+	mk, err := decodeSpilledMutation(payload, bucket, vbucket)
+	if err != nil {
+		return nil, 0, err
+	}
+	return mk, s.roff + 8 + int64(size), nil
+}
+
+//encodeSpilledMutation appends the encoded mutation to buf. Bucket and
+//vbucket of the mutation are those of the queue and are not encoded.
+func encodeSpilledMutation(buf []byte, mk *MutationKeys) []byte {
+
+	var scratch [8]byte
+
+	putUint64 := func(v uint64) {
+		binary.BigEndian.PutUint64(scratch[:], v)
+		buf = append(buf, scratch[:8]...)
+	}
+	putBytes := func(b []byte) {
+		binary.BigEndian.PutUint32(scratch[:], uint32(len(b)))
+		buf = append(buf, scratch[:4]...)
+		buf = append(buf, b...)
+	}
+
+	putUint64(uint64(mk.meta.vbuuid))
+	putUint64(uint64(mk.meta.seqno))
+	if mk.meta.firstSnap {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	putBytes(mk.docid)
+
+	binary.BigEndian.PutUint32(scratch[:], uint32(len(mk.mut)))
+	buf = append(buf, scratch[:4]...)
+	for _, m := range mk.mut {
+		putUint64(uint64(m.uuid))
+		buf = append(buf, m.command)
+		putBytes(m.key)
+		putBytes(m.oldkey)
+		putBytes(m.partnkey)
+	}
+	return buf
+}
+
+func decodeSpilledMutation(payload []byte, bucket string,
+	vbucket Vbucket) (mk *MutationKeys, err error) {
+
+	defer func() {
+		if r := recover(); r != nil { //out of range
+			mk, err = nil, errSpillCorrupted
+		}
+	}()
+
+	getUint64 := func() uint64 {
+		v := binary.BigEndian.Uint64(payload[:8])
+		payload = payload[8:]
+		return v
+	}
+	getByte := func() byte {
+		v := payload[0]
+		payload = payload[1:]
+		return v
+	}
+	getBytes := func() []byte {
+		n := int(binary.BigEndian.Uint32(payload[:4]))
+		if n == 0 {
+			payload = payload[4:]
+			return nil
+		}
+		b := append([]byte(nil), payload[4:4+n]...)
+		payload = payload[4+n:]
+		return b
+	}
+
+	meta := NewMutationMeta()
+	meta.bucket = bucket
+	meta.vbucket = vbucket
+	meta.vbuuid = Vbuuid(getUint64())
+	meta.seqno = Seqno(getUint64())
+	meta.firstSnap = getByte() == 1
+
+	mk = NewMutationKeys()
+	mk.meta = meta
+	mk.docid = getBytes()
+
+	nmut := int(binary.BigEndian.Uint32(payload[:4]))
+	payload = payload[4:]
+	for i := 0; i < nmut; i++ {
+		m := NewMutation()
+		m.uuid = common.IndexInstId(getUint64())
+		m.command = getByte()
+		m.key = getBytes()
+		m.oldkey = getBytes()
+		m.partnkey = getBytes()
+		mk.mut = append(mk.mut, m)
+	}
+	if len(payload) != 0 {
+		return nil, errSpillCorrupted
+	}
+	return mk, nil
+}
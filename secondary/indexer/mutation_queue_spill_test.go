@@ -0,0 +1,115 @@
+package indexer
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func newSpillMutation(seqno Seqno, docid string) *MutationKeys {
+	return &MutationKeys{
+		meta: &MutationMeta{bucket: "default", vbucket: 0,
+			vbuuid: 1234, seqno: seqno, firstSnap: seqno == 1},
+		docid: []byte(docid),
+		mut: []*Mutation{&Mutation{uuid: common.IndexInstId(100),
+			command: common.Upsert, key: []byte(`["` + docid + `"]`),
+			oldkey: []byte(`["old"]`), partnkey: []byte(`"p"`)}},
+	}
+}
+
+func TestSpillA(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "mutation_queue_spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var spillStats QueueSpillStats
+	var used int64
+	max := int64(0) //no memory, spill after minQueueLen
+	conf := common.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+
+	q := NewAtomicMutationQueue("default", 1, &max, &used, conf)
+	q.minQueueLen = 2
+	if err := q.EnableSpill(dir, &spillStats); err != nil {
+		t.Fatal(err)
+	}
+
+	m := make([]*MutationKeys, 6)
+	for i := range m {
+		m[i] = newSpillMutation(Seqno(i+1), "doc"+strconv.Itoa(i))
+		q.Enqueue(m[i], 0, nil)
+	}
+	checkSizeA(t, q, 0, 6)
+	if spillStats.SpilledBytes() == 0 || spillStats.DiskUsed() == 0 {
+		t.Errorf("expected mutations to be spilled")
+	}
+	if tail := q.PeekTail(0); tail == nil || tail.meta.seqno != 6 {
+		t.Errorf("expected seqno 6 at tail of queue, got %v", tail)
+	}
+
+	//mutations in memory followed by spilled mutations
+	ch, _, err := q.DequeueUptoSeqno(0, 4)
+	if err != nil {
+		t.Errorf("DequeueUptoSeqno returned error")
+	}
+	i := 0
+	for p := range ch {
+		checkItemA(t, m[i], p)
+		i++
+	}
+	if i != 4 {
+		t.Errorf("expected 4 mutations to be dequeued, got %v", i)
+	}
+	checkSizeA(t, q, 0, 2)
+
+	//vbucket has spilled, new mutations are spilled till it is drained
+	m = append(m, newSpillMutation(7, "doc6"))
+	q.Enqueue(m[6], 0, nil)
+	checkSizeA(t, q, 0, 3)
+	if used != 0 {
+		t.Errorf("expected no queue memory in use, got %v", used)
+	}
+
+	for ; i < len(m); i++ {
+		checkItemA(t, m[i], q.DequeueSingleElement(0))
+	}
+	checkSizeA(t, q, 0, 0)
+	if q.DequeueSingleElement(0) != nil {
+		t.Errorf("expected empty queue")
+	}
+	if spillStats.DiskUsed() != 0 {
+		t.Errorf("expected spill files to be truncated, disk used %v",
+			spillStats.DiskUsed())
+	}
+
+	//drained vbucket enqueues in memory again
+	q.Enqueue(m[0], 0, nil)
+	if used == 0 {
+		t.Errorf("expected mutation to be queued in memory")
+	}
+	checkItemA(t, m[0], q.DequeueSingleElement(0))
+
+	q.Destroy()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected spill dir to be removed, %v", err)
+	}
+}
+
+func TestSpillCorruptedA(t *testing.T) {
+
+	payload := encodeSpilledMutation(nil, newSpillMutation(1, "doc"))
+	mk, err := decodeSpilledMutation(payload, "default", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkItemA(t, newSpillMutation(1, "doc"), mk)
+
+	if _, err := decodeSpilledMutation(payload[:len(payload)-1], "default", 0); err != errSpillCorrupted {
+		t.Errorf("expected %v, got %v", errSpillCorrupted, err)
+	}
+}
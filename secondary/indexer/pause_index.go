@@ -0,0 +1,94 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+// Pause and resume the maintenance of a single index hosted by this node,
+// unlike the indexer wide pause. A paused index is removed from the
+// mutation stream and serves the scans with any consistency at its last
+// snapshot, the "paused" stat of the index is set meanwhile. On resume
+// the index catches up from its last snapshot and is merged back to
+// MAINT_STREAM. See indexer.handlePauseIndex and indexer.handleResumeIndex.
+
+func (s *scanCoordinator) initPauseIndex() {
+	http.HandleFunc("/pauseIndex", s.handlePauseIndexReq)
+	http.HandleFunc("/resumeIndex", s.handlePauseIndexReq)
+}
+
+//handlePauseIndexReq pauses or resumes an index with
+//POST /pauseIndex?bucket=<bucket>&index=<name>
+//POST /resumeIndex?bucket=<bucket>&index=<name>
+func (s *scanCoordinator) handlePauseIndexReq(w http.ResponseWriter, r *http.Request) {
+
+	creds, valid, err := common.IsAuthValid(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	} else if valid == false {
+		w.WriteHeader(401)
+		w.Write([]byte("401 Unauthorized\n"))
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Unsupported method", 405)
+		return
+	}
+
+	bucket := r.FormValue("bucket")
+	name := r.FormValue("index")
+	if bucket == "" || name == "" {
+		http.Error(w, "Missing bucket or index", http.StatusBadRequest)
+		return
+	}
+
+	permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!alter", bucket)
+	if !common.IsAllowed(creds, []string{permission}, w) {
+		return
+	}
+
+	var mType MsgType = INDEXER_PAUSE_INDEX
+	if r.URL.Path == "/resumeIndex" {
+		mType = INDEXER_RESUME_INDEX
+	}
+
+	respCh := make(chan error, 1)
+	s.supvMsgch <- &MsgPauseIndex{
+		mType:  mType,
+		bucket: bucket,
+		name:   name,
+		respCh: respCh,
+	}
+
+	var resp struct {
+		Error string `json:"error,omitempty"`
+	}
+
+	if err := <-respCh; err != nil {
+		resp.Error = err.Error()
+	}
+
+	bytes, err := json.Marshal(&resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
@@ -0,0 +1,118 @@
+package indexer
+
+import (
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func newPauseIndexer() *indexer {
+	idx := &indexer{
+		state:              common.INDEXER_ACTIVE,
+		indexInstMap:       make(common.IndexInstMap),
+		streamBucketStatus: make(map[common.StreamId]BucketStatus),
+	}
+	for _, streamId := range []common.StreamId{common.MAINT_STREAM, common.INIT_STREAM} {
+		idx.streamBucketStatus[streamId] = make(BucketStatus)
+	}
+	idx.streamBucketStatus[common.MAINT_STREAM]["default"] = STREAM_ACTIVE
+
+	for instId, name := range map[common.IndexInstId]string{1: "idx1", 2: "idx2"} {
+		idx.indexInstMap[instId] = common.IndexInst{InstId: instId,
+			Defn:   common.IndexDefn{Bucket: "default", Name: name},
+			State:  common.INDEX_STATE_ACTIVE,
+			Stream: common.MAINT_STREAM,
+		}
+	}
+	return idx
+}
+
+func TestPauseIndexState(t *testing.T) {
+
+	idx := newPauseIndexer()
+
+	if _, err := idx.checkPauseIndex("default", "idx1", true); err != ErrIndexNotPaused {
+		t.Errorf("expected %v resuming an active index, got %v", ErrIndexNotPaused, err)
+	}
+	if _, err := idx.checkPauseIndex("default", "idx3", false); err != common.ErrIndexNotFound {
+		t.Errorf("expected %v pausing a missing index, got %v", common.ErrIndexNotFound, err)
+	}
+
+	instIdList, err := idx.checkPauseIndex("default", "idx1", false)
+	if err != nil || len(instIdList) != 1 || instIdList[0] != 1 {
+		t.Fatalf("unexpected instances %v err %v", instIdList, err)
+	}
+
+	indexList := idx.pauseIndexInsts(instIdList)
+	if len(indexList) != 1 || indexList[0].Stream != common.MAINT_STREAM {
+		t.Errorf("expected instance removed from %v, got %v", common.MAINT_STREAM, indexList)
+	}
+	if inst := idx.indexInstMap[1]; !inst.Paused || inst.Stream != common.NIL_STREAM ||
+		inst.State != common.INDEX_STATE_ACTIVE {
+		t.Errorf("unexpected paused instance Paused %v Stream %v State %v",
+			inst.Paused, inst.Stream, inst.State)
+	}
+	if inst := idx.indexInstMap[2]; inst.Paused || inst.Stream != common.MAINT_STREAM {
+		t.Errorf("unexpected change to other index Paused %v Stream %v", inst.Paused, inst.Stream)
+	}
+	if !idx.checkBucketExistsInStream("default", common.MAINT_STREAM, false) {
+		t.Errorf("expected bucket to stay in %v", common.MAINT_STREAM)
+	}
+
+	if _, err := idx.checkPauseIndex("default", "idx1", false); err != ErrIndexPaused {
+		t.Errorf("expected %v pausing a paused index, got %v", ErrIndexPaused, err)
+	}
+
+	//resumed index catches up in INIT_STREAM while MAINT_STREAM runs
+	if _, err := idx.checkPauseIndex("default", "idx1", true); err != nil {
+		t.Fatalf("unexpected error resuming index %v", err)
+	}
+	idx.resumeIndexInsts(instIdList, common.INIT_STREAM, common.INDEX_STATE_INITIAL)
+	if inst := idx.indexInstMap[1]; !inst.Paused || inst.Stream != common.INIT_STREAM ||
+		inst.State != common.INDEX_STATE_INITIAL {
+		t.Errorf("unexpected resumed instance Paused %v Stream %v State %v",
+			inst.Paused, inst.Stream, inst.State)
+	}
+
+	if _, err := idx.checkPauseIndex("default", "idx1", true); err == nil {
+		t.Errorf("expected error resuming an index being resumed")
+	}
+	if _, err := idx.checkPauseIndex("default", "idx2", false); err == nil {
+		t.Errorf("expected error pausing an index while an index is built")
+	}
+
+	//resumed index is restarted in MAINT_STREAM
+	idx.resumeIndexInsts(instIdList, common.MAINT_STREAM, common.INDEX_STATE_ACTIVE)
+	if inst := idx.indexInstMap[1]; inst.Paused || inst.Stream != common.MAINT_STREAM ||
+		inst.State != common.INDEX_STATE_ACTIVE {
+		t.Errorf("unexpected restarted instance Paused %v Stream %v State %v",
+			inst.Paused, inst.Stream, inst.State)
+	}
+
+	idx.streamBucketStatus[common.MAINT_STREAM]["default"] = STREAM_RECOVERY
+	if _, err := idx.checkPauseIndex("default", "idx1", false); err != ErrIndexerInRecovery {
+		t.Errorf("expected %v pausing during recovery, got %v", ErrIndexerInRecovery, err)
+	}
+}
+
+func TestPausedIndexScanAllowed(t *testing.T) {
+
+	s := &scanCoordinator{}
+	s.setIndexerState(common.INDEXER_ACTIVE)
+
+	scan := &ScanRequest{IndexInst: common.IndexInst{Paused: true}}
+	for _, c := range []common.Consistency{common.SessionConsistency, common.QueryConsistency} {
+		if err := s.isScanAllowed(c, scan); err != ErrIndexPaused {
+			t.Errorf("expected %v for %v scan, got %v", ErrIndexPaused, c, err)
+		}
+	}
+	if err := s.isScanAllowed(common.AnyConsistency, scan); err != nil {
+		t.Errorf("unexpected error for %v scan %v", common.AnyConsistency, err)
+	}
+
+	scan.IndexInst.Paused = false
+	if err := s.isScanAllowed(common.SessionConsistency, scan); err != nil {
+		t.Errorf("unexpected error for %v scan of resumed index %v",
+			common.SessionConsistency, err)
+	}
+}
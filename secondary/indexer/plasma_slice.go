@@ -160,10 +160,12 @@ func newPlasmaSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 		return nil, err
 	}
 
-	// Array related initialization
-	_, slice.isArrayDistinct, slice.arrayExprPosition, err = queryutil.GetArrayExpressionPosition(idxDefn.SecExprs)
-	if err != nil {
-		return nil, err
+	// Array related initialization, JavaScript expressions are not array keys
+	if !idxDefn.IsJavaScript() {
+		_, slice.isArrayDistinct, slice.arrayExprPosition, err = queryutil.GetArrayExpressionPosition(idxDefn.SecExprs)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	logging.Infof("plasmaSlice:NewplasmaSlice Created New Slice Id %v IndexInstId %v "+
@@ -1515,6 +1517,18 @@ func (s *plasmaSnapshot) StatCountTotal() (uint64, error) {
 	return c, nil
 }
 
+// Readers are shared by all scans of the slice. Do not wait for a reader
+// to be returned to the pool, scans holding a reader may be waiting for
+// more readers too.
+func (s *plasmaSnapshot) NewReaderContext() IndexReaderContext {
+	select {
+	case r := <-s.slice.readers:
+		return &plasmaReaderCtx{ch: s.slice.readers, r: r}
+	default:
+		return nil
+	}
+}
+
 func (s *plasmaSnapshot) CountTotal(ctx IndexReaderContext, stopch StopChannel) (uint64, error) {
 	return uint64(s.MainSnap.Count()), nil
 }
@@ -32,9 +32,9 @@ import (
 	"encoding/json"
 
 	"github.com/couchbase/cbauth"
-	"github.com/couchbase/cbauth/metakv"
 	"github.com/couchbase/cbauth/service"
 	c "github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/common/metakv"
 	"github.com/couchbase/indexing/secondary/fdb"
 	l "github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/manager"
@@ -249,6 +249,11 @@ func (m *ServiceMgr) registerWithServer() {
 	cfg := m.config.Load()
 	l.Infof("ServiceMgr::registerWithServer nodeuuid %v ", cfg["nodeuuid"].String())
 
+	if c.IsStandalone() {
+		l.Infof("ServiceMgr::registerWithServer skipped in standalone mode")
+		return
+	}
+
 	err := service.RegisterManager(m, nil)
 	if err != nil {
 		l.Infof("ServiceMgr::registerWithServer error %v", err)
@@ -2710,7 +2715,7 @@ func getWithAuth(url string) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = cbauth.SetRequestAuthVia(req, nil)
+	err = c.SetRequestAuth(req)
 	if err != nil {
 		l.Errorf("ServiceMgr::getWithAuth Error setting auth %v", err)
 	}
@@ -2730,7 +2735,7 @@ func postWithAuth(url string, bodyType string, body io.Reader) (*http.Response,
 		return nil, err
 	}
 	req.Header.Set("Content-Type", bodyType)
-	err = cbauth.SetRequestAuthVia(req, nil)
+	err = c.SetRequestAuth(req)
 	if err != nil {
 		l.Errorf("ServiceMgr::postWithAuth Error setting auth %v", err)
 		return nil, err
@@ -0,0 +1,441 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/cbauth"
+	"github.com/couchbase/indexing/secondary/collatejson"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// Endpoints used by the replica checker of the client, which gets a
+// snapshot at a common timestamp on all the nodes hosting a replica of
+// an index and compares their contents. The flush of the bucket is split
+// at that timestamp by a flush barrier, and the snapshots are leased to
+// the checker. See common/replica_check.go.
+
+var ErrReplicaCheckTsMismatch = errors.New("Snapshot timestamp does not match the replica check timestamp")
+
+// default time to wait for the snapshot at the replica check timestamp
+const replicaCheckSnapshotTimeout = 60 * time.Second
+
+func (s *scanCoordinator) initReplicaCheck() {
+	http.HandleFunc("/replicaCheck/snapshot", s.handleReplicaSnapshot)
+	http.HandleFunc("/replicaCheck/digest", s.handleReplicaDigest)
+	http.HandleFunc("/replicaCheck/entries", s.handleReplicaEntries)
+}
+
+func (s *scanCoordinator) handleReplicaSnapshot(w http.ResponseWriter, r *http.Request) {
+
+	var req common.ReplicaSnapshotRequest
+	creds, ok := readReplicaCheckRequest(w, r, &req)
+	if !ok {
+		return
+	}
+
+	permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!alter", req.Bucket)
+	if !common.IsAllowed(creds, []string{permission}, w) {
+		return
+	}
+
+	var err error
+	var resp common.ReplicaSnapshotResponse
+
+	switch req.Op {
+	case common.ReplicaSnapshotTs:
+		resp.Ts, err = s.sendFlushBarrier(FLUSH_BARRIER_GET_TS, req.Bucket, nil, 0)
+	case common.ReplicaSnapshotOpen:
+		resp.LeaseIds, err = s.openReplicaSnapshots(&req)
+		resp.Ts = req.Ts
+	case common.ReplicaSnapshotClose:
+		err = s.closeReplicaSnapshots(&req)
+	default:
+		err = fmt.Errorf("Unknown replica snapshot op %v", req.Op)
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	logging.Infof("%v::handleReplicaSnapshot Bucket %v Op %v Error %v",
+		s.logPrefix, req.Bucket, req.Op, resp.Error)
+
+	writeReplicaCheckResponse(w, &resp)
+}
+
+// openReplicaSnapshots sets a flush barrier at the requested timestamp
+// and leases the snapshots of the index instances at that timestamp.
+func (s *scanCoordinator) openReplicaSnapshots(req *common.ReplicaSnapshotRequest) ([]uint64, error) {
+
+	if req.Ts == nil {
+		return nil, errors.New("Missing replica check timestamp")
+	}
+
+	for _, instId := range req.InstIds {
+		if _, err := s.findReplicaCheckInst(instId, req.Bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := replicaCheckSnapshotTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+	}
+	deadline := time.Now().Add(timeout)
+
+	// snapshots are requested before the flush barrier is set, so that
+	// they are served by the first snapshot at or after the timestamp
+	respchs := make([]chan interface{}, len(req.InstIds))
+	for i, instId := range req.InstIds {
+		respchs[i] = s.requestSnapshotAtTs(instId, req.Ts, deadline)
+	}
+
+	snapshots := make([]IndexSnapshot, 0, len(req.InstIds))
+	_, err := s.sendFlushBarrier(FLUSH_BARRIER_SET, req.Bucket, req.Ts, timeout)
+	for i := 0; i < len(respchs); i++ {
+		if err != nil {
+			go readDeallocSnapshot(respchs[i])
+			continue
+		}
+
+		var is IndexSnapshot
+		if is, err = s.waitSnapshotAtTs(req.InstIds[i], req.Ts, respchs[i], deadline); err == nil {
+			snapshots = append(snapshots, is)
+		}
+	}
+
+	if err != nil {
+		if _, err := s.sendFlushBarrier(FLUSH_BARRIER_RELEASE, req.Bucket, nil, 0); err != nil &&
+			err != ErrFlushBarrierNotFound {
+			logging.Errorf("%v::openReplicaSnapshots Bucket %v Failed to release flush barrier: %v",
+				s.logPrefix, req.Bucket, err)
+		}
+		for _, is := range snapshots {
+			DestroyIndexSnapshot(is)
+		}
+		return nil, err
+	}
+
+	leaseIds := make([]uint64, 0, len(snapshots))
+	for _, is := range snapshots {
+		leaseIds = append(leaseIds, s.leases.Pin(is))
+		DestroyIndexSnapshot(is)
+	}
+	return leaseIds, nil
+}
+
+func (s *scanCoordinator) closeReplicaSnapshots(req *common.ReplicaSnapshotRequest) error {
+
+	if len(req.LeaseIds) != len(req.InstIds) {
+		return fmt.Errorf("%v leases for %v index instances", len(req.LeaseIds), len(req.InstIds))
+	}
+
+	for i, instId := range req.InstIds {
+		if _, err := s.findReplicaCheckInst(instId, req.Bucket); err != nil {
+			return err
+		}
+		s.leases.Unpin(req.LeaseIds[i], instId)
+	}
+	return nil
+}
+
+func (s *scanCoordinator) handleReplicaDigest(w http.ResponseWriter, r *http.Request) {
+
+	var req common.ReplicaDigestRequest
+	var resp common.ReplicaDigestResponse
+
+	var digests []common.RangeDigest
+	err := s.scanReplicaCheckRequest(w, r, &req, func(inst *common.IndexInst, entry []byte, i int) {
+		if digests == nil {
+			digests = make([]common.RangeDigest, len(req.Ranges))
+		}
+		digests[i].Add(entry)
+	})
+
+	if err == errReplicaCheckResponded {
+		return
+	} else if err != nil {
+		resp.Error = err.Error()
+	} else if resp.Digests = digests; digests == nil {
+		resp.Digests = make([]common.RangeDigest, len(req.Ranges))
+	}
+	writeReplicaCheckResponse(w, &resp)
+}
+
+func (s *scanCoordinator) handleReplicaEntries(w http.ResponseWriter, r *http.Request) {
+
+	var req common.ReplicaDigestRequest
+	var resp common.ReplicaEntriesResponse
+
+	err := s.scanReplicaCheckRequest(w, r, &req, func(inst *common.IndexInst, entry []byte, i int) {
+		resp.Entries = append(resp.Entries, makeReplicaEntry(entry, inst))
+	})
+
+	if err == errReplicaCheckResponded {
+		return
+	} else if err != nil {
+		resp.Entries = nil
+		resp.Error = err.Error()
+	}
+	writeReplicaCheckResponse(w, &resp)
+}
+
+var errReplicaCheckResponded = errors.New("response already written")
+
+// scanReplicaCheckRequest reads the request, acquires the leased snapshot
+// of the partition and calls callb for every entry
+// in the requested hash ranges, with the index of its range.
+func (s *scanCoordinator) scanReplicaCheckRequest(w http.ResponseWriter, r *http.Request,
+	req *common.ReplicaDigestRequest, callb func(*common.IndexInst, []byte, int)) error {
+
+	creds, ok := readReplicaCheckRequest(w, r, req)
+	if !ok {
+		return errReplicaCheckResponded
+	}
+
+	inst, ctx, err := s.findReplicaCheckPartition(req)
+	if err != nil {
+		return err
+	}
+
+	permission := fmt.Sprintf("cluster.bucket[%s].data.docs!read", inst.Defn.Bucket)
+	if !common.IsAllowed(creds, []string{permission}, w) {
+		return errReplicaCheckResponded
+	}
+
+	is, err := s.leases.Acquire(req.LeaseId, inst.InstId)
+	if err != nil {
+		return err
+	}
+	defer DestroyIndexSnapshot(is)
+
+	ps, ok := is.Partitions()[req.PartnId]
+	if !ok {
+		return ErrNotMyPartition
+	}
+
+	ctx.Init()
+	defer ctx.Done()
+
+	fn := func(entry []byte) error {
+		if i := common.FindHashRange(req.Ranges, common.EntryHash(entry)); i >= 0 {
+			callb(inst, entry, i)
+		}
+		return nil
+	}
+
+	for _, ss := range ps.Slices() {
+		if err := ss.Snapshot().All(ctx, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *scanCoordinator) findReplicaCheckPartition(
+	req *common.ReplicaDigestRequest) (*common.IndexInst, IndexReaderContext, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	inst, ok := s.indexInstMap[req.InstId]
+	if !ok || inst.Defn.DefnId != req.DefnId {
+		return nil, nil, common.ErrIndexNotFound
+	}
+
+	if inst.State != common.INDEX_STATE_ACTIVE {
+		return nil, nil, fmt.Errorf("Index instance %v is in state %v", inst.InstId, inst.State)
+	}
+
+	partition, ok := s.indexPartnMap[inst.InstId][req.PartnId]
+	if !ok {
+		return nil, nil, ErrNotMyPartition
+	}
+
+	return &inst, partition.Sc.GetSliceById(0).GetReaderContext(), nil
+}
+
+func (s *scanCoordinator) findReplicaCheckInst(instId common.IndexInstId,
+	bucket string) (*common.IndexInst, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	inst, ok := s.indexInstMap[instId]
+	if !ok || inst.Defn.Bucket != bucket {
+		return nil, common.ErrIndexNotFound
+	}
+
+	if inst.State != common.INDEX_STATE_ACTIVE {
+		return nil, fmt.Errorf("Index instance %v is in state %v", inst.InstId, inst.State)
+	}
+	return &inst, nil
+}
+
+// requestSnapshotAtTs requests the snapshot of the index instance at
+// ts, or the first one after ts, which is sent on the returned channel.
+func (s *scanCoordinator) requestSnapshotAtTs(instId common.IndexInstId,
+	ts *common.TsVbuuid, deadline time.Time) chan interface{} {
+
+	// vbuuids are checked once the snapshot is received
+	reqTs := ts.Copy()
+	reqTs.Crc64 = 0
+
+	snapResch := make(chan interface{}, 1)
+	s.supvMsgch <- &MsgIndexSnapRequest{
+		ts:          reqTs,
+		cons:        common.SessionConsistency,
+		respch:      snapResch,
+		idxInstId:   instId,
+		expiredTime: deadline,
+	}
+	return snapResch
+}
+
+// waitSnapshotAtTs waits for the snapshot requested on snapResch, which
+// must be at ts.
+func (s *scanCoordinator) waitSnapshotAtTs(instId common.IndexInstId, ts *common.TsVbuuid,
+	snapResch chan interface{}, deadline time.Time) (IndexSnapshot, error) {
+
+	var msg interface{}
+	select {
+	case msg = <-snapResch:
+	case <-time.After(deadline.Sub(time.Now())):
+		go readDeallocSnapshot(snapResch)
+		return nil, common.ErrScanTimedOut
+	}
+
+	switch v := msg.(type) {
+	case IndexSnapshot:
+		if !isSnapshotAtTs(v.Timestamp(), ts) {
+			logging.Warnf("%v::waitSnapshotAtTs Index %v Snapshot %v "+
+				"\n\tExpected %v", s.logPrefix, instId, v.Timestamp(), ts)
+			DestroyIndexSnapshot(v)
+			return nil, ErrReplicaCheckTsMismatch
+		}
+		return v, nil
+	case error:
+		return nil, v
+	}
+	return nil, ErrSnapNotAvailable
+}
+
+func (s *scanCoordinator) sendFlushBarrier(op FlushBarrierOp, bucket string,
+	ts *common.TsVbuuid, timeout time.Duration) (*common.TsVbuuid, error) {
+
+	respch := make(chan interface{}, 1)
+	s.supvMsgch <- &MsgFlushBarrier{
+		op:      op,
+		bucket:  bucket,
+		ts:      ts,
+		timeout: timeout,
+		respch:  respch,
+	}
+
+	switch v := (<-respch).(type) {
+	case *common.TsVbuuid:
+		return v, nil
+	case error:
+		return nil, v
+	}
+	return nil, nil
+}
+
+// isSnapshotAtTs checks whether the snapshot has exactly the mutations
+// up to ts.
+func isSnapshotAtTs(snapTs, ts *common.TsVbuuid) bool {
+	if snapTs == nil || ts == nil || len(snapTs.Seqnos) != len(ts.Seqnos) {
+		return false
+	}
+
+	for i, seqno := range ts.Seqnos {
+		if snapTs.Seqnos[i] != seqno {
+			return false
+		}
+		if seqno != 0 && snapTs.Vbuuids[i] != ts.Vbuuids[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func makeReplicaEntry(entry []byte, inst *common.IndexInst) common.ReplicaEntry {
+	e := common.ReplicaEntry{Raw: append([]byte(nil), entry...)}
+
+	if inst.Defn.IsPrimary {
+		e.DocId = string(entry)
+		return e
+	}
+
+	raw := append([]byte(nil), entry...)
+	if inst.Defn.HasDescending() {
+		jsonEncoder.ReverseCollate(raw, inst.Defn.Desc)
+	}
+
+	se := secondaryIndexEntry(raw)
+	if docid, err := se.ReadDocId(nil); err == nil {
+		e.DocId = string(docid)
+	}
+	buf := make([]byte, 0, 3*len(raw)+collatejson.MinBufferSize)
+	if key, err := se.ReadSecKey(buf); err == nil {
+		e.Key = string(key)
+	}
+	return e
+}
+
+func readReplicaCheckRequest(w http.ResponseWriter, r *http.Request,
+	req interface{}) (cbauth.Creds, bool) {
+
+	creds, valid, err := common.IsAuthValid(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return nil, false
+	} else if valid == false {
+		w.WriteHeader(401)
+		w.Write([]byte("401 Unauthorized\n"))
+		return nil, false
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Unsupported method", 405)
+		return nil, false
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(bytes, req)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return nil, false
+	}
+	return creds, true
+}
+
+func writeReplicaCheckResponse(w http.ResponseWriter, resp interface{}) {
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
@@ -0,0 +1,57 @@
+package indexer
+
+import (
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func newTestTs(seqnos, vbuuids []uint64) *common.TsVbuuid {
+	ts := common.NewTsVbuuid("default", len(seqnos))
+	for i := range seqnos {
+		ts.Seqnos[i] = seqnos[i]
+		ts.Vbuuids[i] = vbuuids[i]
+		ts.Snapshots[i] = [2]uint64{seqnos[i], seqnos[i]}
+	}
+	return ts
+}
+
+func TestClampTsToBarrier(t *testing.T) {
+	barrier := newTestTs([]uint64{10, 20, 0}, []uint64{1, 2, 0})
+
+	ts := newTestTs([]uint64{5, 25, 0}, []uint64{1, 2, 0})
+	clamped, ok := clampTsToBarrier(ts, barrier)
+	if !ok || !clamped {
+		t.Fatalf("expected ts to be clamped, received %v %v", clamped, ok)
+	}
+	if ts.Seqnos[0] != 5 || ts.Seqnos[1] != 20 || ts.Snapshots[1][1] != 20 {
+		t.Errorf("unexpected clamped ts %v", ts)
+	}
+
+	ts = newTestTs([]uint64{5, 15, 0}, []uint64{1, 2, 0})
+	if clamped, ok := clampTsToBarrier(ts, barrier); !ok || clamped {
+		t.Errorf("expected ts behind barrier to be unchanged, received %v %v", clamped, ok)
+	}
+
+	ts = newTestTs([]uint64{5, 15, 0}, []uint64{1, 3, 0})
+	if _, ok := clampTsToBarrier(ts, barrier); ok {
+		t.Errorf("expected vbuuid mismatch to fail")
+	}
+}
+
+func TestIsSnapshotAtTs(t *testing.T) {
+	ts := newTestTs([]uint64{10, 0}, []uint64{1, 0})
+
+	if !isSnapshotAtTs(newTestTs([]uint64{10, 0}, []uint64{1, 5}), ts) {
+		t.Errorf("expected snapshot at ts")
+	}
+	if isSnapshotAtTs(newTestTs([]uint64{11, 0}, []uint64{1, 0}), ts) {
+		t.Errorf("expected snapshot ahead of ts to not match")
+	}
+	if isSnapshotAtTs(newTestTs([]uint64{10, 0}, []uint64{2, 0}), ts) {
+		t.Errorf("expected vbuuid mismatch to not match")
+	}
+	if isSnapshotAtTs(nil, ts) {
+		t.Errorf("expected nil snapshot ts to not match")
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//
+// scanAdmission limits the number of scans processed concurrently, in
+// total and per bucket.  Scans which cannot be admitted right away are
+// queued and admitted using weighted fair queuing across buckets, so a
+// bucket with heavy scans cannot starve the scans of other buckets.
+// Within a bucket, queued scans of a higher priority class are admitted
+// first.  Scans waiting longer than the queue timeout are rejected with
+// an error the client can retry.
+//
+type scanAdmission struct {
+	mu      sync.Mutex
+	flows   map[string]*scanFlow
+	running int
+	queued  int
+	vtime   float64 // virtual time of the last admitted scan
+
+	maxConcurrent int
+	maxPerFlow    int
+	maxQueued     int
+	queueTimeout  time.Duration
+	weights       map[string]float64
+
+	stats *IndexerStatsHolder
+}
+
+// scans of a bucket
+type scanFlow struct {
+	key     string
+	weight  float64
+	vtime   float64 // virtual finish time of the last admitted scan
+	running int
+	waiters [numScanPriorities][]*scanWaiter
+}
+
+type scanWaiter struct {
+	admitch  chan bool
+	enqueued time.Time
+}
+
+const numScanPriorities = 3
+
+// order in which queued scans of a bucket are admitted
+var scanPriorityOrder = [numScanPriorities]common.ScanPriority{
+	common.HighScanPriority,
+	common.NormalScanPriority,
+	common.LowScanPriority,
+}
+
+func newScanAdmission(config common.Config, stats *IndexerStatsHolder) *scanAdmission {
+	a := &scanAdmission{
+		flows: make(map[string]*scanFlow),
+		stats: stats,
+	}
+	a.updateConfig(config)
+	return a
+}
+
+func (a *scanAdmission) updateConfig(config common.Config) {
+	weights := parseScanWeights(config["scan.admission.bucket_weights"].String())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.maxConcurrent = config["scan.admission.max_concurrent"].Int()
+	a.maxPerFlow = config["scan.admission.max_concurrent_per_bucket"].Int()
+	a.maxQueued = config["scan.admission.max_queued"].Int()
+	a.queueTimeout = time.Duration(config["scan.admission.queue_timeout"].Int()) * time.Millisecond
+	a.weights = weights
+	for key, flow := range a.flows {
+		flow.weight = a.weight(key)
+	}
+
+	// limits may have been raised
+	a.dispatch()
+}
+
+// parseScanWeights parses a comma separated list of bucket:weight.
+// Invalid entries are ignored.
+func parseScanWeights(s string) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 {
+			logging.Warnf("ScanCoordinator: ignoring invalid scan admission weight %v", entry)
+			continue
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(entry[i+1:]), 64)
+		if err != nil || w <= 0 {
+			logging.Warnf("ScanCoordinator: ignoring invalid scan admission weight %v", entry)
+			continue
+		}
+		weights[strings.TrimSpace(entry[:i])] = w
+	}
+	return weights
+}
+
+func (a *scanAdmission) weight(key string) float64 {
+	if w, ok := a.weights[key]; ok {
+		return w
+	}
+	return 1
+}
+
+// Admit blocks until the scan of the bucket can be processed. It returns
+// an error if the scan is rejected, is cancelled by the client or expires
+// while waiting. Every admitted scan must be released with Release.
+func (a *scanAdmission) Admit(key string, priority common.ScanPriority,
+	cancelCh <-chan bool, expiredTime time.Time) error {
+
+	a.mu.Lock()
+
+	flow := a.getFlow(key)
+	if !flow.backlogged() && a.canRun(flow) {
+		a.start(flow)
+		a.updateStats(key)
+		a.mu.Unlock()
+		return nil
+	}
+
+	if a.maxQueued > 0 && a.queued >= a.maxQueued {
+		a.reject(key)
+		a.deleteIdleFlow(flow)
+		a.mu.Unlock()
+		return common.ErrScanQueueFull
+	}
+
+	// a bucket which has been idle does not get credit for the time it
+	// was idle
+	if !flow.backlogged() && flow.vtime < a.vtime {
+		flow.vtime = a.vtime
+	}
+
+	class := priorityClass(priority)
+	w := &scanWaiter{admitch: make(chan bool, 1), enqueued: time.Now()}
+	flow.waiters[class] = append(flow.waiters[class], w)
+	a.queued++
+	a.updateStats(key)
+	queueTimeout := a.queueTimeout
+	a.mu.Unlock()
+
+	err := common.ErrScanQueueTimeout
+	if !expiredTime.IsZero() {
+		if d := expiredTime.Sub(time.Now()); d < queueTimeout {
+			queueTimeout, err = d, common.ErrScanTimedOut
+		}
+	}
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.admitch:
+		return nil
+	case <-timer.C:
+	case <-cancelCh:
+		err = common.ErrClientCancel
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !flow.remove(class, w) {
+		// admitted while timing out
+		return nil
+	}
+
+	a.queued--
+	if err != common.ErrClientCancel {
+		a.reject(key)
+	}
+	a.updateStats(key)
+	a.deleteIdleFlow(flow)
+	return err
+}
+
+// Release is called when an admitted scan of the bucket is done.
+func (a *scanAdmission) Release(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	flow, ok := a.flows[key]
+	if !ok {
+		return
+	}
+
+	a.running--
+	flow.running--
+	a.dispatch()
+	a.updateStats(key)
+	a.deleteIdleFlow(flow)
+}
+
+func (a *scanAdmission) getFlow(key string) *scanFlow {
+	flow, ok := a.flows[key]
+	if !ok {
+		flow = &scanFlow{key: key, weight: a.weight(key), vtime: a.vtime}
+		a.flows[key] = flow
+	}
+	return flow
+}
+
+func (a *scanAdmission) deleteIdleFlow(flow *scanFlow) {
+	if flow.running == 0 && !flow.backlogged() {
+		delete(a.flows, flow.key)
+	}
+}
+
+func (a *scanAdmission) canRun(flow *scanFlow) bool {
+	if a.maxConcurrent > 0 && a.running >= a.maxConcurrent {
+		return false
+	}
+	if a.maxPerFlow > 0 && flow.running >= a.maxPerFlow {
+		return false
+	}
+	return true
+}
+
+func (a *scanAdmission) start(flow *scanFlow) {
+	if flow.vtime < a.vtime {
+		flow.vtime = a.vtime
+	}
+	a.vtime = flow.vtime
+	flow.vtime += 1 / flow.weight
+
+	a.running++
+	flow.running++
+}
+
+// dispatch admits queued scans while the limits allow, picking the
+// bucket with the smallest virtual time each time.
+func (a *scanAdmission) dispatch() {
+	for a.queued > 0 {
+		var next *scanFlow
+		for _, flow := range a.flows {
+			if !flow.backlogged() || !a.canRun(flow) {
+				continue
+			}
+			if next == nil || flow.vtime < next.vtime ||
+				(flow.vtime == next.vtime && flow.key < next.key) {
+				next = flow
+			}
+		}
+
+		if next == nil {
+			return
+		}
+
+		w := next.pop()
+		a.queued--
+		a.start(next)
+		a.updateStats(next.key)
+
+		if stats := a.stats.Get(); stats != nil {
+			stats.numScansWaited.Add(1)
+			stats.scanQueueWaitDuration.Add(time.Since(w.enqueued).Nanoseconds())
+		}
+
+		w.admitch <- true
+	}
+}
+
+func (a *scanAdmission) reject(key string) {
+	if stats := a.stats.Get(); stats != nil {
+		stats.numScansRejected.Add(1)
+		if b, ok := stats.buckets[key]; ok {
+			b.numScansRejected.Add(1)
+		}
+	}
+}
+
+func (a *scanAdmission) updateStats(key string) {
+	if stats := a.stats.Get(); stats != nil {
+		stats.numScansRunning.Set(int64(a.running))
+		stats.numScansQueued.Set(int64(a.queued))
+		if b, ok := stats.buckets[key]; ok {
+			queued := 0
+			if flow, ok := a.flows[key]; ok {
+				queued = flow.numQueued()
+			}
+			b.numScansQueued.Set(int64(queued))
+		}
+	}
+}
+
+func priorityClass(priority common.ScanPriority) int {
+	for class, p := range scanPriorityOrder {
+		if p == priority {
+			return class
+		}
+	}
+	return priorityClass(common.NormalScanPriority)
+}
+
+func (f *scanFlow) backlogged() bool {
+	return f.numQueued() != 0
+}
+
+func (f *scanFlow) numQueued() int {
+	n := 0
+	for _, waiters := range f.waiters {
+		n += len(waiters)
+	}
+	return n
+}
+
+// pop removes the first waiter of the highest priority class
+func (f *scanFlow) pop() *scanWaiter {
+	for class, waiters := range f.waiters {
+		if len(waiters) != 0 {
+			w := waiters[0]
+			waiters[0] = nil
+			f.waiters[class] = waiters[1:]
+			return w
+		}
+	}
+	return nil
+}
+
+func (f *scanFlow) remove(class int, w *scanWaiter) bool {
+	waiters := f.waiters[class]
+	for i, w2 := range waiters {
+		if w2 == w {
+			copy(waiters[i:], waiters[i+1:])
+			waiters[len(waiters)-1] = nil
+			f.waiters[class] = waiters[:len(waiters)-1]
+			return true
+		}
+	}
+	return false
+}
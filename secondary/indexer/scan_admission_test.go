@@ -0,0 +1,193 @@
+package indexer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func newTestScanAdmission(maxConcurrent, maxPerBucket int, weights string,
+	queueTimeout int) (*scanAdmission, *IndexerStats) {
+
+	cfg := common.SystemConfig.SectionConfig("indexer.", true)
+	cfg.SetValue("scan.admission.max_concurrent", maxConcurrent)
+	cfg.SetValue("scan.admission.max_concurrent_per_bucket", maxPerBucket)
+	cfg.SetValue("scan.admission.bucket_weights", weights)
+	cfg.SetValue("scan.admission.queue_timeout", queueTimeout)
+
+	stats := &IndexerStats{}
+	stats.Init()
+	stats.AddIndex(1, "travel", "idx1", 0)
+	stats.AddIndex(2, "beer", "idx2", 0)
+
+	var holder IndexerStatsHolder
+	holder.Set(stats)
+	return newScanAdmission(cfg, &holder), stats
+}
+
+//waitQueued waits until n scans are queued
+func waitQueued(t *testing.T, a *scanAdmission, n int) {
+	for i := 0; i < 1000; i++ {
+		a.mu.Lock()
+		queued := a.queued
+		a.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %v scans queued", n)
+}
+
+func TestScanAdmissionFairQueuing(t *testing.T) {
+
+	a, _ := newTestScanAdmission(1, 0, "travel:2", 10000)
+
+	//hold the only slot while the scans queue up
+	if err := a.Admit("travel", common.NormalScanPriority, nil, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	admit := func(bucket string, priority common.ScanPriority) {
+		defer wg.Done()
+		if err := a.Admit(bucket, priority, nil, time.Time{}); err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		order = append(order, bucket+":"+priority.String())
+		mu.Unlock()
+		a.Release(bucket)
+	}
+
+	queued := 0
+	enqueue := func(bucket string, priority common.ScanPriority, n int) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go admit(bucket, priority)
+			queued++
+			waitQueued(t, a, queued)
+		}
+	}
+	enqueue("beer", common.LowScanPriority, 3)
+	enqueue("travel", common.NormalScanPriority, 4)
+	enqueue("travel", common.HighScanPriority, 2)
+
+	a.Release("travel")
+	wg.Wait()
+
+	//travel is admitted twice as often as beer, high priority first
+	expected := []string{
+		"beer:LOW", "travel:HIGH",
+		"beer:LOW", "travel:HIGH", "travel:NORMAL",
+		"beer:LOW", "travel:NORMAL", "travel:NORMAL", "travel:NORMAL",
+	}
+	if len(order) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, order)
+		}
+	}
+	if len(a.flows) != 0 || a.running != 0 || a.queued != 0 {
+		t.Errorf("expected no scans, got %v running %v queued", a.running, a.queued)
+	}
+}
+
+func TestScanAdmissionPerBucketLimit(t *testing.T) {
+
+	a, _ := newTestScanAdmission(0, 2, "", 10000)
+
+	for i := 0; i < 2; i++ {
+		if err := a.Admit("travel", common.NormalScanPriority, nil, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//other buckets are not affected by the limit of travel
+	if err := a.Admit("beer", common.NormalScanPriority, nil, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	donech := make(chan error)
+	go func() {
+		donech <- a.Admit("travel", common.NormalScanPriority, nil, time.Time{})
+	}()
+	waitQueued(t, a, 1)
+
+	a.Release("beer")
+	select {
+	case <-donech:
+		t.Fatal("scan admitted beyond the bucket limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	a.Release("travel")
+	if err := <-donech; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanAdmissionReject(t *testing.T) {
+
+	a, stats := newTestScanAdmission(1, 0, "", 10)
+
+	if err := a.Admit("travel", common.NormalScanPriority, nil, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	//queue timeout
+	if err := a.Admit("beer", common.HighScanPriority, nil, time.Time{}); err != common.ErrScanQueueTimeout {
+		t.Errorf("expected %v, got %v", common.ErrScanQueueTimeout, err)
+	}
+
+	//scan timeout before queue timeout
+	expired := time.Now().Add(time.Millisecond)
+	if err := a.Admit("beer", common.NormalScanPriority, nil, expired); err != common.ErrScanTimedOut {
+		t.Errorf("expected %v, got %v", common.ErrScanTimedOut, err)
+	}
+
+	//client cancel is not counted as rejected
+	cancelCh := make(chan bool)
+	close(cancelCh)
+	if err := a.Admit("beer", common.NormalScanPriority, cancelCh, time.Time{}); err != common.ErrClientCancel {
+		t.Errorf("expected %v, got %v", common.ErrClientCancel, err)
+	}
+
+	//queue full
+	a.mu.Lock()
+	a.maxQueued = 1
+	a.mu.Unlock()
+	go a.Admit("beer", common.NormalScanPriority, nil, time.Now().Add(time.Second))
+	waitQueued(t, a, 1)
+	if err := a.Admit("travel", common.NormalScanPriority, nil, time.Time{}); err != common.ErrScanQueueFull {
+		t.Errorf("expected %v, got %v", common.ErrScanQueueFull, err)
+	}
+
+	if n := stats.numScansRejected.Value(); n != 3 {
+		t.Errorf("expected 3 scans rejected, got %v", n)
+	}
+	if n := stats.buckets["beer"].numScansRejected.Value(); n != 2 {
+		t.Errorf("expected 2 beer scans rejected, got %v", n)
+	}
+	if n := stats.numScansQueued.Value(); n != 1 {
+		t.Errorf("expected 1 scan queued, got %v", n)
+	}
+	if n := stats.numScansRunning.Value(); n != 1 {
+		t.Errorf("expected 1 scan running, got %v", n)
+	}
+}
+
+func TestParseScanWeights(t *testing.T) {
+
+	weights := parseScanWeights(" travel:2, beer : 0.5,bad,neg:-1,,zero:0")
+	if len(weights) != 2 || weights["travel"] != 2 || weights["beer"] != 0.5 {
+		t.Errorf("unexpected weights %v", weights)
+	}
+}
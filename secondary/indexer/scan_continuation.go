@@ -0,0 +1,255 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+var (
+	ErrContinuationInvalid     = errors.New("Invalid scan continuation token")
+	ErrContinuationExpired     = errors.New("Scan continuation token expired. Restart the scan.")
+	ErrContinuationUnsupported = errors.New("Scan continuation not supported for this request")
+)
+
+const scanContinuationVersion = byte(1)
+
+// fixed part of the token: version, leaseId, instId, scanPos, dups, rowsReturned
+const scanContinuationHdrLen = 1 + 8 + 8 + 4 + 2 + 8
+
+// cursor item passed down the scan pipeline: scanPos, dups and raw entry
+const scanCursorHdrLen = 4 + 2
+
+//
+// ScanContinuation identifies the position of a scan within a pinned
+// snapshot. It is handed to the client as an opaque token along with
+// each batch of rows, and can be sent back in a follow-up ScanRequest
+// to resume the scan right after the last row received.
+//
+type ScanContinuation struct {
+	LeaseId      uint64             // pinned snapshot
+	InstId       common.IndexInstId // index instance the snapshot belongs to
+	ScanPos      uint32             // position of the scan in ScanRequest.Scans
+	Dups         uint16             // rows already returned for Entry (array index)
+	RowsReturned uint64             // rows returned so far, used to adjust limit
+	Entry        []byte             // last raw storage entry returned
+}
+
+func (c *ScanContinuation) Encode(buf []byte) []byte {
+	var hdr [scanContinuationHdrLen]byte
+
+	hdr[0] = scanContinuationVersion
+	binary.BigEndian.PutUint64(hdr[1:9], c.LeaseId)
+	binary.BigEndian.PutUint64(hdr[9:17], uint64(c.InstId))
+	binary.BigEndian.PutUint32(hdr[17:21], c.ScanPos)
+	binary.BigEndian.PutUint16(hdr[21:23], c.Dups)
+	binary.BigEndian.PutUint64(hdr[23:31], c.RowsReturned)
+
+	buf = append(buf[:0], hdr[:]...)
+	return append(buf, c.Entry...)
+}
+
+func DecodeScanContinuation(token []byte) (*ScanContinuation, error) {
+	if len(token) < scanContinuationHdrLen || token[0] != scanContinuationVersion {
+		return nil, ErrContinuationInvalid
+	}
+
+	c := &ScanContinuation{
+		LeaseId:      binary.BigEndian.Uint64(token[1:9]),
+		InstId:       common.IndexInstId(binary.BigEndian.Uint64(token[9:17])),
+		ScanPos:      binary.BigEndian.Uint32(token[17:21]),
+		Dups:         binary.BigEndian.Uint16(token[21:23]),
+		RowsReturned: binary.BigEndian.Uint64(token[23:31]),
+	}
+	c.Entry = append([]byte(nil), token[scanContinuationHdrLen:]...)
+	if len(c.Entry) == 0 {
+		return nil, ErrContinuationInvalid
+	}
+
+	return c, nil
+}
+
+func encodeScanCursor(buf []byte, scanPos int, dups int, entry []byte) []byte {
+	var hdr [scanCursorHdrLen]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(scanPos))
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(dups))
+	buf = append(buf[:0], hdr[:]...)
+	return append(buf, entry...)
+}
+
+func decodeScanCursor(cursor []byte) (scanPos uint32, dups uint16, entry []byte) {
+	scanPos = binary.BigEndian.Uint32(cursor[0:4])
+	dups = binary.BigEndian.Uint16(cursor[4:6])
+	entry = cursor[scanCursorHdrLen:]
+	return
+}
+
+// compareResumeEntry compares a storage entry with the last entry returned
+// before the scan was resumed.  Only the secondary keys are compared when
+// keyOnly is set (distinct scans).
+func compareResumeEntry(entry []byte, cont *ScanContinuation, isPrimary, keyOnly bool) int {
+	if isPrimary || !keyOnly {
+		return bytes.Compare(entry, cont.Entry)
+	}
+
+	e1, e2 := secondaryIndexEntry(entry), secondaryIndexEntry(cont.Entry)
+	return bytes.Compare(entry[:e1.lenKey()], cont.Entry[:e2.lenKey()])
+}
+
+/////////////////////////////////////////////////////////////////////////
+//
+//  snapshot lease manager
+//
+/////////////////////////////////////////////////////////////////////////
+
+type snapshotLease struct {
+	is      IndexSnapshot
+	expires time.Time
+}
+
+//
+// snapshotLeaseManager keeps index snapshots referenced by continuation
+// tokens alive.  Every use of a lease extends it; leases which have not
+// been used within the lease duration are destroyed by the reaper.
+//
+type snapshotLeaseManager struct {
+	mu      sync.Mutex
+	leases  map[uint64]*snapshotLease
+	counter uint64
+	stopch  chan bool
+
+	config common.ConfigHolder
+	stats  *IndexerStatsHolder
+}
+
+func newSnapshotLeaseManager(config common.Config, stats *IndexerStatsHolder) *snapshotLeaseManager {
+	m := &snapshotLeaseManager{
+		leases: make(map[uint64]*snapshotLease),
+		stopch: make(chan bool),
+		stats:  stats,
+		// lease ids start from the process epoch, so that tokens handed
+		// out before a restart do not match the leases of this process
+		counter: uint64(time.Now().UnixNano()),
+	}
+	m.config.Store(config)
+
+	go m.reaper()
+	return m
+}
+
+func (m *snapshotLeaseManager) leaseDuration() time.Duration {
+	cfg := m.config.Load()
+	return time.Duration(cfg["settings.scan_continuation_lease"].Int()) * time.Millisecond
+}
+
+func (m *snapshotLeaseManager) updateConfig(config common.Config) {
+	m.config.Store(config)
+}
+
+// Pin clones the snapshot and retains it until the lease expires.
+func (m *snapshotLeaseManager) Pin(is IndexSnapshot) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counter++
+	m.leases[m.counter] = &snapshotLease{
+		is:      CloneIndexSnapshot(is),
+		expires: time.Now().Add(m.leaseDuration()),
+	}
+	m.updateStats()
+
+	return m.counter
+}
+
+// Acquire returns a clone of the leased snapshot and extends the lease.
+// Caller must destroy the returned snapshot once done.
+func (m *snapshotLeaseManager) Acquire(leaseId uint64, instId common.IndexInstId) (IndexSnapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lease, ok := m.leases[leaseId]
+	if !ok {
+		return nil, ErrContinuationExpired
+	}
+
+	if lease.is.IndexInstId() != instId {
+		return nil, ErrContinuationInvalid
+	}
+
+	lease.expires = time.Now().Add(m.leaseDuration())
+	return CloneIndexSnapshot(lease.is), nil
+}
+
+// Unpin releases the lease of the snapshot of index instance instId
+// before it expires.
+func (m *snapshotLeaseManager) Unpin(leaseId uint64, instId common.IndexInstId) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if lease, ok := m.leases[leaseId]; ok && lease.is.IndexInstId() == instId {
+		DestroyIndexSnapshot(lease.is)
+		delete(m.leases, leaseId)
+		m.updateStats()
+	}
+}
+
+func (m *snapshotLeaseManager) Close() {
+	close(m.stopch)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, lease := range m.leases {
+		DestroyIndexSnapshot(lease.is)
+		delete(m.leases, id)
+	}
+	m.updateStats()
+}
+
+func (m *snapshotLeaseManager) reaper() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.expire(time.Now())
+		case <-m.stopch:
+			return
+		}
+	}
+}
+
+func (m *snapshotLeaseManager) expire(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, lease := range m.leases {
+		if now.After(lease.expires) {
+			logging.Debugf("ScanCoordinator: snapshot lease %v for index %v expired", id, lease.is.IndexInstId())
+			DestroyIndexSnapshot(lease.is)
+			delete(m.leases, id)
+		}
+	}
+	m.updateStats()
+}
+
+func (m *snapshotLeaseManager) updateStats() {
+	if stats := m.stats.Get(); stats != nil {
+		stats.numScanLeases.Set(int64(len(m.leases)))
+	}
+}
@@ -0,0 +1,229 @@
+package indexer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func TestScanContinuationToken(t *testing.T) {
+	c := &ScanContinuation{
+		LeaseId:      42,
+		InstId:       1234,
+		ScanPos:      3,
+		Dups:         2,
+		RowsReturned: 1000,
+		Entry:        []byte("entry"),
+	}
+
+	token := c.Encode(nil)
+	c2, err := DecodeScanContinuation(token)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if c2.LeaseId != c.LeaseId || c2.InstId != c.InstId || c2.ScanPos != c.ScanPos ||
+		c2.Dups != c.Dups || c2.RowsReturned != c.RowsReturned || !bytes.Equal(c2.Entry, c.Entry) {
+		t.Errorf("Expected %v, received %v", c, c2)
+	}
+
+	if _, err := DecodeScanContinuation(token[:scanContinuationHdrLen]); err != ErrContinuationInvalid {
+		t.Errorf("Expected %v, received %v", ErrContinuationInvalid, err)
+	}
+
+	token[0] = scanContinuationVersion + 1
+	if _, err := DecodeScanContinuation(token); err != ErrContinuationInvalid {
+		t.Errorf("Expected %v, received %v", ErrContinuationInvalid, err)
+	}
+}
+
+func TestScanCursor(t *testing.T) {
+	cursor := encodeScanCursor(nil, 7, 1, []byte("entry"))
+
+	scanPos, dups, entry := decodeScanCursor(cursor)
+	if scanPos != 7 || dups != 1 || !bytes.Equal(entry, []byte("entry")) {
+		t.Errorf("Unexpected cursor %v %v %v", scanPos, dups, string(entry))
+	}
+}
+
+// testLeaseSnapshot counts the open references to a snapshot
+type testLeaseSnapshot struct {
+	Snapshot
+	refs int32
+}
+
+func (s *testLeaseSnapshot) Open() error {
+	atomic.AddInt32(&s.refs, 1)
+	return nil
+}
+
+func (s *testLeaseSnapshot) Close() error {
+	atomic.AddInt32(&s.refs, -1)
+	return nil
+}
+
+func newTestLeaseSnapshot(instId common.IndexInstId) (IndexSnapshot, *testLeaseSnapshot) {
+	snap := &testLeaseSnapshot{refs: 1}
+	slices := map[SliceId]SliceSnapshot{0: &sliceSnapshot{snap: snap}}
+	is := &indexSnapshot{
+		instId: instId,
+		partns: map[common.PartitionId]PartitionSnapshot{0: &partitionSnapshot{slices: slices}},
+	}
+	return is, snap
+}
+
+// newTestResponseConn returns a connection whose responses are discarded
+func newTestResponseConn() net.Conn {
+	conn, remote := net.Pipe()
+	go io.Copy(ioutil.Discard, remote)
+	return conn
+}
+
+func newTestLeaseManager(lease int) *snapshotLeaseManager {
+	cfg := common.SystemConfig.SectionConfig("indexer.", true)
+	cfg.SetValue("settings.scan_continuation_lease", lease)
+	return newSnapshotLeaseManager(cfg, &IndexerStatsHolder{})
+}
+
+// writeTestRow writes a row of size bytes and its cursor
+func writeTestRow(t *testing.T, w *protoResponseWriter, entry string, size int) {
+	pk := make([]byte, size)
+	copy(pk, entry)
+	if err := w.Row(pk, nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := w.Cursor(encodeScanCursor(nil, 0, 1, []byte(entry))); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestScanContinuationLease(t *testing.T) {
+	m := newTestLeaseManager(60000)
+	defer m.Close()
+	s := &scanCoordinator{leases: m}
+	conn := newTestResponseConn()
+	defer conn.Close()
+
+	is, snap := newTestLeaseSnapshot(1234)
+
+	// first scan pins its snapshot and stops at its limit after handing
+	// out a token with a batch of rows
+	req := &ScanRequest{IndexInstId: 1234, withContinuation: true}
+	req.leaseId = m.Pin(is)
+	DestroyIndexSnapshot(is)
+
+	w := NewProtoWriter(ScanReq, conn)
+	w.InitContinuation(req)
+	writeTestRow(t, w, "doc-1", 1)
+	token := append([]byte(nil), w.contToken...)
+	writeTestRow(t, w, "doc-2", len(*w.rowBuf))
+	w.Done()
+
+	if atomic.LoadInt32(&snap.refs) != 1 {
+		t.Fatalf("Expected snapshot to be pinned, refs %v", snap.refs)
+	}
+
+	// resume from the token, the scan returns its last rows and completes
+	resumed := &ScanRequest{IndexInstId: 1234}
+	if err := resumed.setContinuation(token); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if resumed.leaseId != req.leaseId || string(resumed.continuation.Entry) != "doc-1" {
+		t.Fatalf("Unexpected continuation %v", resumed.continuation)
+	}
+
+	is, err := s.getRequestedIndexSnapshot(resumed)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	w = NewProtoWriter(ScanReq, conn)
+	w.InitContinuation(resumed)
+	writeTestRow(t, w, "doc-2", 1)
+	resumed.scanCompleted = true
+	s.endContinuation(resumed, w)
+	w.Done()
+	DestroyIndexSnapshot(is)
+
+	if w.contToken != nil {
+		t.Errorf("Expected no token with the last rows of a completed scan")
+	}
+	if atomic.LoadInt32(&snap.refs) != 0 {
+		t.Errorf("Expected lease to be released, refs %v", snap.refs)
+	}
+	if _, err := s.getRequestedIndexSnapshot(resumed); err != ErrContinuationExpired {
+		t.Errorf("Expected %v, received %v", ErrContinuationExpired, err)
+	}
+}
+
+func TestScanContinuationLeaseHandedOut(t *testing.T) {
+	m := newTestLeaseManager(60000)
+	defer m.Close()
+	s := &scanCoordinator{leases: m}
+	conn := newTestResponseConn()
+	defer conn.Close()
+
+	is, snap := newTestLeaseSnapshot(1234)
+	req := &ScanRequest{IndexInstId: 1234, withContinuation: true}
+	req.leaseId = m.Pin(is)
+	DestroyIndexSnapshot(is)
+
+	// a completed scan which handed out a token keeps its lease, the
+	// client can resume from the token if the last batch is lost
+	w := NewProtoWriter(ScanReq, conn)
+	w.InitContinuation(req)
+	writeTestRow(t, w, "doc-1", 1)
+	writeTestRow(t, w, "doc-2", len(*w.rowBuf))
+	req.scanCompleted = true
+	s.endContinuation(req, w)
+	w.Done()
+
+	if atomic.LoadInt32(&snap.refs) != 1 {
+		t.Fatalf("Expected snapshot to be pinned, refs %v", snap.refs)
+	}
+
+	// lease expires if it is not used
+	is, err := m.Acquire(req.leaseId, req.IndexInstId)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	DestroyIndexSnapshot(is)
+
+	m.expire(time.Now().Add(30 * time.Second))
+	if atomic.LoadInt32(&snap.refs) != 1 {
+		t.Fatalf("Expected snapshot to be pinned, refs %v", snap.refs)
+	}
+
+	m.expire(time.Now().Add(2 * time.Minute))
+	if atomic.LoadInt32(&snap.refs) != 0 {
+		t.Errorf("Expected lease to expire, refs %v", snap.refs)
+	}
+	if _, err := m.Acquire(req.leaseId, req.IndexInstId); err != ErrContinuationExpired {
+		t.Errorf("Expected %v, received %v", ErrContinuationExpired, err)
+	}
+}
+
+func TestScanContinuationLeaseEpoch(t *testing.T) {
+	m := newTestLeaseManager(60000)
+	is, _ := newTestLeaseSnapshot(1234)
+	leaseId := m.Pin(is)
+	m.Close()
+
+	// a token handed out before a restart does not match a lease of the
+	// new process
+	m = newTestLeaseManager(60000)
+	defer m.Close()
+	is, _ = newTestLeaseSnapshot(1234)
+	if id := m.Pin(is); id == leaseId {
+		t.Errorf("Expected a new lease id, received %v", id)
+	}
+	if _, err := m.Acquire(leaseId, 1234); err != ErrContinuationExpired {
+		t.Errorf("Expected %v, received %v", ErrContinuationExpired, err)
+	}
+}
@@ -35,8 +35,19 @@ var (
 	ErrUnsupportedRequest = errors.New("Unsupported query request")
 	ErrVbuuidMismatch     = errors.New("Mismatch in session vbuuids")
 	ErrNotMyPartition     = errors.New("Not my partition")
+	ErrInvalidStaleness   = errors.New("Invalid staleness for bounded staleness consistency")
+	ErrIntersectBucket    = errors.New("Intersected indexes must be on the same bucket")
+	ErrIntersectSnapshot  = errors.New("No common snapshot available for intersected indexes")
+	ErrIntersectTooLarge  = errors.New("Intersected indexes return too many document ids")
 )
 
+// interval at which bounded staleness scans check for a fresh snapshot
+const stalenessPollInterval = 5 * time.Millisecond
+
+// maximum wait for a fresh snapshot by bounded staleness scans without
+// a scan timeout
+const stalenessDefaultTimeout = 2 * time.Minute
+
 var secKeyBufPool *common.BytesBufPool
 
 func init() {
@@ -68,6 +79,10 @@ type scanCoordinator struct {
 	stats IndexerStatsHolder
 
 	indexerState atomic.Value
+	diskState    int32 //DiskState of storage_dir, accessed atomically
+
+	leases    *snapshotLeaseManager
+	admission *scanAdmission
 }
 
 // NewScanCoordinator returns an instance of scanCoordinator or err message
@@ -90,6 +105,8 @@ func NewScanCoordinator(supvCmdch MsgChannel, supvMsgch MsgChannel,
 
 	s.config.Store(config)
 	s.initRollbackInProgress()
+	s.leases = newSnapshotLeaseManager(config, &s.stats)
+	s.admission = newScanAdmission(config, &s.stats)
 
 	addr := net.JoinHostPort("", config["scanPort"].String())
 	queryportCfg := config.SectionConfig("queryport.", true)
@@ -106,6 +123,9 @@ func NewScanCoordinator(supvCmdch MsgChannel, supvMsgch MsgChannel,
 	}
 
 	s.setIndexerState(common.INDEXER_BOOTSTRAP)
+	s.initReplicaCheck()
+	s.initFsck()
+	s.initPauseIndex()
 
 	// main loop
 	go s.run()
@@ -124,6 +144,7 @@ loop:
 				if cmd.GetMsgType() == SCAN_COORD_SHUTDOWN {
 					logging.Infof("ScanCoordinator: Shutting Down")
 					s.serv.Close()
+					s.leases.Close()
 					s.supvCmdch <- &MsgSuccess{}
 					break loop
 				}
@@ -180,6 +201,9 @@ func (s *scanCoordinator) handleSupvervisorCommands(cmd Message) {
 	case INDEXER_BOOTSTRAP:
 		s.handleIndexerBootstrap(cmd)
 
+	case STORAGE_DISK_STATE:
+		s.handleDiskStateChange(cmd)
+
 	case INDEXER_ROLLBACK:
 		s.handleIndexerRollback(cmd)
 
@@ -241,6 +265,15 @@ func (s *scanCoordinator) serverCallback(protoReq interface{}, conn net.Conn,
 		return
 	}
 
+	// Statistics requests are cheap, they are not queued
+	if req.ScanType != StatsReq {
+		err := s.admission.Admit(req.Bucket, req.Priority, req.CancelCh, req.ExpiredTime)
+		if s.tryRespondWithError(w, req, err) {
+			return
+		}
+		defer s.admission.Release(req.Bucket)
+	}
+
 	if req.Stats != nil {
 		req.Stats.numRequests.Add(1)
 		req.Stats.scanReqInitDuration.Add(time.Now().Sub(ttime).Nanoseconds())
@@ -252,6 +285,11 @@ func (s *scanCoordinator) serverCallback(protoReq interface{}, conn net.Conn,
 	}
 
 	t0 := time.Now()
+	if req.ScanType == IntersectScanReq {
+		s.handleIntersectScanRequest(req, w, t0)
+		return
+	}
+
 	is, err := s.getRequestedIndexSnapshot(req)
 	if s.tryRespondWithError(w, req, err) {
 		return
@@ -264,6 +302,13 @@ func (s *scanCoordinator) serverCallback(protoReq interface{}, conn net.Conn,
 			req.LogPrefix, ScanTStoString(is.Timestamp()))
 	})
 
+	if req.withContinuation {
+		if req.continuation == nil {
+			req.leaseId = s.leases.Pin(is)
+		}
+		w.InitContinuation(req)
+	}
+
 	defer func() {
 		if req.Stats != nil {
 			req.Stats.scanReqDuration.Add(time.Now().Sub(ttime).Nanoseconds())
@@ -278,6 +323,10 @@ func (s *scanCoordinator) serverCallback(protoReq interface{}, conn net.Conn,
 
 	s.processRequest(req, w, is, t0)
 
+	if req.withContinuation && req.scanCompleted {
+		s.endContinuation(req, w)
+	}
+
 	if len(req.Ctxs) != 0 {
 		for _, ctx := range req.Ctxs {
 			ctx.Done()
@@ -301,6 +350,16 @@ func (s *scanCoordinator) processRequest(req *ScanRequest, w ScanResponseWriter,
 	}
 }
 
+//
+// Release the snapshot lease of a completed scan, unless a continuation
+// token referring to it has been handed out to the client.
+//
+func (s *scanCoordinator) endContinuation(req *ScanRequest, w *protoResponseWriter) {
+	if !w.EndContinuation() {
+		s.leases.Unpin(req.leaseId, req.IndexInstId)
+	}
+}
+
 func (s *scanCoordinator) handleHeloRequest(req *ScanRequest, w ScanResponseWriter) {
 	err := w.Helo()
 	s.handleError(req.LogPrefix, err)
@@ -320,6 +379,9 @@ func (s *scanCoordinator) handleScanRequest(req *ScanRequest, w ScanResponseWrit
 	err := scanPipeline.Execute()
 	scanTime := time.Now().Sub(t0)
 
+	// a scan stopped by its limit can still be resumed
+	req.scanCompleted = err == nil && (req.Limit <= 0 || scanPipeline.RowsReturned() < uint64(req.Limit))
+
 	if req.Stats != nil {
 		req.Stats.numRowsReturned.Add(int64(scanPipeline.RowsReturned()))
 		req.Stats.scanBytesRead.Add(int64(scanPipeline.BytesRead()))
@@ -466,10 +528,24 @@ func (s *scanCoordinator) handleStatsRequest(req *ScanRequest, w ScanResponseWri
 // will block wait.
 // This mechanism can be used to implement RYOW.
 func (s *scanCoordinator) getRequestedIndexSnapshot(r *ScanRequest) (snap IndexSnapshot, err error) {
+	// Resumed scan is served from the snapshot pinned by its lease
+	if r.continuation != nil {
+		return s.leases.Acquire(r.leaseId, r.IndexInstId)
+	}
+
+	if *r.Consistency == common.BoundedStalenessConsistency {
+		return s.getFreshIndexSnapshot(r)
+	}
+
 	snapshot, err := func() (IndexSnapshot, error) {
 		s.mu.RLock()
 		defer s.mu.RUnlock()
 
+		// Retained snapshots are only known to storage manager
+		if r.isAsOf() {
+			return nil, nil
+		}
+
 		ss, ok := s.lastSnapshot[r.IndexInstId]
 		cons := *r.Consistency
 		if ok && ss != nil && isSnapshotConsistent(ss, cons, r.Ts) {
@@ -484,6 +560,12 @@ func (s *scanCoordinator) getRequestedIndexSnapshot(r *ScanRequest) (snap IndexS
 		return snapshot, nil
 	}
 
+	// Snapshot requests are not served by the indexer while bootstrapping,
+	// only the last snapshot of the indexes warmed up so far is available.
+	if s.isBootstrapMode() {
+		return nil, common.ErrIndexerInBootstrap
+	}
+
 	snapResch := make(chan interface{}, 1)
 	snapReqMsg := &MsgIndexSnapRequest{
 		ts:          r.Ts,
@@ -491,6 +573,8 @@ func (s *scanCoordinator) getRequestedIndexSnapshot(r *ScanRequest) (snap IndexS
 		respch:      snapResch,
 		idxInstId:   r.IndexInstId,
 		expiredTime: r.ExpiredTime,
+		asOfTime:    r.asOfTime,
+		asOfTs:      r.asOfTs,
 	}
 
 	// Block wait until a ts is available for fullfilling the request
@@ -513,6 +597,81 @@ func (s *scanCoordinator) getRequestedIndexSnapshot(r *ScanRequest) (snap IndexS
 	return
 }
 
+// Bounded staleness scans are served from the last snapshot if it
+// includes all the mutations received until r.FreshAsOf, otherwise
+// wait until timekeeper generates a newer one or the bucket is found
+// caught up.  The wait is bounded by the request expiry, or by
+// stalenessDefaultTimeout if the request has no timeout.
+func (s *scanCoordinator) getFreshIndexSnapshot(r *ScanRequest) (IndexSnapshot, error) {
+	var bstats *BucketStats
+	if stats := s.stats.Get(); stats != nil {
+		bstats = stats.buckets[r.Bucket]
+	}
+
+	expiredTime := r.ExpiredTime
+	if expiredTime.IsZero() {
+		expiredTime = time.Now().Add(stalenessDefaultTimeout)
+	}
+
+	ticker := time.NewTicker(stalenessPollInterval)
+	defer ticker.Stop()
+
+	for {
+		snapshot := func() IndexSnapshot {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+
+			ss, ok := s.lastSnapshot[r.IndexInstId]
+			if ok && ss != nil && isSnapshotFresh(ss, r.FreshAsOf, bstats) {
+				return CloneIndexSnapshot(ss)
+			}
+			return nil
+		}()
+
+		if snapshot != nil {
+			return snapshot, nil
+		}
+
+		// No new snapshot is generated while bootstrapping
+		if s.isBootstrapMode() {
+			return nil, common.ErrIndexerInBootstrap
+		}
+
+		if time.Now().After(expiredTime) {
+			return nil, common.ErrScanTimedOut
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.getTimeoutCh():
+			return nil, common.ErrScanTimedOut
+		case <-r.CancelCh:
+			return nil, common.ErrClientCancel
+		}
+	}
+}
+
+// isSnapshotFresh checks whether the snapshot includes all the mutations
+// received by the indexer until freshAsOf (unix nano time).
+func isSnapshotFresh(ss IndexSnapshot, freshAsOf int64, bstats *BucketStats) bool {
+	snapTs := ss.Timestamp()
+	if snapTs == nil {
+		return false
+	}
+
+	if snapTs.GenTime >= freshAsOf {
+		return true
+	}
+
+	// bucket was found caught up with the snapshot's ts after freshAsOf
+	if bstats != nil && bstats.caughtUpTime.Value() >= freshAsOf &&
+		snapTs.GenTime >= bstats.caughtUpTsTime.Value() {
+		return true
+	}
+
+	return false
+}
+
 func readDeallocSnapshot(ch chan interface{}) {
 	msg := <-ch
 	if msg == nil {
@@ -569,6 +728,19 @@ func (s *scanCoordinator) isScanAllowed(c common.Consistency, scan *ScanRequest)
 		}
 	}
 
+	//a paused index is served at its last snapshot, only to the
+	//scans that do not wait for a timestamp
+	if scan.IndexInst.Paused && c != common.AnyConsistency {
+		return ErrIndexPaused
+	}
+
+	//no new snapshots are created while the disk is full, serve
+	//only the scans that can use the existing ones
+	if DiskState(atomic.LoadInt32(&s.diskState)) == DISK_FULL &&
+		c != common.AnyConsistency {
+		return ErrDiskFull
+	}
+
 	if scan.rollbackTime == 0 {
 		return nil
 	}
@@ -610,7 +782,7 @@ func (s *scanCoordinator) respondWithError(conn net.Conn, req *ScanRequest, err
 		res = &protobuf.CountResponse{
 			Count: proto.Int64(0), Err: protoErr,
 		}
-	case ScanAllReq, ScanReq:
+	case ScanAllReq, ScanReq, IntersectScanReq:
 		res = &protobuf.ResponseStream{
 			Err: protoErr,
 		}
@@ -643,7 +815,8 @@ func (s *scanCoordinator) tryRespondWithError(w ScanResponseWriter, req *ScanReq
 		} else if err == common.ErrIndexNotFound {
 			stats := s.stats.Get()
 			stats.notFoundError.Add(1)
-		} else if err == common.ErrIndexerInBootstrap {
+		} else if err == common.ErrIndexerInBootstrap ||
+			err == common.ErrScanQueueFull || err == common.ErrScanQueueTimeout {
 			logging.Verbosef("%s REQUEST %s", req.LogPrefix, req)
 			logging.Verbosef("%s RESPONSE status:(error = %s), requestId: %v", req.LogPrefix, err, req.RequestId)
 		} else {
@@ -731,6 +904,8 @@ func (s *scanCoordinator) handleUpdateIndexPartnMap(cmd Message) {
 func (s *scanCoordinator) handleConfigUpdate(cmd Message) {
 	cfgUpdate := cmd.(*MsgConfigUpdate)
 	s.config.Store(cfgUpdate.GetConfig())
+	s.leases.updateConfig(cfgUpdate.GetConfig())
+	s.admission.updateConfig(cfgUpdate.GetConfig())
 	s.supvCmdch <- &MsgSuccess{}
 }
 
@@ -759,6 +934,12 @@ func (s *scanCoordinator) handleIndexerBootstrap(cmd Message) {
 	s.supvCmdch <- &MsgSuccess{}
 }
 
+func (s *scanCoordinator) handleDiskStateChange(cmd Message) {
+	state := cmd.(*MsgDiskState).GetState()
+	atomic.StoreInt32(&s.diskState, int32(state))
+	s.supvCmdch <- &MsgSuccess{}
+}
+
 func (s *scanCoordinator) handleIndexerRollback(cmd Message) {
 
 	msg := cmd.(*MsgRollback)
@@ -954,7 +1135,8 @@ func (s *scanCoordinator) findIndexInstance(
 	ctx := make([]IndexReaderContext, len(partitionIds))
 	missing := make(map[common.IndexInstId][]common.PartitionId)
 	for _, inst := range s.indexInstMap {
-		if inst.State != common.INDEX_STATE_ACTIVE || (inst.RState != common.REBAL_ACTIVE && inst.RState != common.REBAL_PENDING) {
+		//index being resumed stays queryable while it catches up
+		if (inst.State != common.INDEX_STATE_ACTIVE && !inst.Paused) || (inst.RState != common.REBAL_ACTIVE && inst.RState != common.REBAL_PENDING) {
 			continue
 		}
 		if inst.Defn.DefnId == common.IndexDefnId(defnID) {
@@ -0,0 +1,283 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// number of attempts to get snapshots of all intersected
+// indexes at the same timestamp
+const intersectSnapshotRetries = 10
+
+// rows written between checks for client cancel
+const intersectCancelCheckRows = 1024
+
+//
+// docIdCollector is a ScanResponseWriter which collects the document ids
+// returned by a scan pipeline. If filter is set, only the document ids
+// found in filter are collected. If limit is set, the scan fails with
+// ErrIntersectTooLarge when more than limit document ids are collected.
+//
+type docIdCollector struct {
+	filter map[string]struct{}
+	docids map[string]struct{}
+	limit  int
+}
+
+func (d *docIdCollector) Row(pk, sk []byte) error {
+	if d.filter != nil {
+		if _, ok := d.filter[string(pk)]; !ok {
+			return nil
+		}
+	}
+	if d.limit > 0 && len(d.docids) >= d.limit {
+		if _, ok := d.docids[string(pk)]; !ok {
+			return ErrIntersectTooLarge
+		}
+	}
+	d.docids[string(pk)] = struct{}{}
+	return nil
+}
+
+// Errors are returned by the scan pipeline
+func (d *docIdCollector) Error(err error) error                            { return nil }
+func (d *docIdCollector) Stats(rows, unique uint64, min, max []byte) error { return nil }
+func (d *docIdCollector) Count(count uint64) error                         { return nil }
+func (d *docIdCollector) RawBytes([]byte) error                            { return nil }
+func (d *docIdCollector) Cursor(cursor []byte) error                       { return nil }
+func (d *docIdCollector) Done() error                                      { return nil }
+func (d *docIdCollector) Helo() error                                      { return nil }
+
+func (s *scanCoordinator) handleIntersectScanRequest(req *ScanRequest, w ScanResponseWriter, t0 time.Time) {
+
+	for _, sr := range req.IndexScans {
+		if sr.Stats != nil {
+			sr.Stats.numRequests.Add(1)
+			sr.Stats.numRequestsRange.Add(1)
+		}
+	}
+
+	snaps, err := s.getCommonIndexSnapshots(req)
+	if s.tryRespondWithError(w, req, err) {
+		return
+	}
+
+	defer func() {
+		for _, is := range snaps {
+			DestroyIndexSnapshot(is)
+		}
+	}()
+
+	logging.LazyVerbose(func() string {
+		return fmt.Sprintf("%s snapshot timestamp: %s",
+			req.LogPrefix, ScanTStoString(snaps[0].Timestamp()))
+	})
+
+	waitTime := time.Now().Sub(t0)
+
+	// Scans of the same index (on different partitions) are unioned first
+	var groups [][]int
+	groupPos := make(map[uint64]int)
+	for i, sr := range req.IndexScans {
+		pos, ok := groupPos[sr.DefnID]
+		if !ok {
+			pos = len(groups)
+			groupPos[sr.DefnID] = pos
+			groups = append(groups, nil)
+		}
+		groups[pos] = append(groups[pos], i)
+	}
+
+	// document ids are held in memory till all the indexes are scanned
+	limit := s.config.Load()["scan.intersect.max_docids"].Int()
+
+	var docids map[string]struct{}
+	for g, group := range groups {
+		collector := &docIdCollector{limit: limit}
+		if req.Union && docids != nil {
+			collector.docids = docids
+		} else {
+			collector.docids = make(map[string]struct{})
+		}
+		if !req.Union && g > 0 {
+			collector.filter = docids
+		}
+
+		for _, i := range group {
+			if err = s.collectDocIds(req.IndexScans[i], snaps[i], collector); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+
+		docids = collector.docids
+		if !req.Union && len(docids) == 0 {
+			break
+		}
+	}
+
+	if s.tryRespondWithError(w, req, err) {
+		return
+	}
+
+	sorted := make([]string, 0, len(docids))
+	for docid := range docids {
+		sorted = append(sorted, docid)
+	}
+	sort.Strings(sorted)
+
+	if req.Limit > 0 && int64(len(sorted)) > req.Limit {
+		sorted = sorted[:req.Limit]
+	}
+
+	err = s.writeDocIds(req, w, sorted)
+	scanTime := time.Now().Sub(t0)
+
+	for _, sr := range req.IndexScans {
+		if sr.Stats != nil {
+			sr.Stats.numRowsReturned.Add(int64(len(sorted)))
+			sr.Stats.numRowsReturnedRange.Add(int64(len(sorted)))
+			sr.Stats.scanDuration.Add(scanTime.Nanoseconds())
+			sr.Stats.scanWaitDuration.Add(waitTime.Nanoseconds())
+		}
+	}
+
+	status := "ok"
+	if err != nil {
+		status = fmt.Sprintf("(error = %s)", err)
+		if err != common.ErrClientCancel {
+			s.tryRespondWithError(w, req, err)
+		}
+	}
+
+	logging.LazyVerbose(func() string {
+		return fmt.Sprintf("%s RESPONSE rows:%d, indexes:%d, waitTime:%v, totalTime:%v, status:%s, requestId:%s",
+			req.LogPrefix, len(sorted), len(groups), waitTime, scanTime, status, req.RequestId)
+	})
+}
+
+func (s *scanCoordinator) collectDocIds(sr *ScanRequest, is IndexSnapshot, collector *docIdCollector) error {
+
+	for _, ctx := range sr.Ctxs {
+		ctx.Init()
+	}
+	defer func() {
+		for _, ctx := range sr.Ctxs {
+			ctx.Done()
+		}
+	}()
+
+	scanPipeline := NewScanPipeline(sr, collector, is, s.config.Load())
+	cancelCb := NewCancelCallback(sr, func(e error) {
+		scanPipeline.Cancel(e)
+	})
+	cancelCb.Run()
+	defer cancelCb.Done()
+
+	err := scanPipeline.Execute()
+
+	if sr.Stats != nil {
+		sr.Stats.scanBytesRead.Add(int64(scanPipeline.BytesRead()))
+		sr.Stats.numRowsScannedRange.Add(int64(scanPipeline.RowsScanned()))
+	}
+
+	return err
+}
+
+func (s *scanCoordinator) writeDocIds(req *ScanRequest, w ScanResponseWriter, docids []string) error {
+
+	for i, docid := range docids {
+		if i%intersectCancelCheckRows == 0 {
+			select {
+			case <-req.CancelCh:
+				return common.ErrClientCancel
+			case <-req.getTimeoutCh():
+				return common.ErrScanTimedOut
+			default:
+			}
+		}
+
+		if err := w.Row([]byte(docid), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// getCommonIndexSnapshots returns a snapshot of every intersected index, all
+// at the same timestamp. Indexes of a bucket get a new snapshot at the same
+// timestamp, but a flush could be completed between requesting the snapshots.
+// In that case, snapshots are requested again at the most recent timestamp.
+//
+func (s *scanCoordinator) getCommonIndexSnapshots(req *ScanRequest) ([]IndexSnapshot, error) {
+
+	snaps := make([]IndexSnapshot, len(req.IndexScans))
+
+	destroy := func() {
+		for i, is := range snaps {
+			DestroyIndexSnapshot(is)
+			snaps[i] = nil
+		}
+	}
+
+	for attempt := 0; attempt < intersectSnapshotRetries; attempt++ {
+		for i, sr := range req.IndexScans {
+			is, err := s.getRequestedIndexSnapshot(sr)
+			if err != nil {
+				destroy()
+				return nil, err
+			}
+			snaps[i] = is
+		}
+
+		// find the most recent timestamp
+		var latest *common.TsVbuuid
+		for _, is := range snaps {
+			if ts := is.Timestamp(); ts != nil && (latest == nil || !latest.AsRecentTs(ts)) {
+				latest = ts
+			}
+		}
+
+		same := latest != nil
+		for _, is := range snaps {
+			if !same || !is.Timestamp().Equal2(latest, false) {
+				same = false
+				break
+			}
+		}
+		if same {
+			return snaps, nil
+		}
+
+		logging.Verbosef("%v getCommonIndexSnapshots: snapshot timestamps differ, attempt %v", req.LogPrefix, attempt)
+
+		if latest != nil {
+			latest = latest.Copy()
+			for _, sr := range req.IndexScans {
+				cons := common.QueryConsistency
+				sr.Consistency = &cons
+				sr.Ts = latest
+			}
+		}
+		destroy()
+	}
+
+	return nil, ErrIntersectSnapshot
+}
@@ -0,0 +1,54 @@
+package indexer
+
+import (
+	"testing"
+)
+
+func TestDocIdCollector(t *testing.T) {
+	collector := &docIdCollector{docids: make(map[string]struct{})}
+	for _, docid := range []string{"a", "b", "c", "b"} {
+		if err := collector.Row([]byte(docid), nil); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if len(collector.docids) != 3 {
+		t.Errorf("Expected 3 docids, got %v", collector.docids)
+	}
+
+	// intersect with the docids of the previous index
+	filtered := &docIdCollector{docids: make(map[string]struct{}), filter: collector.docids}
+	for _, docid := range []string{"b", "c", "d"} {
+		if err := filtered.Row([]byte(docid), nil); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if len(filtered.docids) != 2 {
+		t.Errorf("Expected docids b and c, got %v", filtered.docids)
+	}
+	if _, ok := filtered.docids["d"]; ok {
+		t.Errorf("Unexpected docid d")
+	}
+}
+
+func TestDocIdCollectorLimit(t *testing.T) {
+	collector := &docIdCollector{docids: make(map[string]struct{}), limit: 2}
+	for _, docid := range []string{"a", "b", "a", "b"} {
+		if err := collector.Row([]byte(docid), nil); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if err := collector.Row([]byte("c"), nil); err != ErrIntersectTooLarge {
+		t.Errorf("Expected %v, got %v", ErrIntersectTooLarge, err)
+	}
+
+	// docids filtered out do not count towards the limit
+	filtered := &docIdCollector{docids: make(map[string]struct{}), filter: collector.docids, limit: 1}
+	for _, docid := range []string{"c", "d", "a", "e"} {
+		if err := filtered.Row([]byte(docid), nil); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if err := filtered.Row([]byte("b"), nil); err != ErrIntersectTooLarge {
+		t.Errorf("Expected %v, got %v", ErrIntersectTooLarge, err)
+	}
+}
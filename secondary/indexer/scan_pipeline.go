@@ -17,7 +17,6 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/couchbase/indexing/secondary/collatejson"
 	c "github.com/couchbase/indexing/secondary/common"
 	l "github.com/couchbase/indexing/secondary/logging"
 	p "github.com/couchbase/indexing/secondary/pipeline"
@@ -140,6 +139,12 @@ func (s *IndexScanSource) Routine() error {
 
 	var cachedEntry entryCache
 
+	// continuation
+	var cursor []byte
+	scanPos := r.scanPosBase
+	resume := r.continuation
+	skipDups := 0
+
 	if r.GroupAggr != nil {
 		r.GroupAggr.groups = make([]*groupKey, len(r.GroupAggr.Group))
 		for i, _ := range r.GroupAggr.Group {
@@ -167,6 +172,19 @@ func (s *IndexScanSource) Routine() error {
 		iterCount++
 		s.p.rowsScanned++
 
+		// Skip the entries returned before the scan was resumed
+		raw := entry
+		if resume != nil {
+			cmp := compareResumeEntry(raw, resume, r.isPrimary, checkDistinct)
+			if cmp < 0 || (cmp == 0 && (checkDistinct || r.isPrimary)) {
+				return nil
+			}
+			if cmp == 0 {
+				skipDups = int(resume.Dups)
+			}
+			resume = nil
+		}
+
 		skipRow := false
 		var ck, dk [][]byte
 
@@ -253,9 +271,18 @@ func (s *IndexScanSource) Routine() error {
 			if r.Distinct && i > 0 {
 				break
 			}
+			if i < skipDups {
+				continue
+			}
 			if currOffset >= r.Offset {
 				s.p.rowsReturned++
-				wrErr := s.WriteItem(entry)
+				var wrErr error
+				if r.withContinuation {
+					cursor = encodeScanCursor(cursor, scanPos, i+1, raw)
+					wrErr = s.WriteItem(entry, cursor)
+				} else {
+					wrErr = s.WriteItem(entry)
+				}
 				if wrErr != nil {
 					return wrErr
 				}
@@ -266,6 +293,7 @@ func (s *IndexScanSource) Routine() error {
 				currOffset++
 			}
 		}
+		skipDups = 0
 
 		if checkDistinct {
 			previousRow = append(previousRow[:0], entry...)
@@ -288,8 +316,9 @@ func (s *IndexScanSource) Routine() error {
 	}
 
 loop:
-	for _, scan := range r.Scans {
+	for i, scan := range r.Scans {
 		currentScan = scan
+		scanPos = r.scanPosBase + i
 		err = scatter(r, scan, sliceSnapshots, fn, s.p.config)
 		switch err {
 		case nil:
@@ -371,7 +400,7 @@ func (d *IndexScanDecoder) Routine() error {
 	defer d.CloseWrite()
 	defer d.CloseRead()
 
-	var sk, docid []byte
+	var sk, docid, cursor []byte
 	tmpBuf := p.GetBlock()
 	defer p.PutBlock(tmpBuf)
 
@@ -404,7 +433,15 @@ loop:
 		if !d.p.req.isPrimary && !d.p.req.projectPrimaryKey {
 			docid = nil
 		}
-		err = d.WriteItem(sk, docid)
+		if d.p.req.withContinuation {
+			if cursor, err = d.ReadItem(); err != nil {
+				d.CloseWithError(err)
+				break loop
+			}
+			err = d.WriteItem(sk, docid, cursor)
+		} else {
+			err = d.WriteItem(sk, docid)
+		}
 		if err != nil {
 			break // TODO: Old code. Should it be ClosedWithError?
 		}
@@ -415,7 +452,7 @@ loop:
 
 func (d *IndexScanWriter) Routine() error {
 	var err error
-	var sk, pk []byte
+	var sk, pk, cursor []byte
 
 	defer func() {
 		// Send error to the client if not client requested cancel.
@@ -446,6 +483,15 @@ loop:
 			return err
 		}
 
+		if d.p.req.withContinuation {
+			if cursor, err = d.ReadItem(); err != nil {
+				return err
+			}
+			if err = d.w.Cursor(cursor); err != nil {
+				return err
+			}
+		}
+
 		/*
 		   TODO(sarath): Use block chunk send protocol
 		   Instead of collecting rows and encoding into protobuf,
@@ -1184,8 +1230,7 @@ func encodeValue(raw interface{}) ([]byte, error) {
 		return nil, err
 	}
 
-	encbuf := make([]byte, 3*len(jsonraw)+collatejson.MinBufferSize)
-	encval, err := jsonEncoder.Encode(jsonraw, encbuf)
+	encval, err := jsonEncoder.EncodeJSON(jsonraw, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -24,6 +24,7 @@ type ScanResponseWriter interface {
 	Count(count uint64) error
 	RawBytes([]byte) error
 	Row(pk, sk []byte) error
+	Cursor(cursor []byte) error
 	Done() error
 	Helo() error
 }
@@ -35,6 +36,12 @@ type protoResponseWriter struct {
 	rowBuf     *[]byte
 	rowEntries []*protobuf.IndexEntry
 	rowSize    int
+
+	// continuation token of the last row
+	cont      *ScanContinuation
+	contRows  uint64
+	contToken []byte
+	contSent  bool // a token has been handed out
 }
 
 func NewProtoWriter(t ScanReqType, conn net.Conn) *protoResponseWriter {
@@ -46,6 +53,16 @@ func NewProtoWriter(t ScanReqType, conn net.Conn) *protoResponseWriter {
 	}
 }
 
+func (w *protoResponseWriter) InitContinuation(r *ScanRequest) {
+	w.cont = &ScanContinuation{
+		LeaseId: r.leaseId,
+		InstId:  r.IndexInstId,
+	}
+	if r.continuation != nil {
+		w.contRows = r.continuation.RowsReturned
+	}
+}
+
 func (w *protoResponseWriter) writeLen(l int) error {
 	binary.LittleEndian.PutUint16((*w.encBuf)[:2], uint16(l))
 	_, err := w.conn.Write((*w.rowBuf)[:2])
@@ -69,7 +86,7 @@ func (w *protoResponseWriter) Error(err error) error {
 		res = &protobuf.CountResponse{
 			Count: proto.Int64(0), Err: protoErr,
 		}
-	case ScanAllReq, ScanReq:
+	case ScanAllReq, ScanReq, IntersectScanReq:
 		res = &protobuf.ResponseStream{
 			Err: protoErr,
 		}
@@ -120,12 +137,13 @@ func (w *protoResponseWriter) RawBytes(b []byte) error {
 func (w *protoResponseWriter) Row(pk, sk []byte) error {
 
 	if w.rowSize != 0 && w.rowSize+len(pk)+len(sk) > len(*w.rowBuf) {
-		res := &protobuf.ResponseStream{IndexEntries: w.rowEntries}
+		res := &protobuf.ResponseStream{IndexEntries: w.rowEntries, Continuation: w.contToken}
 		err := protobuf.EncodeAndWrite(w.conn, *w.encBuf, res)
 		if err != nil {
 			return err
 		}
 
+		w.contSent = w.contSent || w.contToken != nil
 		w.rowSize = 0
 		w.rowEntries = nil
 	}
@@ -153,12 +171,37 @@ func (w *protoResponseWriter) Row(pk, sk []byte) error {
 	return nil
 }
 
+// Cursor records the position of the last row written, so that
+// the next batch of rows carries the token to resume after it.
+func (w *protoResponseWriter) Cursor(cursor []byte) error {
+	if w.cont == nil {
+		return nil
+	}
+
+	scanPos, dups, entry := decodeScanCursor(cursor)
+	w.contRows++
+	w.cont.ScanPos = scanPos
+	w.cont.Dups = dups
+	w.cont.RowsReturned = w.contRows
+	w.cont.Entry = entry
+	w.contToken = w.cont.Encode(w.contToken)
+	return nil
+}
+
+// EndContinuation is called once the scan has returned all its rows.  The
+// last batch of rows does not carry a token as there is nothing left to
+// resume.  Returns true if a token has already been handed out.
+func (w *protoResponseWriter) EndContinuation() bool {
+	w.contToken = nil
+	return w.contSent
+}
+
 func (w *protoResponseWriter) Done() error {
 	defer p.PutBlock(w.encBuf)
 	defer p.PutBlock(w.rowBuf)
 
-	if (w.scanType == ScanReq || w.scanType == ScanAllReq) && w.rowSize > 0 {
-		res := &protobuf.ResponseStream{IndexEntries: w.rowEntries}
+	if (w.scanType == ScanReq || w.scanType == ScanAllReq || w.scanType == IntersectScanReq) && w.rowSize > 0 {
+		res := &protobuf.ResponseStream{IndexEntries: w.rowEntries, Continuation: w.contToken}
 		err := protobuf.EncodeAndWrite(w.conn, *w.encBuf, res)
 		if err != nil {
 			return err
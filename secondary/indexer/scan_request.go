@@ -13,6 +13,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"sort"
 	"strings"
 	"sync/atomic"
@@ -37,6 +38,7 @@ const (
 	ScanAllReq                    = "scanAll"
 	HeloReq                       = "helo"
 	MultiScanCountReq             = "multiscancount"
+	IntersectScanReq              = "intersectScan"
 )
 
 type ScanRequest struct {
@@ -51,6 +53,8 @@ type ScanRequest struct {
 	High         IndexKey
 	Keys         []IndexKey
 	Consistency  *common.Consistency
+	FreshAsOf    int64 // unix nano time, for BoundedStalenessConsistency
+	Priority     common.ScanPriority
 	Stats        *IndexStats
 	IndexInst    common.IndexInst
 
@@ -64,6 +68,9 @@ type ScanRequest struct {
 	Limit     int64
 	isPrimary bool
 
+	// unicode collation of string keys, if any
+	collation *collatejson.Collation
+
 	// New parameters for spock
 	Scans             []Scan
 	Indexprojection   *Projection
@@ -79,9 +86,29 @@ type ScanRequest struct {
 	// New parameters for partitioned index
 	Sorted bool
 
+	// Client does not need the rows in order. Older clients do not
+	// set sorted, their rows are always returned in order.
+	unordered bool
+
 	// Rollback Time
 	rollbackTime int64
 
+	// Continuation tokens
+	withContinuation bool
+	continuation     *ScanContinuation
+	leaseId          uint64
+	scanPosBase      int
+	scanCompleted    bool // all the rows of the scan have been returned
+
+	// Time travel: scan a retained snapshot
+	asOfTime int64
+	asOfTs   *common.TsVbuuid
+
+	// Index intersection: scans of each index, and whether
+	// their document ids are unioned instead of intersected
+	IndexScans []*ScanRequest
+	Union      bool
+
 	ScanId      uint64
 	ExpiredTime time.Time
 	Timeout     *time.Timer
@@ -291,10 +318,11 @@ func NewScanRequest(protoReq interface{},
 		cons := common.Consistency(req.GetCons())
 		vector := req.GetVector()
 		r.ScanType = CountReq
+		r.Priority = common.ScanPriority(req.GetPriority())
 		r.Incl = Inclusion(req.GetSpan().GetRange().GetInclusion())
 		r.Sorted = true
 
-		if isBootstrapMode {
+		if isBootstrapMode && cons != common.AnyConsistency {
 			err = common.ErrIndexerInBootstrap
 			return
 		}
@@ -333,16 +361,19 @@ func NewScanRequest(protoReq interface{},
 		cons := common.Consistency(req.GetCons())
 		vector := req.GetVector()
 		r.ScanType = ScanReq
+		r.Priority = common.ScanPriority(req.GetPriority())
 		r.Incl = Inclusion(req.GetSpan().GetRange().GetInclusion())
 		r.Limit = req.GetLimit()
 		r.Sorted = req.GetSorted()
+		r.unordered = req.Sorted != nil && !req.GetSorted()
 		r.Reverse = req.GetReverse()
 		proj := req.GetIndexprojection()
 		if proj == nil {
 			r.Distinct = req.GetDistinct()
 		}
 		r.Offset = req.GetOffset()
-		if isBootstrapMode {
+		r.withContinuation = req.GetWithContinuation()
+		if isBootstrapMode && cons != common.AnyConsistency {
 			err = common.ErrIndexerInBootstrap
 			return
 		}
@@ -350,6 +381,22 @@ func NewScanRequest(protoReq interface{},
 			return
 		}
 
+		if token := req.GetContinuation(); len(token) != 0 {
+			if err = r.setContinuation(token); err != nil {
+				return
+			}
+			// Snapshot is pinned by the lease. No need to wait
+			// for the requested consistency again.
+			cons, vector = common.AnyConsistency, nil
+		} else if req.GetAsOfTime() != 0 || req.GetAsOfVector() != nil {
+			if err = r.setAsOf(req.GetAsOfTime(), req.GetAsOfVector()); err != nil {
+				return
+			}
+			// Retained snapshot is older than any consistency
+			// criteria, it is served as is.
+			cons, vector = common.AnyConsistency, nil
+		}
+
 		if err = r.setConsistency(cons, vector); err != nil {
 			return
 		}
@@ -383,6 +430,9 @@ func NewScanRequest(protoReq interface{},
 		if err = r.fillGroupAggr(req.GetGroupAggr()); err != nil {
 			return
 		}
+		if err = r.applyContinuation(); err != nil {
+			return
+		}
 
 	case *protobuf.ScanAllRequest:
 		r.DefnID = req.GetDefnID()
@@ -392,12 +442,13 @@ func NewScanRequest(protoReq interface{},
 		cons := common.Consistency(req.GetCons())
 		vector := req.GetVector()
 		r.ScanType = ScanAllReq
+		r.Priority = common.ScanPriority(req.GetPriority())
 		r.Limit = req.GetLimit()
 		r.Scans = make([]Scan, 1)
 		r.Scans[0].ScanType = AllReq
 		r.Sorted = true
 
-		if isBootstrapMode {
+		if isBootstrapMode && cons != common.AnyConsistency {
 			err = common.ErrIndexerInBootstrap
 			return
 		}
@@ -409,6 +460,36 @@ func NewScanRequest(protoReq interface{},
 		if err = r.setConsistency(cons, vector); err != nil {
 			return
 		}
+
+	case *protobuf.IntersectScanRequest:
+		r.RequestId = req.GetRequestId()
+		cons := common.Consistency(req.GetCons())
+		vector := req.GetVector()
+		r.ScanType = IntersectScanReq
+		r.Priority = common.ScanPriority(req.GetPriority())
+		r.Limit = req.GetLimit()
+		r.Union = req.GetUnion()
+		r.Sorted = true
+
+		if isBootstrapMode && cons != common.AnyConsistency {
+			err = common.ErrIndexerInBootstrap
+			return
+		}
+
+		if err = r.setIndexScans(req.GetIndexScans()); err != nil {
+			return
+		}
+
+		if err = r.setConsistency(cons, vector); err != nil {
+			return
+		}
+
+		for _, sr := range r.IndexScans {
+			sr.Consistency = r.Consistency
+			sr.Ts = r.Ts
+			sr.FreshAsOf = r.FreshAsOf
+		}
+
 	default:
 		err = ErrUnsupportedRequest
 	}
@@ -441,6 +522,10 @@ func (r *ScanRequest) Done() {
 
 	r.keyBufList = nil
 
+	for _, sr := range r.IndexScans {
+		sr.Done()
+	}
+
 	if r.Timeout != nil {
 		r.Timeout.Stop()
 	}
@@ -465,22 +550,46 @@ func (r *ScanRequest) newKey(k []byte) (IndexKey, error) {
 	}
 }
 
-func (r *ScanRequest) newLowKey(k []byte) (IndexKey, error) {
+func (r *ScanRequest) newLowKey(k []byte, incl Inclusion) (IndexKey, error) {
 	if r.isNil(k) {
 		return MinIndexKey, nil
 	}
 
+	if r.collation != nil {
+		if incl == Low || incl == Both {
+			return r.newCollatedKey(k, collatejson.LowBound)
+		}
+		return r.newCollatedKey(k, collatejson.HighBound)
+	}
+
 	return r.newKey(k)
 }
 
-func (r *ScanRequest) newHighKey(k []byte) (IndexKey, error) {
+func (r *ScanRequest) newHighKey(k []byte, incl Inclusion) (IndexKey, error) {
 	if r.isNil(k) {
 		return MaxIndexKey, nil
 	}
 
+	if r.collation != nil {
+		if incl == High || incl == Both {
+			return r.newCollatedKey(k, collatejson.HighBound)
+		}
+		return r.newCollatedKey(k, collatejson.LowBound)
+	}
+
 	return r.newKey(k)
 }
 
+// Strings that are equal under the collation of the index differ in their
+// encoded bytes, scan keys are encoded as the lowest or highest of them.
+func (r *ScanRequest) newCollatedKey(k []byte, bound collatejson.Bound) (IndexKey, error) {
+	if k == nil {
+		return nil, fmt.Errorf("Key is null")
+	}
+
+	return NewCollatedSecondaryKey(k, r.collation, bound)
+}
+
 func (r *ScanRequest) fillRanges(low, high []byte, keys [][]byte) (localErr error) {
 	var key IndexKey
 
@@ -488,12 +597,12 @@ func (r *ScanRequest) fillRanges(low, high []byte, keys [][]byte) (localErr erro
 	r.LowBytes = low
 	r.HighBytes = high
 
-	if r.Low, localErr = r.newLowKey(low); localErr != nil {
+	if r.Low, localErr = r.newLowKey(low, r.Incl); localErr != nil {
 		localErr = fmt.Errorf("Invalid low key %s (%s)", string(low), localErr)
 		return
 	}
 
-	if r.High, localErr = r.newHighKey(high); localErr != nil {
+	if r.High, localErr = r.newHighKey(high, r.Incl); localErr != nil {
 		localErr = fmt.Errorf("Invalid high key %s (%s)", string(high), localErr)
 		return
 	}
@@ -501,7 +610,12 @@ func (r *ScanRequest) fillRanges(low, high []byte, keys [][]byte) (localErr erro
 	// point query for keys
 	for _, k := range keys {
 		r.KeysBytes = append(r.KeysBytes, k)
-		if key, localErr = r.newKey(k); localErr != nil {
+		if r.collation != nil {
+			key, localErr = r.newCollatedKey(k, collatejson.LowBound)
+		} else {
+			key, localErr = r.newKey(k)
+		}
+		if localErr != nil {
 			localErr = fmt.Errorf("Invalid equal key %s (%s)", string(k), localErr)
 			return
 		}
@@ -667,6 +781,10 @@ func (r *ScanRequest) fillFilterLowHigh(compFilters []CompositeElementFilter, fi
 }
 
 func (r *ScanRequest) fillFilterEquals(protoScan *protobuf.Scan, filter *Filter) error {
+	if r.collation != nil {
+		return r.fillCollatedFilterEquals(protoScan, filter)
+	}
+
 	var e error
 	var equals [][]byte
 	for _, k := range protoScan.Equals {
@@ -712,6 +830,31 @@ func (r *ScanRequest) fillFilterEquals(protoScan *protobuf.Scan, filter *Filter)
 	return nil
 }
 
+// With collation, equal keys are the range from the lowest to the highest
+// of the strings equal to them.
+func (r *ScanRequest) fillCollatedFilterEquals(protoScan *protobuf.Scan, filter *Filter) error {
+	var compFilters []CompositeElementFilter
+	for _, k := range protoScan.Equals {
+		low, e := r.newCollatedKey(k, collatejson.LowBound)
+		if e != nil {
+			return fmt.Errorf("Invalid equal key %s (%s)", logging.TagStrUD(k), e)
+		}
+		high, e := r.newCollatedKey(k, collatejson.HighBound)
+		if e != nil {
+			return fmt.Errorf("Invalid equal key %s (%s)", logging.TagStrUD(k), e)
+		}
+		compFilters = append(compFilters, CompositeElementFilter{
+			Low:       low,
+			High:      high,
+			Inclusion: Both,
+		})
+	}
+
+	filter.CompositeFilters = compFilters
+	filter.Inclusion = Both
+	return r.fillFilterLowHigh(compFilters, filter)
+}
+
 ///// Compose Scans for Secondary Index
 // Create scans from sorted Index Points
 // Iterate over sorted points and keep track of applicable filters
@@ -863,7 +1006,14 @@ func (r *ScanRequest) fillScans(protoScans []*protobuf.Scan) (localErr error) {
 	// For Upgrade
 	if len(protoScans) == 0 {
 		r.Scans = make([]Scan, 1)
-		if len(r.Keys) > 0 {
+		if len(r.Keys) > 0 && r.collation != nil {
+			r.Scans[0].Low = r.Keys[0]
+			if r.Scans[0].High, localErr = r.newCollatedKey(r.KeysBytes[0], collatejson.HighBound); localErr != nil {
+				return
+			}
+			r.Scans[0].Incl = Both
+			r.Scans[0].ScanType = RangeReq
+		} else if len(r.Keys) > 0 {
 			r.Scans[0].Equals = r.Keys[0] //TODO fix for multiple Keys needed?
 			r.Scans[0].ScanType = LookupReq
 		} else {
@@ -915,12 +1065,12 @@ func (r *ScanRequest) fillScans(protoScans []*protobuf.Scan) (localErr error) {
 			}
 
 			fl := protoScan.Filters[0]
-			if l, localErr = r.newLowKey(fl.Low); localErr != nil {
+			if l, localErr = r.newLowKey(fl.Low, Inclusion(fl.GetInclusion())); localErr != nil {
 				localErr = fmt.Errorf("Invalid low key %s (%s)", logging.TagStrUD(fl.Low), localErr)
 				return
 			}
 
-			if h, localErr = r.newHighKey(fl.High); localErr != nil {
+			if h, localErr = r.newHighKey(fl.High, Inclusion(fl.GetInclusion())); localErr != nil {
 				localErr = fmt.Errorf("Invalid high key %s (%s)", logging.TagStrUD(fl.High), localErr)
 				return
 			}
@@ -991,12 +1141,12 @@ func (r *ScanRequest) fillScans(protoScans []*protobuf.Scan) (localErr error) {
 			var compFilters []CompositeElementFilter
 			// Encode Filters
 			for _, fl := range protoScan.Filters {
-				if l, localErr = r.newLowKey(fl.Low); localErr != nil {
+				if l, localErr = r.newLowKey(fl.Low, Inclusion(fl.GetInclusion())); localErr != nil {
 					localErr = fmt.Errorf("Invalid low key %s (%s)", logging.TagStrUD(fl.Low), localErr)
 					return
 				}
 
-				if h, localErr = r.newHighKey(fl.High); localErr != nil {
+				if h, localErr = r.newHighKey(fl.High, Inclusion(fl.GetInclusion())); localErr != nil {
 					localErr = fmt.Errorf("Invalid high key %s (%s)", logging.TagStrUD(fl.High), localErr)
 					return
 				}
@@ -1066,10 +1216,186 @@ func (r *ScanRequest) setConsistency(cons common.Consistency, vector *protobuf.T
 		}
 		r.Ts.Crc64 = 0
 		r.Ts.Bucket = r.Bucket
+	} else if cons == common.BoundedStalenessConsistency {
+		staleness := vector.GetStaleness()
+		if staleness < 0 {
+			localErr = ErrInvalidStaleness
+			return
+		}
+		r.FreshAsOf = time.Now().Add(-time.Duration(staleness) * time.Millisecond).UnixNano()
 	}
 	return
 }
 
+func (r *ScanRequest) setAsOf(asOfTime int64, vector *protobuf.TsConsistency) error {
+	if asOfTime > time.Now().UnixNano() {
+		return ErrAsOfTimeInFuture
+	}
+	r.asOfTime = asOfTime
+
+	if vector != nil {
+		cfg := r.sco.config.Load()
+		numVbuckets := cfg["numVbuckets"].Int()
+		if len(vector.Vbnos) > numVbuckets || len(vector.Seqnos) != len(vector.Vbnos) ||
+			len(vector.Vbuuids) != len(vector.Vbnos) {
+			return ErrInvalidAsOfVector
+		}
+
+		r.asOfTs = common.NewTsVbuuid(r.Bucket, numVbuckets)
+		// vbuckets not in the vector do not constrain the snapshot
+		for i := range r.asOfTs.Seqnos {
+			r.asOfTs.Seqnos[i] = math.MaxUint64
+		}
+		for i, vbno := range vector.Vbnos {
+			if int(vbno) >= numVbuckets {
+				r.asOfTs = nil
+				return ErrInvalidAsOfVector
+			}
+			r.asOfTs.Seqnos[vbno] = vector.Seqnos[i]
+			r.asOfTs.Vbuuids[vbno] = vector.Vbuuids[i]
+		}
+	}
+	return nil
+}
+
+func (r *ScanRequest) isAsOf() bool {
+	return r.asOfTime != 0 || r.asOfTs != nil
+}
+
+// setIndexScans prepares a scan request for each index of an
+// intersect scan. All indexes must belong to the same bucket.
+func (r *ScanRequest) setIndexScans(protoScans []*protobuf.ScanRequest) (localErr error) {
+	if len(protoScans) == 0 {
+		return ErrUnsupportedRequest
+	}
+
+	for _, protoScan := range protoScans {
+		sr := &ScanRequest{
+			ScanType:          ScanReq,
+			DefnID:            protoScan.GetDefnID(),
+			RequestId:         r.RequestId,
+			rollbackTime:      protoScan.GetRollbackTime(),
+			PartitionIds:      makePartitionIds(protoScan.GetPartitionIds()),
+			Incl:              Inclusion(protoScan.GetSpan().GetRange().GetInclusion()),
+			Limit:             math.MaxInt64,
+			Sorted:            true,
+			projectPrimaryKey: true,
+			ScanId:            r.ScanId,
+			LogPrefix:         r.LogPrefix,
+			ExpiredTime:       r.ExpiredTime,
+			Timeout:           r.Timeout,
+			CancelCh:          r.CancelCh,
+			sco:               r.sco,
+		}
+		r.IndexScans = append(r.IndexScans, sr)
+
+		if localErr = sr.setIndexParams(); localErr != nil {
+			return
+		}
+
+		localErr = sr.fillRanges(
+			protoScan.GetSpan().GetRange().GetLow(),
+			protoScan.GetSpan().GetRange().GetHigh(),
+			protoScan.GetSpan().GetEquals())
+		if localErr != nil {
+			return
+		}
+
+		if localErr = sr.fillScans(protoScan.GetScans()); localErr != nil {
+			return
+		}
+	}
+
+	// Request level parameters are taken from the first index
+	first := r.IndexScans[0]
+	r.DefnID, r.IndexInstId, r.IndexName, r.Bucket = first.DefnID, first.IndexInstId, first.IndexName, first.Bucket
+	r.rollbackTime = first.rollbackTime
+	r.hasRollback = first.hasRollback
+
+	for _, sr := range r.IndexScans {
+		if sr.Bucket != r.Bucket {
+			return ErrIntersectBucket
+		}
+	}
+
+	return
+}
+
+func (r *ScanRequest) setContinuation(token []byte) (localErr error) {
+	if r.continuation, localErr = DecodeScanContinuation(token); localErr != nil {
+		return
+	}
+
+	if r.continuation.InstId != r.IndexInstId {
+		localErr = ErrContinuationInvalid
+		return
+	}
+
+	r.withContinuation = true
+	r.leaseId = r.continuation.LeaseId
+	return
+}
+
+// Validate the request for continuation and, if resuming, drop the scans
+// which are already completed and move the low key of the current scan
+// up to the last returned entry.  Entries up to and including the last
+// returned entry are skipped by the scan pipeline.
+func (r *ScanRequest) applyContinuation() error {
+	if !r.withContinuation {
+		return nil
+	}
+
+	if r.GroupAggr != nil || (len(r.PartitionIds) > 1 && !r.Sorted) {
+		return ErrContinuationUnsupported
+	}
+
+	cont := r.continuation
+	if cont == nil {
+		return nil
+	}
+
+	if int(cont.ScanPos) >= len(r.Scans) {
+		return ErrContinuationInvalid
+	}
+
+	r.Offset = 0
+	if r.Limit > 0 {
+		if uint64(r.Limit) <= cont.RowsReturned {
+			r.Scans = nil
+			return nil
+		}
+		r.Limit -= int64(cont.RowsReturned)
+	}
+
+	r.scanPosBase = int(cont.ScanPos)
+	r.Scans = r.Scans[cont.ScanPos:]
+
+	var seek IndexKey
+	if r.isPrimary {
+		seek, _ = NewPrimaryKey(cont.Entry)
+	} else {
+		e := secondaryIndexEntry(cont.Entry)
+		k := secondaryKey(cont.Entry[:e.lenKey()])
+		seek = &k
+	}
+
+	scan := &r.Scans[0]
+	switch scan.ScanType {
+	case AllReq:
+		scan.Low, scan.High, scan.Incl = seek, MaxIndexKey, Both
+		scan.ScanType = RangeReq
+	case RangeReq, FilterRangeReq:
+		scan.Low = seek
+		if scan.Incl == Neither {
+			scan.Incl = Low
+		} else if scan.Incl == High {
+			scan.Incl = Both
+		}
+	}
+
+	return nil
+}
+
 func (r *ScanRequest) setIndexParams() (localErr error) {
 	r.sco.mu.RLock()
 	defer r.sco.mu.RUnlock()
@@ -1078,7 +1404,10 @@ func (r *ScanRequest) setIndexParams() (localErr error) {
 
 	stats := r.sco.stats.Get()
 	indexInst, r.Ctxs, localErr = r.sco.findIndexInstance(r.DefnID, r.PartitionIds)
-	if localErr == nil {
+	if localErr != nil && r.sco.isBootstrapMode() {
+		// only the indexes warmed up so far are known while bootstrapping
+		localErr = common.ErrIndexerInBootstrap
+	} else if localErr == nil {
 		r.isPrimary = indexInst.Defn.IsPrimary
 		r.IndexName, r.Bucket = indexInst.Defn.Name, indexInst.Defn.Bucket
 		r.IndexInstId = indexInst.InstId
@@ -1086,6 +1415,8 @@ func (r *ScanRequest) setIndexParams() (localErr error) {
 
 		if indexInst.State != common.INDEX_STATE_ACTIVE {
 			localErr = common.ErrIndexNotReady
+		} else if indexInst.Defn.Collation != nil && !r.isPrimary {
+			r.collation, localErr = getCollation(indexInst.Defn.Collation)
 		}
 		r.Stats = stats.indexes[r.IndexInstId]
 		rbMap := *r.sco.getRollbackInProgress()
@@ -1481,14 +1812,37 @@ func (r ScanRequest) String() string {
 		str += fmt.Sprintf(", consistency:%s", strings.ToLower(r.Consistency.String()))
 	}
 
+	if r.Priority != common.NormalScanPriority {
+		str += fmt.Sprintf(", priority:%s", strings.ToLower(r.Priority.String()))
+	}
+
 	if r.RequestId != "" {
 		str += fmt.Sprintf(", requestId:%v", r.RequestId)
 	}
 
+	if r.continuation != nil {
+		str += fmt.Sprintf(", continuation:(lease:%v scan:%v rows:%v)",
+			r.continuation.LeaseId, r.continuation.ScanPos, r.continuation.RowsReturned)
+	}
+
+	if r.asOfTime != 0 {
+		str += fmt.Sprintf(", asof:%v", time.Unix(0, r.asOfTime))
+	} else if r.asOfTs != nil {
+		str += ", asof:seqnos"
+	}
+
 	if r.GroupAggr != nil {
 		str += fmt.Sprintf(", groupaggr: %v", r.GroupAggr)
 	}
 
+	if len(r.IndexScans) != 0 {
+		defnIds := make([]uint64, len(r.IndexScans))
+		for i, sr := range r.IndexScans {
+			defnIds[i] = sr.DefnID
+		}
+		str += fmt.Sprintf(", indexes:%v, union:%v", defnIds, r.Union)
+	}
+
 	return str
 }
 
@@ -36,27 +36,37 @@ func scatter(request *ScanRequest, scan Scan, snapshots []SliceSnapshot, cb Entr
 		return
 	}
 
-	if len(snapshots) == 1 {
-		return scanOne(request, scan, snapshots, cb)
+	units := scanUnits(request, scan, snapshots, config)
+	defer releaseScanUnits(units)
+
+	if len(units) == 1 {
+		return scanOne(request, units[0], cb)
 	}
 
-	return scanMultiple(request, scan, snapshots, cb, config)
+	return scanMultiple(request, units, len(units) > len(snapshots), cb, config)
 }
 
-func scanMultiple(request *ScanRequest, scan Scan, snapshots []SliceSnapshot, cb EntryCallback, config common.Config) (err error) {
+func scanMultiple(request *ScanRequest, units []scanUnit, split bool, cb EntryCallback, config common.Config) (err error) {
 
 	var wg sync.WaitGroup
 
 	notifych := make(chan bool, 1)
 	killch := make(chan bool, 1)
 	donech := make(chan bool, 1)
-	errch := make(chan error, len(snapshots)+100)
+	errch := make(chan error, len(units)+100)
 
 	sorted := request.Sorted
+	if split {
+		sorted = !canForwardSubRanges(request)
+	}
 
-	queues := make([]*Queue, len(snapshots))
-	size, limit := queueSize(len(snapshots), sorted, config)
-	for i := 0; i < len(snapshots); i++ {
+	queues := make([]*Queue, len(units))
+	size, limit := queueSize(len(units), sorted, config)
+	if split {
+		// read ahead sub-ranges while the rows before them are returned
+		size = config["scan.subrange.queue_size"].Int()
+	}
+	for i := 0; i < len(units); i++ {
 		queues[i] = NewQueue(int64(size), int64(limit), notifych)
 	}
 
@@ -68,9 +78,9 @@ func scanMultiple(request *ScanRequest, scan Scan, snapshots []SliceSnapshot, cb
 	}
 
 	// run scatter
-	for i, snap := range snapshots {
+	for i, unit := range units {
 		wg.Add(1)
-		go scanSingleSlice(request, scan, request.Ctxs[i], snap, queues[i], &wg, errch, nil)
+		go scanSingleSlice(request, unit.scan, unit.ctx, unit.snap, queues[i], &wg, errch, nil)
 	}
 
 	// wait for scatter to be done
@@ -104,10 +114,10 @@ func scanMultiple(request *ScanRequest, scan Scan, snapshots []SliceSnapshot, cb
 	return
 }
 
-func scanOne(request *ScanRequest, scan Scan, snapshots []SliceSnapshot, cb EntryCallback) (err error) {
+func scanOne(request *ScanRequest, unit scanUnit, cb EntryCallback) (err error) {
 
 	errch := make(chan error, 1)
-	count := scanSingleSlice(request, scan, request.Ctxs[0], snapshots[0], nil, nil, errch, cb)
+	count := scanSingleSlice(request, unit.scan, unit.ctx, unit.snap, nil, nil, errch, cb)
 
 	logging.Debugf("scan_scatter:scanOnce: scan done. Count %v", count)
 
@@ -131,6 +141,12 @@ func scanSingleSlice(request *ScanRequest, scan Scan, ctx IndexReaderContext, sn
 		}
 	}()
 
+	// Rows in the queue are used after the callback returns
+	copyRows := false
+	if reuser, ok := snap.Snapshot().(EntryBufferReuser); ok && queue != nil {
+		copyRows = reuser.ReusesEntryBuffer()
+	}
+
 	handler := func(entry []byte) error {
 		// Do not call enqueue when there is error.
 		if len(errch) != 0 {
@@ -141,6 +157,10 @@ func scanSingleSlice(request *ScanRequest, scan Scan, ctx IndexReaderContext, sn
 
 		if queue != nil {
 
+			if copyRows {
+				entry = append([]byte(nil), entry...)
+			}
+
 			var r Row
 			if !request.isPrimary {
 				entry1 := secondaryIndexEntry(entry)
@@ -553,7 +573,13 @@ func comparePrimaryKey(k1 *Row, k2 *Row) int {
 
 func compareSecKey(k1 *Row, k2 *Row) int {
 
-	return bytes.Compare(k1.key[:k1.len], k2.key[:k2.len])
+	if r := bytes.Compare(k1.key[:k1.len], k2.key[:k2.len]); r != 0 {
+		return r
+	}
+
+	// break ties on docid so that the merged order is deterministic.
+	// Scan continuation relies on this to resume a partitioned scan.
+	return bytes.Compare(k1.key, k2.key)
 }
 
 func queueSize(partition int, sorted bool, cfg common.Config) (int, int) {
@@ -0,0 +1,106 @@
+package indexer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func newTestStalenessCoordinator(state common.IndexerState, genTime int64) *scanCoordinator {
+	s := &scanCoordinator{
+		lastSnapshot: make(map[common.IndexInstId]IndexSnapshot),
+	}
+	s.indexerState.Store(state)
+	s.setTestSnapshot(genTime)
+	return s
+}
+
+func (s *scanCoordinator) setTestSnapshot(genTime int64) {
+	is, _ := newTestLeaseSnapshot(1234)
+	is.(*indexSnapshot).ts = &common.TsVbuuid{GenTime: genTime}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSnapshot[1234] = is
+}
+
+func newTestStalenessRequest(freshAsOf int64, timeout time.Duration) *ScanRequest {
+	r := &ScanRequest{IndexInstId: 1234, FreshAsOf: freshAsOf}
+	if timeout != 0 {
+		r.ExpiredTime = time.Now().Add(timeout)
+	}
+	return r
+}
+
+func TestFreshIndexSnapshot(t *testing.T) {
+	now := time.Now().UnixNano()
+
+	s := newTestStalenessCoordinator(common.INDEXER_ACTIVE, now)
+	is, err := s.getFreshIndexSnapshot(newTestStalenessRequest(now, 0))
+	if err != nil || is.Timestamp().GenTime != now {
+		t.Errorf("Expected the last snapshot, received %v %v", is, err)
+	}
+
+	// wait for a fresh snapshot
+	s = newTestStalenessCoordinator(common.INDEXER_ACTIVE, now-1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.setTestSnapshot(now + 1)
+	}()
+	is, err = s.getFreshIndexSnapshot(newTestStalenessRequest(now, time.Minute))
+	if err != nil || is.Timestamp().GenTime != now+1 {
+		t.Errorf("Expected the new snapshot, received %v %v", is, err)
+	}
+
+	// bucket caught up with the last snapshot
+	bstats := &BucketStats{}
+	bstats.Init()
+	bstats.caughtUpTime.Set(now)
+	bstats.caughtUpTsTime.Set(now - 1)
+	s = newTestStalenessCoordinator(common.INDEXER_ACTIVE, now-1)
+	if !isSnapshotFresh(s.lastSnapshot[1234], now, bstats) {
+		t.Errorf("Expected the snapshot of a caught up bucket to be fresh")
+	}
+	if isSnapshotFresh(s.lastSnapshot[1234], now+1, bstats) {
+		t.Errorf("Expected the snapshot to be stale")
+	}
+}
+
+func TestFreshIndexSnapshotTimeout(t *testing.T) {
+	now := time.Now().UnixNano()
+
+	// request expires without a scan timeout
+	s := newTestStalenessCoordinator(common.INDEXER_ACTIVE, now-1)
+	t0 := time.Now()
+	if _, err := s.getFreshIndexSnapshot(newTestStalenessRequest(now, 50*time.Millisecond)); err != common.ErrScanTimedOut {
+		t.Errorf("Expected %v, received %v", common.ErrScanTimedOut, err)
+	}
+	if d := time.Since(t0); d > 5*time.Second {
+		t.Errorf("Expected the request to expire, waited %v", d)
+	}
+
+	// request cancelled by the client
+	cancelCh := make(chan bool)
+	r := newTestStalenessRequest(now, 0)
+	r.CancelCh = cancelCh
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(cancelCh)
+	}()
+	if _, err := s.getFreshIndexSnapshot(r); err != common.ErrClientCancel {
+		t.Errorf("Expected %v, received %v", common.ErrClientCancel, err)
+	}
+
+	// no new snapshot while bootstrapping
+	s = newTestStalenessCoordinator(common.INDEXER_BOOTSTRAP, now-1)
+	if _, err := s.getFreshIndexSnapshot(newTestStalenessRequest(now, 0)); err != common.ErrIndexerInBootstrap {
+		t.Errorf("Expected %v, received %v", common.ErrIndexerInBootstrap, err)
+	}
+
+	// a fresh snapshot is served while bootstrapping
+	s = newTestStalenessCoordinator(common.INDEXER_BOOTSTRAP, now)
+	if _, err := s.getFreshIndexSnapshot(newTestStalenessRequest(now, 0)); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
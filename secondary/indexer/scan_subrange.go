@@ -0,0 +1,444 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//--------------------------
+// sub-range scan
+//--------------------------
+
+//
+// A large range of a partition is split into sub-ranges which are scanned
+// concurrently, each with its own reader context.  Rows of the sub-ranges
+// are merged in order by gather, or forwarded as they arrive when the
+// client does not need the rows in order.
+//
+
+var errProbeDone = errors.New("Probe done")
+
+// entries sampled for each sub-range to estimate the size of a range
+const splitSamplesPerRange = 16
+
+// windows of 8 bytes bisected to locate the last entry of a range
+const maxProbeWindows = 4
+
+// a range of a slice snapshot scanned by a scatter go-routine
+type scanUnit struct {
+	scan  Scan
+	ctx   IndexReaderContext
+	snap  SliceSnapshot
+	owned bool // ctx is acquired for a sub-range
+}
+
+// scanUnits returns the ranges to scan for a scan of the snapshots.  The
+// reader contexts acquired for sub-ranges are released by releaseScanUnits.
+func scanUnits(request *ScanRequest, scan Scan, snapshots []SliceSnapshot,
+	config common.Config) []scanUnit {
+
+	units := make([]scanUnit, 0, len(snapshots))
+
+	n := 0
+	if canSplitScan(request, scan, config) {
+		n = config["scan.subrange.max_parallelism"].Int() / len(snapshots)
+	}
+	minEntries := uint64(config["scan.subrange.min_entries"].Int())
+
+	for i, snap := range snapshots {
+		ctx := request.Ctxs[i]
+
+		var scans []Scan
+		var ctxs []IndexReaderContext
+		if n > 1 {
+			scans, ctxs = splitScan(request, scan, snap.Snapshot(), ctx, n, minEntries)
+		}
+
+		if len(scans) == 0 {
+			units = append(units, scanUnit{scan: scan, ctx: ctx, snap: snap})
+			continue
+		}
+
+		units = append(units, scanUnit{scan: scans[0], ctx: ctx, snap: snap})
+		for j, ctx := range ctxs {
+			units = append(units, scanUnit{scan: scans[j+1], ctx: ctx, snap: snap, owned: true})
+		}
+
+		logging.Debugf("%s scan of slice %v split into %v sub-ranges",
+			request.LogPrefix, snap.SliceId(), len(scans))
+	}
+
+	return units
+}
+
+func releaseScanUnits(units []scanUnit) {
+	for _, unit := range units {
+		if unit.owned {
+			unit.ctx.Done()
+		}
+	}
+}
+
+// canSplitScan returns true if the scan can be split into sub-ranges
+func canSplitScan(request *ScanRequest, scan Scan, config common.Config) bool {
+
+	switch scan.ScanType {
+	case AllReq, RangeReq, FilterRangeReq:
+	default:
+		return false
+	}
+
+	// A few rows are returned faster by scanning a single range
+	minEntries := int64(config["scan.subrange.min_entries"].Int())
+	if request.GroupAggr == nil && request.Limit > 0 &&
+		request.Limit < minEntries-request.Offset {
+		return false
+	}
+
+	return true
+}
+
+// canForwardSubRanges returns true if the rows of sub-ranges can be
+// returned as they arrive.  The scan pipeline needs the rows in order for
+// distinct, group by and scan continuation.
+func canForwardSubRanges(request *ScanRequest) bool {
+	return request.unordered && !request.Distinct && request.GroupAggr == nil &&
+		!request.withContinuation
+}
+
+// splitScan splits the range of the scan into up to n sub-ranges, the first
+// of which is scanned with ctx.  It returns the sub-ranges and the reader
+// contexts acquired for the other sub-ranges.
+func splitScan(request *ScanRequest, scan Scan, snap Snapshot, ctx IndexReaderContext,
+	n int, minEntries uint64) ([]Scan, []IndexReaderContext) {
+
+	reader, ok := snap.(ParallelReader)
+	if !ok {
+		return nil, nil
+	}
+
+	keys, err := rangeSplitKeys(request, scan, snap, ctx, n, minEntries)
+	if err != nil {
+		logging.Warnf("%s scan range is not split. Error: %v", request.LogPrefix, err)
+		return nil, nil
+	}
+
+	var ctxs []IndexReaderContext
+	for len(ctxs) < len(keys) {
+		ctx := reader.NewReaderContext()
+		if ctx == nil {
+			break
+		}
+		ctxs = append(ctxs, ctx)
+	}
+
+	if len(ctxs) == 0 {
+		return nil, nil
+	}
+
+	keys = pickSplitKeys(keys, len(ctxs)+1)
+	return subRanges(scan, keys), ctxs
+}
+
+// rangeSplitKeys returns up to n-1 keys splitting the range of the scan into
+// sub-ranges of at least minEntries entries each.
+func rangeSplitKeys(request *ScanRequest, scan Scan, snap Snapshot, ctx IndexReaderContext,
+	n int, minEntries uint64) ([]IndexKey, error) {
+
+	total, err := snap.StatCountTotal()
+	if err != nil || total < 2*minEntries {
+		return nil, err
+	}
+
+	low, high, incl := scanBounds(scan)
+
+	splitter, ok := snap.(RangeSplitter)
+	if !ok {
+		parts := total / minEntries
+		if parts > uint64(n) {
+			parts = uint64(n)
+		}
+		return probeSplitKeys(request, snap, ctx, low, high, incl, int(parts))
+	}
+
+	entries := splitter.RangeSplitEntries(n * splitSamplesPerRange)
+
+	var keys []IndexKey
+	for _, entry := range entries {
+		keys = appendSplitKey(keys, entryKey(entry, request.isPrimary), low, high)
+	}
+
+	// Estimate the entries in the range from the samples in the range
+	estimate := total * uint64(len(keys)+1) / uint64(len(entries)+1)
+	parts := estimate / minEntries
+	if parts > uint64(n) {
+		parts = uint64(n)
+	}
+	if parts < 2 {
+		return nil, nil
+	}
+
+	return pickSplitKeys(keys, int(parts)), nil
+}
+
+// probeSplitKeys returns the keys of the first entries at or after evenly
+// spaced points of the key space of the range.  It is used when the storage
+// cannot sample the index.  Sub-ranges are of equal size only if the keys
+// are uniformly distributed.
+func probeSplitKeys(request *ScanRequest, snap Snapshot, ctx IndexReaderContext,
+	low, high IndexKey, incl Inclusion, parts int) ([]IndexKey, error) {
+
+	if parts < 2 {
+		return nil, nil
+	}
+
+	// Key space of the range starts at its first entry
+	first, err := probeEntry(snap, ctx, low, high, incl)
+	if err != nil || first == nil {
+		return nil, err
+	}
+	start := entryKey(first, request.isPrimary).Bytes()
+
+	end := high.Bytes()
+	if end == nil {
+		// Past all keys. Encoded secondary keys start with the same type.
+		if request.isPrimary {
+			end = []byte{0xff}
+		} else {
+			end = []byte{start[0] + 1}
+		}
+	}
+
+	end, err = probeKeySpaceEnd(request, snap, ctx, start, end, high, incl)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []IndexKey
+	for _, point := range splitKeySpace(start, end, parts) {
+		entry, err := probeEntry(snap, ctx, newRawIndexKey(point, request.isPrimary), high, Low|(incl&High))
+		if err != nil {
+			return nil, err
+		}
+
+		// No more entries in the range
+		if entry == nil {
+			break
+		}
+
+		keys = appendSplitKey(keys, entryKey(entry, request.isPrimary), low, high)
+	}
+
+	return keys, nil
+}
+
+// probeEntry returns a copy of the first entry of the range, or nil if
+// the range is empty
+func probeEntry(snap Snapshot, ctx IndexReaderContext, low, high IndexKey,
+	incl Inclusion) ([]byte, error) {
+
+	var entry []byte
+	err := snap.Range(ctx, low, high, incl, func(e []byte) error {
+		entry = append([]byte(nil), e...)
+		return errProbeDone
+	})
+
+	if err == errProbeDone {
+		err = nil
+	}
+
+	return entry, err
+}
+
+// probeKeySpaceEnd returns a key past the last entry of the range and
+// close to it, so that the key space of the range is not mostly empty.  The
+// key space between start and end is bisected to locate the last entry.
+// While all entries share the bytes of start being bisected, the bytes
+// following them are bisected next.
+func probeKeySpaceEnd(request *ScanRequest, snap Snapshot, ctx IndexReaderContext,
+	start, end []byte, high IndexKey, incl Inclusion) ([]byte, error) {
+
+	p := commonPrefixLen(start, end)
+	prefix := start[:p]
+	rest := start[p:]
+	lo, hi := keyPrefixUint64(rest), keyPrefixUint64(end[p:])
+
+	for i := 0; i < maxProbeWindows; i++ {
+		// An entry is at or after lo, and no entry is at or after hi
+		for lo < hi && hi-lo > 1 {
+			mid := lo + (hi-lo)/2
+			point := newRawIndexKey(appendUint64(prefix, mid), request.isPrimary)
+			entry, err := probeEntry(snap, ctx, point, high, Low|(incl&High))
+			if err != nil {
+				return nil, err
+			}
+
+			if entry != nil {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+
+		if lo != keyPrefixUint64(rest) || len(rest) <= 8 {
+			break
+		}
+
+		prefix = appendUint64(prefix, lo)
+		rest = rest[8:]
+		lo, hi = keyPrefixUint64(rest), math.MaxUint64
+	}
+
+	return appendUint64(prefix, hi), nil
+}
+
+// splitKeySpace returns n-1 keys evenly spaced between low and high.  The
+// bytes following the common prefix of low and high are interpolated as
+// a big endian number.
+func splitKeySpace(low, high []byte, n int) [][]byte {
+
+	p := commonPrefixLen(low, high)
+	a, b := keyPrefixUint64(low[p:]), keyPrefixUint64(high[p:])
+	if b <= a {
+		return nil
+	}
+
+	step := (b - a) / uint64(n)
+	if step == 0 {
+		return nil
+	}
+
+	keys := make([][]byte, 0, n-1)
+	for i := 1; i < n; i++ {
+		keys = append(keys, appendUint64(low[:p], a+step*uint64(i)))
+	}
+
+	return keys
+}
+
+func commonPrefixLen(a, b []byte) int {
+	p := 0
+	for p < len(a) && p < len(b) && a[p] == b[p] {
+		p++
+	}
+	return p
+}
+
+// keyPrefixUint64 returns the first 8 bytes of b as a big endian number,
+// padding b with zeros
+func keyPrefixUint64(b []byte) uint64 {
+	var buf [8]byte
+	copy(buf[:], b)
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// appendUint64 returns a copy of prefix followed by v in big endian
+func appendUint64(prefix []byte, v uint64) []byte {
+	key := make([]byte, len(prefix)+8)
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], v)
+	return key
+}
+
+// appendSplitKey appends key if it is after the last key and strictly
+// within the range, so that every sub-range is within the range.  Keys
+// matching a prefix bound of the range are not used to split it.
+func appendSplitKey(keys []IndexKey, key, low, high IndexKey) []IndexKey {
+
+	if key.ComparePrefixIndexKey(low) <= 0 || key.ComparePrefixIndexKey(high) >= 0 {
+		return keys
+	}
+
+	if len(keys) != 0 && key.CompareIndexKey(keys[len(keys)-1]) <= 0 {
+		return keys
+	}
+
+	return append(keys, key)
+}
+
+// pickSplitKeys returns up to parts-1 keys evenly spaced in keys
+func pickSplitKeys(keys []IndexKey, parts int) []IndexKey {
+
+	if len(keys) < parts {
+		return keys
+	}
+
+	picked := make([]IndexKey, 0, parts-1)
+	for i := 1; i < parts; i++ {
+		picked = append(picked, keys[i*(len(keys)+1)/parts-1])
+	}
+
+	return picked
+}
+
+// subRanges splits the range of the scan at keys.  Entries equal to a
+// split key belong to the sub-range starting with the key.
+func subRanges(scan Scan, keys []IndexKey) []Scan {
+
+	low, high, incl := scanBounds(scan)
+
+	scans := make([]Scan, 0, len(keys)+1)
+	for i := 0; i <= len(keys); i++ {
+		sub := scan
+		if sub.ScanType == AllReq {
+			sub.ScanType = RangeReq
+		}
+
+		sub.Low, sub.Incl = low, incl&Low
+		if i > 0 {
+			sub.Low, sub.Incl = keys[i-1], Low
+		}
+
+		sub.High = high
+		if i < len(keys) {
+			sub.High = keys[i]
+		} else {
+			sub.Incl |= incl & High
+		}
+
+		scans = append(scans, sub)
+	}
+
+	return scans
+}
+
+func scanBounds(scan Scan) (IndexKey, IndexKey, Inclusion) {
+	if scan.ScanType == AllReq {
+		return MinIndexKey, MaxIndexKey, Both
+	}
+	return scan.Low, scan.High, scan.Incl
+}
+
+// entryKey returns the index key of an index entry
+func entryKey(entry []byte, isPrimary bool) IndexKey {
+	if isPrimary {
+		return newRawIndexKey(entry, true)
+	}
+
+	e := secondaryIndexEntry(entry)
+	return newRawIndexKey(entry[:e.lenKey()], false)
+}
+
+// newRawIndexKey returns an index key of encoded key bytes
+func newRawIndexKey(b []byte, isPrimary bool) IndexKey {
+	if isPrimary {
+		k := primaryKey(b)
+		return &k
+	}
+
+	k := secondaryKey(b)
+	return &k
+}
@@ -0,0 +1,312 @@
+package indexer
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+// testRangeSnapshot is a snapshot of a primary index which can only scan
+// ranges, sub-ranges are split by probing it
+type testRangeSnapshot struct {
+	Snapshot
+	entries [][]byte
+	readers int32
+}
+
+func (s *testRangeSnapshot) StatCountTotal() (uint64, error) {
+	return uint64(len(s.entries)), nil
+}
+
+func (s *testRangeSnapshot) Range(ctx IndexReaderContext, low, high IndexKey,
+	incl Inclusion, callb EntryCallback) error {
+
+	for _, entry := range s.entries {
+		if low.Bytes() != nil {
+			r := bytes.Compare(entry, low.Bytes())
+			if r < 0 || (r == 0 && incl&Low == 0) {
+				continue
+			}
+		}
+		if high.Bytes() != nil {
+			r := bytes.Compare(entry, high.Bytes())
+			if r > 0 || (r == 0 && incl&High == 0) {
+				break
+			}
+		}
+		if err := callb(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *testRangeSnapshot) All(ctx IndexReaderContext, callb EntryCallback) error {
+	return s.Range(ctx, MinIndexKey, MaxIndexKey, Both, callb)
+}
+
+func (s *testRangeSnapshot) NewReaderContext() IndexReaderContext {
+	atomic.AddInt32(&s.readers, 1)
+	return &testReaderCtx{readers: &s.readers}
+}
+
+// testSampledSnapshot can sample the entries splitting it
+type testSampledSnapshot struct {
+	*testRangeSnapshot
+}
+
+func (s testSampledSnapshot) RangeSplitEntries(n int) [][]byte {
+	var entries [][]byte
+	for i := 1; i < n; i++ {
+		entries = append(entries, s.entries[i*len(s.entries)/n])
+	}
+	return entries
+}
+
+// testReusingSnapshot reuses the buffer of the entries passed to the callback
+type testReusingSnapshot struct {
+	*testRangeSnapshot
+}
+
+func (s testReusingSnapshot) Range(ctx IndexReaderContext, low, high IndexKey,
+	incl Inclusion, callb EntryCallback) error {
+
+	var buf []byte
+	return s.testRangeSnapshot.Range(ctx, low, high, incl, func(entry []byte) error {
+		buf = append(buf[:0], entry...)
+		return callb(buf)
+	})
+}
+
+func (s testReusingSnapshot) ReusesEntryBuffer() bool {
+	return true
+}
+
+type testReaderCtx struct {
+	cursorCtx
+	readers *int32
+}
+
+func (ctx *testReaderCtx) Done() {
+	atomic.AddInt32(ctx.readers, -1)
+}
+
+func newTestRangeSnapshot(n int) *testRangeSnapshot {
+	s := &testRangeSnapshot{}
+	for i := 0; i < n; i++ {
+		s.entries = append(s.entries, []byte(fmt.Sprintf("doc-%06d", i*7)))
+	}
+	return s
+}
+
+func newTestSubRangeConfig() common.Config {
+	cfg := common.SystemConfig.SectionConfig("indexer.", true)
+	cfg.SetValue("scan.subrange.max_parallelism", 4)
+	cfg.SetValue("scan.subrange.min_entries", 1000)
+	cfg.SetValue("scan.subrange.queue_size", 100)
+	return cfg
+}
+
+func newTestSubRangeRequest() *ScanRequest {
+	return &ScanRequest{
+		isPrimary: true,
+		Ctxs:      []IndexReaderContext{&cursorCtx{}},
+		LogPrefix: "SUBRANGE",
+	}
+}
+
+func TestSplitKeySpace(t *testing.T) {
+	keys := splitKeySpace([]byte("doc-000"), []byte("doc-100"), 4)
+	if len(keys) != 3 {
+		t.Fatalf("Expected 3 keys, received %v", len(keys))
+	}
+
+	prev := []byte("doc-000")
+	for _, key := range keys {
+		if bytes.Compare(key, prev) <= 0 || bytes.Compare(key, []byte("doc-100")) >= 0 {
+			t.Errorf("Key %q out of order", key)
+		}
+		prev = key
+	}
+
+	if keys := splitKeySpace([]byte("doc-1"), []byte("doc-0"), 4); len(keys) != 0 {
+		t.Errorf("Expected no keys, received %q", keys)
+	}
+}
+
+func TestSubRanges(t *testing.T) {
+	scan := Scan{
+		ScanType: RangeReq,
+		Low:      newRawIndexKey([]byte("b"), true),
+		High:     newRawIndexKey([]byte("y"), true),
+		Incl:     High,
+	}
+
+	keys := []IndexKey{newRawIndexKey([]byte("f"), true), newRawIndexKey([]byte("m"), true)}
+	scans := subRanges(scan, keys)
+
+	expected := []struct {
+		low, high string
+		incl      Inclusion
+	}{
+		{"b", "f", Neither},
+		{"f", "m", Low},
+		{"m", "y", Both},
+	}
+
+	if len(scans) != len(expected) {
+		t.Fatalf("Expected %v sub-ranges, received %v", len(expected), len(scans))
+	}
+	for i, e := range expected {
+		sub := scans[i]
+		if string(sub.Low.Bytes()) != e.low || string(sub.High.Bytes()) != e.high || sub.Incl != e.incl {
+			t.Errorf("Sub-range %v: expected %v, received %v %v %v", i, e,
+				string(sub.Low.Bytes()), string(sub.High.Bytes()), sub.Incl)
+		}
+	}
+}
+
+func TestScanUnits(t *testing.T) {
+	cfg := newTestSubRangeConfig()
+
+	scans := []Scan{
+		{ScanType: AllReq},
+		{
+			ScanType: RangeReq,
+			Low:      newRawIndexKey([]byte("doc-007000"), true),
+			High:     newRawIndexKey([]byte("doc-063000"), true),
+			Incl:     Low,
+		},
+		{
+			ScanType: RangeReq,
+			Low:      MinIndexKey,
+			High:     newRawIndexKey([]byte("doc-035000"), true),
+			Incl:     Both,
+		},
+	}
+
+	rs := newTestRangeSnapshot(10000)
+	for _, snap := range []Snapshot{rs, testSampledSnapshot{rs}} {
+		for _, scan := range scans {
+			request := newTestSubRangeRequest()
+			snapshots := []SliceSnapshot{&sliceSnapshot{snap: snap}}
+
+			var expected [][]byte
+			low, high, incl := scanBounds(scan)
+			snap.Range(nil, low, high, incl, func(entry []byte) error {
+				expected = append(expected, entry)
+				return nil
+			})
+
+			units := scanUnits(request, scan, snapshots, cfg)
+			if len(units) < 2 {
+				t.Errorf("%T: expected scan to be split, received %v units", snap, len(units))
+			}
+
+			var received [][]byte
+			for _, unit := range units {
+				var n int
+				low, high, incl := scanBounds(unit.scan)
+				unit.snap.Snapshot().Range(unit.ctx, low, high, incl, func(entry []byte) error {
+					received = append(received, entry)
+					n++
+					return nil
+				})
+				if n == 0 {
+					t.Errorf("%T: unexpected empty sub-range %v", snap, unit.scan)
+				}
+			}
+
+			if len(received) != len(expected) {
+				t.Fatalf("%T: expected %v entries, received %v", snap, len(expected), len(received))
+			}
+			for i := range expected {
+				if !bytes.Equal(received[i], expected[i]) {
+					t.Fatalf("%T: expected %q at %v, received %q", snap, expected[i], i, received[i])
+				}
+			}
+
+			releaseScanUnits(units)
+			if n := atomic.LoadInt32(&rs.readers); n != 0 {
+				t.Errorf("%T: expected readers to be released, %v in use", snap, n)
+			}
+		}
+	}
+}
+
+func TestScanUnitsNotSplit(t *testing.T) {
+	cfg := newTestSubRangeConfig()
+	snapshots := []SliceSnapshot{&sliceSnapshot{snap: newTestRangeSnapshot(10000)}}
+
+	// small limit
+	request := newTestSubRangeRequest()
+	request.Limit = 10
+	if units := scanUnits(request, Scan{ScanType: AllReq}, snapshots, cfg); len(units) != 1 {
+		t.Errorf("Expected scan with limit not to be split, received %v units", len(units))
+	}
+
+	// small index
+	request = newTestSubRangeRequest()
+	snapshots = []SliceSnapshot{&sliceSnapshot{snap: newTestRangeSnapshot(1000)}}
+	if units := scanUnits(request, Scan{ScanType: AllReq}, snapshots, cfg); len(units) != 1 {
+		t.Errorf("Expected scan of small index not to be split, received %v units", len(units))
+	}
+
+	// range within a single key
+	key := newRawIndexKey([]byte("doc-000700"), true)
+	scan := Scan{ScanType: RangeReq, Low: key, High: key, Incl: Both}
+	snapshots = []SliceSnapshot{&sliceSnapshot{snap: newTestRangeSnapshot(10000)}}
+	if units := scanUnits(request, scan, snapshots, cfg); len(units) != 1 {
+		t.Errorf("Expected single key range not to be split, received %v units", len(units))
+	}
+}
+
+func TestScatterSubRanges(t *testing.T) {
+	cfg := newTestSubRangeConfig()
+	rs := newTestRangeSnapshot(10000)
+
+	for _, snap := range []Snapshot{testSampledSnapshot{rs}, testReusingSnapshot{rs}} {
+		snapshots := []SliceSnapshot{&sliceSnapshot{snap: snap}}
+
+		for _, unordered := range []bool{false, true} {
+			request := newTestSubRangeRequest()
+			request.Sorted = !unordered
+			request.unordered = unordered
+
+			var received [][]byte
+			err := scatter(request, Scan{ScanType: AllReq}, snapshots, func(entry []byte) error {
+				received = append(received, entry)
+				return nil
+			}, cfg)
+			if err != nil {
+				t.Fatalf("%T: unexpected error %v", snap, err)
+			}
+
+			if len(received) != len(rs.entries) {
+				t.Fatalf("%T: expected %v entries, received %v", snap, len(rs.entries), len(received))
+			}
+
+			seen := make(map[string]bool)
+			inOrder := true
+			for i, entry := range received {
+				seen[string(entry)] = true
+				if !bytes.Equal(entry, rs.entries[i]) {
+					inOrder = false
+				}
+			}
+			if len(seen) != len(rs.entries) {
+				t.Errorf("%T: expected %v distinct entries, received %v", snap, len(rs.entries), len(seen))
+			}
+			if !unordered && !inOrder {
+				t.Errorf("%T: expected entries in order", snap)
+			}
+
+			if n := atomic.LoadInt32(&rs.readers); n != 0 {
+				t.Errorf("%T: expected readers to be released, %v in use", snap, n)
+			}
+		}
+	}
+}
@@ -15,8 +15,8 @@ import (
 	"fmt"
 
 	"github.com/couchbase/cbauth"
-	"github.com/couchbase/cbauth/metakv"
 	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/common/metakv"
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/pipeline"
 	"github.com/couchbase/indexing/secondary/stubs/nitro/mm"
@@ -0,0 +1,181 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//retained snapshots are kept in memory, they do not survive a restart
+//of the indexer
+var ErrSnapshotNotRetained = errors.New("No retained index snapshot for the requested point in time, " +
+	"snapshots are not retained across an indexer restart")
+var ErrAsOfTimeInFuture = errors.New("Requested point in time is in the future")
+var ErrInvalidAsOfVector = errors.New("Requested seqnos do not match the vbuckets of the bucket")
+
+//
+// retainedSnapshot is an index snapshot kept alive after a newer one
+// has been created, for indexes with a snapshot retention window.
+// Holding on to the snapshot keeps the underlying storage snapshot
+// (memdb snapshot, plasma snapshot, forestdb snapshot handle) readable.
+// Retained snapshots are not persisted, after a restart the retention
+// window starts again from the recovered snapshot.
+//
+type retainedSnapshot struct {
+	is IndexSnapshot
+
+	// delete bytes of the index when the snapshot was created. Entries
+	// deleted since then are kept alive by the snapshot.
+	deleteBytes int64
+}
+
+func snapshotGenTime(is IndexSnapshot) int64 {
+	if ts := is.Timestamp(); ts != nil {
+		return ts.GenTime
+	}
+	return 0
+}
+
+func (s *storageMgr) snapshotRetention(instId common.IndexInstId) time.Duration {
+	inst, ok := s.indexInstMap[instId]
+	if !ok || inst.State == common.INDEX_STATE_DELETED {
+		return 0
+	}
+	return time.Duration(inst.Defn.SnapshotRetention) * time.Second
+}
+
+// retainOrDestroySnapshot is called with muSnap held when the current
+// snapshot of the index is replaced by a newer one. Snapshots are not
+// retained while the storage disk is running low on space.
+func (s *storageMgr) retainOrDestroySnapshot(old, curr IndexSnapshot, idxStats *IndexStats) {
+	instId := curr.IndexInstId()
+
+	if old != nil && old.Timestamp() != nil && !old.IsEpoch() && s.snapshotRetention(instId) > 0 &&
+		s.getDiskState() == DISK_OK {
+		s.retainedSnapMap[instId] = append(s.retainedSnapMap[instId],
+			&retainedSnapshot{is: old, deleteBytes: s.currSnapDeleteBytes[instId]})
+	} else {
+		DestroyIndexSnapshot(old)
+	}
+
+	s.currSnapDeleteBytes[instId] = getDeleteBytes(idxStats)
+	s.pruneRetainedSnapshots(instId, curr, idxStats)
+}
+
+// pruneRetainedSnapshots destroys the retained snapshots which have been
+// superseded before the beginning of the retention window.
+func (s *storageMgr) pruneRetainedSnapshots(instId common.IndexInstId,
+	curr IndexSnapshot, idxStats *IndexStats) {
+
+	retained := s.retainedSnapMap[instId]
+	windowStart := time.Now().Add(-s.snapshotRetention(instId)).UnixNano()
+
+	var i int
+	for i = 0; i < len(retained); i++ {
+		// snapshot is valid until the next one is created
+		next := curr
+		if i+1 < len(retained) {
+			next = retained[i+1].is
+		}
+
+		if snapshotGenTime(next) >= windowStart {
+			break
+		}
+		DestroyIndexSnapshot(retained[i].is)
+	}
+
+	if i == len(retained) {
+		delete(s.retainedSnapMap, instId)
+	} else {
+		s.retainedSnapMap[instId] = retained[i:]
+	}
+
+	s.updateRetainedSnapshotStats(instId, idxStats)
+}
+
+// destroyRetainedSnapshots is called with muSnap held when the index is
+// dropped or rolled back.
+func (s *storageMgr) destroyRetainedSnapshots(instId common.IndexInstId) {
+	retained, ok := s.retainedSnapMap[instId]
+	if !ok {
+		return
+	}
+
+	logging.Infof("StorageMgr::destroyRetainedSnapshots Index %v Destroying %v retained snapshots",
+		instId, len(retained))
+
+	for _, rs := range retained {
+		DestroyIndexSnapshot(rs.is)
+	}
+	delete(s.retainedSnapMap, instId)
+
+	if stats := s.stats.Get(); stats != nil {
+		s.updateRetainedSnapshotStats(instId, stats.indexes[instId])
+	}
+}
+
+// getRetainedSnapshot returns the newest snapshot, among the retained ones
+// and the current one, that is not newer than the requested time or seqnos.
+// Caller must hold muSnap.
+func (s *storageMgr) getRetainedSnapshot(req *MsgIndexSnapRequest) (IndexSnapshot, error) {
+	instId := req.GetIndexId()
+
+	curr := s.indexSnapMap[instId]
+	if curr == nil || curr.Timestamp() == nil {
+		return nil, ErrSnapNotAvailable
+	}
+
+	candidates := make([]IndexSnapshot, 0, len(s.retainedSnapMap[instId])+1)
+	for _, rs := range s.retainedSnapMap[instId] {
+		candidates = append(candidates, rs.is)
+	}
+	candidates = append(candidates, curr)
+
+	for i := len(candidates) - 1; i >= 0; i-- {
+		is := candidates[i]
+		if req.GetAsOfTime() != 0 && snapshotGenTime(is) > req.GetAsOfTime() {
+			continue
+		}
+		if req.GetAsOfTS() != nil && !req.GetAsOfTS().AsRecentTs(is.Timestamp()) {
+			continue
+		}
+		return CloneIndexSnapshot(is), nil
+	}
+
+	return nil, ErrSnapshotNotRetained
+}
+
+func (s *storageMgr) updateRetainedSnapshotStats(instId common.IndexInstId, idxStats *IndexStats) {
+	if idxStats == nil {
+		return
+	}
+
+	retained := s.retainedSnapMap[instId]
+	idxStats.numRetainedSnapshots.Set(int64(len(retained)))
+	if len(retained) != 0 {
+		idxStats.retainedDeleteBytes.Set(retained[0].deleteBytes)
+	} else {
+		idxStats.retainedDeleteBytes.Set(0)
+	}
+}
+
+func getDeleteBytes(idxStats *IndexStats) int64 {
+	if idxStats == nil {
+		return 0
+	}
+
+	return idxStats.partnInt64Stats(func(ss *IndexStats) int64 {
+		return ss.deleteBytes.Value()
+	})
+}
@@ -0,0 +1,184 @@
+package indexer
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+)
+
+func newTestRetentionConfig() common.Config {
+	return common.SystemConfig.SectionConfig("indexer.", true)
+}
+
+func newTestRetainedSnapshot(genTime int64, seqno uint64) (IndexSnapshot, *testLeaseSnapshot) {
+	is, snap := newTestLeaseSnapshot(1234)
+	ts := common.NewTsVbuuid("default", newTestRetentionConfig()["numVbuckets"].Int())
+	ts.GenTime = genTime
+	ts.Seqnos[0] = seqno
+	is.(*indexSnapshot).ts = ts
+	return is, snap
+}
+
+func newTestRetentionStorageMgr(retention uint64) *storageMgr {
+	inst := common.IndexInst{InstId: 1234, State: common.INDEX_STATE_ACTIVE}
+	inst.Defn.Bucket = "default"
+	inst.Defn.SnapshotRetention = retention
+	return &storageMgr{
+		indexInstMap:        common.IndexInstMap{1234: inst},
+		indexSnapMap:        make(map[common.IndexInstId]IndexSnapshot),
+		retainedSnapMap:     make(map[common.IndexInstId][]*retainedSnapshot),
+		currSnapDeleteBytes: make(map[common.IndexInstId]int64),
+	}
+}
+
+// addTestSnapshot replaces the current snapshot of the index, the same
+// way the storage manager does.
+func (s *storageMgr) addTestSnapshot(is IndexSnapshot) {
+	s.retainOrDestroySnapshot(s.indexSnapMap[1234], is, nil)
+	s.indexSnapMap[1234] = is
+}
+
+func newTestAsOfRequest(asOfTime int64, asOfTs *common.TsVbuuid) *MsgIndexSnapRequest {
+	return &MsgIndexSnapRequest{idxInstId: 1234, asOfTime: asOfTime, asOfTs: asOfTs}
+}
+
+func TestRetainedSnapshot(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) int64 { return now.Add(d).UnixNano() }
+
+	s := newTestRetentionStorageMgr(60)
+	is1, snap1 := newTestRetainedSnapshot(at(-10*time.Minute), 10)
+	is2, snap2 := newTestRetainedSnapshot(at(-30*time.Second), 20)
+	is3, snap3 := newTestRetainedSnapshot(at(-10*time.Second), 30)
+	s.addTestSnapshot(is1)
+	s.addTestSnapshot(is2)
+	s.addTestSnapshot(is3)
+
+	// snapshots superseded within the retention window are retained
+	if snap1.refs != 1 || snap2.refs != 1 || snap3.refs != 1 {
+		t.Errorf("Expected all snapshots open, received %v %v %v", snap1.refs, snap2.refs, snap3.refs)
+	}
+	if n := len(s.retainedSnapMap[1234]); n != 2 {
+		t.Errorf("Expected 2 retained snapshots, received %v", n)
+	}
+
+	tests := []struct {
+		asOfTime int64
+		seqno    uint64
+		is       IndexSnapshot
+		err      error
+	}{
+		{at(-20 * time.Second), 0, is2, nil},
+		{at(0), 0, is3, nil},
+		{at(-5 * time.Minute), 0, is1, nil},
+		{at(-20 * time.Minute), 0, nil, ErrSnapshotNotRetained},
+		{0, 25, is2, nil},
+		{0, 5, nil, ErrSnapshotNotRetained},
+	}
+	for i, test := range tests {
+		var asOfTs *common.TsVbuuid
+		if test.seqno != 0 {
+			asOfTs = common.NewTsVbuuid("default", newTestRetentionConfig()["numVbuckets"].Int())
+			for vb := range asOfTs.Seqnos {
+				asOfTs.Seqnos[vb] = math.MaxUint64
+			}
+			asOfTs.Seqnos[0] = test.seqno
+		}
+		is, err := s.getRetainedSnapshot(newTestAsOfRequest(test.asOfTime, asOfTs))
+		if is != test.is || err != test.err {
+			t.Errorf("test %v: expected %v %v, received %v %v", i, test.is, test.err, is, err)
+		}
+		DestroyIndexSnapshot(is)
+	}
+
+	// retained snapshots are destroyed on rollback
+	s.destroyRetainedSnapshots(1234)
+	if snap1.refs != 0 || snap2.refs != 0 || snap3.refs != 1 {
+		t.Errorf("Expected retained snapshots closed, received %v %v %v", snap1.refs, snap2.refs, snap3.refs)
+	}
+	if _, err := s.getRetainedSnapshot(newTestAsOfRequest(at(-20*time.Second), nil)); err != ErrSnapshotNotRetained {
+		t.Errorf("Expected %v, received %v", ErrSnapshotNotRetained, err)
+	}
+}
+
+func TestRetainedSnapshotPrune(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) int64 { return now.Add(d).UnixNano() }
+
+	s := newTestRetentionStorageMgr(60)
+	is1, snap1 := newTestRetainedSnapshot(at(-10*time.Minute), 10)
+	is2, snap2 := newTestRetainedSnapshot(at(-5*time.Minute), 20)
+	is3, snap3 := newTestRetainedSnapshot(at(-10*time.Second), 30)
+	s.addTestSnapshot(is1)
+	s.addTestSnapshot(is2)
+	s.addTestSnapshot(is3)
+
+	if snap1.refs != 0 || snap2.refs != 1 || snap3.refs != 1 {
+		t.Errorf("Expected oldest snapshot closed, received %v %v %v", snap1.refs, snap2.refs, snap3.refs)
+	}
+
+	// snapshots are not retained while the disk is low on space
+	s.setDiskState(DISK_LOW)
+	is4, snap4 := newTestRetainedSnapshot(at(0), 40)
+	s.addTestSnapshot(is4)
+	if snap3.refs != 0 || snap4.refs != 1 {
+		t.Errorf("Expected snapshot closed, received %v %v", snap3.refs, snap4.refs)
+	}
+
+	// no retention
+	s = newTestRetentionStorageMgr(0)
+	is1, snap1 = newTestRetainedSnapshot(at(-10*time.Second), 10)
+	s.addTestSnapshot(is1)
+	s.addTestSnapshot(is2)
+	if snap1.refs != 0 || len(s.retainedSnapMap) != 0 {
+		t.Errorf("Expected no retained snapshot, received %v %v", snap1.refs, s.retainedSnapMap)
+	}
+}
+
+func TestScanRequestAsOf(t *testing.T) {
+	sco := &scanCoordinator{}
+	sco.config.Store(newTestRetentionConfig())
+	numVbuckets := newTestRetentionConfig()["numVbuckets"].Int()
+
+	r := &ScanRequest{sco: sco, Bucket: "default"}
+	past := time.Now().Add(-time.Minute).UnixNano()
+	if err := r.setAsOf(past, nil); err != nil || r.asOfTime != past {
+		t.Errorf("Unexpected error %v", err)
+	}
+	r = &ScanRequest{sco: sco, Bucket: "default"}
+	if err := r.setAsOf(time.Now().Add(time.Minute).UnixNano(), nil); err != ErrAsOfTimeInFuture {
+		t.Errorf("Expected %v, received %v", ErrAsOfTimeInFuture, err)
+	}
+
+	vector := func(vbnos ...uint32) *protobuf.TsConsistency {
+		seqnos := make([]uint64, len(vbnos))
+		vbuuids := make([]uint64, len(vbnos))
+		for i := range vbnos {
+			seqnos[i], vbuuids[i] = 100, 1
+		}
+		return &protobuf.TsConsistency{Vbnos: vbnos, Seqnos: seqnos, Vbuuids: vbuuids}
+	}
+
+	r = &ScanRequest{sco: sco, Bucket: "default"}
+	if err := r.setAsOf(0, vector(1, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if r.asOfTs.Seqnos[1] != 100 || r.asOfTs.Seqnos[0] != math.MaxUint64 {
+		t.Errorf("Unexpected as-of seqnos %v", r.asOfTs.Seqnos[:4])
+	}
+
+	tooMany := make([]uint32, numVbuckets+1)
+	for _, v := range []*protobuf.TsConsistency{
+		vector(uint32(numVbuckets)),
+		vector(tooMany...),
+		{Vbnos: []uint32{1, 2}, Seqnos: []uint64{100}, Vbuuids: []uint64{1, 1}},
+	} {
+		r = &ScanRequest{sco: sco, Bucket: "default"}
+		if err := r.setAsOf(0, v); err != ErrInvalidAsOfVector || r.asOfTs != nil {
+			t.Errorf("Expected %v, received %v", ErrInvalidAsOfVector, err)
+		}
+	}
+}
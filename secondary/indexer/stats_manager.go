@@ -45,6 +45,14 @@ type BucketStats struct {
 
 	tsQueueSize   stats.Int64Val
 	numNonAlignTS stats.Int64Val
+
+	// set by timekeeper when all the mutations received for the
+	// bucket are flushed, used for bounded staleness scans
+	caughtUpTime   stats.Int64Val
+	caughtUpTsTime stats.Int64Val
+
+	numScansQueued   stats.Int64Val
+	numScansRejected stats.Int64Val
 }
 
 func (s *BucketStats) Init() {
@@ -53,6 +61,10 @@ func (s *BucketStats) Init() {
 	s.numMutationsQueued.Init()
 	s.tsQueueSize.Init()
 	s.numNonAlignTS.Init()
+	s.caughtUpTime.Init()
+	s.caughtUpTsTime.Init()
+	s.numScansQueued.Init()
+	s.numScansRejected.Init()
 }
 
 type IndexTimingStats struct {
@@ -145,9 +157,12 @@ type IndexStats struct {
 	sinceLastSnapshot         stats.Int64Val
 	numSnapshotWaiters        stats.Int64Val
 	numLastSnapshotReply      stats.Int64Val
+	numRetainedSnapshots      stats.Int64Val
+	retainedDeleteBytes       stats.Int64Val
 	numItemsRestored          stats.Int64Val
 	diskSnapStoreDuration     stats.Int64Val
 	diskSnapLoadDuration      stats.Int64Val
+	numCorruptSnapshots       stats.Int64Val
 	notReadyError             stats.Int64Val
 	clientCancelError         stats.Int64Val
 	avgScanRate               stats.Int64Val
@@ -162,6 +177,8 @@ type IndexStats struct {
 	progressStatTime          stats.TimeVal
 	residentPercent           stats.Int64Val
 	cacheHitPercent           stats.Int64Val
+	paused                    stats.Int64Val
+	warmupDuration            stats.Int64Val
 
 	Timings IndexTimingStats
 }
@@ -224,9 +241,12 @@ func (s *IndexStats) Init() {
 	s.sinceLastSnapshot.Init()
 	s.numSnapshotWaiters.Init()
 	s.numLastSnapshotReply.Init()
+	s.numRetainedSnapshots.Init()
+	s.retainedDeleteBytes.Init()
 	s.numItemsRestored.Init()
 	s.diskSnapStoreDuration.Init()
 	s.diskSnapLoadDuration.Init()
+	s.numCorruptSnapshots.Init()
 	s.notReadyError.Init()
 	s.clientCancelError.Init()
 	s.avgScanRate.Init()
@@ -241,6 +261,8 @@ func (s *IndexStats) Init() {
 	s.progressStatTime.Init()
 	s.residentPercent.Init()
 	s.cacheHitPercent.Init()
+	s.paused.Init()
+	s.warmupDuration.Init()
 
 	s.Timings.Init()
 
@@ -335,11 +357,27 @@ type IndexerStats struct {
 	memoryUsedStorage  stats.Int64Val
 	memoryTotalStorage stats.Int64Val
 	memoryUsedQueue    stats.Int64Val
+	spilledBytesQueue  stats.Int64Val
+	diskUsedQueue      stats.Int64Val
 	needsRestart       stats.BoolVal
 	statsResponse      stats.TimingStat
 	notFoundError      stats.Int64Val
+	numScanLeases      stats.Int64Val
+
+	numScansRunning       stats.Int64Val
+	numScansQueued        stats.Int64Val
+	numScansWaited        stats.Int64Val
+	numScansRejected      stats.Int64Val
+	scanQueueWaitDuration stats.Int64Val
+
+	numIndexesWarmupPending stats.Int64Val
+	numIndexesWarmedUp      stats.Int64Val
+	warmupDuration          stats.Int64Val
 
 	indexerState stats.Int64Val
+
+	diskState       stats.Int64Val
+	diskUsedPercent stats.Int64Val
 }
 
 func (s *IndexerStats) Init() {
@@ -351,16 +389,35 @@ func (s *IndexerStats) Init() {
 	s.memoryUsedStorage.Init()
 	s.memoryTotalStorage.Init()
 	s.memoryUsedQueue.Init()
+	s.spilledBytesQueue.Init()
+	s.diskUsedQueue.Init()
 	s.needsRestart.Init()
 	s.statsResponse.Init()
 	s.indexerState.Init()
 	s.notFoundError.Init()
+	s.numScanLeases.Init()
+	s.numScansRunning.Init()
+	s.numScansQueued.Init()
+	s.numScansWaited.Init()
+	s.numScansRejected.Init()
+	s.scanQueueWaitDuration.Init()
+	s.numIndexesWarmupPending.Init()
+	s.numIndexesWarmedUp.Init()
+	s.warmupDuration.Init()
+	s.diskState.Init()
+	s.diskUsedPercent.Init()
 }
 
 func (s *IndexerStats) Reset() {
 	old := *s
 	*s = IndexerStats{}
 	s.Init()
+	s.diskState.Set(old.diskState.Value())
+	s.numIndexesWarmupPending.Set(old.numIndexesWarmupPending.Value())
+	s.numIndexesWarmedUp.Set(old.numIndexesWarmedUp.Value())
+	s.warmupDuration.Set(old.warmupDuration.Value())
+	s.numScansRunning.Set(old.numScansRunning.Value())
+	s.numScansQueued.Set(old.numScansQueued.Value())
 	for k, v := range old.indexes {
 		s.AddIndex(k, v.bucket, v.name, v.replicaId)
 	}
@@ -452,7 +509,18 @@ func (is IndexerStats) GetStats(getPartition bool, skipEmpty bool) common.Statis
 	addStat("memory_used_storage", is.memoryUsedStorage.Value())
 	addStat("memory_total_storage", is.memoryTotalStorage.Value())
 	addStat("memory_used_queue", is.memoryUsedQueue.Value())
+	addStat("mutation_queue_spilled_bytes", is.spilledBytesQueue.Value())
+	addStat("disk_used_queue", is.diskUsedQueue.Value())
 	addStat("needs_restart", is.needsRestart.Value())
+	addStat("num_scan_leases", is.numScanLeases.Value())
+	addStat("num_scans_running", is.numScansRunning.Value())
+	addStat("num_scans_queued", is.numScansQueued.Value())
+	addStat("num_scans_waited", is.numScansWaited.Value())
+	addStat("num_scans_rejected", is.numScansRejected.Value())
+	addStat("scan_queue_wait_duration", is.scanQueueWaitDuration.Value())
+	addStat("num_indexes_warmup_pending", is.numIndexesWarmupPending.Value())
+	addStat("num_indexes_warmed_up", is.numIndexesWarmedUp.Value())
+	addStat("warmup_duration", is.warmupDuration.Value())
 	storageMode := fmt.Sprintf("%s", common.GetStorageMode())
 	addStat("storage_mode", storageMode)
 	addStat("num_cpu_core", num_cpu_core)
@@ -463,6 +531,8 @@ func (is IndexerStats) GetStats(getPartition bool, skipEmpty bool) common.Statis
 		indexerState = common.INDEXER_PAUSED
 	}
 	addStat("indexer_state", fmt.Sprintf("%s", indexerState))
+	addStat("disk_state", fmt.Sprintf("%s", DiskState(is.diskState.Value())))
+	addStat("disk_used_percent", is.diskUsedPercent.Value())
 
 	addStat("timings/stats_response", is.statsResponse.Value())
 
@@ -584,6 +654,14 @@ func (is IndexerStats) GetStats(getPartition bool, skipEmpty bool) common.Statis
 			s.int64Stats(func(ss *IndexStats) int64 {
 				return ss.completionProgress.Value()
 			}))
+		addStat("paused",
+			s.int64Stats(func(ss *IndexStats) int64 {
+				return ss.paused.Value()
+			}))
+		addStat("warmup_duration",
+			s.int64Stats(func(ss *IndexStats) int64 {
+				return ss.warmupDuration.Value()
+			}))
 		addStat("num_docs_queued",
 			s.int64Stats(func(ss *IndexStats) int64 {
 				return ss.numDocsQueued.Value()
@@ -669,6 +747,14 @@ func (is IndexerStats) GetStats(getPartition bool, skipEmpty bool) common.Statis
 			s.int64Stats(func(ss *IndexStats) int64 {
 				return ss.numLastSnapshotReply.Value()
 			}))
+		addStat("num_retained_snapshots", s.numRetainedSnapshots.Value())
+		// estimate of data kept alive only by retained snapshots
+		if s.numRetainedSnapshots.Value() != 0 {
+			addStat("retained_snapshot_bytes",
+				postiveNum(getDeleteBytes(s)-s.retainedDeleteBytes.Value()))
+		} else {
+			addStat("retained_snapshot_bytes", int64(0))
+		}
 		// partition stats
 		addStat("num_items_restored",
 			s.partnInt64Stats(func(ss *IndexStats) int64 {
@@ -684,6 +770,11 @@ func (is IndexerStats) GetStats(getPartition bool, skipEmpty bool) common.Statis
 			s.partnAvgInt64Stats(func(ss *IndexStats) int64 {
 				return ss.diskSnapLoadDuration.Value()
 			}))
+		// partition stats
+		addStat("num_corrupt_snapshots",
+			s.partnInt64Stats(func(ss *IndexStats) int64 {
+				return ss.numCorruptSnapshots.Value()
+			}))
 		addStat("not_ready_errcount",
 			s.int64Stats(func(ss *IndexStats) int64 {
 				return ss.notReadyError.Value()
@@ -809,6 +900,8 @@ func (is IndexerStats) GetStats(getPartition bool, skipEmpty bool) common.Statis
 		addStat("num_mutations_queued", s.numMutationsQueued.Value())
 		addStat("ts_queue_size", s.tsQueueSize.Value())
 		addStat("num_nonalign_ts", s.numNonAlignTS.Value())
+		addStat("num_scans_queued", s.numScansQueued.Value())
+		addStat("num_scans_rejected", s.numScansRejected.Value())
 		if st := common.BucketSeqsTiming(s.bucket); st != nil {
 			addStat("timings/dcp_getseqs", st.Value())
 		}
@@ -876,6 +969,7 @@ func (is IndexerStats) constructIndexerStats(skipEmpty bool, version string) com
 			indexerState = common.INDEXER_PAUSED
 		}
 		addStat("indexer_state", fmt.Sprintf("%s", indexerState))
+		addStat("disk_state", fmt.Sprintf("%s", DiskState(is.diskState.Value())))
 	}
 
 	return indexerStats
@@ -998,6 +1092,9 @@ type statsManager struct {
 	lastStatTime          time.Time
 	cacheUpdateInProgress bool
 	statsLogDumpInterval  uint64
+
+	// scan rates persisted for ordering the warmup on restart
+	scanRates map[common.IndexInstId]int64
 }
 
 func NewStatsManager(supvCmdch MsgChannel,
@@ -1241,12 +1338,55 @@ func (s *statsManager) runStatsDumpLogger() {
 				logging.Infof("PeriodicStats = %s", string(bytes))
 				skipStorage++
 			}
+			s.persistScanRates(stats)
 		}
 
 		time.Sleep(time.Second * time.Duration(atomic.LoadUint64(&s.statsLogDumpInterval)))
 	}
 }
 
+//persistScanRates saves the scan rate of indexes which have served scans
+//since the indexer started, rates persisted earlier are retained for the
+//rest so that indexes not yet scanned after a restart keep their priority.
+func (s *statsManager) persistScanRates(stats *IndexerStats) {
+
+	if common.IndexerState(stats.indexerState.Value()) != common.INDEXER_ACTIVE {
+		return
+	}
+
+	dir := s.config.Load()["storage_dir"].String()
+	if s.scanRates == nil {
+		s.scanRates = loadScanRates(dir)
+	}
+
+	changed := false
+	for instId := range s.scanRates {
+		if _, ok := stats.indexes[instId]; !ok {
+			delete(s.scanRates, instId)
+			changed = true
+		}
+	}
+
+	for instId, is := range stats.indexes {
+		if is.numRequests.Value() == 0 {
+			continue
+		}
+		rate := is.int64Stats(func(ss *IndexStats) int64 {
+			return ss.avgScanRate.Value()
+		})
+		if old, ok := s.scanRates[instId]; !ok || old != rate {
+			s.scanRates[instId] = rate
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := saveScanRates(dir, s.scanRates); err != nil {
+			logging.Errorf("StatsManager::persistScanRates Error saving scan rates: %v", err)
+		}
+	}
+}
+
 func postiveNum(n int64) int64 {
 	if n < 0 {
 		return 0
@@ -17,6 +17,8 @@ import (
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/fdb"
 	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/memdb"
+	"os"
 	"sync"
 	"time"
 )
@@ -48,6 +50,10 @@ type storageMgr struct {
 	// List of waiters waiting for a snapshot to be created with expected
 	// atleast-timestamp
 	waitersMap map[common.IndexInstId][]*snapshotWaiter
+	// Older snapshots kept for indexes with snapshot retention,
+	// oldest first
+	retainedSnapMap     map[common.IndexInstId][]*retainedSnapshot
+	currSnapDeleteBytes map[common.IndexInstId]int64
 
 	dbfile *forestdb.File
 	meta   *forestdb.KVStore // handle for index meta
@@ -56,7 +62,10 @@ type storageMgr struct {
 
 	stats IndexerStatsHolder
 
-	muSnap sync.Mutex //lock to protect snapMap and waitersMap
+	muSnap sync.Mutex //lock to protect snapMap, waitersMap and retainedSnapMap
+
+	diskState         int32     //DiskState of storage_dir, accessed atomically
+	diskMonitorStopCh chan bool //closed to stop monitorDiskUsage
 }
 
 type IndexSnapMap map[common.IndexInstId]IndexSnapshot
@@ -95,9 +104,11 @@ func (w *snapshotWaiter) Error(err error) {
 //by a synchronous response of the supvCmdch.
 //Any async response to supervisor is sent to supvRespch.
 //If supvCmdch get closed, storageMgr will shut itself down.
+//Snapshots already opened while warming up the indexes are passed
+//in warmSnapMap, these are not opened again.
 func NewStorageManager(supvCmdch MsgChannel, supvRespch MsgChannel,
-	indexPartnMap IndexPartnMap, config common.Config, snapshotNotifych chan IndexSnapshot) (
-	StorageManager, Message) {
+	indexPartnMap IndexPartnMap, warmSnapMap IndexSnapMap, config common.Config,
+	snapshotNotifych chan IndexSnapshot) (StorageManager, Message) {
 
 	//Init the storageMgr struct
 	s := &storageMgr{
@@ -107,15 +118,18 @@ func NewStorageManager(supvCmdch MsgChannel, supvRespch MsgChannel,
 		indexSnapMap:     make(map[common.IndexInstId]IndexSnapshot),
 		waitersMap:       make(map[common.IndexInstId][]*snapshotWaiter),
 		config:           config,
+
+		retainedSnapMap:     make(map[common.IndexInstId][]*retainedSnapshot),
+		currSnapDeleteBytes: make(map[common.IndexInstId]int64),
+		diskMonitorStopCh:   make(chan bool),
 	}
 
 	//if manager is not enabled, create meta file
 	if config["enableManager"].Bool() == false {
-		fdbconfig := forestdb.DefaultConfig()
 		kvconfig := forestdb.DefaultKVStoreConfig()
 		var err error
 
-		if s.dbfile, err = forestdb.Open("meta", fdbconfig); err != nil {
+		if s.dbfile, err = openMetaFile(META_FILE); err != nil {
 			return nil, &MsgError{err: Error{cause: err}}
 		}
 
@@ -125,10 +139,11 @@ func NewStorageManager(supvCmdch MsgChannel, supvRespch MsgChannel,
 		}
 	}
 
-	s.updateIndexSnapMap(indexPartnMap, common.ALL_STREAMS, "")
+	s.initIndexSnapMap(indexPartnMap, warmSnapMap)
 
 	//start Storage Manager loop which listens to commands from its supervisor
 	go s.run()
+	go s.monitorDiskUsage()
 
 	return s, &MsgSuccess{}
 
@@ -138,6 +153,8 @@ func NewStorageManager(supvCmdch MsgChannel, supvRespch MsgChannel,
 //from its supervisor(indexer)
 func (s *storageMgr) run() {
 
+	defer close(s.diskMonitorStopCh)
+
 	//main Storage Manager loop
 loop:
 	for {
@@ -253,7 +270,10 @@ func (s *storageMgr) createSnapshotWorker(streamId common.StreamId, bucket strin
 	var forceCommit bool
 	snapType := tsVbuuid.GetSnapType()
 	if snapType == common.DISK_SNAP {
-		needsCommit = true
+		//skip persisting snapshots when running low on disk space
+		if s.getDiskState() == DISK_OK {
+			needsCommit = true
+		}
 	} else if snapType == common.FORCE_COMMIT {
 		forceCommit = true
 	}
@@ -336,6 +356,10 @@ func (s *storageMgr) createSnapshotWorker(streamId common.StreamId, bucket strin
 
 							snapCreateStart := time.Now()
 							if info, err = slice.NewSnapshot(newTsVbuuid, needsCommit); err != nil {
+								if err == memdb.ErrMaxSnapshotsLimitReached {
+									logging.Warnf("Maximum snapshots limit reached for indexer. Restarting indexer...")
+									os.Exit(0)
+								}
 								logging.Errorf("handleCreateSnapshot::handleCreateSnapshot Error "+
 									"Creating new snapshot Slice Index: %v Slice: %v. Skipped. Error %v", idxInstId,
 									slice.Id(), err)
@@ -456,7 +480,8 @@ func (s *storageMgr) updateSnapMapAndNotify(is IndexSnapshot, idxStats *IndexSta
 	s.muSnap.Lock()
 	defer s.muSnap.Unlock()
 
-	DestroyIndexSnapshot(s.indexSnapMap[is.IndexInstId()])
+	// keep the replaced snapshot if the index has a retention window
+	s.retainOrDestroySnapshot(s.indexSnapMap[is.IndexInstId()], is, idxStats)
 	s.indexSnapMap[is.IndexInstId()] = is
 
 	// notify a new snapshot through channel
@@ -665,6 +690,7 @@ func (s *storageMgr) handleUpdateIndexInstMap(cmd Message) {
 			inst.State == common.INDEX_STATE_DELETED {
 			DestroyIndexSnapshot(is)
 			delete(s.indexSnapMap, idxInstId)
+			s.destroyRetainedSnapshots(idxInstId)
 			s.notifySnapshotDeletion(idxInstId)
 		}
 	}
@@ -738,6 +764,16 @@ func (s *storageMgr) handleGetIndexSnapshot(cmd Message) {
 	s.muSnap.Lock()
 	defer s.muSnap.Unlock()
 
+	// Time travel scans are served from retained snapshots right away
+	if req.IsAsOf() {
+		if is, err := s.getRetainedSnapshot(req); err != nil {
+			req.respch <- err
+		} else {
+			req.respch <- is
+		}
+		return
+	}
+
 	// Return snapshot immediately if a matching snapshot exists already
 	// Otherwise add into waiters list so that next snapshot creation event
 	// can notify the requester when a snapshot with matching timestamp
@@ -778,6 +814,15 @@ func (s *storageMgr) handleStats(cmd Message) {
 	replych := req.GetReplyChannel()
 	storageStats := s.getIndexStorageStats()
 
+	// retained snapshots of idle indexes are pruned here
+	s.muSnap.Lock()
+	for instId := range s.retainedSnapMap {
+		if curr := s.indexSnapMap[instId]; curr != nil {
+			s.pruneRetainedSnapshots(instId, curr, s.stats.Get().indexes[instId])
+		}
+	}
+	s.muSnap.Unlock()
+
 	stats := s.stats.Get()
 	for _, st := range storageStats {
 		inst := s.indexInstMap[st.InstId]
@@ -1139,6 +1184,27 @@ func (s *storageMgr) handleIndexCompaction(cmd Message) {
 	}()
 }
 
+//initIndexSnapMap adopts the snapshots opened while warming up the
+//indexes, latest snapshots of the remaining indexes are opened here.
+//Scan coordinator has been notified of the warm snapshots already.
+func (s *storageMgr) initIndexSnapMap(indexPartnMap IndexPartnMap,
+	warmSnapMap IndexSnapMap) {
+
+	coldPartnMap := make(IndexPartnMap)
+
+	s.muSnap.Lock()
+	for idxInstId, partnMap := range indexPartnMap {
+		if is, ok := warmSnapMap[idxInstId]; ok && is != nil {
+			s.indexSnapMap[idxInstId] = is
+		} else {
+			coldPartnMap[idxInstId] = partnMap
+		}
+	}
+	s.muSnap.Unlock()
+
+	s.updateIndexSnapMap(coldPartnMap, common.ALL_STREAMS, "")
+}
+
 // Update index-snapshot map using index partition map
 // This function should be called only during initialization
 // of storage manager and during rollback.
@@ -1167,71 +1233,102 @@ func (s *storageMgr) updateIndexSnapMap(indexPartnMap IndexPartnMap,
 
 		DestroyIndexSnapshot(s.indexSnapMap[idxInstId])
 		delete(s.indexSnapMap, idxInstId)
+		// retained snapshots are not valid history after rollback
+		s.destroyRetainedSnapshots(idxInstId)
 		s.notifySnapshotDeletion(idxInstId)
 
-		var tsVbuuid *common.TsVbuuid
-		partnSnapMap := make(map[common.PartitionId]PartitionSnapshot)
+		is, err := openLatestIndexSnapshot(idxInstId, partnMap)
+		// TODO: Proper error handling if possible
+		if err != nil {
+			panic(err.Error())
+		}
 
-		for _, partnInst := range partnMap {
+		if is != nil {
+			s.indexSnapMap[idxInstId] = is
+			s.notifySnapshotCreation(is)
+		} else {
+			s.addNilSnapshot(idxInstId, bucket)
+		}
+	}
+}
 
-			pid := partnInst.Defn.GetPartitionId()
-			sc := partnInst.Sc
+//openLatestIndexSnapshot opens the latest snapshot of all the partitions
+//of an index instance. A nil snapshot is returned if any of the partitions
+//has no snapshot.
+func openLatestIndexSnapshot(idxInstId common.IndexInstId,
+	partnMap PartitionInstMap) (is IndexSnapshot, err error) {
 
-			//there is only one slice for now
-			slice := sc.GetSliceById(0)
-			infos, err := slice.GetSnapshots()
-			// TODO: Proper error handling if possible
-			if err != nil {
-				panic("Unable to read snapinfo -" + err.Error())
-			}
+	var tsVbuuid *common.TsVbuuid
+	partnSnapMap := make(map[common.PartitionId]PartitionSnapshot)
 
-			snapInfoContainer := NewSnapshotInfoContainer(infos)
-			latestSnapshotInfo := snapInfoContainer.GetLatest()
+	//close the snapshots of the partitions already opened, if the
+	//snapshot of the index is not returned
+	defer func() {
+		if is == nil {
+			DestroyIndexSnapshot(&indexSnapshot{partns: partnSnapMap})
+		}
+	}()
 
-			if latestSnapshotInfo != nil {
-				logging.Infof("StorageMgr::updateIndexSnapMap IndexInst:%v Attempting to open snapshot (%v)",
-					idxInstId, latestSnapshotInfo)
-				latestSnapshot, err := slice.OpenSnapshot(latestSnapshotInfo)
-				if err != nil {
-					panic("Unable to open snapshot -" + err.Error())
-				}
-				ss := &sliceSnapshot{
-					id:   SliceId(0),
-					snap: latestSnapshot,
-				}
+	for _, partnInst := range partnMap {
 
-				tsVbuuid = latestSnapshotInfo.Timestamp()
+		pid := partnInst.Defn.GetPartitionId()
+		sc := partnInst.Sc
 
-				sid := SliceId(0)
+		//there is only one slice for now
+		slice := sc.GetSliceById(0)
+		infos, err := slice.GetSnapshots()
+		if err != nil {
+			return nil, errors.New("Unable to read snapinfo -" + err.Error())
+		}
 
-				ps := &partitionSnapshot{
-					id:     pid,
-					slices: map[SliceId]SliceSnapshot{sid: ss},
-				}
+		snapInfoContainer := NewSnapshotInfoContainer(infos)
+		latestSnapshotInfo := snapInfoContainer.GetLatest()
 
-				partnSnapMap[pid] = ps
+		if latestSnapshotInfo == nil {
+			// If it fails to open a snapshot for one of the slice/partition,
+			// do not compute the snapshot for the index instance.  This function
+			// will return a nil snapshot.
+			return nil, nil
+		}
 
-			} else {
-				// If it fails to open a snapshot for one of the slice/partition,
-				// do not compute the snapshot for the index instance.  This function
-				// will return a nil snapshot.
-				partnSnapMap = nil
-				break
-			}
+		logging.Infof("StorageMgr::openLatestIndexSnapshot IndexInst:%v Attempting to open snapshot (%v)",
+			idxInstId, latestSnapshotInfo)
+		latestSnapshot, err := slice.OpenSnapshot(latestSnapshotInfo)
+		if err != nil {
+			return nil, errors.New("Unable to open snapshot -" + err.Error())
+		}
+		ss := &sliceSnapshot{
+			id:   SliceId(0),
+			snap: latestSnapshot,
 		}
 
-		if len(partnSnapMap) != 0 {
-			is := &indexSnapshot{
-				instId: idxInstId,
-				ts:     tsVbuuid,
-				partns: partnSnapMap,
-			}
-			s.indexSnapMap[idxInstId] = is
-			s.notifySnapshotCreation(is)
-		} else {
-			s.addNilSnapshot(idxInstId, bucket)
+		//timestamp of the snapshot actually loaded, which may be
+		//older than the latest one if that is found corrupted. The
+		//index snapshot has the oldest timestamp of its partitions.
+		ts := latestSnapshot.Timestamp()
+		if len(partnSnapMap) == 0 || !ts.AsRecent(tsVbuuid) {
+			tsVbuuid = ts
+		}
+
+		sid := SliceId(0)
+
+		ps := &partitionSnapshot{
+			id:     pid,
+			slices: map[SliceId]SliceSnapshot{sid: ss},
 		}
+
+		partnSnapMap[pid] = ps
+	}
+
+	if len(partnSnapMap) == 0 {
+		return nil, nil
 	}
+
+	return &indexSnapshot{
+		instId: idxInstId,
+		ts:     tsVbuuid,
+		partns: partnSnapMap,
+	}, nil
 }
 
 func copyIndexSnapMap(inMap IndexSnapMap) IndexSnapMap {
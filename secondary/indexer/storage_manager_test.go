@@ -0,0 +1,138 @@
+package indexer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+type testSnapshotInfo struct {
+	ts *common.TsVbuuid
+}
+
+func (info *testSnapshotInfo) Timestamp() *common.TsVbuuid {
+	return info.ts
+}
+
+func (info *testSnapshotInfo) IsCommitted() bool {
+	return true
+}
+
+// testRecoverySlice opens its latest snapshot, falling back to an older
+// timestamp if fallbackTs is set, as a slice finding its latest snapshot
+// corrupted does.
+type testRecoverySlice struct {
+	Slice
+	infos      []SnapshotInfo
+	fallbackTs *common.TsVbuuid
+	openErr    error
+	snap       *testLeaseSnapshot
+}
+
+func (s *testRecoverySlice) GetSnapshots() ([]SnapshotInfo, error) {
+	return s.infos, nil
+}
+
+func (s *testRecoverySlice) OpenSnapshot(info SnapshotInfo) (Snapshot, error) {
+	if s.openErr != nil {
+		return nil, s.openErr
+	}
+	ts := info.Timestamp()
+	if s.fallbackTs != nil {
+		ts = s.fallbackTs
+	}
+	s.snap = &testLeaseSnapshot{Snapshot: &testTsSnapshot{ts: ts}, refs: 1}
+	return s.snap, nil
+}
+
+type testTsSnapshot struct {
+	Snapshot
+	ts *common.TsVbuuid
+}
+
+func (s *testTsSnapshot) Timestamp() *common.TsVbuuid {
+	return s.ts
+}
+
+func newTestRecoveryTs(seqno uint64) *common.TsVbuuid {
+	ts := common.NewTsVbuuid("default", 4)
+	for i := range ts.Seqnos {
+		ts.Seqnos[i] = seqno
+		ts.Vbuuids[i] = 1
+	}
+	return ts
+}
+
+func newTestPartnMap(slices map[common.PartitionId]*testRecoverySlice) PartitionInstMap {
+	partnMap := make(PartitionInstMap)
+	for pid, slice := range slices {
+		sc := NewHashedSliceContainer()
+		sc.AddSlice(0, slice)
+		partnMap[pid] = PartitionInst{
+			Defn: common.KeyPartitionDefn{Id: pid},
+			Sc:   sc,
+		}
+	}
+	return partnMap
+}
+
+func TestOpenLatestIndexSnapshotFallback(t *testing.T) {
+
+	latestTs := newTestRecoveryTs(100)
+	olderTs := newTestRecoveryTs(50)
+
+	// only partition 2 falls back to an older snapshot
+	slices := map[common.PartitionId]*testRecoverySlice{
+		1: {infos: []SnapshotInfo{&testSnapshotInfo{ts: latestTs}}},
+		2: {infos: []SnapshotInfo{&testSnapshotInfo{ts: latestTs}}, fallbackTs: olderTs},
+		3: {infos: []SnapshotInfo{&testSnapshotInfo{ts: latestTs}}},
+	}
+
+	// the result must not depend on the order partitions are opened in
+	for i := 0; i < 10; i++ {
+		is, err := openLatestIndexSnapshot(common.IndexInstId(1), newTestPartnMap(slices))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if is == nil {
+			t.Fatalf("expected an index snapshot")
+		}
+		if len(is.Partitions()) != len(slices) {
+			t.Fatalf("expected %v partitions, got %v", len(slices), len(is.Partitions()))
+		}
+		if is.Timestamp() != olderTs {
+			t.Fatalf("expected the timestamp of the fallen back partition %v, got %v",
+				olderTs.Seqnos, is.Timestamp().Seqnos)
+		}
+		DestroyIndexSnapshot(is)
+	}
+}
+
+func TestOpenLatestIndexSnapshotError(t *testing.T) {
+
+	ts := newTestRecoveryTs(100)
+	opened := &testRecoverySlice{infos: []SnapshotInfo{&testSnapshotInfo{ts: ts}}}
+	failed := &testRecoverySlice{infos: []SnapshotInfo{&testSnapshotInfo{ts: ts}},
+		openErr: errors.New("corrupted")}
+	empty := &testRecoverySlice{}
+
+	for _, last := range []*testRecoverySlice{failed, empty} {
+		// retry until the good partition is opened first
+		for i := 0; i < 100 && opened.snap == nil; i++ {
+			partnMap := newTestPartnMap(map[common.PartitionId]*testRecoverySlice{
+				1: opened, 2: last})
+			if is, _ := openLatestIndexSnapshot(common.IndexInstId(1), partnMap); is != nil {
+				t.Fatalf("expected no index snapshot")
+			}
+		}
+		if opened.snap == nil {
+			t.Fatalf("expected the snapshot of partition 1 to be opened")
+		}
+		if opened.snap.refs != 0 {
+			t.Errorf("expected the snapshot of partition 1 to be closed, refs %v",
+				opened.snap.refs)
+		}
+		opened.snap = nil
+	}
+}
@@ -54,6 +54,9 @@ type StreamState struct {
 	streamBucketSkippedInMemTs  map[common.StreamId]BucketSkippedInMemTs
 
 	bucketRollbackTime map[string]int64
+
+	//flush is stopped for all streams while the storage disk is full
+	diskFull bool
 }
 
 type BucketHWTMap map[string]*common.TsVbuuid
@@ -792,6 +795,7 @@ func (ss *StreamState) checkCommitOverdue(streamId common.StreamId, bucket strin
 		tsList := bucketTsListMap[bucket]
 		if bucketFlushInProgressTsMap[bucket] == nil &&
 			bucketFlushEnabledMap[bucket] == true &&
+			!ss.diskFull &&
 			tsList.Len() == 0 &&
 			bucketNeedsCommit[bucket] == true {
 			return true
@@ -809,6 +813,7 @@ func (ss *StreamState) getNextStabilityTS(streamId common.StreamId,
 	tsVbuuid := ss.streamBucketHWTMap[streamId][bucket].Copy()
 
 	tsVbuuid.SetSnapType(common.NO_SNAP)
+	tsVbuuid.GenTime = time.Now().UnixNano()
 
 	ss.alignSnapBoundary(streamId, bucket, tsVbuuid)
 
@@ -903,6 +908,7 @@ func (ss *StreamState) canFlushNewTS(streamId common.StreamId,
 	tsList := bucketTsListMap[bucket]
 	if bucketFlushInProgressTsMap[bucket] == nil &&
 		bucketFlushEnabledMap[bucket] == true &&
+		!ss.diskFull &&
 		tsList.Len() == 0 {
 		return true
 	}
@@ -28,6 +28,11 @@ const (
 	maxStatsRetries = 5
 )
 
+var (
+	ErrFlushBarrierExists   = errors.New("Flush barrier already exists for bucket")
+	ErrFlushBarrierNotFound = errors.New("Flush barrier not found for bucket")
+)
+
 //Timekeeper manages the Stability Timestamp Generation and also
 //keeps track of the HWTimestamp for each bucket
 type Timekeeper interface {
@@ -56,6 +61,9 @@ type timekeeper struct {
 	lock sync.RWMutex //lock to protect this structure
 
 	indexerState common.IndexerState
+
+	//map of bucket to its flush barrier in MAINT_STREAM
+	flushBarriers map[string]*flushBarrier
 }
 
 type InitialBuildInfo struct {
@@ -65,6 +73,16 @@ type InitialBuildInfo struct {
 	minMergeTs           *common.TsVbuuid //minimum merge ts for init stream
 }
 
+//flushBarrier splits the flush of a bucket at ts, ahead of the flushed
+//ts, and forces a snapshot at ts, so that the snapshots of the replicas
+//of an index on different nodes can be compared at the same timestamp.
+//Vbuckets which reach ts wait for the others, the barrier is dropped
+//once the snapshot at ts is requested.
+type flushBarrier struct {
+	ts     *common.TsVbuuid
+	expiry time.Time
+}
+
 //timeout in milliseconds to batch the vbuckets
 //together for repair message
 const REPAIR_BATCH_TIMEOUT = 1000
@@ -73,6 +91,9 @@ const KV_RETRY_INTERVAL = 5000
 //const REPAIR_RETRY_INTERVAL = 5000
 const REPAIR_RETRY_BEFORE_SHUTDOWN = 5
 
+//flush barrier is dropped if not released in time
+const defaultFlushBarrierTimeout = 60 * time.Second
+
 //NewTimekeeper returns an instance of timekeeper or err message.
 //It listens on supvCmdch for command and every command is followed
 //by a synchronous response of the supvCmdch.
@@ -91,6 +112,7 @@ func NewTimekeeper(supvCmdch MsgChannel, supvRespch MsgChannel,
 		indexPartnMap:  make(IndexPartnMap),
 		indexBuildInfo: make(map[common.IndexInstId]*InitialBuildInfo),
 		bucketConn:     make(map[string]*couchbase.Bucket),
+		flushBarriers:  make(map[string]*flushBarrier),
 	}
 
 	//start timekeeper loop which listens to commands from its supervisor
@@ -176,6 +198,9 @@ func (tk *timekeeper) handleSupervisorCommands(cmd Message) {
 	case TK_GET_BUCKET_HWT:
 		tk.handleGetBucketHWT(cmd)
 
+	case TK_FLUSH_BARRIER:
+		tk.handleFlushBarrier(cmd)
+
 	case INDEXER_INIT_PREP_RECOVERY:
 		tk.handleInitPrepRecovery(cmd)
 
@@ -215,6 +240,9 @@ func (tk *timekeeper) handleSupervisorCommands(cmd Message) {
 	case INDEXER_RESUME:
 		tk.handleIndexerResume(cmd)
 
+	case STORAGE_DISK_STATE:
+		tk.handleDiskStateChange(cmd)
+
 	default:
 		logging.Errorf("Timekeeper::handleSupvervisorCommands "+
 			"Received Unknown Command %v", cmd)
@@ -874,6 +902,37 @@ func (tk *timekeeper) handleFlushStateChange(cmd Message) {
 	tk.supvCmdch <- &MsgSuccess{}
 }
 
+//handleDiskStateChange stops flushing mutations for all the streams
+//and buckets while the storage disk is full. Stability timestamps keep
+//getting queued and are flushed once the disk has enough free space.
+func (tk *timekeeper) handleDiskStateChange(cmd Message) {
+
+	state := cmd.(*MsgDiskState).GetState()
+
+	logging.Infof("Timekeeper::handleDiskStateChange Disk State %v", state)
+
+	tk.lock.Lock()
+	defer tk.lock.Unlock()
+
+	diskFull := state == DISK_FULL
+	if tk.ss.diskFull != diskFull {
+		tk.ss.diskFull = diskFull
+
+		if !diskFull {
+			//if there are any pending TS, send that
+			for s, bs := range tk.ss.streamBucketStatus {
+				for b, status := range bs {
+					if status != STREAM_INACTIVE {
+						tk.processPendingTS(s, b)
+					}
+				}
+			}
+		}
+	}
+
+	tk.supvCmdch <- &MsgSuccess{}
+}
+
 func (tk *timekeeper) handleGetBucketHWT(cmd Message) {
 
 	logging.Debugf("Timekeeper::handleGetBucketHWT %v", cmd)
@@ -897,6 +956,249 @@ func (tk *timekeeper) handleGetBucketHWT(cmd Message) {
 	tk.supvCmdch <- msg
 }
 
+func (tk *timekeeper) handleFlushBarrier(cmd Message) {
+
+	logging.Debugf("Timekeeper::handleFlushBarrier %v", cmd)
+
+	msg := cmd.(*MsgFlushBarrier)
+	bucket := msg.GetBucket()
+
+	tk.lock.Lock()
+	defer tk.lock.Unlock()
+
+	var resp interface{}
+	switch msg.GetOp() {
+
+	case FLUSH_BARRIER_GET_TS:
+		resp = tk.getFlushBarrierTs(bucket)
+
+	case FLUSH_BARRIER_SET:
+		resp = tk.setFlushBarrier(bucket, msg.GetTS(), msg.GetTimeout())
+
+	case FLUSH_BARRIER_RELEASE:
+		resp = tk.releaseFlushBarrier(bucket)
+
+	default:
+		resp = fmt.Errorf("Unknown flush barrier op %v", msg.GetOp())
+	}
+
+	msg.GetReplyChannel() <- resp
+	tk.supvCmdch <- &MsgSuccess{}
+}
+
+//getFlushBarrierTs returns the HWT of the bucket, a ts the flush has
+//not reached yet for a flush barrier
+func (tk *timekeeper) getFlushBarrierTs(bucket string) interface{} {
+
+	streamId := common.MAINT_STREAM
+
+	if status, ok := tk.ss.streamBucketStatus[streamId][bucket]; !ok || status != STREAM_ACTIVE {
+		return fmt.Errorf("Bucket %v is not active in %v", bucket, streamId)
+	}
+
+	if tk.hasInitStateIndex(streamId, bucket) {
+		return fmt.Errorf("Bucket %v has indexes in initial build", bucket)
+	}
+
+	hwt := tk.ss.streamBucketHWTMap[streamId][bucket]
+	if hwt == nil {
+		return fmt.Errorf("Bucket %v has no mutation yet", bucket)
+	}
+
+	ts := hwt.Copy()
+	ts.Bucket = bucket
+	return ts
+}
+
+//setFlushBarrier splits the flush of the bucket at ts and requests a
+//snapshot at ts. ts must not be behind the ts being flushed or the last
+//flushed ts.
+func (tk *timekeeper) setFlushBarrier(bucket string, ts *common.TsVbuuid,
+	timeout time.Duration) interface{} {
+
+	streamId := common.MAINT_STREAM
+
+	if tk.getFlushBarrier(bucket) != nil {
+		return ErrFlushBarrierExists
+	}
+
+	if status, ok := tk.ss.streamBucketStatus[streamId][bucket]; !ok || status != STREAM_ACTIVE {
+		return fmt.Errorf("Bucket %v is not active in %v", bucket, streamId)
+	}
+
+	base := tk.getFlushBarrierBaseTs(bucket)
+	if ts == nil || base == nil || len(ts.Seqnos) != len(base.Seqnos) {
+		return fmt.Errorf("Invalid flush barrier ts for bucket %v", bucket)
+	}
+
+	for i, seqno := range ts.Seqnos {
+		if seqno < base.Seqnos[i] {
+			return fmt.Errorf("Flush barrier ts for bucket %v is behind the flushed "+
+				"ts for vbucket %v (%v < %v)", bucket, i, seqno, base.Seqnos[i])
+		}
+		if seqno == base.Seqnos[i] && seqno != 0 && ts.Vbuuids[i] != base.Vbuuids[i] {
+			return fmt.Errorf("Flush barrier ts for bucket %v has vbuuid mismatch "+
+				"for vbucket %v (%v != %v)", bucket, i, ts.Vbuuids[i], base.Vbuuids[i])
+		}
+	}
+
+	//no barrier is needed if the flush at ts creates a snapshot
+	if getSeqTsFromTsVbuuid(base).Equals(getSeqTsFromTsVbuuid(ts)) &&
+		base.GetSnapType() != common.NO_SNAP {
+		return base.Copy()
+	}
+
+	if timeout <= 0 {
+		timeout = defaultFlushBarrierTimeout
+	}
+
+	b := &flushBarrier{
+		ts:     ts.Copy(),
+		expiry: time.Now().Add(timeout),
+	}
+	b.ts.Bucket = bucket
+	tk.flushBarriers[bucket] = b
+
+	logging.Infof("Timekeeper::setFlushBarrier Bucket %v Flush Barrier %v", bucket, b.ts)
+
+	if !tk.processPendingTS(streamId, bucket) {
+		tk.checkFlushBarrierSnap(streamId, bucket)
+	}
+
+	return b.ts.Copy()
+}
+
+func (tk *timekeeper) releaseFlushBarrier(bucket string) interface{} {
+
+	streamId := common.MAINT_STREAM
+
+	b, ok := tk.flushBarriers[bucket]
+	if !ok {
+		return ErrFlushBarrierNotFound
+	}
+	delete(tk.flushBarriers, bucket)
+
+	logging.Infof("Timekeeper::releaseFlushBarrier Bucket %v Flush Barrier %v", bucket, b.ts)
+
+	tk.processPendingTS(streamId, bucket)
+	return b.ts
+}
+
+//getFlushBarrier returns the flush barrier of the bucket, dropping it
+//if it has expired
+func (tk *timekeeper) getFlushBarrier(bucket string) *flushBarrier {
+
+	b, ok := tk.flushBarriers[bucket]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(b.expiry) {
+		logging.Warnf("Timekeeper::getFlushBarrier Bucket %v Flush Barrier "+
+			"Expired. Dropped.", bucket)
+		delete(tk.flushBarriers, bucket)
+		return nil
+	}
+	return b
+}
+
+//getFlushBarrierBaseTs returns the ts being flushed or the last flushed
+//ts, no flush can stop before it
+func (tk *timekeeper) getFlushBarrierBaseTs(bucket string) *common.TsVbuuid {
+
+	streamId := common.MAINT_STREAM
+
+	if ts := tk.ss.streamBucketFlushInProgressTsMap[streamId][bucket]; ts != nil {
+		return ts
+	}
+	return tk.ss.streamBucketLastFlushedTsMap[streamId][bucket]
+}
+
+//applyFlushBarrier clamps flushTs to the flush barrier of the bucket.
+//The part of flushTs past the barrier is added back to the pending list.
+//Returns true if flushTs is at the barrier, which is then dropped, and a
+//snapshot is required at flushTs.
+func (tk *timekeeper) applyFlushBarrier(streamId common.StreamId,
+	bucket string, flushTs *common.TsVbuuid) bool {
+
+	if streamId != common.MAINT_STREAM {
+		return false
+	}
+
+	b := tk.getFlushBarrier(bucket)
+	if b == nil {
+		return false
+	}
+
+	orig := flushTs.Copy()
+	clamped, ok := clampTsToBarrier(flushTs, b.ts)
+	if !ok {
+		logging.Warnf("Timekeeper::applyFlushBarrier Bucket %v Vbuuid Mismatch "+
+			"with Flush Barrier. Dropped. \n\tFlushTs %v \n\tBarrier %v", bucket, flushTs, b.ts)
+		delete(tk.flushBarriers, bucket)
+		return false
+	}
+
+	if clamped {
+		tsList := tk.ss.streamBucketTsListMap[streamId][bucket]
+		tsList.PushFront(orig)
+		flushTs.SetSnapAligned(flushTs.CheckSnapAligned())
+	}
+
+	if !getSeqTsFromTsVbuuid(flushTs).Equals(getSeqTsFromTsVbuuid(b.ts)) {
+		return false
+	}
+
+	logging.Infof("Timekeeper::applyFlushBarrier Bucket %v Flush Barrier Reached %v",
+		bucket, b.ts)
+	delete(tk.flushBarriers, bucket)
+	return true
+}
+
+//checkFlushBarrierSnap requests the snapshot at the flush barrier of
+//the bucket, if it has already been flushed without one
+func (tk *timekeeper) checkFlushBarrierSnap(streamId common.StreamId, bucket string) {
+
+	if streamId != common.MAINT_STREAM {
+		return
+	}
+
+	b := tk.getFlushBarrier(bucket)
+	if b == nil || !tk.ss.canFlushNewTS(streamId, bucket) {
+		return
+	}
+
+	lts := tk.ss.streamBucketLastFlushedTsMap[streamId][bucket]
+	if lts == nil || !getSeqTsFromTsVbuuid(lts).Equals(getSeqTsFromTsVbuuid(b.ts)) {
+		return
+	}
+
+	tk.sendNewStabilityTS(lts.Copy(), bucket, streamId)
+}
+
+//clampTsToBarrier lowers the seqnos of ts past the barrier to the
+//barrier. Returns false, leaving ts unchanged, if ts doesn't have the
+//same vbucket history as the barrier.
+func clampTsToBarrier(ts, barrier *common.TsVbuuid) (bool, bool) {
+
+	for i, seqno := range barrier.Seqnos {
+		if seqno != 0 && ts.Vbuuids[i] != 0 && ts.Vbuuids[i] != barrier.Vbuuids[i] {
+			return false, false
+		}
+	}
+
+	clamped := false
+	for i, seqno := range ts.Seqnos {
+		if seqno > barrier.Seqnos[i] {
+			ts.Seqnos[i] = barrier.Seqnos[i]
+			ts.Vbuuids[i] = barrier.Vbuuids[i]
+			ts.Snapshots[i] = barrier.Snapshots[i]
+			clamped = true
+		}
+	}
+	return clamped, true
+}
+
 func (tk *timekeeper) handleStreamBegin(cmd Message) {
 
 	streamId := cmd.(*MsgStream).GetStreamId()
@@ -1922,6 +2224,9 @@ func (tk *timekeeper) generateNewStabilityTS(streamId common.StreamId,
 	} else if tk.processPendingTS(streamId, bucket) {
 		//nothing to do
 	} else {
+		tk.checkBucketCaughtUp(streamId, bucket)
+		tk.checkFlushBarrierSnap(streamId, bucket)
+
 		if !tk.hasInitStateIndex(streamId, bucket) &&
 			tk.ss.checkCommitOverdue(streamId, bucket) {
 
@@ -1938,6 +2243,45 @@ func (tk *timekeeper) generateNewStabilityTS(streamId common.StreamId,
 
 }
 
+//checkBucketCaughtUp records the time at which all the mutations received
+//for the bucket are known to be flushed, along with the generation time of
+//the last flushed TS. Bounded staleness scans use it to serve the last
+//snapshot of an idle bucket without waiting for a new one.
+func (tk *timekeeper) checkBucketCaughtUp(streamId common.StreamId, bucket string) {
+
+	if streamId != common.MAINT_STREAM {
+		return
+	}
+
+	if tk.ss.streamBucketFlushInProgressTsMap[streamId][bucket] != nil ||
+		!tk.ss.streamBucketFlushEnabledMap[streamId][bucket] ||
+		tk.ss.diskFull {
+		return
+	}
+
+	if tsList := tk.ss.streamBucketTsListMap[streamId][bucket]; tsList == nil || tsList.Len() > 0 {
+		return
+	}
+
+	lastFlushedTs := tk.ss.streamBucketLastFlushedTsMap[streamId][bucket]
+	hwt := tk.ss.streamBucketHWTMap[streamId][bucket]
+	if lastFlushedTs == nil || hwt == nil {
+		return
+	}
+
+	if !getSeqTsFromTsVbuuid(lastFlushedTs).Equals(getSeqTsFromTsVbuuid(hwt)) {
+		return
+	}
+
+	stats := tk.stats.Get()
+	if stat, ok := stats.buckets[bucket]; ok {
+		// caughtUpTsTime has to be set first, readers load the
+		// values in the reverse order
+		stat.caughtUpTsTime.Set(lastFlushedTs.GenTime)
+		stat.caughtUpTime.Set(time.Now().UnixNano())
+	}
+}
+
 //merge a new Ts with one already pending for the stream-bucket,
 //if large snapshots are being processed
 func (tk *timekeeper) maybeMergeTs(streamId common.StreamId,
@@ -1981,12 +2325,13 @@ func (tk *timekeeper) maybeMergeTs(streamId common.StreamId,
 func (tk *timekeeper) processPendingTS(streamId common.StreamId, bucket string) bool {
 
 	//if there is a flush already in progress for this stream and bucket
-	//or flush is disabled, nothing to be done
+	//or flush is disabled or the disk is full, nothing to be done
 	bucketFlushInProgressTsMap := tk.ss.streamBucketFlushInProgressTsMap[streamId]
 	bucketFlushEnabledMap := tk.ss.streamBucketFlushEnabledMap[streamId]
 
 	if bucketFlushInProgressTsMap[bucket] != nil ||
-		bucketFlushEnabledMap[bucket] == false {
+		bucketFlushEnabledMap[bucket] == false ||
+		tk.ss.diskFull {
 		return false
 	}
 
@@ -2050,15 +2395,21 @@ func (tk *timekeeper) sendNewStabilityTS(flushTs *common.TsVbuuid, bucket string
 
 	tk.mayBeMakeSnapAligned(streamId, bucket, flushTs)
 	tk.ensureMonotonicTs(streamId, bucket, flushTs)
+	atBarrier := tk.applyFlushBarrier(streamId, bucket, flushTs)
 
 	var changeVec []bool
 	if flushTs.GetSnapType() != common.FORCE_COMMIT {
 		var noChange bool
 		changeVec, noChange = tk.ss.computeTsChangeVec(streamId, bucket, flushTs)
-		if noChange {
+		if noChange && !atBarrier {
 			return
 		}
 		tk.setSnapshotType(streamId, bucket, flushTs)
+
+		//snapshot at the flush barrier is required for replica check
+		if atBarrier && flushTs.GetSnapType() == common.NO_SNAP {
+			flushTs.SetSnapType(common.INMEM_SNAP)
+		}
 	}
 
 	tk.setNeedsCommit(streamId, bucket, flushTs)
@@ -2847,6 +3198,11 @@ func (tk *timekeeper) handleStats(cmd Message) {
 				}
 			}
 
+			paused := int64(0)
+			if inst.Paused {
+				paused = 1
+			}
+
 			if idxStats != nil {
 				idxStats.numDocsProcessed.Set(int64(flushedCount))
 				idxStats.numDocsQueued.Set(int64(queued))
@@ -2855,6 +3211,7 @@ func (tk *timekeeper) handleStats(cmd Message) {
 				idxStats.completionProgress.Set(int64(math.Float64bits(v)))
 				idxStats.lastRollbackTime.Set(tk.ss.bucketRollbackTime[inst.Defn.Bucket])
 				idxStats.progressStatTime.Set(time.Now().UnixNano())
+				idxStats.paused.Set(paused)
 			}
 		}
 
@@ -0,0 +1,291 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// Warmup of indexes on indexer restart. Slices of an index are opened
+// (plasma recovery, forestdb open) and its latest snapshot is loaded
+// (memdb LoadFromDisk), with at most "settings.warmup.parallelism"
+// indexes warming up at a time. Indexes listed in
+// "settings.warmup.priority" are warmed up first, followed by the rest in
+// decreasing order of the scan rate last persisted by the stats manager.
+//
+// As soon as an index is warmed up, scan coordinator is handed its
+// snapshot and scans on it with AnyConsistency are served, while the
+// indexer is still bootstrapping.
+
+const warmupScanRatesFile = "warmup_scan_rates.json"
+
+type warmupTask struct {
+	inst     common.IndexInst
+	partnMap PartitionInstMap
+	snap     IndexSnapshot
+	duration time.Duration
+	err      error
+}
+
+//warmupIndexes initializes the partitions of all the index instances and
+//opens their latest snapshot, in the order of warmup priority. Snapshots
+//opened are returned to be handed over to the storage manager.
+func (idx *indexer) warmupIndexes(snapshotNotifych chan IndexSnapshot) (IndexSnapMap, error) {
+
+	priority := parseWarmupPriority(idx.config["settings.warmup.priority"].String())
+	parallelism := idx.config["settings.warmup.parallelism"].Int()
+	scanRates := loadScanRates(idx.config["storage_dir"].String())
+
+	insts := make([]common.IndexInst, 0, len(idx.indexInstMap))
+	for _, inst := range idx.indexInstMap {
+		insts = append(insts, inst)
+	}
+	tasks := make([]*warmupTask, 0, len(insts))
+	for _, inst := range warmupOrder(insts, priority, scanRates) {
+		tasks = append(tasks, &warmupTask{inst: inst})
+	}
+
+	logging.Infof("Indexer::warmupIndexes Warming up %v indexes, parallelism %v",
+		len(tasks), parallelism)
+
+	idx.stats.numIndexesWarmupPending.Set(int64(len(tasks)))
+	idx.stats.numIndexesWarmedUp.Set(0)
+	idx.stats.warmupDuration.Set(0)
+
+	//let the periodic stats log report the warmup progress
+	if err := idx.sendUpdatedIndexMapToWorker(idx.newIndexInstMsg(idx.indexInstMap), nil,
+		idx.statsMgrCmdCh, "statsMgr"); err != nil {
+		return nil, err
+	}
+
+	warmSnapMap := make(IndexSnapMap)
+	warmInstMap := make(common.IndexInstMap)
+	warmPartnMap := make(IndexPartnMap)
+
+	warm := func(t *warmupTask) {
+		start := time.Now()
+		if t.partnMap, t.err = idx.initPartnInstance(t.inst, nil); t.err != nil {
+			return
+		}
+		if t.inst.State != common.INDEX_STATE_DELETED {
+			t.snap, t.err = openLatestIndexSnapshot(t.inst.InstId, t.partnMap)
+		}
+		t.duration = time.Since(start)
+	}
+
+	start := time.Now()
+	done := func(t *warmupTask) error {
+		if t.err != nil {
+			logging.Errorf("Indexer::warmupIndexes Error warming up index %v: %v",
+				t.inst.InstId, t.err)
+			return t.err
+		}
+
+		idx.indexPartnMap[t.inst.InstId] = t.partnMap
+
+		idx.stats.numIndexesWarmupPending.Add(-1)
+		idx.stats.numIndexesWarmedUp.Add(1)
+		idx.stats.warmupDuration.Set(int64(time.Since(start) / time.Millisecond))
+		if stats, ok := idx.stats.indexes[t.inst.InstId]; ok {
+			stats.warmupDuration.Set(int64(t.duration / time.Millisecond))
+		}
+
+		logging.Infof("Indexer::warmupIndexes Warmed up index %v %v:%v in %v (%v pending)",
+			t.inst.InstId, t.inst.Defn.Bucket, t.inst.Defn.Name, t.duration,
+			idx.stats.numIndexesWarmupPending.Value())
+
+		//indexes without a snapshot are left to the storage manager
+		if t.snap == nil {
+			return nil
+		}
+		warmSnapMap[t.inst.InstId] = t.snap
+
+		//serve scans on the warm index while others are warming up
+		warmInstMap[t.inst.InstId] = t.inst
+		warmPartnMap[t.inst.InstId] = t.partnMap
+		if err := idx.sendUpdatedIndexMapToWorker(idx.newIndexInstMsg(warmInstMap),
+			&MsgUpdatePartnMap{indexPartnMap: warmPartnMap}, idx.scanCoordCmdCh,
+			"ScanCoordinator"); err != nil {
+			return err
+		}
+		snapshotNotifych <- CloneIndexSnapshot(t.snap)
+		return nil
+	}
+
+	if err := runWarmup(tasks, parallelism, warm, done); err != nil {
+		destroyIndexSnapMap(warmSnapMap)
+		return nil, err
+	}
+
+	logging.Infof("Indexer::warmupIndexes Warmed up %v indexes in %v",
+		len(tasks), time.Since(start))
+
+	return warmSnapMap, nil
+}
+
+//runWarmup warms up the tasks in the order given, with at most parallelism
+//tasks in progress at a time. Completed tasks are handed over to done in
+//the caller's goroutine. No new task is started once done returns an
+//error, which is returned after the tasks in progress complete.
+func runWarmup(tasks []*warmupTask, parallelism int,
+	warm func(*warmupTask), done func(*warmupTask) error) error {
+
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	donech := make(chan *warmupTask, len(tasks))
+	next, inProgress := 0, 0
+
+	var err error
+	for {
+		for err == nil && next < len(tasks) && inProgress < parallelism {
+			go func(t *warmupTask) {
+				warm(t)
+				donech <- t
+			}(tasks[next])
+			next++
+			inProgress++
+		}
+
+		if inProgress == 0 {
+			return err
+		}
+
+		t := <-donech
+		inProgress--
+		if e := done(t); e != nil && err == nil {
+			err = e
+		}
+	}
+}
+
+//parseWarmupPriority parses a comma separated list of bucket:index or
+//index names.
+func parseWarmupPriority(s string) []string {
+	var priority []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			priority = append(priority, name)
+		}
+	}
+	return priority
+}
+
+//warmupOrder sorts the index instances in the order of warmup. Indexes in
+//the priority list come first in the order listed, followed by the rest in
+//decreasing order of their scan rate. Ties are broken by instance id.
+func warmupOrder(insts []common.IndexInst, priority []string,
+	scanRates map[common.IndexInstId]int64) []common.IndexInst {
+
+	w := &warmupSorter{
+		insts: make([]common.IndexInst, len(insts)),
+		rank:  make([]int, len(insts)),
+		rates: scanRates,
+	}
+	copy(w.insts, insts)
+
+	for i, inst := range w.insts {
+		w.rank[i] = len(priority)
+		for r, name := range priority {
+			if name == inst.Defn.Name || name == inst.Defn.Bucket+":"+inst.Defn.Name {
+				w.rank[i] = r
+				break
+			}
+		}
+	}
+
+	sort.Sort(w)
+	return w.insts
+}
+
+type warmupSorter struct {
+	insts []common.IndexInst
+	rank  []int
+	rates map[common.IndexInstId]int64
+}
+
+func (w *warmupSorter) Len() int {
+	return len(w.insts)
+}
+
+func (w *warmupSorter) Less(i, j int) bool {
+	if w.rank[i] != w.rank[j] {
+		return w.rank[i] < w.rank[j]
+	}
+	ri, rj := w.rates[w.insts[i].InstId], w.rates[w.insts[j].InstId]
+	if ri != rj {
+		return ri > rj
+	}
+	return w.insts[i].InstId < w.insts[j].InstId
+}
+
+func (w *warmupSorter) Swap(i, j int) {
+	w.insts[i], w.insts[j] = w.insts[j], w.insts[i]
+	w.rank[i], w.rank[j] = w.rank[j], w.rank[i]
+}
+
+//loadScanRates reads the scan rates persisted in storage dir, missing or
+//unreadable file is treated as no scan rates.
+func loadScanRates(dir string) map[common.IndexInstId]int64 {
+
+	rates := make(map[common.IndexInstId]int64)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, warmupScanRatesFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warnf("Indexer::loadScanRates Error reading scan rates: %v", err)
+		}
+		return rates
+	}
+
+	var persisted map[string]int64
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		logging.Warnf("Indexer::loadScanRates Error decoding scan rates: %v", err)
+		return rates
+	}
+
+	for k, v := range persisted {
+		if instId, err := strconv.ParseUint(k, 10, 64); err == nil {
+			rates[common.IndexInstId(instId)] = v
+		}
+	}
+	return rates
+}
+
+//saveScanRates persists the scan rates in storage dir.
+func saveScanRates(dir string, rates map[common.IndexInstId]int64) error {
+
+	persisted := make(map[string]int64)
+	for instId, v := range rates {
+		persisted[strconv.FormatUint(uint64(instId), 10)] = v
+	}
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, warmupScanRatesFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
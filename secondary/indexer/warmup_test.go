@@ -0,0 +1,138 @@
+package indexer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func newWarmupInst(instId common.IndexInstId, bucket, name string) common.IndexInst {
+	return common.IndexInst{InstId: instId,
+		Defn: common.IndexDefn{Bucket: bucket, Name: name}}
+}
+
+func TestWarmupOrder(t *testing.T) {
+
+	insts := []common.IndexInst{
+		newWarmupInst(1, "default", "idx1"),
+		newWarmupInst(2, "default", "idx2"),
+		newWarmupInst(3, "beer", "idx3"),
+		newWarmupInst(4, "default", "idx4"),
+		newWarmupInst(5, "beer", "idx1"),
+		newWarmupInst(6, "default", "idx6"),
+	}
+	priority := parseWarmupPriority(" beer:idx1, idx4 ,,")
+	scanRates := map[common.IndexInstId]int64{2: 10, 6: 100, 4: 1}
+
+	expected := []common.IndexInstId{5, 4, 6, 2, 1, 3}
+	ordered := warmupOrder(insts, priority, scanRates)
+	if len(ordered) != len(expected) {
+		t.Fatalf("expected %v indexes, got %v", len(expected), len(ordered))
+	}
+	for i, inst := range ordered {
+		if inst.InstId != expected[i] {
+			t.Errorf("expected index %v at %v, got %v", expected[i], i, inst.InstId)
+		}
+	}
+}
+
+func TestRunWarmup(t *testing.T) {
+
+	tasks := make([]*warmupTask, 10)
+	for i := range tasks {
+		tasks[i] = &warmupTask{inst: newWarmupInst(common.IndexInstId(i), "default", "idx")}
+	}
+
+	var inProgress, maxInProgress int32
+	warm := func(t *warmupTask) {
+		n := atomic.AddInt32(&inProgress, 1)
+		for {
+			m := atomic.LoadInt32(&maxInProgress)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInProgress, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&inProgress, -1)
+	}
+
+	numDone := 0
+	done := func(t *warmupTask) error {
+		numDone++
+		return nil
+	}
+
+	if err := runWarmup(tasks, 3, warm, done); err != nil {
+		t.Fatal(err)
+	}
+	if numDone != len(tasks) {
+		t.Errorf("expected %v tasks done, got %v", len(tasks), numDone)
+	}
+	if maxInProgress > 3 {
+		t.Errorf("expected at most 3 tasks in progress, got %v", maxInProgress)
+	}
+
+	//tasks are warmed up in order
+	var order []common.IndexInstId
+	done = func(t *warmupTask) error {
+		order = append(order, t.inst.InstId)
+		return nil
+	}
+	if err := runWarmup(tasks, 1, func(*warmupTask) {}, done); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range order {
+		if id != common.IndexInstId(i) {
+			t.Errorf("expected task %v to be done, got %v", i, id)
+		}
+	}
+
+	//no new task is started after an error
+	errWarmup := errors.New("warmup failed")
+	numDone = 0
+	done = func(t *warmupTask) error {
+		numDone++
+		if t.inst.InstId == 0 {
+			return errWarmup
+		}
+		return nil
+	}
+	if err := runWarmup(tasks, 1, func(*warmupTask) {}, done); err != errWarmup {
+		t.Errorf("expected %v, got %v", errWarmup, err)
+	}
+	if numDone != 1 {
+		t.Errorf("expected 1 task done, got %v", numDone)
+	}
+}
+
+func TestScanRates(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "warmup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if rates := loadScanRates(dir); len(rates) != 0 {
+		t.Errorf("expected no scan rates, got %v", rates)
+	}
+
+	rates := map[common.IndexInstId]int64{1: 100, 12345678901234: 5}
+	if err := saveScanRates(dir, rates); err != nil {
+		t.Fatal(err)
+	}
+	loaded := loadScanRates(dir)
+	if len(loaded) != len(rates) {
+		t.Fatalf("expected %v scan rates, got %v", rates, loaded)
+	}
+	for instId, rate := range rates {
+		if loaded[instId] != rate {
+			t.Errorf("expected scan rate %v for %v, got %v", rate, instId, loaded[instId])
+		}
+	}
+}
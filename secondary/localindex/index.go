@@ -0,0 +1,333 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+//Package localindex embeds secondary indexes in a Go application, without
+//the indexer supervisor. Documents are evaluated by the projector's
+//evaluator and written to a slice of the index storage, and snapshots of
+//the slice are scanned by the same scan pipeline as the indexer's.
+//
+//Errors of the storage on which the indexer crashes, to be restarted by
+//its supervisor, are returned to the application instead, with the
+//exception of write errors of forestdb and plasma storage, which happen
+//in the background writers of the slice.
+package localindex
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/common/queryutil"
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+	"github.com/couchbase/indexing/secondary/indexer"
+	"github.com/couchbase/indexing/secondary/logging"
+	projector "github.com/couchbase/indexing/secondary/protobuf/projector"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+)
+
+//Index is an index embedded in an application.
+//
+//Upsert and Delete can be called concurrently, mutations of a document
+//are applied in the order of the calls. Mutations become visible to
+//scans in the next snapshot.
+type Index struct {
+	mu     sync.RWMutex
+	closed bool
+
+	inst      common.IndexInst
+	slice     indexer.Slice
+	evaluator *projector.IndexEvaluator
+	scanner   *indexer.LocalScanner
+	config    common.Config
+	stats     *indexer.IndexStats
+
+	//seqno of the last mutation of each vbucket, documents are
+	//distributed to vbuckets by docid like in KV. Mutations of a
+	//vbucket are serialised by its lock, from the seqno to the slice.
+	ts          *common.TsVbuuid
+	vbLocks     []sync.Mutex
+	numVbuckets int
+}
+
+//Snapshot is a point in time view of an Index. Scans of a snapshot can
+//run concurrently.
+type Snapshot struct {
+	idx  *Index
+	snap indexer.Snapshot
+	is   indexer.IndexSnapshot
+}
+
+//RowCallback is called for each row of a scan, with the document id and
+//the secondary key as a JSON array, which are valid only during the
+//call. Returning an error stops the scan.
+type RowCallback func(docid []byte, key []byte) error
+
+var ErrIndexClosed = errors.New("Local index is closed")
+var ErrEmptyDocId = errors.New("DocID is empty")
+
+//NewIndex opens the index defined by defn, with its storage in path. If
+//path has a persisted snapshot of the index, the index is recovered from
+//it. config is the indexer section of the system config, the default
+//config is used if nil.
+func NewIndex(defn common.IndexDefn, path string,
+	config common.Config) (idx *Index, err error) {
+
+	defer recoverError(&err)
+
+	if config == nil {
+		config = common.SystemConfig.SectionConfig("indexer.", true)
+	}
+	if defn.ExprType == "" {
+		defn.ExprType = common.N1QL
+	}
+	if defn.Using == "" {
+		defn.Using = common.MemoryOptimized
+	}
+	if !defn.IsPrimary && !defn.IsJavaScript() {
+		isArray, _, _, err := queryutil.GetArrayExpressionPosition(defn.SecExprs)
+		if err != nil {
+			return nil, err
+		}
+		defn.IsArrayIndex = isArray
+	}
+
+	idx = &Index{
+		inst: common.IndexInst{
+			InstId: common.IndexInstId(defn.DefnId),
+			Defn:   defn,
+			State:  common.INDEX_STATE_ACTIVE,
+			RState: common.REBAL_ACTIVE,
+		},
+		config:      config,
+		numVbuckets: config["numVbuckets"].Int(),
+	}
+	idx.stats = &indexer.IndexStats{}
+	idx.stats.Init()
+	idx.ts = common.NewTsVbuuid(defn.Bucket, idx.numVbuckets)
+	idx.vbLocks = make([]sync.Mutex, idx.numVbuckets)
+
+	if idx.evaluator, err = indexer.NewLocalIndexEvaluator(config, idx.inst); err != nil {
+		return nil, err
+	}
+	if err := idx.openSlice(path); err != nil {
+		return nil, err
+	}
+	idx.scanner = indexer.NewLocalScanner(idx.inst, idx.slice, config, idx.stats)
+
+	logging.Infof("LocalIndex::NewIndex Opened index %v (%v) in %v",
+		defn.Name, defn.Using, path)
+	return idx, nil
+}
+
+func (idx *Index) openSlice(path string) (err error) {
+	defn := idx.inst.Defn
+	sliceId := indexer.SliceId(0)
+	switch defn.Using {
+	case common.MemDB, common.MemoryOptimized:
+		idx.slice, err = indexer.NewMemDBSlice(path, sliceId, defn, idx.inst.InstId,
+			defn.IsPrimary, true, idx.config, idx.stats)
+	case common.ForestDB:
+		idx.slice, err = indexer.NewForestDBSlice(path, sliceId, defn, idx.inst.InstId,
+			defn.IsPrimary, idx.config, idx.stats)
+	case common.PlasmaDB:
+		idx.slice, err = indexer.NewPlasmaSlice(path, sliceId, defn, idx.inst.InstId,
+			defn.IsPrimary, idx.config, idx.stats)
+	default:
+		err = fmt.Errorf("Unsupported storage %v", defn.Using)
+	}
+	if err != nil {
+		return err
+	}
+
+	//recover from the latest persisted snapshot, if any
+	infos, err := idx.slice.GetSnapshots()
+	if err != nil {
+		idx.slice.Close()
+		return err
+	}
+	if latest := indexer.NewSnapshotInfoContainer(infos).GetLatest(); latest != nil {
+		snap, err := idx.slice.OpenSnapshot(latest)
+		if err != nil {
+			idx.slice.Close()
+			return err
+		}
+		if ts := snap.Timestamp(); ts != nil && len(ts.Seqnos) == idx.numVbuckets {
+			idx.ts = ts.Copy()
+		}
+		snap.Close()
+
+		logging.Infof("LocalIndex::openSlice Recovered index %v from snapshot %v",
+			defn.Name, latest)
+	}
+	return nil
+}
+
+//Upsert indexes document doc with id docid, replacing its previous
+//version. A document which does not qualify for the index is removed.
+func (idx *Index) Upsert(docid, doc []byte) error {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if idx.closed {
+		return ErrIndexClosed
+	} else if err := validateDocId(docid); err != nil {
+		return err
+	}
+	//slice writes docid and key in the background
+	docid = append([]byte(nil), docid...)
+
+	vb := idx.vbucket(docid)
+	idx.vbLocks[vb].Lock()
+	defer idx.vbLocks[vb].Unlock()
+
+	meta := idx.newMutationMeta(vb)
+	m := &mc.DcpEvent{Opcode: mcd.DCP_MUTATION, Key: docid, Value: doc,
+		VBucket: uint16(vb), Seqno: idx.ts.Seqnos[vb]}
+	m.TreatAsJSON()
+
+	key, _, err := idx.evaluator.Evaluate(m, nil)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return idx.slice.Delete(docid, meta)
+	}
+	return idx.slice.Insert(key, docid, meta)
+}
+
+//Delete removes the document with id docid from the index.
+func (idx *Index) Delete(docid []byte) error {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if idx.closed {
+		return ErrIndexClosed
+	} else if err := validateDocId(docid); err != nil {
+		return err
+	}
+	docid = append([]byte(nil), docid...)
+
+	vb := idx.vbucket(docid)
+	idx.vbLocks[vb].Lock()
+	defer idx.vbLocks[vb].Unlock()
+
+	return idx.slice.Delete(docid, idx.newMutationMeta(vb))
+}
+
+//slices crash on docids they cannot index
+func validateDocId(docid []byte) error {
+	if len(docid) == 0 {
+		return ErrEmptyDocId
+	} else if len(docid) > indexer.MAX_DOCID_LEN {
+		return indexer.ErrDocIdTooLong
+	}
+	return nil
+}
+
+func (idx *Index) vbucket(docid []byte) uint32 {
+	return crc32.ChecksumIEEE(docid) % uint32(idx.numVbuckets)
+}
+
+//newMutationMeta shall be called with the lock of vbucket vb.
+func (idx *Index) newMutationMeta(vb uint32) *indexer.MutationMeta {
+	seqno := atomic.AddUint64(&idx.ts.Seqnos[vb], 1)
+	return indexer.NewLocalMutationMeta(idx.inst.Defn.Bucket,
+		indexer.Vbucket(vb), indexer.Seqno(seqno))
+}
+
+//Snapshot waits for the pending mutations to be written and returns a
+//snapshot of the index. If persist is true, the snapshot is persisted
+//and the index is recovered from it when reopened. The snapshot must be
+//closed when no longer used.
+func (idx *Index) Snapshot(persist bool) (s *Snapshot, err error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	defer recoverError(&err)
+
+	if idx.closed {
+		return nil, ErrIndexClosed
+	}
+
+	info, err := idx.slice.NewSnapshot(idx.ts.Copy(), persist)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := idx.slice.OpenSnapshot(info)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{idx: idx, snap: snap, is: idx.scanner.IndexSnapshot(snap)}, nil
+}
+
+//Statistics returns the storage statistics of the index.
+func (idx *Index) Statistics() (stats indexer.StorageStatistics, err error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	defer recoverError(&err)
+
+	if idx.closed {
+		return indexer.StorageStatistics{}, ErrIndexClosed
+	}
+	return idx.slice.Statistics()
+}
+
+//Close closes the index. Storage of the index is released once all its
+//snapshots are closed.
+func (idx *Index) Close() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if !idx.closed {
+		idx.closed = true
+		idx.slice.Close()
+	}
+}
+
+//Destroy closes the index and removes its storage.
+func (idx *Index) Destroy() {
+	idx.Close()
+	idx.slice.Destroy()
+}
+
+//Timestamp returns the seqnos of the mutations in the snapshot.
+func (s *Snapshot) Timestamp() *common.TsVbuuid {
+	return s.snap.Timestamp()
+}
+
+//Close releases the snapshot.
+func (s *Snapshot) Close() error {
+	return s.snap.Close()
+}
+
+//Scan runs a range, multi-scan or group aggregate scan request, or a scan
+//all request, on the snapshot and calls callback for each row. DefnID,
+//consistency and continuation of the request are ignored.
+func (s *Snapshot) Scan(protoReq interface{}, callback RowCallback) (err error) {
+	defer recoverError(&err)
+	return s.idx.scanner.Scan(s.is, protoReq, callback)
+}
+
+//Count runs a count request on the snapshot.
+func (s *Snapshot) Count(req *protobuf.CountRequest) (count uint64, err error) {
+	defer recoverError(&err)
+	return s.idx.scanner.Count(s.is, req)
+}
+
+//recoverError returns the panic of a storage as an error, the indexer
+//crashes on them.
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		logging.Errorf("LocalIndex::recoverError %v", r)
+		*err = fmt.Errorf("%v", r)
+	}
+}
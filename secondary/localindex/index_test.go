@@ -0,0 +1,173 @@
+package localindex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/indexer"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestIndex(t *testing.T) {
+	path, err := ioutil.TempDir("", "localindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	defn := common.IndexDefn{
+		DefnId:    common.IndexDefnId(1),
+		Name:      "idx_age",
+		Bucket:    "default",
+		SecExprs:  []string{"age"},
+		WhereExpr: `type = "user"`,
+	}
+	idx, err := NewIndex(defn, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Destroy()
+
+	for i := 0; i < 100; i++ {
+		docid := []byte(fmt.Sprintf("user-%d", i))
+		doc := []byte(fmt.Sprintf(`{"type":"user","age":%d}`, i))
+		if err := idx.Upsert(docid, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx.Upsert([]byte("other"), []byte(`{"type":"other","age":15}`))
+	idx.Upsert([]byte("user-12"), []byte(`{"type":"admin","age":12}`))
+	idx.Delete([]byte("user-13"))
+
+	snap, err := idx.Snapshot(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	span := &protobuf.Span{
+		Range: &protobuf.Range{
+			Low:       []byte("[10]"),
+			High:      []byte("[20]"),
+			Inclusion: proto.Uint32(uint32(indexer.Both)),
+		},
+	}
+
+	count, err := snap.Count(&protobuf.CountRequest{Span: span})
+	if err != nil || count != 9 {
+		t.Errorf("Expected count 9, received %v %v", count, err)
+	}
+
+	var docids, keys []string
+	req := &protobuf.ScanRequest{Span: span, Limit: proto.Int64(3)}
+	err = snap.Scan(req, func(docid, key []byte) error {
+		docids = append(docids, string(docid))
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"user-10", "user-11", "user-14"}
+	if fmt.Sprint(docids) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, received %v", expected, docids)
+	}
+	if len(keys) != 3 || keys[0] != "[10]" {
+		t.Errorf("Expected keys from [10], received %v", keys)
+	}
+
+	//mutations after the snapshot are not visible
+	idx.Upsert([]byte("user-13"), []byte(`{"type":"user","age":13}`))
+	if count, _ := snap.Count(&protobuf.CountRequest{Span: span}); count != 9 {
+		t.Errorf("Expected count 9 in the old snapshot, received %v", count)
+	}
+
+	snap2, err := idx.Snapshot(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap2.Close()
+	if count, _ := snap2.Count(&protobuf.CountRequest{Span: span}); count != 10 {
+		t.Errorf("Expected count 10 in the new snapshot, received %v", count)
+	}
+
+	errStop := fmt.Errorf("stop")
+	rows := 0
+	err = snap2.Scan(&protobuf.ScanAllRequest{}, func(docid, key []byte) error {
+		rows++
+		if rows == 5 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || rows != 5 {
+		t.Errorf("Expected scan stopped after 5 rows, received %v %v", rows, err)
+	}
+}
+
+func TestIndexUpsert(t *testing.T) {
+	path, err := ioutil.TempDir("", "localindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	defn := common.IndexDefn{
+		DefnId:   common.IndexDefnId(1),
+		Name:     "idx_age",
+		Bucket:   "default",
+		SecExprs: []string{"age"},
+	}
+	idx, err := NewIndex(defn, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Destroy()
+
+	if err := idx.Upsert(nil, []byte(`{"age":1}`)); err != ErrEmptyDocId {
+		t.Errorf("Expected %v, received %v", ErrEmptyDocId, err)
+	}
+	longId := make([]byte, indexer.MAX_DOCID_LEN+1)
+	if err := idx.Delete(longId); err != indexer.ErrDocIdTooLong {
+		t.Errorf("Expected %v, received %v", indexer.ErrDocIdTooLong, err)
+	}
+
+	//concurrent mutations of the same document, and docid reused by the
+	//caller after the call
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			docid := []byte("user-1")
+			for j := 0; j < 100; j++ {
+				if err := idx.Upsert(docid, []byte(fmt.Sprintf(`{"age":%d}`, i*100+j))); err != nil {
+					t.Error(err)
+				}
+				copy(docid, "xxxxxx")
+				copy(docid, "user-1")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	snap, err := idx.Snapshot(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	var docids []string
+	err = snap.Scan(&protobuf.ScanAllRequest{}, func(docid, key []byte) error {
+		docids = append(docids, string(docid))
+		return nil
+	})
+	if err != nil || len(docids) != 1 || docids[0] != "user-1" {
+		t.Errorf("Expected a single row for user-1, received %v %v", docids, err)
+	}
+}
@@ -44,6 +44,7 @@ const (
 	OPCODE_COMMIT_CREATE_INDEX                    = OPCODE_PREPARE_CREATE_INDEX + 1
 	OPCODE_REBALANCE_RUNNING                      = OPCODE_COMMIT_CREATE_INDEX + 1
 	OPCODE_CREATE_INDEX_DEFER_BUILD               = OPCODE_REBALANCE_RUNNING + 1
+	OPCODE_SCHEDULE_BUILD_INDEX                   = OPCODE_CREATE_INDEX_DEFER_BUILD + 1
 )
 
 /////////////////////////////////////////////////////////////////////////
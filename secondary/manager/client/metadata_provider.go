@@ -16,11 +16,13 @@ import (
 	gometaL "github.com/couchbase/gometa/log"
 	"github.com/couchbase/gometa/message"
 	"github.com/couchbase/gometa/protocol"
+	"github.com/couchbase/indexing/secondary/collatejson"
 	c "github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/common/queryutil"
 	"github.com/couchbase/indexing/secondary/logging"
 	mc "github.com/couchbase/indexing/secondary/manager/common"
 	"github.com/couchbase/indexing/secondary/planner"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
 	"github.com/couchbase/query/expression"
 	"github.com/couchbase/query/expression/parser"
 	"math"
@@ -171,7 +173,8 @@ type watcherCallback func(string, c.IndexerId, c.IndexerId)
 var REQUEST_CHANNEL_COUNT = 1000
 
 var VALID_PARAM_NAMES = []string{"nodes", "defer_build", "retain_deleted_xattr", "immutable",
-	"num_partition", "num_replica", "docKeySize", "secKeySize", "arrSize", "numDoc", "residentRatio"}
+	"num_partition", "num_replica", "docKeySize", "secKeySize", "arrSize", "numDoc", "residentRatio",
+	"snapshot_retention", "collation", "immutable_where", "build_priority"}
 
 ///////////////////////////////////////////////////////
 // Public function : MetadataProvider
@@ -1004,6 +1007,21 @@ func (o *MetadataProvider) PrepareIndexDefn(
 		return nil, err, false
 	}
 
+	isJavaScript := strings.EqualFold(exprType, string(c.JavaScript))
+	if isJavaScript {
+		exprType = string(c.JavaScript)
+
+		if err := o.validateJavaScript(secExprs, "index key"); err != nil {
+			return nil, err, false
+		}
+
+		if len(whereExpr) > 0 {
+			if err := o.validateJavaScript([]string{whereExpr}, "where clause"); err != nil {
+				return nil, err, false
+			}
+		}
+	}
+
 	//
 	// Parse WITH CLAUSE
 	//
@@ -1014,6 +1032,10 @@ func (o *MetadataProvider) PrepareIndexDefn(
 	var numReplica int = 0
 	var numPartition int = 0
 	var retainDeletedXATTR = false
+	var snapshotRetention uint64 = 0
+	var buildPriority int = 0
+	var collation *c.IndexCollation = nil
+	var immutableWhere = false
 	var numDoc uint64 = 0
 	var secKeySize uint64 = 0
 	var docKeySize uint64 = 0
@@ -1039,12 +1061,15 @@ func (o *MetadataProvider) PrepareIndexDefn(
 			return nil, err, retry
 		}
 
+		// JavaScript expressions do not index extended attributes
 		xattrExprs := make([]string, 0)
-		xattrExprs = append(xattrExprs, secExprs...)
-		if len(whereExpr) > 0 {
-			xattrExprs = append(xattrExprs, whereExpr)
+		if !isJavaScript {
+			xattrExprs = append(xattrExprs, secExprs...)
+			if len(whereExpr) > 0 {
+				xattrExprs = append(xattrExprs, whereExpr)
+			}
+			xattrExprs = append(xattrExprs, partitionKeys...)
 		}
-		xattrExprs = append(xattrExprs, partitionKeys...)
 		isXATTRIndex, XATTRNames, err := queryutil.GetXATTRNames(xattrExprs)
 		if err != nil {
 			return nil, err, retry
@@ -1102,7 +1127,7 @@ func (o *MetadataProvider) PrepareIndexDefn(
 			}
 		}
 
-		err = o.validatePartitionKeys(partitionScheme, partitionKeys, secExprs, isPrimary)
+		err = o.validatePartitionKeys(partitionScheme, partitionKeys, secExprs, isPrimary, isJavaScript)
 		if err != nil {
 			return nil, err, false
 		}
@@ -1158,6 +1183,34 @@ func (o *MetadataProvider) PrepareIndexDefn(
 		if err != nil {
 			return nil, err, retry
 		}
+
+		snapshotRetention, err, retry = o.getSnapshotRetentionParam(plan)
+		if err != nil {
+			return nil, err, retry
+		}
+
+		buildPriority, err, retry = o.getBuildPriorityParam(plan)
+		if err != nil {
+			return nil, err, retry
+		}
+
+		collation, err, retry = o.getCollationParam(plan)
+		if err != nil {
+			return nil, err, retry
+		}
+
+		if collation != nil && isPrimary {
+			return nil, errors.New("Fails to create index.  Parameter collation cannot be used for primary index."), false
+		}
+
+		immutableWhere, err, retry = o.getImmutableWhereParam(plan)
+		if err != nil {
+			return nil, err, retry
+		}
+
+		if immutableWhere && len(whereExpr) == 0 {
+			return nil, errors.New("Fails to create index.  immutable_where can be used only for partial index with a where clause."), false
+		}
 	}
 
 	logging.Debugf("MetadataProvider:CreateIndex(): deferred_build %v nodes %v", deferred, nodes)
@@ -1167,7 +1220,12 @@ func (o *MetadataProvider) PrepareIndexDefn(
 	//
 	isArrayIndex := false
 	arrayExprCount := 0
-	for _, exp := range secExprs {
+	arrayExprs := secExprs
+	if isJavaScript {
+		// JavaScript expressions cannot be array index keys
+		arrayExprs = nil
+	}
+	for _, exp := range arrayExprs {
 		isArray, _, err := queryutil.IsArrayExpression(exp)
 		if err != nil {
 			return nil, errors.New(fmt.Sprintf("Fails to create index.  Error in parsing expression %v : %v", exp, err)), false
@@ -1219,6 +1277,7 @@ func (o *MetadataProvider) PrepareIndexDefn(
 		PartitionScheme:    partitionScheme,
 		PartitionKeys:      partitionKeys,
 		WhereExpr:          whereExpr,
+		ImmutableWhere:     immutableWhere,
 		Deferred:           deferred,
 		Nodes:              nodes,
 		Immutable:          immutable,
@@ -1227,6 +1286,9 @@ func (o *MetadataProvider) PrepareIndexDefn(
 		HashScheme:         c.CRC32,
 		NumPartitions:      uint32(numPartition),
 		RetainDeletedXATTR: retainDeletedXATTR,
+		SnapshotRetention:  snapshotRetention,
+		BuildPriority:      buildPriority,
+		Collation:          collation,
 		NumDoc:             numDoc,
 		SecKeySize:         secKeySize,
 		DocKeySize:         docKeySize,
@@ -1247,6 +1309,7 @@ func (o *MetadataProvider) plan(defn *c.IndexDefn, plan map[string]interface{},
 	spec.IsPrimary = defn.IsPrimary
 	spec.SecExprs = defn.SecExprs
 	spec.WhereExpr = defn.WhereExpr
+	spec.ImmutableWhere = defn.ImmutableWhere
 	spec.Deferred = defn.Deferred
 	spec.Immutable = defn.Immutable
 	spec.IsArrayIndex = defn.IsArrayIndex
@@ -1257,6 +1320,9 @@ func (o *MetadataProvider) plan(defn *c.IndexDefn, plan map[string]interface{},
 	spec.PartitionKeys = defn.PartitionKeys
 	spec.Replica = uint64(defn.NumReplica) + 1
 	spec.RetainDeletedXATTR = defn.RetainDeletedXATTR
+	spec.SnapshotRetention = defn.SnapshotRetention
+	spec.BuildPriority = defn.BuildPriority
+	spec.Collation = defn.Collation
 	spec.ExprType = string(defn.ExprType)
 
 	spec.NumDoc = defn.NumDoc
@@ -1436,6 +1502,36 @@ func (o *MetadataProvider) getXATTRParam(plan map[string]interface{}) (bool, err
 	return xattr, nil, false
 }
 
+//
+// immutable_where declares that the where clause is only on fields that are not
+// changed once a document is created. Projector can then skip the deletes it
+// would send for documents not matching the where clause.
+//
+func (o *MetadataProvider) getImmutableWhereParam(plan map[string]interface{}) (bool, error, bool) {
+
+	immutableWhere := false
+
+	immutableWhere2, ok := plan["immutable_where"].(bool)
+	if !ok {
+		immutableWhere_str, ok := plan["immutable_where"].(string)
+		if ok {
+			var err error
+			immutableWhere2, err = strconv.ParseBool(immutableWhere_str)
+			if err != nil {
+				return false, errors.New("Fails to create index.  Parameter immutable_where must be a boolean value of (true or false)."), false
+			}
+			immutableWhere = immutableWhere2
+
+		} else if _, ok := plan["immutable_where"]; ok {
+			return false, errors.New("Fails to create index.  Parameter immutable_where must be a boolean value of (true or false)."), false
+		}
+	} else {
+		immutableWhere = immutableWhere2
+	}
+
+	return immutableWhere, nil, false
+}
+
 func (o *MetadataProvider) getDeferredParam(plan map[string]interface{}) (bool, error, bool) {
 
 	deferred := false
@@ -1461,7 +1557,8 @@ func (o *MetadataProvider) getDeferredParam(plan map[string]interface{}) (bool,
 	return deferred, nil, false
 }
 
-func (o *MetadataProvider) validatePartitionKeys(partitionScheme c.PartitionScheme, partitionKeys []string, secKeys []string, isPrimary bool) error {
+func (o *MetadataProvider) validatePartitionKeys(partitionScheme c.PartitionScheme, partitionKeys []string, secKeys []string, isPrimary bool,
+	isJavaScript bool) error {
 
 	if partitionScheme != c.SINGLE && partitionScheme != c.KEY {
 		return errors.New(fmt.Sprintf("Fails to create index.  Partition Scheme %v is not allowed.", partitionScheme))
@@ -1479,6 +1576,10 @@ func (o *MetadataProvider) validatePartitionKeys(partitionScheme c.PartitionSche
 		return errors.New(fmt.Sprintf("Fails to create index.  Must specify partition keys for partitioned index."))
 	}
 
+	if isJavaScript {
+		return o.validateJavaScript(partitionKeys, "partition key")
+	}
+
 	secExprs := make(expression.Expressions, 0, len(secKeys))
 	for _, key := range secKeys {
 		expr, err := parser.Parse(key)
@@ -1537,6 +1638,21 @@ func (o *MetadataProvider) validatePartitionKeys(partitionScheme c.PartitionSche
 	return nil
 }
 
+//
+// JavaScript expressions are compiled to validate them, without calling the
+// functions.
+//
+func (o *MetadataProvider) validateJavaScript(exprs []string, what string) error {
+
+	for _, expr := range exprs {
+		if _, err := protobuf.NewJSFunction(expr); err != nil {
+			return errors.New(fmt.Sprintf("Fails to create index.  Invalid JavaScript %v %v : %v", what, expr, err))
+		}
+	}
+
+	return nil
+}
+
 func (o *MetadataProvider) getPartitionKeyParam(plan map[string]interface{}, secKeys []string) ([]string, error, bool) {
 
 	partitionKey, ok := plan["partition_key"].(string)
@@ -1736,6 +1852,105 @@ func (o *MetadataProvider) getNumDocParam(plan map[string]interface{}) (uint64,
 	return numDoc, nil, false
 }
 
+func (o *MetadataProvider) getSnapshotRetentionParam(plan map[string]interface{}) (uint64, error, bool) {
+
+	retention := int64(0)
+
+	retention2, ok := plan["snapshot_retention"].(float64)
+	if !ok {
+		retention_str, ok := plan["snapshot_retention"].(string)
+		if ok {
+			var err error
+			retention, err = strconv.ParseInt(retention_str, 10, 64)
+			if err != nil {
+				return 0, errors.New("Fails to create index.  Parameter snapshot_retention must be a integer value."), false
+			}
+
+		} else if _, ok := plan["snapshot_retention"]; ok {
+			return 0, errors.New("Fails to create index.  Parameter snapshot_retention must be a integer value."), false
+		}
+	} else {
+		retention = int64(retention2)
+	}
+
+	if retention < 0 {
+		return 0, errors.New("Fails to create index.  Parameter snapshot_retention must be a positive value."), false
+	}
+
+	return uint64(retention), nil, false
+}
+
+func (o *MetadataProvider) getBuildPriorityParam(plan map[string]interface{}) (int, error, bool) {
+
+	priority := int64(0)
+
+	priority2, ok := plan["build_priority"].(float64)
+	if !ok {
+		priority_str, ok := plan["build_priority"].(string)
+		if ok {
+			var err error
+			priority, err = strconv.ParseInt(priority_str, 10, 32)
+			if err != nil {
+				return 0, errors.New("Fails to create index.  Parameter build_priority must be a integer value."), false
+			}
+
+		} else if _, ok := plan["build_priority"]; ok {
+			return 0, errors.New("Fails to create index.  Parameter build_priority must be a integer value."), false
+		}
+	} else {
+		priority = int64(priority2)
+	}
+
+	return int(priority), nil, false
+}
+
+//
+// Collation is either a locale, or an object with locale, strength and caseLevel,
+// e.g. {"locale":"de", "strength":"primary"}.
+//
+func (o *MetadataProvider) getCollationParam(plan map[string]interface{}) (*c.IndexCollation, error, bool) {
+
+	param, ok := plan["collation"]
+	if !ok {
+		return nil, nil, false
+	}
+
+	collation := &c.IndexCollation{}
+
+	switch v := param.(type) {
+	case string:
+		collation.Locale = v
+
+	case map[string]interface{}:
+		if collation.Locale, ok = v["locale"].(string); !ok {
+			return nil, errors.New("Fails to create index.  Parameter collation must specify a locale."), false
+		}
+		if strength, ok := v["strength"]; ok {
+			if collation.Strength, ok = strength.(string); !ok {
+				return nil, errors.New("Fails to create index.  Collation strength must be one of (primary, secondary or tertiary)."), false
+			}
+		}
+		if caseLevel, ok := v["caseLevel"]; ok {
+			if collation.CaseLevel, ok = caseLevel.(bool); !ok {
+				return nil, errors.New("Fails to create index.  Collation caseLevel must be a boolean value of (true or false)."), false
+			}
+		}
+
+	default:
+		return nil, errors.New("Fails to create index.  Parameter collation must be a locale or an object."), false
+	}
+
+	if len(collation.Strength) == 0 {
+		collation.Strength = "tertiary"
+	}
+
+	if _, err := collatejson.NewCollation(collation.Locale, collation.Strength, collation.CaseLevel); err != nil {
+		return nil, errors.New(fmt.Sprintf("Fails to create index.  Invalid collation %v: %v.", collation, err)), false
+	}
+
+	return collation, nil, false
+}
+
 func (o *MetadataProvider) getResidentRatioParam(plan map[string]interface{}) (float64, error, bool) {
 
 	residentRatio := float64(100)
@@ -24,6 +24,7 @@ import (
 	mc "github.com/couchbase/indexing/secondary/manager/common"
 	"math"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	//"runtime/debug"
@@ -92,10 +93,42 @@ type builder struct {
 	batchSize int32
 	disable   int32
 
+	// pending index of a bucket are kept in descending order of priority
+	priorities map[uint64]int
+
+	// limits and time windows for starting index build
+	maxInitStreams   int32
+	maxBucketIndexes int32
+	windows          atomic.Value // []buildWindow
+
+	// for estimating the time to build index in the queue
+	building     map[uint64]time.Time
+	avgBuildTime time.Duration
+
+	queueLock sync.Mutex
+	queue     []BuildQueueEntry
+
 	commandListener *mc.CommandListener
 	listenerDonech  chan bool
 }
 
+// time window in a day, in minutes since midnight
+type buildWindow struct {
+	start int
+	end   int
+}
+
+// Position of an index in the build queue of a node, starting with 1.
+// ETA is the estimated time (in seconds) for the index to get built, or
+// 0 if not known yet.
+type BuildQueueEntry struct {
+	DefnId   common.IndexDefnId `json:"defnId,omitempty"`
+	Bucket   string             `json:"bucket,omitempty"`
+	Priority int                `json:"priority,omitempty"`
+	Position int                `json:"position,omitempty"`
+	ETA      int64              `json:"eta,omitempty"`
+}
+
 type janitor struct {
 	manager *LifecycleMgr
 
@@ -359,6 +392,8 @@ func (m *LifecycleMgr) dispatchRequest(request *requestHolder, factory *message.
 		err = m.handleRebalanceRunning(content)
 	case client.OPCODE_CREATE_INDEX_DEFER_BUILD:
 		err = m.handleCreateIndex(key, content, common.NewUserRequestContext())
+	case client.OPCODE_SCHEDULE_BUILD_INDEX:
+		err = m.handleScheduleBuildIndexes(content)
 	}
 
 	logging.Debugf("LifecycleMgr.dispatchRequest () : send response for requestId %d, op %d, len(result) %d", reqId, op, len(result))
@@ -1125,6 +1160,73 @@ func (m *LifecycleMgr) BuildIndexes(ids []common.IndexDefnId,
 	return retryErrList, skipList, errList
 }
 
+//-----------------------------------------------------------
+// Schedule Index Build
+//-----------------------------------------------------------
+
+//
+// Queue the index build to the background builder, instead of building
+// it right away.  The scheduled flag is persisted, so the build is queued
+// again upon restart until it is done.
+//
+func (m *LifecycleMgr) handleScheduleBuildIndexes(content []byte) error {
+
+	list, err := client.UnmarshallIndexIdList(content)
+	if err != nil {
+		logging.Errorf("LifecycleMgr.handleScheduleBuildIndexes() : scheduleBuildIndex fails. Unable to unmarshall index list. Reason = %v", err)
+		return err
+	}
+
+	for _, id := range list.DefnIds {
+
+		defn, err := m.repo.GetIndexDefnById(common.IndexDefnId(id))
+		if err != nil {
+			logging.Errorf("LifecycleMgr.handleScheduleBuildIndexes() : scheduleBuildIndex fails. Reason = %v", err)
+			return err
+		}
+		if defn == nil {
+			return errors.New(fmt.Sprintf("Fails to schedule index build.  Index %v does not exist.", id))
+		}
+
+		insts, err := m.FindAllLocalIndexInst(defn.Bucket, defn.DefnId)
+		if len(insts) == 0 || err != nil {
+			return errors.New(fmt.Sprintf("Fails to schedule index build.  Index %v has no instance on this node.", defn.Name))
+		}
+
+		scheduled := false
+		for _, inst := range insts {
+
+			if inst.State != uint32(common.INDEX_STATE_READY) {
+				logging.Warnf("LifecycleMgr.handleScheduleBuildIndexes: index instance (%v, %v, %v) is not in ready state.  Skip this index.",
+					defn.Name, defn.Bucket, inst.ReplicaId)
+				continue
+			}
+
+			if err := m.SetScheduledFlag(defn.Bucket, defn.DefnId, common.IndexInstId(inst.InstId), true); err != nil {
+				logging.Errorf("LifecycleMgr.handleScheduleBuildIndexes: Unable to set scheduled flag in index instance (%v, %v, %v).",
+					defn.Name, defn.Bucket, inst.ReplicaId)
+				return err
+			}
+			scheduled = true
+		}
+
+		if scheduled {
+			logging.Infof("LifecycleMgr.handleScheduleBuildIndexes() : Schedule index build for (%v, %v) with priority %v",
+				defn.Bucket, defn.Name, defn.BuildPriority)
+			m.builder.notifych <- defn
+		}
+	}
+
+	return nil
+}
+
+//
+// Build queue of this node, in the order of index build.
+//
+func (m *LifecycleMgr) GetBuildQueue() []BuildQueueEntry {
+	return m.builder.getBuildQueue()
+}
+
 //-----------------------------------------------------------
 // Delete Index
 //-----------------------------------------------------------
@@ -2597,6 +2699,7 @@ func (s *builder) run() {
 
 	// wait for indexer bootstrap to complete before recover
 	s.recover()
+	s.publishQueue()
 
 	// check if there is any pending index build every second
 	ticker := time.NewTicker(time.Millisecond * 200)
@@ -2606,7 +2709,8 @@ func (s *builder) run() {
 		select {
 		case defn := <-s.notifych:
 			logging.Infof("builder:  Received new index build request %v.  Schedule to build index for bucket %v", defn.DefnId, defn.Bucket)
-			s.addPending(defn.Bucket, uint64(defn.DefnId))
+			s.addPending(defn.Bucket, uint64(defn.DefnId), defn.BuildPriority)
+			s.publishQueue()
 
 		case <-ticker.C:
 			s.processBuildToken(false)
@@ -2616,12 +2720,29 @@ func (s *builder) run() {
 			// Otherwise, rebalancer could fail if builder has issued an index build ahead of the rebalancer.
 			time.Sleep(time.Second * 120)
 
-			buildList, quota := s.getBuildList()
+			s.checkBuildDone()
 
-			for _, bucket := range buildList {
-				quota = s.tryBuildIndex(bucket, quota)
+			if s.inBuildWindow(time.Now()) {
+				buildList, quota, numStreams := s.getBuildList()
+				maxStreams := int(atomic.LoadInt32(&s.maxInitStreams))
+
+				for _, bucket := range buildList {
+					if maxStreams > 0 && numStreams >= maxStreams {
+						logging.Infof("builder: Index build in progress for %v buckets.  Will build index for bucket %v in next iteration.",
+							numStreams, bucket)
+						break
+					}
+
+					var started bool
+					quota, started = s.tryBuildIndex(bucket, quota)
+					if started {
+						numStreams++
+					}
+				}
 			}
 
+			s.publishQueue()
+
 		case <-s.manager.killch:
 			s.commandListener.Close()
 			logging.Infof("builder: Index builder terminates.")
@@ -2634,7 +2755,11 @@ func (s *builder) run() {
 	}
 }
 
-func (s *builder) getBuildList() ([]string, int32) {
+//
+// Returns the buckets to build index for, the quota for number of index
+// to build and the number of buckets with index build in progress.
+//
+func (s *builder) getBuildList() ([]string, int32, int) {
 
 	// get quota
 	quota, skipList := s.getQuota()
@@ -2647,6 +2772,13 @@ func (s *builder) getBuildList() ([]string, int32) {
 		}
 	}
 
+	s.sortBuildList(buildList, quota)
+
+	return buildList, quota, len(skipList)
+}
+
+func (s *builder) sortBuildList(buildList []string, quota int32) {
+
 	// sort buildList by ascending order
 	for i := 0; i < len(buildList)-1; i++ {
 		for j := i + 1; j < len(buildList); j++ {
@@ -2675,10 +2807,23 @@ func (s *builder) getBuildList() ([]string, int32) {
 		}
 	}
 
-	return buildList, quota
+	// bucket with the highest priority index goes first (stable)
+	for i := 1; i < len(buildList); i++ {
+		for j := i; j > 0 && s.topPriority(buildList[j]) > s.topPriority(buildList[j-1]); j-- {
+			buildList[j], buildList[j-1] = buildList[j-1], buildList[j]
+		}
+	}
+}
+
+func (s *builder) topPriority(bucket string) int {
+
+	if defnIds := s.pendings[bucket]; len(defnIds) != 0 {
+		return s.priorities[defnIds[0]]
+	}
+	return 0
 }
 
-func (s *builder) addPending(bucket string, id uint64) bool {
+func (s *builder) addPending(bucket string, id uint64, priority int) bool {
 
 	for _, id2 := range s.pendings[bucket] {
 		if id2 == id {
@@ -2686,14 +2831,32 @@ func (s *builder) addPending(bucket string, id uint64) bool {
 		}
 	}
 
-	s.pendings[bucket] = append(s.pendings[bucket], uint64(id))
+	// insert after the pending index of same or higher priority
+	defnIds := s.pendings[bucket]
+	pos := len(defnIds)
+	for pos > 0 && s.priorities[defnIds[pos-1]] < priority {
+		pos--
+	}
+
+	defnIds = append(defnIds, 0)
+	copy(defnIds[pos+1:], defnIds[pos:])
+	defnIds[pos] = id
+
+	s.pendings[bucket] = defnIds
+	s.priorities[id] = priority
 	return true
 }
 
-func (s *builder) tryBuildIndex(bucket string, quota int32) int32 {
+func (s *builder) tryBuildIndex(bucket string, quota int32) (int32, bool) {
 
 	newQuota := quota
 
+	// limit on the number of index built together for the bucket
+	bucketQuota := atomic.LoadInt32(&s.maxBucketIndexes)
+	if bucketQuota <= 0 {
+		bucketQuota = -1
+	}
+
 	defnIds := s.pendings[bucket]
 	if len(defnIds) != 0 {
 		// This is a pre-cautionary check if there is any index being
@@ -2702,13 +2865,14 @@ func (s *builder) tryBuildIndex(bucket string, quota int32) int32 {
 
 			buildList := ([]uint64)(nil)
 			buildMap := make(map[uint64]bool)
+			retryList := ([]uint64)(nil)
 
 			pendingList := make([]uint64, len(defnIds))
 			copy(pendingList, defnIds)
 
 			for _, defnId := range defnIds {
 
-				if newQuota == 0 {
+				if newQuota == 0 || bucketQuota == 0 {
 					break
 				}
 
@@ -2728,7 +2892,7 @@ func (s *builder) tryBuildIndex(bucket string, quota int32) int32 {
 
 				for _, inst := range insts {
 
-					if newQuota == 0 {
+					if newQuota == 0 || bucketQuota == 0 {
 						break
 					}
 
@@ -2742,9 +2906,10 @@ func (s *builder) tryBuildIndex(bucket string, quota int32) int32 {
 								buildMap[defnId] = true
 							}
 							newQuota = newQuota - 1
+							bucketQuota = bucketQuota - 1
 						} else {
 							// put it back to the pending list if index build is disable
-							pendingList = append(pendingList, defnId)
+							retryList = append(retryList, defnId)
 							logging.Warnf("builder: Background build is disabled.  Will retry building index (%v, %v) in next iteration.", defnId, bucket)
 						}
 					} else {
@@ -2764,34 +2929,79 @@ func (s *builder) tryBuildIndex(bucket string, quota int32) int32 {
 				content, err := client.MarshallIndexIdList(idList)
 				if err != nil {
 					logging.Warnf("builder: Failed to marshall index defnIds during index build.  Error = %v. Retry later.", err)
-					return quota
+					return quota, false
 				}
 
 				logging.Infof("builder: Try build index for bucket %v. Index %v", bucket, idList)
 
 				// Clean up the map.  If there is any index that needs retry, they will be put into the notifych again.
 				// Once this function is done, the map will be populated again from the notifych.
-				s.pendings[bucket] = pendingList
+				s.setPendingWithRetry(bucket, pendingList, retryList)
 
 				// If any of the index cannot be built, those index will be skipped by lifecycle manager, so it
 				// will send the rest of the indexes to the indexer.  An index cannot be built if it does not have
 				// an index instance or the index instance is not in READY state.
 				if err := s.manager.requestServer.MakeRequest(client.OPCODE_BUILD_INDEX_RETRY, key, content); err != nil {
 					logging.Warnf("builder: Failed to build index.  Error = %v.", err)
+				} else {
+					now := time.Now()
+					for _, defnId := range buildList {
+						s.building[defnId] = now
+					}
 				}
 
 				logging.Infof("builder: pending definitons to be build %v.", pendingList)
 
+				return newQuota, true
+
 			} else {
 
 				// Clean up the map.  If there is any index that needs retry, they will be put into the notifych again.
 				// Once this function is done, the map will be populated again from the notifych.
-				s.pendings[bucket] = pendingList
+				s.setPendingWithRetry(bucket, pendingList, retryList)
 			}
 		}
 	}
 
-	return newQuota
+	return newQuota, false
+}
+
+//
+// Set the pending list of the bucket, and put back the index to retry
+// in the order of their priority.
+//
+func (s *builder) setPendingWithRetry(bucket string, pendingList []uint64, retryList []uint64) {
+
+	priorities := make(map[uint64]int)
+	for _, defnId := range retryList {
+		priorities[defnId] = s.priorities[defnId]
+	}
+
+	s.setPending(bucket, pendingList)
+
+	for _, defnId := range retryList {
+		s.addPending(bucket, defnId, priorities[defnId])
+	}
+}
+
+func (s *builder) setPending(bucket string, pendingList []uint64) {
+
+	pendingMap := make(map[uint64]bool)
+	for _, defnId := range pendingList {
+		pendingMap[defnId] = true
+	}
+
+	for _, defnId := range s.pendings[bucket] {
+		if !pendingMap[defnId] {
+			delete(s.priorities, defnId)
+		}
+	}
+
+	if len(pendingList) == 0 {
+		delete(s.pendings, bucket)
+	} else {
+		s.pendings[bucket] = pendingList
+	}
 }
 
 func (s *builder) getQuota() (int32, map[string]bool) {
@@ -2858,7 +3068,7 @@ func (s *builder) processBuildToken(bootstrap bool) {
 			if inst.State == uint32(common.INDEX_STATE_READY) {
 				logging.Infof("builder: Processing build token %v", entry)
 
-				if s.addPending(defn.Bucket, uint64(defn.DefnId)) {
+				if s.addPending(defn.Bucket, uint64(defn.DefnId), defn.BuildPriority) {
 					logging.Infof("builder: Schedule index build for (%v, %v).", defn.Bucket, defn.Name)
 				}
 			}
@@ -2901,7 +3111,7 @@ func (s *builder) recover() {
 		for _, inst := range insts {
 
 			if inst.Scheduled && inst.State == uint32(common.INDEX_STATE_READY) {
-				if s.addPending(defn.Bucket, uint64(defn.DefnId)) {
+				if s.addPending(defn.Bucket, uint64(defn.DefnId), defn.BuildPriority) {
 					logging.Infof("builder: Schedule index build for (%v, %v, %v).", defn.Bucket, defn.Name, inst.ReplicaId)
 				}
 			}
@@ -2919,6 +3129,10 @@ func (s *builder) configUpdate(config *common.Config) {
 	} else {
 		atomic.StoreInt32(&s.disable, int32(0))
 	}
+
+	atomic.StoreInt32(&s.maxInitStreams, int32((*config)["settings.build.max_init_streams"].Int()))
+	atomic.StoreInt32(&s.maxBucketIndexes, int32((*config)["settings.build.max_indexes_per_bucket"].Int()))
+	s.setBuildWindows((*config)["settings.build.window"].String())
 }
 
 func (s *builder) disableBuild() bool {
@@ -2930,17 +3144,214 @@ func (s *builder) disableBuild() bool {
 	return false
 }
 
+//
+// Build window is specified as a comma separated list of HH:MM-HH:MM, in
+// local time.  A window ending before its start spans across midnight.
+// Index build already started is not stopped at the end of a window.
+//
+func (s *builder) setBuildWindows(value string) {
+
+	windows, err := parseBuildWindows(value)
+	if err != nil {
+		logging.Errorf("builder: Invalid index build window %v.  Error = %v.  Build window is not changed.", value, err)
+		return
+	}
+
+	s.windows.Store(windows)
+}
+
+func parseBuildWindows(value string) ([]buildWindow, error) {
+
+	parseTime := func(str string) (int, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(str))
+		if err != nil {
+			return 0, err
+		}
+		return t.Hour()*60 + t.Minute(), nil
+	}
+
+	windows := make([]buildWindow, 0)
+	for _, str := range strings.Split(value, ",") {
+		if len(strings.TrimSpace(str)) == 0 {
+			continue
+		}
+
+		times := strings.Split(str, "-")
+		if len(times) != 2 {
+			return nil, errors.New(fmt.Sprintf("expected HH:MM-HH:MM, found %v", str))
+		}
+
+		start, err := parseTime(times[0])
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := parseTime(times[1])
+		if err != nil {
+			return nil, err
+		}
+
+		windows = append(windows, buildWindow{start: start, end: end})
+	}
+
+	return windows, nil
+}
+
+func (s *builder) inBuildWindow(now time.Time) bool {
+	return s.untilBuildWindow(now) == 0
+}
+
+//
+// Returns the time until the next build window starts, 0 if index build
+// can be started now.
+//
+func (s *builder) untilBuildWindow(now time.Time) time.Duration {
+
+	windows, _ := s.windows.Load().([]buildWindow)
+	if len(windows) == 0 {
+		return 0
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	wait := 24 * 60
+
+	for _, w := range windows {
+		if w.start < w.end && minute >= w.start && minute < w.end {
+			return 0
+		}
+		if w.start > w.end && (minute >= w.start || minute < w.end) {
+			return 0
+		}
+		if w.start == w.end {
+			// whole day
+			return 0
+		}
+
+		if m := (w.start - minute + 24*60) % (24 * 60); m < wait {
+			wait = m
+		}
+	}
+
+	return time.Duration(wait)*time.Minute - time.Duration(now.Second())*time.Second
+}
+
+//
+// Keep track of the time taken to build index issued by the builder, for
+// estimating the time to build index in the queue.
+//
+func (s *builder) checkBuildDone() {
+
+	for defnId, start := range s.building {
+
+		defn, err := s.manager.repo.GetIndexDefnById(common.IndexDefnId(defnId))
+		if err != nil {
+			continue
+		}
+
+		var insts []IndexInstDistribution
+		if defn != nil {
+			insts, err = s.manager.FindAllLocalIndexInst(defn.Bucket, defn.DefnId)
+			if err != nil {
+				continue
+			}
+		}
+
+		done, failed := len(insts) != 0, len(insts) == 0
+		for _, inst := range insts {
+			if inst.State != uint32(common.INDEX_STATE_ACTIVE) {
+				done = false
+			}
+			if inst.State == uint32(common.INDEX_STATE_READY) ||
+				inst.State == uint32(common.INDEX_STATE_DELETED) {
+				failed = true
+			}
+		}
+
+		if done {
+			elapsed := time.Since(start)
+			if s.avgBuildTime == 0 {
+				s.avgBuildTime = elapsed
+			} else {
+				s.avgBuildTime = (s.avgBuildTime + elapsed) / 2
+			}
+			logging.Infof("builder: Index %v built in %v.  Average index build time %v.", defnId, elapsed, s.avgBuildTime)
+		}
+
+		if done || failed {
+			delete(s.building, defnId)
+		}
+	}
+}
+
+//
+// Publish the build queue in the order the index would be built, along
+// with the estimated time to build them.
+//
+func (s *builder) publishQueue() {
+
+	buckets := ([]string)(nil)
+	for bucket, _ := range s.pendings {
+		buckets = append(buckets, bucket)
+	}
+	batchSize := atomic.LoadInt32(&s.batchSize)
+	s.sortBuildList(buckets, batchSize)
+
+	wait := s.untilBuildWindow(time.Now())
+
+	queue := make([]BuildQueueEntry, 0)
+	for _, bucket := range buckets {
+		for _, defnId := range s.pendings[bucket] {
+
+			entry := BuildQueueEntry{
+				DefnId:   common.IndexDefnId(defnId),
+				Bucket:   bucket,
+				Priority: s.priorities[defnId],
+				Position: len(queue) + 1,
+			}
+
+			if s.avgBuildTime != 0 {
+				rounds := 1
+				if batchSize > 0 {
+					rounds = (entry.Position-1)/int(batchSize) + 1
+				}
+				eta := wait + time.Duration(rounds)*s.avgBuildTime
+				entry.ETA = int64(eta / time.Second)
+			}
+
+			queue = append(queue, entry)
+		}
+	}
+
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	s.queue = queue
+}
+
+func (s *builder) getBuildQueue() []BuildQueueEntry {
+
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+
+	queue := make([]BuildQueueEntry, len(s.queue))
+	copy(queue, s.queue)
+	return queue
+}
+
 func newBuilder(mgr *LifecycleMgr) *builder {
 
 	donech := make(chan bool)
 
 	builder := &builder{
-		manager:         mgr,
-		pendings:        make(map[string][]uint64),
-		notifych:        make(chan *common.IndexDefn, 10000),
-		batchSize:       int32(common.SystemConfig["indexer.settings.build.batch_size"].Int()),
-		commandListener: mc.NewCommandListener(donech, false, true, false),
-		listenerDonech:  donech,
+		manager:          mgr,
+		pendings:         make(map[string][]uint64),
+		priorities:       make(map[uint64]int),
+		building:         make(map[uint64]time.Time),
+		notifych:         make(chan *common.IndexDefn, 10000),
+		batchSize:        int32(common.SystemConfig["indexer.settings.build.batch_size"].Int()),
+		maxInitStreams:   int32(common.SystemConfig["indexer.settings.build.max_init_streams"].Int()),
+		maxBucketIndexes: int32(common.SystemConfig["indexer.settings.build.max_indexes_per_bucket"].Int()),
+		commandListener:  mc.NewCommandListener(donech, false, true, false),
+		listenerDonech:   donech,
 	}
 
 	disable := common.SystemConfig["indexer.build.background.disable"].Bool()
@@ -2949,6 +3360,10 @@ func newBuilder(mgr *LifecycleMgr) *builder {
 	} else {
 		atomic.StoreInt32(&builder.disable, int32(0))
 	}
+
+	builder.windows.Store([]buildWindow(nil))
+	builder.setBuildWindows(common.SystemConfig["indexer.settings.build.window"].String())
+
 	return builder
 }
 
@@ -0,0 +1,275 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package manager
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	gometaC "github.com/couchbase/gometa/common"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/manager/client"
+)
+
+func TestParseBuildWindows(t *testing.T) {
+
+	tests := []struct {
+		value   string
+		windows []buildWindow
+		err     bool
+	}{
+		{"", []buildWindow{}, false},
+		{"01:00-05:30", []buildWindow{{60, 330}}, false},
+		{" 22:00-02:00 , 12:00-13:00,", []buildWindow{{1320, 120}, {720, 780}}, false},
+		{"00:00-00:00", []buildWindow{{0, 0}}, false},
+		{"01:00", nil, true},
+		{"01:00-02:00-03:00", nil, true},
+		{"25:00-02:00", nil, true},
+		{"01:00-xx", nil, true},
+	}
+
+	for _, test := range tests {
+		windows, err := parseBuildWindows(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error %v", test.value, err)
+		} else if !test.err && !reflect.DeepEqual(windows, test.windows) {
+			t.Errorf("%q: expected %v, received %v", test.value, test.windows, windows)
+		}
+	}
+}
+
+func TestUntilBuildWindow(t *testing.T) {
+
+	at := func(hour, minute, second int) time.Time {
+		return time.Date(2018, 6, 1, hour, minute, second, 0, time.Local)
+	}
+
+	tests := []struct {
+		windows string
+		now     time.Time
+		wait    time.Duration
+	}{
+		// no window, build any time
+		{"", at(3, 0, 0), 0},
+		{"01:00-05:00", at(1, 0, 0), 0},
+		{"01:00-05:00", at(4, 59, 59), 0},
+		{"01:00-05:00", at(5, 0, 0), 20 * time.Hour},
+		{"01:00-05:00", at(0, 30, 10), 29*time.Minute + 50*time.Second},
+		// window spanning midnight
+		{"22:00-02:00", at(23, 0, 0), 0},
+		{"22:00-02:00", at(0, 0, 0), 0},
+		{"22:00-02:00", at(1, 59, 0), 0},
+		{"22:00-02:00", at(2, 0, 0), 20 * time.Hour},
+		{"22:00-02:00", at(21, 0, 0), time.Hour},
+		// whole day
+		{"03:00-03:00", at(12, 0, 0), 0},
+		// closest of several windows
+		{"22:00-23:00,06:00-07:00", at(23, 30, 0), 6*time.Hour + 30*time.Minute},
+		{"22:00-23:00,06:00-07:00", at(8, 0, 0), 14 * time.Hour},
+	}
+
+	for _, test := range tests {
+		s := &builder{}
+		s.windows.Store([]buildWindow(nil))
+		s.setBuildWindows(test.windows)
+		if wait := s.untilBuildWindow(test.now); wait != test.wait {
+			t.Errorf("%q at %v: expected %v, received %v",
+				test.windows, test.now.Format("15:04:05"), test.wait, wait)
+		}
+		if s.inBuildWindow(test.now) != (test.wait == 0) {
+			t.Errorf("%q at %v: unexpected inBuildWindow", test.windows, test.now.Format("15:04:05"))
+		}
+	}
+}
+
+func TestAddPending(t *testing.T) {
+
+	tests := []struct {
+		adds     [][2]int // defnId, priority
+		pendings []uint64
+	}{
+		{[][2]int{{1, 0}, {2, 0}, {3, 0}}, []uint64{1, 2, 3}},
+		{[][2]int{{1, 0}, {2, 5}, {3, 1}}, []uint64{2, 3, 1}},
+		// same priority keeps the order of arrival
+		{[][2]int{{1, 5}, {2, 0}, {3, 5}, {4, 0}}, []uint64{1, 3, 2, 4}},
+		{[][2]int{{1, -1}, {2, 0}}, []uint64{2, 1}},
+		// duplicate is ignored
+		{[][2]int{{1, 0}, {2, 5}, {1, 9}}, []uint64{2, 1}},
+	}
+
+	for i, test := range tests {
+		s := newTestBuilder(nil)
+		for _, add := range test.adds {
+			s.addPending("default", uint64(add[0]), add[1])
+		}
+		if pendings := s.pendings["default"]; !reflect.DeepEqual(pendings, test.pendings) {
+			t.Errorf("test %v: expected %v, received %v", i, test.pendings, pendings)
+		}
+	}
+
+	s := newTestBuilder(nil)
+	if !s.addPending("default", 1, 0) || s.addPending("default", 1, 0) {
+		t.Errorf("Expected only the first add to be pending")
+	}
+}
+
+func TestTryBuildIndex(t *testing.T) {
+
+	// quota of the batch
+	s, srv := newTestBuildBuilder("default", 1, 2, 3)
+	quota, started := s.tryBuildIndex("default", 2)
+	if !started || quota != 0 {
+		t.Errorf("Expected build started with no quota left, received %v %v", started, quota)
+	}
+	srv.checkBuild(t, []uint64{1, 2})
+	checkPending(t, s, "default", []uint64{3})
+
+	// quota of the bucket
+	s, srv = newTestBuildBuilder("default", 1, 2, 3)
+	s.maxBucketIndexes = 2
+	quota, started = s.tryBuildIndex("default", 10)
+	if !started || quota != 8 {
+		t.Errorf("Expected build started with quota 8 left, received %v %v", started, quota)
+	}
+	srv.checkBuild(t, []uint64{1, 2})
+	checkPending(t, s, "default", []uint64{3})
+
+	quota, started = s.tryBuildIndex("default", quota)
+	if !started || quota != 7 {
+		t.Errorf("Expected build started with quota 7 left, received %v %v", started, quota)
+	}
+	srv.checkBuild(t, []uint64{3})
+	checkPending(t, s, "default", nil)
+
+	// no index built while another is being built for the bucket
+	s, srv = newTestBuildBuilder("default", 1)
+	topology, _ := s.manager.repo.GetTopologyByBucket("default")
+	topology.Definitions[0].Instances[0].State = uint32(common.INDEX_STATE_INITIAL)
+	if _, started = s.tryBuildIndex("default", 10); started {
+		t.Errorf("Expected no build while index is being built")
+	}
+	srv.checkBuild(t, nil)
+	checkPending(t, s, "default", []uint64{1})
+}
+
+func TestTryBuildIndexDisabled(t *testing.T) {
+
+	// index requeued by priority, ahead of index of lower priority
+	s, srv := newTestBuildBuilder("default", 1, 2, 3)
+	s.disable = 1
+	s.setPending("default", nil)
+	s.addPending("default", 1, 5)
+	s.addPending("default", 2, 0)
+	s.addPending("default", 3, 0)
+	topology, _ := s.manager.repo.GetTopologyByBucket("default")
+	topology.Definitions[1].Instances[0].OldStorageMode = common.ForestDB
+
+	// index build due to upgrade is not disabled
+	quota, started := s.tryBuildIndex("default", 1)
+	if !started || quota != 0 {
+		t.Errorf("Expected build started with no quota left, received %v %v", started, quota)
+	}
+	srv.checkBuild(t, []uint64{2})
+	checkPending(t, s, "default", []uint64{1, 3})
+	if s.priorities[1] != 5 || s.priorities[3] != 0 {
+		t.Errorf("Expected priorities of requeued index, received %v", s.priorities)
+	}
+
+	// nothing to build
+	if _, started = s.tryBuildIndex("default", 10); started {
+		t.Errorf("Expected no build while background build is disabled")
+	}
+	srv.checkBuild(t, nil)
+	checkPending(t, s, "default", []uint64{1, 3})
+
+	s.addPending("default", 4, 1)
+	checkPending(t, s, "default", []uint64{1, 4, 3})
+}
+
+type testRequestServer struct {
+	builds [][]uint64
+}
+
+func (srv *testRequestServer) MakeRequest(opCode gometaC.OpCode, key string, value []byte) error {
+	if opCode == client.OPCODE_BUILD_INDEX_RETRY {
+		idList, err := client.UnmarshallIndexIdList(value)
+		if err != nil {
+			return err
+		}
+		srv.builds = append(srv.builds, idList.DefnIds)
+	}
+	return nil
+}
+
+func (srv *testRequestServer) MakeAsyncRequest(opCode gometaC.OpCode, key string, value []byte) error {
+	return srv.MakeRequest(opCode, key, value)
+}
+
+func (srv *testRequestServer) checkBuild(t *testing.T, defnIds []uint64) {
+	var build []uint64
+	if len(srv.builds) != 0 {
+		build = srv.builds[0]
+		srv.builds = srv.builds[1:]
+	}
+	if fmt.Sprint(build) != fmt.Sprint(defnIds) {
+		t.Errorf("Expected build of %v, received %v", defnIds, build)
+	}
+}
+
+func checkPending(t *testing.T, s *builder, bucket string, defnIds []uint64) {
+	if pendings := s.pendings[bucket]; fmt.Sprint(pendings) != fmt.Sprint(defnIds) {
+		t.Errorf("Expected pending %v, received %v", defnIds, pendings)
+	}
+}
+
+func newTestBuilder(mgr *LifecycleMgr) *builder {
+	s := &builder{
+		manager:    mgr,
+		pendings:   make(map[string][]uint64),
+		priorities: make(map[uint64]int),
+		building:   make(map[uint64]time.Time),
+	}
+	s.windows.Store([]buildWindow(nil))
+	return s
+}
+
+// builder of index in READY state, all pending in the order of defnIds,
+// with metadata served from the cache of the repository.
+func newTestBuildBuilder(bucket string, defnIds ...uint64) (*builder, *testRequestServer) {
+
+	repo := &MetadataRepo{
+		defnCache: make(map[common.IndexDefnId]*common.IndexDefn),
+		topoCache: make(map[string]*IndexTopology),
+	}
+	topology := &IndexTopology{Bucket: bucket}
+	for _, defnId := range defnIds {
+		name := fmt.Sprintf("idx%v", defnId)
+		repo.defnCache[common.IndexDefnId(defnId)] = &common.IndexDefn{
+			DefnId: common.IndexDefnId(defnId), Name: name, Bucket: bucket}
+		topology.Definitions = append(topology.Definitions, IndexDefnDistribution{
+			Bucket: bucket,
+			Name:   name,
+			DefnId: defnId,
+			Instances: []IndexInstDistribution{
+				{InstId: defnId, State: uint32(common.INDEX_STATE_READY)},
+			},
+		})
+	}
+	repo.topoCache[bucket] = topology
+
+	srv := &testRequestServer{}
+	s := newTestBuilder(&LifecycleMgr{repo: repo, requestServer: srv})
+	for _, defnId := range defnIds {
+		s.addPending(bucket, defnId, 0)
+	}
+	return s, srv
+}
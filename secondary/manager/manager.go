@@ -448,6 +448,20 @@ func (m *IndexManager) HandleBuildIndexDDL(indexIds client.IndexIdList) error {
 	return nil
 }
 
+//
+// Queue the build of local index instances to the background index builder.
+//
+func (m *IndexManager) HandleScheduleBuildIndexDDL(indexIds client.IndexIdList) error {
+
+	key := fmt.Sprintf("%d", indexIds.DefnIds[0])
+	content, err := client.MarshallIndexIdList(&indexIds)
+	if err != nil {
+		return err
+	}
+
+	return m.requestServer.MakeRequest(client.OPCODE_SCHEDULE_BUILD_INDEX, key, content)
+}
+
 func (m *IndexManager) UpdateIndexInstance(bucket string, defnId common.IndexDefnId, instId common.IndexInstId,
 	state common.IndexState, streamId common.StreamId, err string, buildTime []uint64, rState common.RebalanceState,
 	partitions []uint64, versions []int, instVersion int) error {
@@ -71,6 +71,7 @@ type LocalIndexMetadata struct {
 	LocalSettings    map[string]string  `json:"localSettings,omitempty"`
 	IndexTopologies  []IndexTopology    `json:"topologies,omitempty"`
 	IndexDefinitions []common.IndexDefn `json:"definitions,omitempty"`
+	BuildQueue       []BuildQueueEntry  `json:"buildQueue,omitempty"`
 }
 
 type ClusterIndexMetadata struct {
@@ -121,6 +122,8 @@ type IndexStatus struct {
 	Partitioned  bool               `json:"partitioned"`
 	NumPartition int                `json:"numPartition"`
 	PartitionMap map[string][]int   `json:"partitionMap"`
+	QueuePos     int                `json:"queuePosition,omitempty"`
+	BuildETA     int64              `json:"buildETA,omitempty"`
 }
 
 type indexStatusSorter []IndexStatus
@@ -163,6 +166,7 @@ func registerRequestHandler(mgr *IndexManager, clusterUrl string) {
 		http.HandleFunc("/createIndexRebalance", handlerContext.createIndexRequestRebalance)
 		http.HandleFunc("/dropIndex", handlerContext.dropIndexRequest)
 		http.HandleFunc("/buildIndex", handlerContext.buildIndexRequest)
+		http.HandleFunc("/scheduleBuildIndex", handlerContext.scheduleBuildIndexRequest)
 		http.HandleFunc("/getLocalIndexMetadata", handlerContext.handleLocalIndexMetadataRequest)
 		http.HandleFunc("/getIndexMetadata", handlerContext.handleIndexMetadataRequest)
 		http.HandleFunc("/restoreIndexMetadata", handlerContext.handleRestoreIndexMetadataRequest)
@@ -318,6 +322,39 @@ func (m *requestHandlerContext) buildIndexRequest(w http.ResponseWriter, r *http
 	}
 }
 
+//
+// Queue deferred index to be built in background by the index builder of
+// this node.
+//
+func (m *requestHandlerContext) scheduleBuildIndexRequest(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := doAuth(r, w)
+	if !ok {
+		return
+	}
+
+	// convert request
+	request := m.convertIndexRequest(r)
+	if request == nil || len(request.IndexIds.DefnIds) == 0 {
+		sendIndexResponseWithError(http.StatusBadRequest, w, "Unable to convert request for schedule build index")
+		return
+	}
+
+	permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!build", request.Index.Bucket)
+	if !isAllowed(creds, []string{permission}, w) {
+		return
+	}
+
+	// call the index manager to handle the DDL
+	if err := m.mgr.HandleScheduleBuildIndexDDL(request.IndexIds); err == nil {
+		// No error, return success
+		sendIndexResponse(w)
+	} else {
+		// report failure
+		sendIndexResponseWithError(http.StatusInternalServerError, w, fmt.Sprintf("%v", err))
+	}
+}
+
 func (m *requestHandlerContext) convertIndexRequest(r *http.Request) *IndexRequest {
 
 	req := &IndexRequest{}
@@ -552,6 +589,16 @@ func (m *requestHandlerContext) getIndexStatus(creds cbauth.Creds, bucket string
 								PartitionMap: partitionMap,
 							}
 
+							if state == common.INDEX_STATE_READY {
+								for _, entry := range localMeta.BuildQueue {
+									if entry.DefnId == defn.DefnId {
+										status.QueuePos = entry.Position
+										status.BuildETA = entry.ETA
+										break
+									}
+								}
+							}
+
 							list = append(list, status)
 						}
 					}
@@ -880,6 +927,15 @@ func (m *requestHandlerContext) getLocalIndexMetadata(creds cbauth.Creds, bucket
 		topology, err = iter1.Next()
 	}
 
+	for _, entry := range m.mgr.lifecycleMgr.GetBuildQueue() {
+		if len(bucket) == 0 || bucket == entry.Bucket {
+			permission := fmt.Sprintf("cluster.bucket[%s].n1ql.index!list", entry.Bucket)
+			if isAllowed(creds, []string{permission}, nil) {
+				meta.BuildQueue = append(meta.BuildQueue, entry)
+			}
+		}
+	}
+
 	return meta, nil
 }
 
@@ -1226,7 +1282,7 @@ func getWithAuth(url string) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	cbauth.SetRequestAuthVia(req, nil)
+	common.SetRequestAuth(req)
 
 	client := http.Client{Timeout: time.Duration(10 * time.Second)}
 	return client.Do(req)
@@ -1243,7 +1299,7 @@ func postWithAuth(url string, bodyType string, body io.Reader) (*http.Response,
 		return nil, err
 	}
 	req.Header.Set("Content-Type", bodyType)
-	cbauth.SetRequestAuthVia(req, nil)
+	common.SetRequestAuth(req)
 
 	client := http.Client{Timeout: time.Duration(10 * time.Second)}
 	return client.Do(req)
@@ -0,0 +1,189 @@
+package memdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// Snapshot data files are written as a sequence of checksummed blocks:
+//
+//   block: len[4] | crc32c[4] | data[len]
+//
+// An empty block marks the end of the file, so that a file truncated at a
+// block boundary is detected as well.
+
+const maxChecksumBlockSize = 64 * 1024
+
+var ErrCorruptSnapshot = errors.New("MemDB snapshot is corrupted")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type checksumWriter struct {
+	w   io.Writer
+	hdr [8]byte
+}
+
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{w: w}
+}
+
+func (cw *checksumWriter) writeBlock(p []byte) error {
+	binary.BigEndian.PutUint32(cw.hdr[0:4], uint32(len(p)))
+	binary.BigEndian.PutUint32(cw.hdr[4:8], crc32.Checksum(p, crcTable))
+	if _, err := cw.w.Write(cw.hdr[:]); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(p)
+	return err
+}
+
+func (cw *checksumWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		l := len(p)
+		if l > maxChecksumBlockSize {
+			l = maxChecksumBlockSize
+		}
+		if err := cw.writeBlock(p[:l]); err != nil {
+			return n, err
+		}
+		p = p[l:]
+		n += l
+	}
+	return n, nil
+}
+
+// Close writes the end of file marker. It does not close the underlying
+// writer.
+func (cw *checksumWriter) Close() error {
+	return cw.writeBlock(nil)
+}
+
+type checksumReader struct {
+	r    io.Reader
+	hdr  [8]byte
+	buf  []byte
+	data []byte
+	eof  bool
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	return &checksumReader{r: r}
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	for len(cr.data) == 0 {
+		if cr.eof {
+			return 0, io.EOF
+		}
+		if err := cr.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, cr.data)
+	cr.data = cr.data[n:]
+	return n, nil
+}
+
+func (cr *checksumReader) readBlock() error {
+	if _, err := io.ReadFull(cr.r, cr.hdr[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrCorruptSnapshot
+		}
+		return err
+	}
+
+	l := binary.BigEndian.Uint32(cr.hdr[0:4])
+	if l > maxChecksumBlockSize {
+		return ErrCorruptSnapshot
+	}
+
+	if cap(cr.buf) < int(l) {
+		cr.buf = make([]byte, l)
+	}
+	cr.buf = cr.buf[:l]
+	if _, err := io.ReadFull(cr.r, cr.buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrCorruptSnapshot
+		}
+		return err
+	}
+
+	if crc32.Checksum(cr.buf, crcTable) != binary.BigEndian.Uint32(cr.hdr[4:8]) {
+		return ErrCorruptSnapshot
+	}
+
+	cr.data = cr.buf
+	cr.eof = l == 0
+	return nil
+}
+
+// snapshotManifest is stored in nitro.json. It is written after all other
+// files of the snapshot and records the checksums of the file lists.
+// Snapshots written by older versions have no checksums.
+type snapshotManifest struct {
+	Version            int    `json:"version"`
+	KeyId              string `json:"key_id,omitempty"`
+	BlockChecksums     bool   `json:"block_checksums,omitempty"`
+	FilesChecksum      uint32 `json:"files_checksum,omitempty"`
+	DeltaFilesChecksum uint32 `json:"delta_files_checksum,omitempty"`
+	Checksum           uint32 `json:"checksum,omitempty"`
+}
+
+func (sm snapshotManifest) checksum() uint32 {
+	sm.Checksum = 0
+	bs, _ := json.Marshal(sm)
+	return crc32.Checksum(bs, crcTable)
+}
+
+func writeManifest(path string, sm snapshotManifest) error {
+	sm.Checksum = sm.checksum()
+	bs, _ := json.Marshal(sm)
+	return ioutil.WriteFile(path, bs, 0660)
+}
+
+func readManifest(path string) (sm snapshotManifest, err error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return sm, err
+	}
+
+	if err = json.Unmarshal(bs, &sm); err != nil {
+		return sm, ErrCorruptSnapshot
+	}
+	if sm.Checksum != 0 && sm.Checksum != sm.checksum() {
+		return sm, ErrCorruptSnapshot
+	}
+	return sm, nil
+}
+
+// writeFileList writes the list of data files of a snapshot directory and
+// returns its checksum.
+func writeFileList(path string, files []string) (uint32, error) {
+	bs, _ := json.Marshal(files)
+	return crc32.Checksum(bs, crcTable), ioutil.WriteFile(path, bs, 0660)
+}
+
+// readFileList reads the list of data files of a snapshot directory. A
+// zero checksum is not verified.
+func readFileList(path string, checksum uint32) ([]string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if checksum != 0 && crc32.Checksum(bs, crcTable) != checksum {
+		return nil, ErrCorruptSnapshot
+	}
+
+	var files []string
+	if err := json.Unmarshal(bs, &files); err != nil {
+		return nil, ErrCorruptSnapshot
+	}
+	return files, nil
+}
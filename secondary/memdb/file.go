@@ -1,8 +1,10 @@
 package memdb
 
 import "os"
+import "io"
 import "bufio"
 import "errors"
+import "github.com/couchbase/indexing/secondary/encryption"
 import "github.com/couchbase/indexing/secondary/fdb"
 import "bytes"
 
@@ -14,10 +16,26 @@ var (
 )
 
 func init() {
-	forestdbConfig = forestdb.DefaultConfig()
-	forestdbConfig.SetSeqTreeOpt(forestdb.SEQTREE_NOT_USE)
-	forestdbConfig.SetBufferCacheSize(1024 * 1024)
+	forestdbConfig = newForestdbConfig(nil)
+}
+
+func newForestdbConfig(key *encryption.Key) *forestdb.Config {
+	config := forestdb.DefaultConfig()
+	config.SetSeqTreeOpt(forestdb.SEQTREE_NOT_USE)
+	config.SetBufferCacheSize(1024 * 1024)
+	if key != nil {
+		config.SetEncryptionKey(key.Bytes)
+	}
+
+	return config
+}
 
+func getForestdbConfig(key *encryption.Key) *forestdb.Config {
+	if key == nil {
+		return forestdbConfig
+	}
+
+	return newForestdbConfig(key)
 }
 
 type FileWriter interface {
@@ -32,22 +50,28 @@ type FileReader interface {
 	Close() error
 }
 
-func (m *MemDB) newFileWriter(t FileType) FileWriter {
+// newFileWriter returns a writer for the given file type. If key is not
+// nil, files are encrypted with it. Raw files are written with block
+// checksums, forestdb checksums its own blocks.
+func (m *MemDB) newFileWriter(t FileType, key *encryption.Key) FileWriter {
 	var w FileWriter
 	if t == RawdbFile {
-		w = &rawFileWriter{db: m}
+		w = &rawFileWriter{db: m, key: key}
 	} else if t == ForestdbFile {
-		w = &forestdbFileWriter{db: m}
+		w = &forestdbFileWriter{db: m, key: key}
 	}
 	return w
 }
 
-func (m *MemDB) newFileReader(t FileType, ver int) FileReader {
+// newFileReader returns a reader for the given file type. Raw files
+// record their encryption key, forestdb files are opened with key. Block
+// checksums of raw files are verified if checksums is set.
+func (m *MemDB) newFileReader(t FileType, ver int, key *encryption.Key, checksums bool) FileReader {
 	var r FileReader
 	if t == RawdbFile {
-		r = &rawFileReader{db: m, version: ver}
+		r = &rawFileReader{db: m, version: ver, checksums: checksums}
 	} else if t == ForestdbFile {
-		r = &forestdbFileReader{db: m}
+		r = &forestdbFileReader{db: m, key: key}
 	}
 	return r
 }
@@ -55,9 +79,12 @@ func (m *MemDB) newFileReader(t FileType, ver int) FileReader {
 type rawFileWriter struct {
 	db   *MemDB
 	fd   *os.File
+	ew   io.WriteCloser
+	cw   *checksumWriter
 	w    *bufio.Writer
 	buf  []byte
 	path string
+	key  *encryption.Key
 }
 
 func (f *rawFileWriter) Open(path string) error {
@@ -65,7 +92,16 @@ func (f *rawFileWriter) Open(path string) error {
 	f.fd, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0755)
 	if err == nil {
 		f.buf = make([]byte, encodeBufSize)
-		f.w = bufio.NewWriterSize(f.fd, DiskBlockSize)
+		if f.key == nil {
+			f.cw = newChecksumWriter(f.fd)
+			f.w = bufio.NewWriterSize(f.cw, DiskBlockSize)
+		} else if f.ew, err = encryption.NewWriter(f.fd, f.key); err == nil {
+			f.cw = newChecksumWriter(f.ew)
+			f.w = bufio.NewWriterSize(f.cw, DiskBlockSize)
+		} else {
+			f.fd.Close()
+			f.fd = nil
+		}
 	}
 	return err
 }
@@ -81,17 +117,28 @@ func (f *rawFileWriter) Close() error {
 		return err
 	}
 
-	f.w.Flush()
+	if err := f.w.Flush(); err != nil {
+		return err
+	}
+	if err := f.cw.Close(); err != nil {
+		return err
+	}
+	if f.ew != nil {
+		if err := f.ew.Close(); err != nil {
+			return err
+		}
+	}
 	return f.fd.Close()
 }
 
 type rawFileReader struct {
-	version int
-	db      *MemDB
-	fd      *os.File
-	r       *bufio.Reader
-	buf     []byte
-	path    string
+	version   int
+	checksums bool
+	db        *MemDB
+	fd        *os.File
+	r         io.Reader
+	buf       []byte
+	path      string
 }
 
 func (f *rawFileReader) Open(path string) error {
@@ -99,13 +146,32 @@ func (f *rawFileReader) Open(path string) error {
 	f.fd, err = os.Open(path)
 	if err == nil {
 		f.buf = make([]byte, encodeBufSize)
-		f.r = bufio.NewReaderSize(f.fd, DiskBlockSize)
+		br := bufio.NewReaderSize(f.fd, DiskBlockSize)
+		f.r = br
+		if encryption.IsEncrypted(br) {
+			var dr io.Reader
+			if dr, err = encryption.NewReader(br, f.db.keyProvider); err == nil {
+				f.r = bufio.NewReaderSize(dr, DiskBlockSize)
+			} else {
+				f.fd.Close()
+				f.fd = nil
+			}
+		}
+		if err == nil && f.checksums {
+			f.r = newChecksumReader(f.r)
+		}
 	}
 	return err
 }
 
 func (f *rawFileReader) ReadItem() (*Item, error) {
-	return f.db.DecodeItem(f.version, f.buf, f.r)
+	itm, err := f.db.DecodeItem(f.version, f.buf, f.r)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, encryption.ErrCorrupted, encryption.ErrTruncated:
+		// end of file before the terminator
+		err = ErrCorruptSnapshot
+	}
+	return itm, err
 }
 
 func (f *rawFileReader) Close() error {
@@ -118,11 +184,12 @@ type forestdbFileWriter struct {
 	store *forestdb.KVStore
 	buf   []byte
 	wbuf  bytes.Buffer
+	key   *encryption.Key
 }
 
 func (f *forestdbFileWriter) Open(path string) error {
 	var err error
-	f.file, err = forestdb.Open(path, forestdbConfig)
+	f.file, err = forestdb.Open(path, getForestdbConfig(f.key))
 	if err == nil {
 		f.buf = make([]byte, encodeBufSize)
 		f.store, err = f.file.OpenKVStoreDefault(nil)
@@ -159,12 +226,13 @@ type forestdbFileReader struct {
 	store *forestdb.KVStore
 	iter  *forestdb.Iterator
 	buf   []byte
+	key   *encryption.Key
 }
 
 func (f *forestdbFileReader) Open(path string) error {
 	var err error
 
-	f.file, err = forestdb.Open(path, forestdbConfig)
+	f.file, err = forestdb.Open(path, getForestdbConfig(f.key))
 	if err == nil {
 		f.buf = make([]byte, encodeBufSize)
 		f.store, err = f.file.OpenKVStoreDefault(nil)
@@ -189,6 +257,10 @@ func (f *forestdbFileReader) ReadItem() (*Item, error) {
 		itm, err = f.db.DecodeItem(0, f.buf, rbuf)
 	}
 
+	if err == forestdb.FDB_RESULT_CHECKSUM_ERROR || err == forestdb.FDB_RESULT_FILE_CORRUPTION {
+		err = ErrCorruptSnapshot
+	}
+
 	return itm, err
 }
 
@@ -3,11 +3,9 @@ package memdb
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math"
 	"math/rand"
 	"os"
@@ -18,6 +16,7 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/couchbase/indexing/secondary/encryption"
 	"github.com/couchbase/indexing/secondary/memdb/skiplist"
 	"github.com/couchbase/indexing/secondary/stubs/nitro/mm"
 )
@@ -279,6 +278,8 @@ type Config struct {
 	useDeltaFiles bool
 	mallocFun     skiplist.MallocFn
 	freeFun       skiplist.FreeFn
+
+	keyProvider encryption.KeyProvider
 }
 
 func (cfg *Config) SetKeyComparator(cmp KeyCompare) {
@@ -315,6 +316,13 @@ func (cfg *Config) UseDeltaInterleaving() {
 	cfg.useDeltaFiles = true
 }
 
+// SetKeyProvider enables encryption of the snapshot files written by
+// StoreToDisk with the active key of p. Files written with an older key
+// are re-encrypted by the next StoreToDisk.
+func (cfg *Config) SetKeyProvider(p encryption.KeyProvider) {
+	cfg.keyProvider = p
+}
+
 type restoreStats struct {
 	DeltaRestored      uint64
 	DeltaRestoreFailed uint64
@@ -558,6 +566,44 @@ func (s *Snapshot) NewIterator() *Iterator {
 	return s.db.NewIterator(s)
 }
 
+// ItemChanged returns true if the item has been inserted or deleted after
+// the snapshot was taken. It can be called while writers are active.
+func (s *Snapshot) ItemChanged(itm *Item) bool {
+	return itm.bornSn > s.sn || atomic.LoadUint32(&itm.deadSn) > s.sn
+}
+
+// GetRangeSplitItems returns up to nways-1 keys in ascending order which
+// split the items of the snapshot into ranges of approximately equal size.
+// The returned keys are copies and can be used after the snapshot is closed.
+func (s *Snapshot) GetRangeSplitItems(nways int) [][]byte {
+	m := s.db
+	itr := m.NewIterator(s)
+	if itr == nil {
+		return nil
+	}
+	defer itr.Close()
+
+	barrier := m.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	var keys [][]byte
+	for _, itmPtr := range m.store.GetRangeSplitItems(nways) {
+		// Pivot item may not be visible in the snapshot
+		itr.Seek(m.ptrToItem(itmPtr).Bytes())
+		if !itr.Valid() {
+			continue
+		}
+
+		key := itr.Get()
+		if len(keys) == 0 || m.keyCmp(key, keys[len(keys)-1]) > 0 {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+	}
+
+	return keys
+}
+
 func CompareSnapshot(this, that unsafe.Pointer) int {
 	thisItem := (*Snapshot)(this)
 	thatItem := (*Snapshot)(that)
@@ -853,23 +899,45 @@ func (m *MemDB) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		defer m.shutdownWg1.Done()
 	}
 
+	key, err := encryption.ActiveKey(m.keyProvider)
+	if err != nil {
+		return err
+	}
+
 	manifestdir := dir
 	datadir := filepath.Join(dir, "data")
 	os.MkdirAll(datadir, 0755)
 	shards := runtime.NumCPU()
 
+	manifest := snapshotManifest{
+		Version:        version,
+		BlockChecksums: m.fileType == RawdbFile,
+	}
+	if key != nil {
+		manifest.KeyId = key.Id
+	}
+
+	// The manifest is written last, once all data files are complete
+	defer func() {
+		if err == nil {
+			err = writeManifest(filepath.Join(manifestdir, "nitro.json"), manifest)
+		}
+	}()
+
 	writers := make([]FileWriter, shards)
 	files := make([]string, shards)
 	defer func() {
 		for _, w := range writers {
 			if w != nil {
-				w.Close()
+				if cerr := w.Close(); err == nil {
+					err = cerr
+				}
 			}
 		}
 	}()
 
 	for shard := 0; shard < shards; shard++ {
-		w := m.newFileWriter(m.fileType)
+		w := m.newFileWriter(m.fileType, key)
 		file := fmt.Sprintf("shard-%d", shard)
 		datafile := filepath.Join(datadir, file)
 		if err := w.Open(datafile); err != nil {
@@ -887,7 +955,9 @@ func (m *MemDB) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		defer func() {
 			for _, w := range deltaWriters {
 				if w != nil {
-					w.Close()
+					if cerr := w.Close(); err == nil {
+						err = cerr
+					}
 				}
 			}
 		}()
@@ -895,7 +965,7 @@ func (m *MemDB) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		deltadir := filepath.Join(dir, "delta")
 		os.MkdirAll(deltadir, 0755)
 		for id := 0; id < m.numWriters(); id++ {
-			dw := m.newFileWriter(m.fileType)
+			dw := m.newFileWriter(m.fileType, key)
 			file := fmt.Sprintf("shard-%d", id)
 			deltafile := filepath.Join(deltadir, file)
 			if err = dw.Open(deltafile); err != nil {
@@ -921,8 +991,8 @@ func (m *MemDB) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 
 		defer func() {
 			if err = m.changeDeltaWrState(dwStateTerminate, nil, nil); err == nil {
-				bs, _ := json.Marshal(deltaFiles)
-				err = ioutil.WriteFile(filepath.Join(deltadir, "files.json"), bs, 0660)
+				manifest.DeltaFilesChecksum, err = writeFileList(
+					filepath.Join(deltadir, "files.json"), deltaFiles)
 			}
 		}()
 	}
@@ -944,12 +1014,8 @@ func (m *MemDB) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		return nil
 	}
 
-	manifest, _ := json.Marshal(map[string]interface{}{"version": version})
-	if err = ioutil.WriteFile(filepath.Join(manifestdir, "nitro.json"), manifest, 0660); err == nil {
-		if err = m.Visitor(snap, visitorCallback, shards, concurr); err == nil {
-			bs, _ := json.Marshal(files)
-			err = ioutil.WriteFile(filepath.Join(datadir, "files.json"), bs, 0660)
-		}
+	if err = m.Visitor(snap, visitorCallback, shards, concurr); err == nil {
+		manifest.FilesChecksum, err = writeFileList(filepath.Join(datadir, "files.json"), files)
 	}
 
 	return err
@@ -960,23 +1026,22 @@ func (m *MemDB) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 	datadir := filepath.Join(dir, "data")
 	var files []string
 	manifestdir := dir
-	var version int
+	var key *encryption.Key
 
-	// Read file version
-	if bs, err := ioutil.ReadFile(filepath.Join(manifestdir, "nitro.json")); err == nil {
-		mMap := make(map[string]int)
-		if err = json.Unmarshal(bs, &mMap); err != nil {
+	// Read file version, encryption key and checksums
+	manifest, err := readManifest(filepath.Join(manifestdir, "nitro.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	version := manifest.Version
+	if manifest.KeyId != "" {
+		if key, err = encryption.GetKey(m.keyProvider, manifest.KeyId); err != nil {
 			return nil, err
 		}
-		version = mMap["version"]
-	} else if !os.IsNotExist(err) {
-		return nil, err
 	}
 
-	if bs, err := ioutil.ReadFile(filepath.Join(datadir, "files.json")); err != nil {
+	if files, err = readFileList(filepath.Join(datadir, "files.json"), manifest.FilesChecksum); err != nil {
 		return nil, err
-	} else {
-		json.Unmarshal(bs, &files)
 	}
 
 	var nodeCallb skiplist.NodeCallback
@@ -1004,7 +1069,7 @@ func (m *MemDB) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 	for i, file := range files {
 		segments[i] = b.NewSegment()
 		segments[i].SetNodeCallback(nodeCallb)
-		r := m.newFileReader(m.fileType, version)
+		r := m.newFileReader(m.fileType, version, key, manifest.BlockChecksums)
 		datafile := filepath.Join(datadir, file)
 		if err := r.Open(datafile); err != nil {
 			return nil, err
@@ -1058,9 +1123,9 @@ func (m *MemDB) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 
 		wchan := make(chan int)
 		deltadir := filepath.Join(dir, "delta")
-		var files []string
-		if bs, err := ioutil.ReadFile(filepath.Join(deltadir, "files.json")); err == nil {
-			json.Unmarshal(bs, &files)
+		files, err := readFileList(filepath.Join(deltadir, "files.json"), manifest.DeltaFilesChecksum)
+		if err != nil && (manifest.DeltaFilesChecksum != 0 || !os.IsNotExist(err)) {
+			return nil, err
 		}
 
 		readers := make([]FileReader, len(files))
@@ -1076,7 +1141,7 @@ func (m *MemDB) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 		}()
 
 		for i, file := range files {
-			r := m.newFileReader(m.fileType, version)
+			r := m.newFileReader(m.fileType, version, key, manifest.BlockChecksums)
 			deltafile := filepath.Join(deltadir, file)
 			if err := r.Open(deltafile); err != nil {
 				return nil, err
@@ -9,6 +9,11 @@ import "math/rand"
 import "sync"
 import "runtime"
 import "encoding/binary"
+import "bufio"
+import "bytes"
+import "path/filepath"
+import "io/ioutil"
+import "github.com/couchbase/indexing/secondary/encryption"
 import "github.com/couchbase/indexing/secondary/stubs/nitro/mm"
 
 var testConf Config
@@ -266,6 +271,172 @@ func TestLoadStoreDisk(t *testing.T) {
 	fmt.Println(db.DumpStats())
 }
 
+type testKeyProvider struct {
+	active string
+}
+
+func (p *testKeyProvider) ActiveKey() (*encryption.Key, error) {
+	return p.GetKey(p.active)
+}
+
+func (p *testKeyProvider) GetKey(id string) (*encryption.Key, error) {
+	if id == "" || id > p.active {
+		return nil, encryption.ErrKeyNotFound
+	}
+	return &encryption.Key{Id: id, Bytes: bytes.Repeat([]byte(id[:1]), encryption.KeySize)}, nil
+}
+
+func TestLoadStoreDiskEncrypted(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+	var wg sync.WaitGroup
+
+	provider := &testKeyProvider{active: "a"}
+	conf := testConf
+	conf.SetKeyProvider(provider)
+
+	db := NewWithConfig(conf)
+	defer db.Close()
+	n := 100000
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go doInsert(db, &wg, n/runtime.GOMAXPROCS(0), true, true)
+	}
+	wg.Wait()
+	n = n / runtime.GOMAXPROCS(0) * runtime.GOMAXPROCS(0)
+
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 8, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	fd, err := os.Open(filepath.Join("db.dump", "data", "shard-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encryption.IsEncrypted(bufio.NewReader(fd)) {
+		t.Errorf("Expected snapshot file to be encrypted")
+	}
+	fd.Close()
+
+	load := func(p encryption.KeyProvider) (int, error) {
+		conf := testConf
+		conf.SetKeyProvider(p)
+		db := NewWithConfig(conf)
+		defer db.Close()
+		snap, err := db.LoadFromDisk("db.dump", 8, nil)
+		if err != nil {
+			return 0, err
+		}
+		defer snap.Close()
+		return CountItems(snap), nil
+	}
+
+	if _, err := load(nil); err == nil {
+		t.Errorf("Expected error loading encrypted snapshot without key provider")
+	}
+
+	// rotate the key, files written with the old key remain readable
+	provider.active = "b"
+	if count, err := load(provider); err != nil || count != n {
+		t.Errorf("Expected %v items, got %v %v", n, count, err)
+	}
+
+	// next snapshot is encrypted with the new key
+	snap, _ = db.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 8, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	if count, err := load(&testKeyProvider{active: "b"}); err != nil || count != n {
+		t.Errorf("Expected %v items, got %v %v", n, count, err)
+	}
+	if _, err := load(&testKeyProvider{active: "a"}); err == nil {
+		t.Errorf("Expected error loading snapshot without its key")
+	}
+}
+
+func TestLoadStoreDiskCorrupted(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+	var wg sync.WaitGroup
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	n := 100000
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go doInsert(db, &wg, n/runtime.GOMAXPROCS(0), true, true)
+	}
+	wg.Wait()
+
+	store := func() {
+		snap, _ := db.NewSnapshot()
+		if err := db.StoreToDisk("db.dump", snap, 8, nil); err != nil {
+			t.Fatalf("Expected no error. got=%v", err)
+		}
+	}
+
+	load := func() error {
+		db := NewWithConfig(testConf)
+		defer db.Close()
+		snap, err := db.LoadFromDisk("db.dump", 8, nil)
+		if err == nil {
+			snap.Close()
+		}
+		return err
+	}
+
+	corrupt := func(file string, f func([]byte) []byte) {
+		path := filepath.Join("db.dump", file)
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, f(bs), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store()
+	if err := load(); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	flip := func(bs []byte) []byte {
+		bs[len(bs)/2] ^= 0x10
+		return bs
+	}
+
+	corrupt(filepath.Join("data", "shard-0"), flip)
+	if err := load(); err != ErrCorruptSnapshot {
+		t.Errorf("Expected %v for bit flip, got %v", ErrCorruptSnapshot, err)
+	}
+
+	store()
+	corrupt(filepath.Join("data", "shard-0"), func(bs []byte) []byte {
+		return bs[:len(bs)/2]
+	})
+	if err := load(); err != ErrCorruptSnapshot {
+		t.Errorf("Expected %v for truncated file, got %v", ErrCorruptSnapshot, err)
+	}
+
+	store()
+	corrupt(filepath.Join("data", "files.json"), func(bs []byte) []byte {
+		return bytes.Replace(bs, []byte("shard-0"), []byte("shard-1"), 1)
+	})
+	if err := load(); err != ErrCorruptSnapshot {
+		t.Errorf("Expected %v for modified file list, got %v", ErrCorruptSnapshot, err)
+	}
+
+	store()
+	corrupt("nitro.json", func(bs []byte) []byte {
+		return bytes.Replace(bs, []byte(`"version":1`), []byte(`"version":0`), 1)
+	})
+	if err := load(); err != ErrCorruptSnapshot {
+		t.Errorf("Expected %v for modified manifest, got %v", ErrCorruptSnapshot, err)
+	}
+}
+
 func TestStoreDiskShutdown(t *testing.T) {
 	os.RemoveAll("db.dump")
 	var wg sync.WaitGroup
@@ -521,6 +692,72 @@ func TestVisitorError(t *testing.T) {
 	}
 }
 
+func TestSnapshotRangeSplitItems(t *testing.T) {
+	const n = 100000
+	var wg sync.WaitGroup
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	wg.Add(1)
+	doInsert(db, &wg, n, false, false)
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	// Items deleted after the snapshot should still be used for splitting
+	w := db.NewWriter()
+	for i := 0; i < n/2; i++ {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(i))
+		w.Delete(buf)
+	}
+
+	keys := snap.GetRangeSplitItems(8)
+	if len(keys) == 0 || len(keys) > 7 {
+		t.Fatalf("Expected up to 7 split keys, got %d", len(keys))
+	}
+
+	var prev uint64
+	for i, key := range keys {
+		v := binary.BigEndian.Uint64(key)
+		if v >= n || (i > 0 && v <= prev) {
+			t.Errorf("Invalid split key %d after %d", v, prev)
+		}
+		prev = v
+	}
+
+	if v := binary.BigEndian.Uint64(keys[0]); v >= n/2 {
+		t.Errorf("Expected first split key in deleted range, got %d", v)
+	}
+}
+
+func TestSnapshotItemChanged(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	n1 := w.Put2([]byte("k1"))
+	n2 := w.Put2([]byte("k2"))
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	w.Delete([]byte("k2"))
+	n3 := w.Put2([]byte("k3"))
+
+	for _, tc := range []struct {
+		key     string
+		item    *Item
+		changed bool
+	}{
+		{"k1", (*Item)(n1.Item()), false},
+		{"k2", (*Item)(n2.Item()), true},
+		{"k3", (*Item)(n3.Item()), true},
+	} {
+		if snap.ItemChanged(tc.item) != tc.changed {
+			t.Errorf("Expected changed %v for %v", tc.changed, tc.key)
+		}
+	}
+}
+
 func doUpdate(db *MemDB, wg *sync.WaitGroup, w *Writer, start, end int, version int) {
 	defer wg.Done()
 	for ; start < end; start++ {
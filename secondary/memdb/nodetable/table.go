@@ -191,6 +191,25 @@ func (nt *NodeTable) Remove(key []byte) (success bool, nptr unsafe.Pointer) {
 	return
 }
 
+// Range calls f for every pointer stored in the table, in no particular
+// order. Iteration stops if f returns false. The table must not be
+// modified during the iteration.
+func (nt *NodeTable) Range(f func(unsafe.Pointer) bool) {
+	for h, v := range nt.fastHT {
+		if !f(decodePointer(v)) {
+			return
+		}
+
+		if nt.hasConflict(v) {
+			for _, sv := range nt.slowHT[h] {
+				if !f(decodePointer(sv)) {
+					return
+				}
+			}
+		}
+	}
+}
+
 func decodePointer(v uint64) unsafe.Pointer {
 	var x uintptr
 	if unsafe.Sizeof(x) == 8 {
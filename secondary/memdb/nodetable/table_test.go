@@ -294,6 +294,51 @@ func TestLargeConflicts(t *testing.T) {
 
 }
 
+func TestRange(t *testing.T) {
+	n := 10000
+	hfn := func(k []byte) uint32 {
+		return crc32.ChecksumIEEE(k) % 1000
+	}
+	table := New(hfn, equalObject)
+	objects := make([]*object, n)
+	for i := 0; i < n; i++ {
+		objects[i] = mkObject(fmt.Sprintf("key-%d", i), i)
+		table.Update(objects[i].key, unsafe.Pointer(objects[i]))
+	}
+
+	for i := 0; i < n; i += 2 {
+		table.Remove(objects[i].key)
+	}
+
+	seen := make(map[int]bool)
+	table.Range(func(p unsafe.Pointer) bool {
+		o := (*object)(p)
+		if seen[o.value] {
+			t.Errorf("Object %s seen twice", string(o.key))
+		}
+		seen[o.value] = true
+		return true
+	})
+
+	if len(seen) != n/2 {
+		t.Errorf("Expected %d objects, found %d", n/2, len(seen))
+	}
+	for i := 1; i < n; i += 2 {
+		if !seen[i] {
+			t.Errorf("Expected object key-%d", i)
+		}
+	}
+
+	count := 0
+	table.Range(func(p unsafe.Pointer) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Errorf("Expected iteration to stop after 10 objects, saw %d", count)
+	}
+}
+
 func TestMemoryOverhead(t *testing.T) {
 	n := 100000
 	table := New(crc32.ChecksumIEEE, equalObject)
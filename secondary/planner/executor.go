@@ -98,10 +98,13 @@ type IndexSpec struct {
 	IsPrimary          bool               `json:"isPrimary,omitempty"`
 	SecExprs           []string           `json:"secExprs,omitempty"`
 	WhereExpr          string             `json:"where,omitempty"`
+	ImmutableWhere     bool               `json:"immutableWhere,omitempty"`
 	Deferred           bool               `json:"deferred,omitempty"`
 	Immutable          bool               `json:"immutable,omitempty"`
 	IsArrayIndex       bool               `json:"isArrayIndex,omitempty"`
 	RetainDeletedXATTR bool               `json:"retainDeletedXATTR,omitempty"`
+	SnapshotRetention  uint64             `json:"snapshotRetention,omitempty"`
+	BuildPriority      int                `json:"buildPriority,omitempty"`
 	NumPartition       uint64             `json:"numPartition,omitempty"`
 	PartitionScheme    string             `json:"partitionScheme,omitempty"`
 	HashScheme         uint64             `json:"hashScheme,omitempty"`
@@ -111,6 +114,9 @@ type IndexSpec struct {
 	Using              string             `json:"using,omitempty"`
 	ExprType           string             `json:"exprType,omitempty"`
 
+	// unicode collation of string keys
+	Collation *common.IndexCollation `json:"collation,omitempty"`
+
 	// usage
 	NumDoc        uint64  `json:"numDoc,omitempty"`
 	DocKeySize    uint64  `json:"docKeySize,omitempty"`
@@ -1151,9 +1157,13 @@ func indexUsageFromSpec(sizing SizingMethod, spec *IndexSpec) ([]*IndexUsage, er
 			index.Instance.Defn.IsPrimary = spec.IsPrimary
 			index.Instance.Defn.SecExprs = spec.SecExprs
 			index.Instance.Defn.WhereExpr = spec.WhereExpr
+			index.Instance.Defn.ImmutableWhere = spec.ImmutableWhere
 			index.Instance.Defn.Immutable = spec.Immutable
 			index.Instance.Defn.IsArrayIndex = spec.IsArrayIndex
 			index.Instance.Defn.RetainDeletedXATTR = spec.RetainDeletedXATTR
+			index.Instance.Defn.SnapshotRetention = spec.SnapshotRetention
+			index.Instance.Defn.BuildPriority = spec.BuildPriority
+			index.Instance.Defn.Collation = spec.Collation
 			index.Instance.Defn.Deferred = spec.Deferred
 			index.Instance.Defn.Desc = spec.Desc
 			index.Instance.Defn.NumReplica = uint32(spec.Replica) - 1
@@ -13,7 +13,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/couchbase/cbauth"
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/logging"
 	mc "github.com/couchbase/indexing/secondary/manager/common"
@@ -885,7 +884,7 @@ func getWithCbauth(url string) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	cbauth.SetRequestAuthVia(req, nil)
+	common.SetRequestAuth(req)
 
 	client := http.Client{Timeout: time.Duration(10 * time.Second)}
 	response, err := client.Do(req)
@@ -0,0 +1,26 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// +build !windows
+
+package platform
+
+import "syscall"
+
+// DiskUsage returns the total size and the bytes available to
+// unprivileged users on the filesystem holding path.
+func DiskUsage(path string) (total, avail uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	total = uint64(st.Blocks) * uint64(st.Bsize)
+	avail = uint64(st.Bavail) * uint64(st.Bsize)
+	return total, avail, nil
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// +build windows
+
+package platform
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// DiskUsage returns the total size and the bytes available to
+// the calling user on the volume holding path.
+func DiskUsage(path string) (total, avail uint64, err error) {
+	var k32 = syscall.NewLazyDLL("kernel32.dll")
+	var gdfs = k32.NewProc("GetDiskFreeSpaceExW")
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, _, e := gdfs.Call(uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&avail)), uintptr(unsafe.Pointer(&total)), 0)
+	if r == 0 {
+		return 0, 0, e
+	}
+	return total, avail, nil
+}
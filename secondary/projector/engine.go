@@ -60,10 +60,16 @@ func (engine *Engine) StreamEndData(
 	return engine.evaluator.StreamEndData(vbno, vbuuid, seqno)
 }
 
-// TransformRoute data to endpoints.
+// TransformRoute data to endpoints, `context` is shared by the engines
+// of the bucket.
 func (engine *Engine) TransformRoute(
 	vbuuid uint64, m *mc.DcpEvent, data map[string]interface{},
-	encodeBuf []byte) ([]byte, error) {
+	encodeBuf []byte, context c.EvalContext) ([]byte, error) {
 
-	return engine.evaluator.TransformRoute(vbuuid, m, data, encodeBuf)
+	return engine.evaluator.TransformRoute(vbuuid, m, data, encodeBuf, context)
+}
+
+// Statistics of this engine.
+func (engine *Engine) Statistics() map[string]interface{} {
+	return engine.evaluator.Statistics()
 }
@@ -127,6 +127,9 @@ func (p *Projector) ResetConfig(config c.Config) {
 	if cv, ok := config["projector.memstatTick"]; ok {
 		c.Memstatch <- int64(cv.Int())
 	}
+	if cv, ok := config["projector.jsTimeout"]; ok {
+		protobuf.SetJSTimeout(time.Duration(cv.Int()) * time.Millisecond)
+	}
 	p.config = p.config.Override(config)
 
 	// CPU-profiling
@@ -25,6 +25,7 @@ import "strconv"
 import mcd "github.com/couchbase/indexing/secondary/dcp/transport"
 import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
 import c "github.com/couchbase/indexing/secondary/common"
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
 import "github.com/couchbase/indexing/secondary/logging"
 
 // VbucketWorker is immutable structure defined for each vbucket.
@@ -48,6 +49,8 @@ type VbucketWorker struct {
 	mutChanSize int
 
 	encodeBuf []byte
+	// evaluation context shared by the engines for a mutation
+	evalContext *protobuf.EvalContext
 }
 
 // NewVbucketWorker creates a new routine to handle this vbucket stream.
@@ -72,6 +75,8 @@ func NewVbucketWorker(
 		reqch:     make(chan []interface{}, mutChanSize),
 		finch:     make(chan bool),
 		encodeBuf: make([]byte, 0, encodeBufSize),
+
+		evalContext: protobuf.NewEvalContext(),
 	}
 	fmsg := "WRKR[%v<-%v<-%v #%v]"
 	worker.logPrefix = fmt.Sprintf(fmsg, id, bucket, feed.cluster, feed.topic)
@@ -384,8 +389,10 @@ func (worker *VbucketWorker) handleEvent(m *mc.DcpEvent) *Vbucket {
 		dataForEndpoints := make(map[string]interface{})
 		// for each engine distribute transformations to endpoints.
 		fmsg := "%v ##%x TransformRoute: %v\n"
+		worker.evalContext.Reset(m)
 		for _, engine := range worker.engines {
-			newBuf, err := engine.TransformRoute(v.vbuuid, m, dataForEndpoints, worker.encodeBuf)
+			newBuf, err := engine.TransformRoute(
+				v.vbuuid, m, dataForEndpoints, worker.encodeBuf, worker.evalContext)
 			if err != nil {
 				logging.Errorf(fmsg, logPrefix, m.Opaque, err)
 			}
@@ -394,6 +401,7 @@ func (worker *VbucketWorker) handleEvent(m *mc.DcpEvent) *Vbucket {
 				worker.encodeBuf = newBuf[:0]
 			}
 		}
+		worker.evalContext.Reset(nil) // release the document
 		// send data to corresponding endpoint.
 		for raddr, data := range dataForEndpoints {
 			if endpoint, ok := worker.endpoints[raddr]; ok {
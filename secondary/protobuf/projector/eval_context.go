@@ -0,0 +1,108 @@
+package protobuf
+
+import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+import qexpr "github.com/couchbase/query/expression"
+import qvalue "github.com/couchbase/query/value"
+
+// EvalContext is the evaluation context of a mutation, shared by the
+// index evaluators of a bucket. Document and old document of the mutation
+// are parsed once for all evaluators, and the value of an expression
+// common to several index definitions, like a field path or a WHERE
+// predicate, is evaluated once.
+//
+// EvalContext is not thread safe, it is expected to be used by a single
+// worker routine.
+type EvalContext struct {
+	m      *mc.DcpEvent
+	meta   map[string]interface{}
+	newDoc evalDoc
+	oldDoc evalDoc
+}
+
+// evalDoc is a parsed document and the memoized values of expressions,
+// by expression text.
+type evalDoc struct {
+	docval qvalue.AnnotatedValue
+	values map[string]evalValue
+}
+
+type evalValue struct {
+	scalar qvalue.Value
+	vector qvalue.Values
+	err    error
+}
+
+// NewEvalContext returns a new evaluation context.
+func NewEvalContext() *EvalContext {
+	return &EvalContext{
+		newDoc: evalDoc{values: make(map[string]evalValue)},
+		oldDoc: evalDoc{values: make(map[string]evalValue)},
+	}
+}
+
+// Reset implements common.EvalContext{} interface.
+func (ctx *EvalContext) Reset(m *mc.DcpEvent) {
+	ctx.m, ctx.meta = m, nil
+	ctx.newDoc.reset()
+	ctx.oldDoc.reset()
+}
+
+// document returns the shared value of the document of mutation `m`, or
+// of its old document if `old` is true.
+func (ctx *EvalContext) document(m *mc.DcpEvent, old bool) *evalDoc {
+	if m != ctx.m {
+		ctx.Reset(m)
+	}
+
+	if ctx.meta == nil {
+		ctx.meta = eventMeta(m)
+	} else if xattrs, _ := ctx.meta["xattrs"].(map[string]interface{}); xattrs == nil && m.ParsedXATTR != nil {
+		// XATTRs are parsed by the first evaluator using them.
+		ctx.meta["xattrs"] = m.ParsedXATTR
+	}
+
+	doc, value := &ctx.newDoc, m.Value
+	if old {
+		doc, value = &ctx.oldDoc, m.OldValue
+	}
+	if doc.docval == nil {
+		doc.docval = qvalue.NewAnnotatedValue(qvalue.NewParsedValue(value, true))
+		doc.docval.SetAttachment("meta", ctx.meta)
+	}
+	return doc
+}
+
+func (doc *evalDoc) reset() {
+	doc.docval = nil
+	for key := range doc.values {
+		delete(doc.values, key)
+	}
+}
+
+// evaluate expression `expr` for `docval`. If `doc` is not nil, the value
+// is memoized as `exprKey`, which must be same for expressions that are
+// equivalent.
+func (doc *evalDoc) evaluate(
+	expr qexpr.Expression, exprKey string, docval qvalue.AnnotatedValue,
+	context qexpr.Context) (qvalue.Value, qvalue.Values, error) {
+
+	if doc == nil || exprKey == "" {
+		return expr.EvaluateForIndex(docval, context)
+	}
+	if v, ok := doc.values[exprKey]; ok {
+		return v.scalar, v.vector, v.err
+	}
+	scalar, vector, err := expr.EvaluateForIndex(doc.docval, context)
+	doc.values[exprKey] = evalValue{scalar: scalar, vector: vector, err: err}
+	return scalar, vector, err
+}
+
+// exprKeys return the texts of compiled expressions, to memoize their
+// values.
+func exprKeys(cExprs []interface{}) []string {
+	keys := make([]string, 0, len(cExprs))
+	for _, cExpr := range cExprs {
+		keys = append(keys, qexpr.NewStringer().Visit(cExpr.(qexpr.Expression)))
+	}
+	return keys
+}
@@ -0,0 +1,149 @@
+package protobuf
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+	"github.com/golang/protobuf/proto"
+)
+
+var evalExprs = [][]string{
+	{`age`},
+	{`city`},
+	{`age`, `city`},
+	{`lower(city)`},
+	{`emailid`, `age`},
+	{`meta().id`},
+	{`gender`, `lower(city)`},
+}
+
+var evalWheres = []string{``, `type = "user"`, `age > 30`}
+
+// newTestEvaluators returns evaluators for `n` indexes, with expressions
+// and WHERE predicates common to several of them.
+func newTestEvaluators(tb testing.TB, n int) []*IndexEvaluator {
+	evaluators := make([]*IndexEvaluator, 0, n)
+	for i := 0; i < n; i++ {
+		defn := &IndexDefn{
+			DefnID:          proto.Uint64(uint64(i)),
+			Bucket:          proto.String("default"),
+			IsPrimary:       proto.Bool(false),
+			Name:            proto.String(fmt.Sprintf("index%v", i)),
+			Using:           StorageType_memdb.Enum(),
+			ExprType:        ExprType_N1QL.Enum(),
+			SecExpressions:  evalExprs[i%len(evalExprs)],
+			PartitionScheme: PartitionScheme_TEST.Enum(),
+			WhereExpression: proto.String(evalWheres[i%len(evalWheres)]),
+			HashScheme:      HashScheme_CRC32.Enum(),
+		}
+		instance := &IndexInst{
+			InstId:     proto.Uint64(uint64(i)),
+			State:      IndexState_IndexActive.Enum(),
+			Definition: defn,
+			Tp:         NewTestParitition([]string{"localhost:9100"}),
+		}
+		ie, err := NewIndexEvaluator(instance, FeedVersion_watson)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		evaluators = append(evaluators, ie)
+	}
+	return evaluators
+}
+
+func newTestEvent() *mc.DcpEvent {
+	m := &mc.DcpEvent{
+		Opcode: mcd.DCP_MUTATION, Key: []byte("docid"), Value: doc150, Seqno: 10,
+	}
+	m.TreatAsJSON()
+	return m
+}
+
+func transformAll(
+	evaluators []*IndexEvaluator, m *mc.DcpEvent,
+	ectx *EvalContext) (map[string]interface{}, error) {
+
+	data := make(map[string]interface{})
+	if ectx != nil {
+		ectx.Reset(m)
+	}
+	for _, ie := range evaluators {
+		var context c.EvalContext
+		if ectx != nil {
+			context = ectx // avoid a non-nil interface holding a nil pointer
+		}
+		if _, err := ie.TransformRoute(1, m, data, buf, context); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func TestEvalContext(t *testing.T) {
+	evaluators := newTestEvaluators(t, 2*len(evalExprs)*len(evalWheres))
+
+	expected, err := transformAll(evaluators, newTestEvent(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ectx := NewEvalContext()
+	for i := 0; i < 2; i++ { // context is reused across mutations
+		received, err := transformAll(evaluators, newTestEvent(), ectx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, received) {
+			t.Fatalf("Expected %v, received %v", expected, received)
+		}
+	}
+
+	// values of a mutation are not shared with the next one
+	m := newTestEvent()
+	m.Value = []byte(`{"type": "user", "age": 20, "city": "Pune"}`)
+	expected, _ = transformAll(evaluators, m, nil)
+	received, _ := transformAll(evaluators, m, ectx)
+	if !reflect.DeepEqual(expected, received) {
+		t.Fatalf("Expected %v, received %v", expected, received)
+	}
+}
+
+func benchmarkTransformRoute(b *testing.B, n int, shared bool) {
+	evaluators := newTestEvaluators(b, n)
+	var ectx *EvalContext
+	if shared {
+		ectx = NewEvalContext()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transformAll(evaluators, newTestEvent(), ectx)
+	}
+}
+
+func BenchmarkTransformRoute1(b *testing.B) {
+	benchmarkTransformRoute(b, 1, false)
+}
+
+func BenchmarkTransformRoute1Shared(b *testing.B) {
+	benchmarkTransformRoute(b, 1, true)
+}
+
+func BenchmarkTransformRoute10(b *testing.B) {
+	benchmarkTransformRoute(b, 10, false)
+}
+
+func BenchmarkTransformRoute10Shared(b *testing.B) {
+	benchmarkTransformRoute(b, 10, true)
+}
+
+func BenchmarkTransformRoute50(b *testing.B) {
+	benchmarkTransformRoute(b, 50, false)
+}
+
+func BenchmarkTransformRoute50Shared(b *testing.B) {
+	benchmarkTransformRoute(b, 50, true)
+}
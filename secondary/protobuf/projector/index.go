@@ -1,8 +1,10 @@
 package protobuf
 
 import "fmt"
+import "sync/atomic"
 
 import "github.com/couchbase/indexing/secondary/logging"
+import "github.com/couchbase/indexing/secondary/collatejson"
 import c "github.com/couchbase/indexing/secondary/common"
 import mcd "github.com/couchbase/indexing/secondary/dcp/transport"
 import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
@@ -95,12 +97,23 @@ func (instance *IndexInst) GetPartitionObject() Partition {
 // IndexEvaluator implements `Evaluator` interface for protobuf
 // definition of an index instance.
 type IndexEvaluator struct {
-	skExprs  []interface{} // compiled expression
-	pkExprs  []interface{} // compiled expression
-	whExpr   interface{}   // compiled expression
+	// stats, 64-bit aligned for atomic access.
+	upsertDeletions        uint64 // UpsertDeletion sent for WHERE false
+	upsertDeletionsAvoided uint64 // UpsertDeletion not sent for WHERE false
+	jsErrors               uint64 // JavaScript expressions failed
+	jsTimeouts             uint64 // JavaScript expressions timed out
+
+	skExprs  []interface{} // compiled expression, or *JSFunction
+	pkExprs  []interface{} // compiled expression, or *JSFunction
+	whExpr   interface{}   // compiled expression, or *JSFunction
+	skKeys   []string      // text of expressions, to share their values
+	pkKeys   []string
+	whKey    string
 	instance *IndexInst
 	version  FeedVersion
 	xattrs   []string
+
+	collation *collatejson.Collation // nil, if strings are ordered by utf8
 }
 
 // NewIndexEvaluator returns a reference to a new instance
@@ -124,6 +137,7 @@ func NewIndexEvaluator(instance *IndexInst,
 		if err != nil {
 			return nil, err
 		}
+		ie.skKeys = exprKeys(ie.skExprs)
 		// expression to evaluate partition key
 		exprs = defn.GetPartnExpressions()
 		xattrExprs = append(xattrExprs, exprs...)
@@ -133,6 +147,7 @@ func NewIndexEvaluator(instance *IndexInst,
 				return nil, err
 			} else if len(cExprs) > 0 {
 				ie.pkExprs = cExprs
+				ie.pkKeys = exprKeys(cExprs)
 			}
 		}
 		// expression to evaluate where clause
@@ -144,11 +159,48 @@ func NewIndexEvaluator(instance *IndexInst,
 				return nil, err
 			} else if len(cExprs) > 0 {
 				ie.whExpr = cExprs[0]
+				ie.whKey = exprKeys(cExprs)[0]
 			}
 		}
 		_, xattrNames, _ := qu.GetXATTRNames(xattrExprs)
 		ie.xattrs = xattrNames
 
+		if locale := defn.GetCollationLocale(); len(locale) > 0 {
+			ie.collation, err = collatejson.NewCollation(
+				locale, defn.GetCollationStrength(), defn.GetCollationCaseLevel())
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case ExprType_JAVASCRIPT:
+		// expressions are not memoized, and XATTRs are not available
+		// to JavaScript expressions.
+		ie.skExprs, err = CompileJSExpression(defn.GetSecExpressions())
+		if err != nil {
+			return nil, err
+		}
+		if exprs := defn.GetPartnExpressions(); len(exprs) > 0 {
+			if ie.pkExprs, err = CompileJSExpression(exprs); err != nil {
+				return nil, err
+			}
+		}
+		if expr := defn.GetWhereExpression(); len(expr) > 0 {
+			fns, err := CompileJSExpression([]string{expr})
+			if err != nil {
+				return nil, err
+			}
+			ie.whExpr = fns[0]
+		}
+
+		if locale := defn.GetCollationLocale(); len(locale) > 0 {
+			ie.collation, err = collatejson.NewCollation(
+				locale, defn.GetCollationStrength(), defn.GetCollationCaseLevel())
+			if err != nil {
+				return nil, err
+			}
+		}
+
 	default:
 		logging.Errorf("invalid expression type %v\n", exprtype)
 		return nil, fmt.Errorf("invalid expression type %v", exprtype)
@@ -204,7 +256,7 @@ func (ie *IndexEvaluator) StreamEndData(
 // TransformRoute implement Evaluator{} interface.
 func (ie *IndexEvaluator) TransformRoute(
 	vbuuid uint64, m *mc.DcpEvent, data map[string]interface{},
-	encodeBuf []byte) ([]byte, error) {
+	encodeBuf []byte, context c.EvalContext) ([]byte, error) {
 	var err error
 	defer func() { // panic safe
 		if r := recover(); r != nil {
@@ -230,29 +282,31 @@ func (ie *IndexEvaluator) TransformRoute(
 		opcode = mcd.DCP_MUTATION
 	}
 
-	meta := ie.dcpEvent2Meta(m)
-	docval := qvalue.NewAnnotatedValue(qvalue.NewParsedValue(m.Value, true))
-	docval.SetAttachment("meta", meta)
-	where, err := ie.wherePredicate(m, docval, encodeBuf)
+	// document is parsed once for all the evaluators sharing the context.
+	ectx, _ := context.(*EvalContext)
+	docval, doc := ie.document(ectx, m, false)
+	where, err := ie.wherePredicate(m, docval, encodeBuf, doc)
 	if err != nil {
 		return nil, err
 	}
+	// a JSON document, that is not a retained deletion, not matching an
+	// immutable WHERE predicate never matched it.
+	neverIndexed := !where && m.IsJSON() && !retainDelete && defn.GetImmutableWhere()
 
 	if where && (len(m.Value) > 0 || retainDelete) { // project new secondary key
-		if npkey, err = ie.partitionKey(m, m.Key, docval, encodeBuf); err != nil {
+		if npkey, err = ie.partitionKey(m, m.Key, docval, encodeBuf, doc); err != nil {
 			return nil, err
 		}
-		if nkey, newBuf, err = ie.evaluate(m, m.Key, docval, encodeBuf); err != nil {
+		if nkey, newBuf, err = ie.evaluate(m, m.Key, docval, encodeBuf, doc); err != nil {
 			return nil, err
 		}
 	}
 	if len(m.OldValue) > 0 { // project old secondary key
-		docval = qvalue.NewAnnotatedValue(qvalue.NewParsedValue(m.OldValue, true))
-		docval.SetAttachment("meta", meta)
-		if opkey, err = ie.partitionKey(m, m.Key, docval, encodeBuf); err != nil {
+		docval, doc = ie.document(ectx, m, true)
+		if opkey, err = ie.partitionKey(m, m.Key, docval, encodeBuf, doc); err != nil {
 			return nil, err
 		}
-		if okey, newBuf, err = ie.evaluate(m, m.Key, docval, encodeBuf); err != nil {
+		if okey, newBuf, err = ie.evaluate(m, m.Key, docval, encodeBuf, doc); err != nil {
 			return nil, err
 		}
 	}
@@ -269,9 +323,9 @@ func (ie *IndexEvaluator) TransformRoute(
 
 	switch opcode {
 	case mcd.DCP_MUTATION:
-		// FIXME: TODO: where clause is not used to for optimizing out messages
-		// not passing the where clause. For this we need a gaurantee that
-		// where clause will be defined only on immutable fields.
+		// If WHERE is false for the new document, it is deleted from the
+		// index unless the where clause is declared to be defined only on
+		// immutable fields.
 		if where { // WHERE predicate, sent upsert only if where is true.
 			raddrs := instn.UpsertEndpoints(m, npkey, nkey, okey)
 			if len(raddrs) != 0 {
@@ -302,9 +356,13 @@ func (ie *IndexEvaluator) TransformRoute(
 					data[raddr] = dkv
 				}
 			}
+		} else if neverIndexed {
+			atomic.AddUint64(&ie.upsertDeletionsAvoided, 1)
+
 		} else { // if WHERE is false, broadcast upsertdelete.
 			// NOTE: downstream can use upsertdelete and immutable flag
 			// to optimize out back-index lookup.
+			atomic.AddUint64(&ie.upsertDeletions, 1)
 			raddrs := instn.UpsertDeletionEndpoints(m, npkey, nkey, okey)
 			for _, raddr := range raddrs {
 				dkv, ok := data[raddr].(*c.DataportKeyVersions)
@@ -338,9 +396,63 @@ func (ie *IndexEvaluator) TransformRoute(
 	return newBuf, nil
 }
 
+// Statistics implement Evaluator{} interface.
+func (ie *IndexEvaluator) Statistics() map[string]interface{} {
+	return map[string]interface{}{
+		"upsertDeletions":        float64(atomic.LoadUint64(&ie.upsertDeletions)),
+		"upsertDeletionsAvoided": float64(atomic.LoadUint64(&ie.upsertDeletionsAvoided)),
+		"jsErrors":               float64(atomic.LoadUint64(&ie.jsErrors)),
+		"jsTimeouts":             float64(atomic.LoadUint64(&ie.jsTimeouts)),
+	}
+}
+
+// Evaluate returns the secondary key of the document in event `m`, nil
+// if the document is not indexed, for indexing documents without a feed.
+// WHERE predicate is applied and the key is returned as collated JSON if
+// `encodeBuf` is not nil.
+func (ie *IndexEvaluator) Evaluate(
+	m *mc.DcpEvent, encodeBuf []byte) (key, newBuf []byte, err error) {
+
+	defer func() { // panic safe
+		if r := recover(); r != nil {
+			key, newBuf, err = nil, nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	docval, _ := ie.document(nil, m, false)
+	where, err := ie.wherePredicate(m, docval, encodeBuf, nil)
+	if err != nil || !where || len(m.Value) == 0 {
+		return nil, nil, err
+	}
+	return ie.evaluate(m, m.Key, docval, encodeBuf, nil)
+}
+
+// document returns the value of the document of mutation `m`, or of its
+// old document if `old` is true. If evaluation context `ectx` is not nil,
+// document is shared with other evaluators along with the values of its
+// expressions.
+func (ie *IndexEvaluator) document(
+	ectx *EvalContext, m *mc.DcpEvent,
+	old bool) (qvalue.AnnotatedValue, *evalDoc) {
+
+	ie.parseXATTRs(m)
+	if ectx != nil {
+		doc := ectx.document(m, old)
+		return doc.docval, doc
+	}
+
+	value := m.Value
+	if old {
+		value = m.OldValue
+	}
+	docval := qvalue.NewAnnotatedValue(qvalue.NewParsedValue(value, true))
+	docval.SetAttachment("meta", eventMeta(m))
+	return docval, nil
+}
+
 func (ie *IndexEvaluator) evaluate(
 	m *mc.DcpEvent, docid []byte, docval qvalue.AnnotatedValue,
-	encodeBuf []byte) ([]byte, []byte, error) {
+	encodeBuf []byte, doc *evalDoc) ([]byte, []byte, error) {
 
 	defn := ie.instance.GetDefinition()
 	if defn.GetIsPrimary() { // primary index supported !!
@@ -354,14 +466,29 @@ func (ie *IndexEvaluator) evaluate(
 	exprType := defn.GetExprType()
 	switch exprType {
 	case ExprType_N1QL:
-		return N1QLTransform(docid, docval, ie.skExprs, encodeBuf)
+		if ie.collation != nil {
+			// indexer cannot collate a JSON key, always encode it.
+			if encodeBuf == nil {
+				encodeBuf = make([]byte, 0, 1024)
+			}
+		}
+		return n1qlTransform(
+			docid, docval, ie.skExprs, ie.skKeys, encodeBuf, ie.collation, doc)
+
+	case ExprType_JAVASCRIPT:
+		if ie.collation != nil && encodeBuf == nil {
+			encodeBuf = make([]byte, 0, 1024)
+		}
+		out, newBuf, err := JSTransform(
+			docid, docval, ie.skExprs, encodeBuf, ie.collation)
+		return ie.jsResult(docid, out, newBuf, err)
 	}
 	return nil, nil, nil
 }
 
 func (ie *IndexEvaluator) partitionKey(
 	m *mc.DcpEvent, docid []byte, docval qvalue.AnnotatedValue,
-	encodeBuf []byte) ([]byte, error) {
+	encodeBuf []byte, doc *evalDoc) ([]byte, error) {
 
 	defn := ie.instance.GetDefinition()
 	if ie.pkExprs == nil { // no partition key
@@ -374,7 +501,13 @@ func (ie *IndexEvaluator) partitionKey(
 	exprType := defn.GetExprType()
 	switch exprType {
 	case ExprType_N1QL:
-		out, _, err := N1QLTransform(docid, docval, ie.pkExprs, nil)
+		out, _, err := n1qlTransform(
+			docid, docval, ie.pkExprs, ie.pkKeys, nil, nil, doc)
+		return out, err
+
+	case ExprType_JAVASCRIPT:
+		out, _, err := JSTransform(docid, docval, ie.pkExprs, nil, nil)
+		out, _, err = ie.jsResult(docid, out, nil, err)
 		return out, err
 	}
 	return nil, nil
@@ -382,7 +515,7 @@ func (ie *IndexEvaluator) partitionKey(
 
 func (ie *IndexEvaluator) wherePredicate(
 	m *mc.DcpEvent, docval qvalue.AnnotatedValue,
-	encodeBuf []byte) (bool, error) {
+	encodeBuf []byte, doc *evalDoc) (bool, error) {
 
 	// if where predicate is not supplied - always evaluate to `true`
 	if ie.whExpr == nil {
@@ -398,7 +531,9 @@ func (ie *IndexEvaluator) wherePredicate(
 	switch exprType {
 	case ExprType_N1QL:
 		// TODO: can be optimized by using a custom N1QL-evaluator.
-		out, _, err := N1QLTransform(nil, docval, []interface{}{ie.whExpr}, encodeBuf)
+		out, _, err := n1qlTransform(
+			nil, docval, []interface{}{ie.whExpr}, []string{ie.whKey},
+			encodeBuf, nil, doc)
 		if out == nil { // missing is treated as false
 			return false, err
 		} else if err != nil { // errors are treated as false
@@ -407,12 +542,37 @@ func (ie *IndexEvaluator) wherePredicate(
 			return true, nil
 		}
 		return false, nil // predicate is false
+
+	case ExprType_JAVASCRIPT:
+		out, _, err := JSTransform(
+			nil, docval, []interface{}{ie.whExpr}, nil, nil)
+		out, _, err = ie.jsResult(m.Key, out, nil, err)
+		return string(out) == "true", err
 	}
 	return true, nil
 }
 
+// jsResult counts and logs the error of a JavaScript expression, the
+// document is skipped like for a failed N1QL expression.
+func (ie *IndexEvaluator) jsResult(
+	docid, out, newBuf []byte, err error) ([]byte, []byte, error) {
+
+	if err == nil {
+		return out, newBuf, nil
+	}
+	if err == ErrorJSTimeout {
+		atomic.AddUint64(&ie.jsTimeouts, 1)
+	}
+	atomic.AddUint64(&ie.jsErrors, 1)
+	fmsg := "JavaScript expression of index %v for docid %v, err: %v skip document"
+	arg1 := ie.instance.GetDefinition().GetName()
+	arg2 := logging.TagUD(string(docid))
+	logging.Errorf(fmsg, arg1, arg2, err)
+	return nil, newBuf, nil
+}
+
 // helper functions
-func (ie *IndexEvaluator) dcpEvent2Meta(m *mc.DcpEvent) map[string]interface{} {
+func (ie *IndexEvaluator) parseXATTRs(m *mc.DcpEvent) {
 	// If index is defined on xattr (either where-expression, part-expression
 	// or secondary-expression) then unmarshall XATTR, and only one for this
 	// event, and only used XATTRs. Cache the results for reuse.
@@ -433,6 +593,9 @@ func (ie *IndexEvaluator) dcpEvent2Meta(m *mc.DcpEvent) map[string]interface{} {
 		}
 	}
 
+}
+
+func eventMeta(m *mc.DcpEvent) map[string]interface{} {
 	return map[string]interface{}{
 		"id":         string(m.Key),
 		"byseqno":    m.Seqno,
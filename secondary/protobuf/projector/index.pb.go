@@ -291,6 +291,10 @@ type IndexDefn struct {
 	PartnExpressions   []string    `protobuf:"bytes,11,rep,name=partnExpressions" json:"partnExpressions,omitempty"`
 	RetainDeletedXATTR *bool       `protobuf:"varint,12,opt,name=retainDeletedXATTR" json:"retainDeletedXATTR,omitempty"`
 	HashScheme         *HashScheme `protobuf:"varint,13,req,name=hashScheme,enum=protobuf.HashScheme" json:"hashScheme,omitempty"`
+	CollationLocale    *string     `protobuf:"bytes,14,opt,name=collationLocale" json:"collationLocale,omitempty"`
+	CollationStrength  *string     `protobuf:"bytes,15,opt,name=collationStrength" json:"collationStrength,omitempty"`
+	CollationCaseLevel *bool       `protobuf:"varint,16,opt,name=collationCaseLevel" json:"collationCaseLevel,omitempty"`
+	ImmutableWhere     *bool       `protobuf:"varint,17,opt,name=immutableWhere" json:"immutableWhere,omitempty"`
 	XXX_unrecognized   []byte      `json:"-"`
 }
 
@@ -382,6 +386,34 @@ func (m *IndexDefn) GetHashScheme() HashScheme {
 	return HashScheme_CRC32
 }
 
+func (m *IndexDefn) GetCollationLocale() string {
+	if m != nil && m.CollationLocale != nil {
+		return *m.CollationLocale
+	}
+	return ""
+}
+
+func (m *IndexDefn) GetCollationStrength() string {
+	if m != nil && m.CollationStrength != nil {
+		return *m.CollationStrength
+	}
+	return ""
+}
+
+func (m *IndexDefn) GetCollationCaseLevel() bool {
+	if m != nil && m.CollationCaseLevel != nil {
+		return *m.CollationCaseLevel
+	}
+	return false
+}
+
+func (m *IndexDefn) GetImmutableWhere() bool {
+	if m != nil && m.ImmutableWhere != nil {
+		return *m.ImmutableWhere
+	}
+	return false
+}
+
 func init() {
 	proto.RegisterEnum("protobuf.IndexState", IndexState_name, IndexState_value)
 	proto.RegisterEnum("protobuf.StorageType", StorageType_name, StorageType_value)
@@ -0,0 +1,85 @@
+package protobuf
+
+import (
+	"testing"
+
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+	"github.com/golang/protobuf/proto"
+)
+
+func newPartialIndexEvaluator(t *testing.T, immutableWhere bool) *IndexEvaluator {
+	defn := &IndexDefn{
+		DefnID:          proto.Uint64(1),
+		Bucket:          proto.String("default"),
+		IsPrimary:       proto.Bool(false),
+		Name:            proto.String("partial"),
+		Using:           StorageType_memdb.Enum(),
+		ExprType:        ExprType_N1QL.Enum(),
+		SecExpressions:  []string{`age`},
+		PartitionScheme: PartitionScheme_TEST.Enum(),
+		WhereExpression: proto.String(`type = "user"`),
+		HashScheme:      HashScheme_CRC32.Enum(),
+		ImmutableWhere:  proto.Bool(immutableWhere),
+	}
+	instance := &IndexInst{
+		InstId:     proto.Uint64(1),
+		State:      IndexState_IndexActive.Enum(),
+		Definition: defn,
+		Tp:         NewTestParitition([]string{"localhost:9100"}),
+	}
+	ie, err := NewIndexEvaluator(instance, FeedVersion_watson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ie
+}
+
+func transformPartial(
+	t *testing.T, ie *IndexEvaluator, value, oldValue []byte) bool {
+
+	m := &mc.DcpEvent{
+		Opcode: mcd.DCP_MUTATION, Key: []byte("docid"),
+		Value: value, OldValue: oldValue, Seqno: 10,
+	}
+	m.TreatAsJSON()
+	data := make(map[string]interface{})
+	if _, err := ie.TransformRoute(1, m, data, buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	return len(data) > 0
+}
+
+func TestUpsertDeletionAvoided(t *testing.T) {
+	user := []byte(`{"type": "user", "age": 20}`)
+	other := []byte(`{"type": "other", "age": 20}`)
+
+	ie := newPartialIndexEvaluator(t, false)
+	if !transformPartial(t, ie, user, nil) {
+		t.Errorf("Expected upsert for matching document")
+	}
+	if !transformPartial(t, ie, other, nil) {
+		t.Errorf("Expected upsertDeletion without old document")
+	}
+	if !transformPartial(t, ie, other, other) {
+		t.Errorf("Expected upsertDeletion for mutable where")
+	}
+	stats := ie.Statistics()
+	if stats["upsertDeletions"] != float64(2) {
+		t.Errorf("Expected 2 upsertDeletions, received %v", stats)
+	}
+	if stats["upsertDeletionsAvoided"] != float64(0) {
+		t.Errorf("Expected no upsertDeletionsAvoided, received %v", stats)
+	}
+
+	ie = newPartialIndexEvaluator(t, true)
+	if !transformPartial(t, ie, user, nil) {
+		t.Errorf("Expected upsert for matching document")
+	}
+	if transformPartial(t, ie, other, nil) {
+		t.Errorf("Expected no upsertDeletion for immutable where")
+	}
+	if stats := ie.Statistics(); stats["upsertDeletionsAvoided"] != float64(1) {
+		t.Errorf("Expected 1 upsertDeletionsAvoided, received %v", stats)
+	}
+}
@@ -0,0 +1,239 @@
+package protobuf
+
+import "errors"
+import "fmt"
+import "sync"
+import "sync/atomic"
+import "time"
+
+import "github.com/couchbase/indexing/secondary/logging"
+import "github.com/couchbase/indexing/secondary/collatejson"
+import "github.com/couchbase/indexing/secondary/common/json"
+import qvalue "github.com/couchbase/query/value"
+import "github.com/robertkrimen/otto"
+
+// JavaScript expressions of an index are sources of functions, that are
+// called with the document and its metadata and return the value of a
+// secondary key, partition key or where predicate, like,
+//
+//     function (doc, meta) { return doc.name.toLowerCase(); }
+//
+// returning `undefined` is same as MISSING in N1QL. Functions are
+// evaluated in a sandbox without I/O, and each call, including the
+// evaluation of the source when the function is compiled, is interrupted
+// after a time limit.
+//
+// otto cannot limit the memory allocated by a VM, memory used by a call
+// is only bounded by what it can allocate within the time limit.
+
+var jsTimeout = int64(100 * time.Millisecond)
+
+// ErrorJSTimeout is returned when a call to a JavaScript expression is
+// interrupted after the time limit.
+var ErrorJSTimeout = errors.New("JavaScript expression timed out")
+
+// SetJSTimeout sets the time limit for a call to JavaScript expression.
+func SetJSTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&jsTimeout, int64(timeout))
+}
+
+// globals removed from the sandbox, otto does not provide any other
+// built-in for I/O.
+var jsUnsafeGlobals = []string{"console", "eval", "Function"}
+
+// JSFunction is a compiled JavaScript expression, it can be called
+// concurrently, each call is evaluated in a VM of its own.
+type JSFunction struct {
+	src    string
+	script *otto.Script
+	vms    sync.Pool // of *jsVM
+}
+
+type jsVM struct {
+	vm        *otto.Otto
+	fn        otto.Value
+	json      otto.Value
+	parse     otto.Value
+	stringify otto.Value
+}
+
+// CompileJSExpression will take JavaScript expressions of an index and
+// compile them for evaluation.
+func CompileJSExpression(expressions []string) ([]interface{}, error) {
+	fns := make([]interface{}, 0, len(expressions))
+	for _, expr := range expressions {
+		fn, err := NewJSFunction(expr)
+		if err != nil {
+			arg1 := logging.TagUD(expr)
+			logging.Errorf("CompileJSExpression() %v: %v\n", arg1, err)
+			return nil, err
+		}
+		fns = append(fns, fn)
+	}
+	return fns, nil
+}
+
+// NewJSFunction compiles the source of a JavaScript function.
+func NewJSFunction(src string) (*JSFunction, error) {
+	script, err := otto.New().Compile("", "("+src+")")
+	if err != nil {
+		return nil, err
+	}
+	fn := &JSFunction{src: src, script: script}
+	jvm, err := fn.newVM()
+	if err != nil {
+		return nil, err
+	}
+	fn.vms.Put(jvm)
+	return fn, nil
+}
+
+func (fn *JSFunction) newVM() (*jsVM, error) {
+	vm := otto.New()
+	vm.Interrupt = make(chan func(), 1)
+	for _, name := range jsUnsafeGlobals {
+		if err := vm.Set(name, otto.UndefinedValue()); err != nil {
+			return nil, err
+		}
+	}
+
+	// source could be an expression that never returns a function.
+	var value otto.Value
+	ok, err := runJS(vm, func() (err error) {
+		value, err = vm.Run(fn.script)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrorJSTimeout
+	} else if !value.IsFunction() {
+		return nil, fmt.Errorf("JavaScript expression is not a function")
+	}
+
+	jvm := &jsVM{vm: vm, fn: value}
+	if jvm.json, err = vm.Get("JSON"); err != nil {
+		return nil, err
+	}
+	if jvm.parse, err = jvm.json.Object().Get("parse"); err != nil {
+		return nil, err
+	}
+	if jvm.stringify, err = jvm.json.Object().Get("stringify"); err != nil {
+		return nil, err
+	}
+	return jvm, nil
+}
+
+// runJS calls `call` interrupting the VM after the time limit. Return
+// false if the VM has been, or can still be, interrupted, in which case
+// it shall be discarded.
+func runJS(vm *otto.Otto, call func() error) (ok bool, err error) {
+	timeout := time.Duration(atomic.LoadInt64(&jsTimeout))
+	timer := time.AfterFunc(timeout, func() {
+		vm.Interrupt <- func() { panic(ErrorJSTimeout) }
+	})
+	defer func() {
+		if r := recover(); r != nil {
+			if r != ErrorJSTimeout {
+				panic(r)
+			}
+			err = ErrorJSTimeout
+		}
+		ok = timer.Stop()
+	}()
+	return false, call()
+}
+
+// Call the function with document `doc` and its metadata `meta`, both
+// as JSON, and return its value as JSON, nil if value is undefined.
+func (fn *JSFunction) Call(doc, meta []byte) (out []byte, err error) {
+	jvm, _ := fn.vms.Get().(*jsVM)
+	if jvm == nil {
+		if jvm, err = fn.newVM(); err != nil {
+			return nil, err
+		}
+	}
+
+	ok, err := runJS(jvm.vm, func() (err error) {
+		out, err = jvm.call(doc, meta)
+		return err
+	})
+	if ok {
+		fn.vms.Put(jvm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (jvm *jsVM) call(doc, meta []byte) ([]byte, error) {
+	docArg, err := jvm.parse.Call(jvm.json, string(doc))
+	if err != nil {
+		return nil, err
+	}
+	metaArg, err := jvm.parse.Call(jvm.json, string(meta))
+	if err != nil {
+		return nil, err
+	}
+	value, err := jvm.fn.Call(otto.NullValue(), docArg, metaArg)
+	if err != nil {
+		return nil, err
+	} else if value.IsUndefined() {
+		return nil, nil
+	}
+	value, err = jvm.stringify.Call(jvm.json, value)
+	if err != nil {
+		return nil, err
+	} else if value.IsUndefined() { // like functions
+		return nil, nil
+	}
+	return []byte(value.String()), nil
+}
+
+// String return the source of the function.
+func (fn *JSFunction) String() string {
+	return fn.src
+}
+
+// JSTransform will use compiled list of JavaScript expressions and
+// evaluate a document using them to return a secondary key as JSON
+// object, in the same shape as N1QLTransform.
+func JSTransform(
+	docid []byte, docval qvalue.AnnotatedValue, fns []interface{},
+	encodeBuf []byte, coll *collatejson.Collation) ([]byte, []byte, error) {
+
+	doc, err := docval.MarshalJSON()
+	if err != nil {
+		return nil, nil, err
+	}
+	// XATTRs are not parsed for JavaScript expressions.
+	attachment, _ := docval.GetAttachment("meta").(map[string]interface{})
+	jsMeta := make(map[string]interface{}, len(attachment))
+	for key, value := range attachment {
+		if key != "xattrs" {
+			jsMeta[key] = value
+		}
+	}
+	meta, err := json.Marshal(jsMeta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	arrValue := make([]interface{}, 0, len(fns))
+	skip := true
+	for _, fn := range fns {
+		out, err := fn.(*JSFunction).Call(doc, meta)
+		if err != nil {
+			return nil, nil, err
+		} else if out == nil && skip { // leading key is missing
+			return nil, nil, nil
+		} else if out == nil {
+			arrValue = append(arrValue, qvalue.NewMissingValue())
+			continue
+		}
+		skip = false
+		arrValue = append(arrValue, qvalue.NewValue(out))
+	}
+	return encodeKey(docid, len(fns), arrValue, encodeBuf, coll)
+}
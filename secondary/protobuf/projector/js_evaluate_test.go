@@ -0,0 +1,68 @@
+package protobuf
+
+import (
+	"testing"
+	"time"
+
+	qvalue "github.com/couchbase/query/value"
+)
+
+func TestJSTransform(t *testing.T) {
+	fns, err := CompileJSExpression([]string{
+		`function (doc) { return doc["first-name"].toUpperCase(); }`,
+		`function (doc, meta) { return meta.id; }`,
+		`function (doc) { return doc.missing; }`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docval := qvalue.NewAnnotatedValue(qvalue.NewParsedValue(doc150, true))
+	docval.SetAttachment("meta", map[string]interface{}{"id": "user-1"})
+	out, _, err := JSTransform([]byte("user-1"), docval, fns, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(out) != `["DANIEL","user-1"]` {
+		t.Errorf("Expected key, received %s", out)
+	}
+
+	// leading key is missing
+	out, _, err = JSTransform([]byte("user-1"), docval, fns[2:], nil, nil)
+	if err != nil || out != nil {
+		t.Errorf("Expected missing key, received %s %v", out, err)
+	}
+}
+
+func TestJSFunction(t *testing.T) {
+	if _, err := NewJSFunction(`function (doc) { return `); err == nil {
+		t.Errorf("Expected compile error")
+	}
+	if _, err := NewJSFunction(`"not a function"`); err == nil {
+		t.Errorf("Expected error for expression that is not a function")
+	}
+
+	// sandbox
+	fn, err := NewJSFunction(`function (doc) { console.log(doc); return 1; }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fn.Call([]byte(`{}`), []byte(`{}`)); err == nil {
+		t.Errorf("Expected console to be unavailable")
+	}
+
+	// time limit
+	SetJSTimeout(10 * time.Millisecond)
+	defer SetJSTimeout(100 * time.Millisecond)
+	fn, err = NewJSFunction(`function (doc) { while (true) {} }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fn.Call([]byte(`{}`), []byte(`{}`)); err != ErrorJSTimeout {
+		t.Errorf("Expected %v, received %v", ErrorJSTimeout, err)
+	}
+	// time limit when evaluating the source
+	src := `(function () { while (true) {} })()`
+	if _, err := NewJSFunction(src); err != ErrorJSTimeout {
+		t.Errorf("Expected %v, received %v", ErrorJSTimeout, err)
+	}
+}
@@ -31,12 +31,36 @@ func N1QLTransform(
 	docid []byte, docval qvalue.AnnotatedValue, cExprs []interface{},
 	encodeBuf []byte) ([]byte, []byte, error) {
 
+	return N1QLTransformCollated(docid, docval, cExprs, encodeBuf, nil)
+}
+
+// N1QLTransformCollated is same as N1QLTransform, except that strings in
+// the collated JSON key are ordered by collation `coll`, if not nil.
+func N1QLTransformCollated(
+	docid []byte, docval qvalue.AnnotatedValue, cExprs []interface{},
+	encodeBuf []byte, coll *collatejson.Collation) ([]byte, []byte, error) {
+
+	return n1qlTransform(docid, docval, cExprs, nil, encodeBuf, coll, nil)
+}
+
+// n1qlTransform is same as N1QLTransformCollated, except that values of
+// the expressions, identified by `exprKeys`, are memoized in the shared
+// evaluation context `doc` of the document, if not nil.
+func n1qlTransform(
+	docid []byte, docval qvalue.AnnotatedValue, cExprs []interface{},
+	exprKeys []string, encodeBuf []byte, coll *collatejson.Collation,
+	doc *evalDoc) ([]byte, []byte, error) {
+
 	arrValue := make([]interface{}, 0, len(cExprs))
 	context := qexpr.NewIndexContext()
 	skip := true
-	for _, cExpr := range cExprs {
+	for i, cExpr := range cExprs {
 		expr := cExpr.(qexpr.Expression)
-		scalar, vector, err := expr.EvaluateForIndex(docval, context)
+		exprKey := ""
+		if exprKeys != nil {
+			exprKey = exprKeys[i]
+		}
+		scalar, vector, err := doc.evaluate(expr, exprKey, docval, context)
 		if err != nil {
 			exprstr := qexpr.NewStringer().Visit(expr)
 			fmsg := "EvaluateForIndex(%q) for docid %v, err: %v skip document"
@@ -93,7 +117,15 @@ func N1QLTransform(
 		}
 	}
 
-	if len(cExprs) == 1 && len(arrValue) == 1 && docid == nil {
+	return encodeKey(docid, len(cExprs), arrValue, encodeBuf, coll)
+}
+
+// encodeKey returns the values of `nExprs` expressions as secondary key.
+func encodeKey(
+	docid []byte, nExprs int, arrValue []interface{}, encodeBuf []byte,
+	coll *collatejson.Collation) ([]byte, []byte, error) {
+
+	if nExprs == 1 && len(arrValue) == 1 && docid == nil {
 		// used for partition-key evaluation and where predicate.
 		// Marshal partition-key and where as a basic JSON data-type.
 		out, err := qvalue.NewValue(arrValue[0]).MarshalJSON()
@@ -110,7 +142,7 @@ func N1QLTransform(
 		//    arrValue = append(arrValue, qvalue.NewValue(string(docid)))
 		//}
 		if encodeBuf != nil {
-			out, newBuf, err := CollateJSONEncode(qvalue.NewValue(arrValue), encodeBuf)
+			out, newBuf, err := collateJSONEncode(qvalue.NewValue(arrValue), encodeBuf, coll)
 			if err != nil {
 				fmsg := "CollateJSONEncode: index field for docid: %s (err: %v) skip document"
 				arg1 := logging.TagUD(docid)
@@ -130,7 +162,14 @@ func N1QLTransform(
 }
 
 func CollateJSONEncode(val qvalue.Value, encodeBuf []byte) ([]byte, []byte, error) {
+	return collateJSONEncode(val, encodeBuf, nil)
+}
+
+func collateJSONEncode(val qvalue.Value, encodeBuf []byte,
+	coll *collatejson.Collation) ([]byte, []byte, error) {
+
 	codec := collatejson.NewCodec(16)
+	codec.SortbyCollation(coll)
 	encoded, err := codec.EncodeN1QLValue(val, encodeBuf[:0])
 
 	if err != nil && err.Error() == collatejson.ErrorOutputLen.Error() {
@@ -138,7 +177,11 @@ func CollateJSONEncode(val qvalue.Value, encodeBuf []byte) ([]byte, []byte, erro
 		if e1 != nil {
 			return append([]byte(nil), encoded...), nil, err
 		}
-		newBuf := make([]byte, 0, len(valBytes)*3)
+		factor := 3
+		if coll != nil {
+			factor = collatejson.CollatedBufferFactor
+		}
+		newBuf := make([]byte, 0, len(valBytes)*factor)
 		enc, e2 := codec.EncodeN1QLValue(val, newBuf)
 		return append([]byte(nil), enc...), newBuf, e2
 	}
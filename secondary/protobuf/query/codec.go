@@ -36,6 +36,9 @@ func ProtobufEncodeInBuf(payload interface{}, buf []byte) (data []byte, err erro
 	case *ScanAllRequest:
 		pl.ScanAllRequest = val
 
+	case *IntersectScanRequest:
+		pl.IntersectScanRequest = val
+
 	case *EndStreamRequest:
 		pl.EndStream = val
 
@@ -93,6 +96,8 @@ func ProtobufDecode(data []byte) (value interface{}, err error) {
 		return val, nil
 	} else if val := pl.GetScanAllRequest(); val != nil {
 		return val, nil
+	} else if val := pl.GetIntersectScanRequest(); val != nil {
+		return val, nil
 	} else if val := pl.GetEndStream(); val != nil {
 		return val, nil
 		// response
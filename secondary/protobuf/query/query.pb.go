@@ -6,9 +6,11 @@
 Package protobuf is a generated protocol buffer package.
 
 It is generated from these files:
+
 	query.proto
 
 It has these top-level messages:
+
 	Error
 	TsConsistency
 	QueryPayload
@@ -70,6 +72,7 @@ type TsConsistency struct {
 	Seqnos           []uint64 `protobuf:"varint,2,rep,name=seqnos" json:"seqnos,omitempty"`
 	Vbuuids          []uint64 `protobuf:"varint,3,rep,name=vbuuids" json:"vbuuids,omitempty"`
 	Crc64            *uint64  `protobuf:"varint,4,opt,name=crc64" json:"crc64,omitempty"`
+	Staleness        *int64   `protobuf:"varint,5,opt,name=staleness" json:"staleness,omitempty"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -105,21 +108,29 @@ func (m *TsConsistency) GetCrc64() uint64 {
 	return 0
 }
 
+func (m *TsConsistency) GetStaleness() int64 {
+	if m != nil && m.Staleness != nil {
+		return *m.Staleness
+	}
+	return 0
+}
+
 // Request can be one of the optional field.
 type QueryPayload struct {
-	Version           *uint32             `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
-	StatisticsRequest *StatisticsRequest  `protobuf:"bytes,2,opt,name=statisticsRequest" json:"statisticsRequest,omitempty"`
-	Statistics        *StatisticsResponse `protobuf:"bytes,3,opt,name=statistics" json:"statistics,omitempty"`
-	ScanRequest       *ScanRequest        `protobuf:"bytes,4,opt,name=scanRequest" json:"scanRequest,omitempty"`
-	ScanAllRequest    *ScanAllRequest     `protobuf:"bytes,5,opt,name=scanAllRequest" json:"scanAllRequest,omitempty"`
-	Stream            *ResponseStream     `protobuf:"bytes,6,opt,name=stream" json:"stream,omitempty"`
-	CountRequest      *CountRequest       `protobuf:"bytes,7,opt,name=countRequest" json:"countRequest,omitempty"`
-	CountResponse     *CountResponse      `protobuf:"bytes,8,opt,name=countResponse" json:"countResponse,omitempty"`
-	EndStream         *EndStreamRequest   `protobuf:"bytes,9,opt,name=endStream" json:"endStream,omitempty"`
-	StreamEnd         *StreamEndResponse  `protobuf:"bytes,10,opt,name=streamEnd" json:"streamEnd,omitempty"`
-	HeloRequest       *HeloRequest        `protobuf:"bytes,11,opt,name=heloRequest" json:"heloRequest,omitempty"`
-	HeloResponse      *HeloResponse       `protobuf:"bytes,12,opt,name=heloResponse" json:"heloResponse,omitempty"`
-	XXX_unrecognized  []byte              `json:"-"`
+	Version              *uint32               `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
+	StatisticsRequest    *StatisticsRequest    `protobuf:"bytes,2,opt,name=statisticsRequest" json:"statisticsRequest,omitempty"`
+	Statistics           *StatisticsResponse   `protobuf:"bytes,3,opt,name=statistics" json:"statistics,omitempty"`
+	ScanRequest          *ScanRequest          `protobuf:"bytes,4,opt,name=scanRequest" json:"scanRequest,omitempty"`
+	ScanAllRequest       *ScanAllRequest       `protobuf:"bytes,5,opt,name=scanAllRequest" json:"scanAllRequest,omitempty"`
+	Stream               *ResponseStream       `protobuf:"bytes,6,opt,name=stream" json:"stream,omitempty"`
+	CountRequest         *CountRequest         `protobuf:"bytes,7,opt,name=countRequest" json:"countRequest,omitempty"`
+	CountResponse        *CountResponse        `protobuf:"bytes,8,opt,name=countResponse" json:"countResponse,omitempty"`
+	EndStream            *EndStreamRequest     `protobuf:"bytes,9,opt,name=endStream" json:"endStream,omitempty"`
+	StreamEnd            *StreamEndResponse    `protobuf:"bytes,10,opt,name=streamEnd" json:"streamEnd,omitempty"`
+	HeloRequest          *HeloRequest          `protobuf:"bytes,11,opt,name=heloRequest" json:"heloRequest,omitempty"`
+	HeloResponse         *HeloResponse         `protobuf:"bytes,12,opt,name=heloResponse" json:"heloResponse,omitempty"`
+	IntersectScanRequest *IntersectScanRequest `protobuf:"bytes,13,opt,name=intersectScanRequest" json:"intersectScanRequest,omitempty"`
+	XXX_unrecognized     []byte                `json:"-"`
 }
 
 func (m *QueryPayload) Reset()         { *m = QueryPayload{} }
@@ -210,6 +221,13 @@ func (m *QueryPayload) GetHeloResponse() *HeloResponse {
 	return nil
 }
 
+func (m *QueryPayload) GetIntersectScanRequest() *IntersectScanRequest {
+	if m != nil {
+		return m.IntersectScanRequest
+	}
+	return nil
+}
+
 // Get current server version/capabilities
 type HeloRequest struct {
 	Version          *uint32 `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
@@ -317,6 +335,11 @@ type ScanRequest struct {
 	PartitionIds     []uint64         `protobuf:"varint,13,rep,name=partitionIds" json:"partitionIds,omitempty"`
 	GroupAggr        *GroupAggr       `protobuf:"bytes,14,opt,name=groupAggr" json:"groupAggr,omitempty"`
 	Sorted           *bool            `protobuf:"varint,15,opt,name=sorted" json:"sorted,omitempty"`
+	WithContinuation *bool            `protobuf:"varint,16,opt,name=withContinuation" json:"withContinuation,omitempty"`
+	Continuation     []byte           `protobuf:"bytes,17,opt,name=continuation" json:"continuation,omitempty"`
+	AsOfTime         *int64           `protobuf:"varint,18,opt,name=asOfTime" json:"asOfTime,omitempty"`
+	AsOfVector       *TsConsistency   `protobuf:"bytes,19,opt,name=asOfVector" json:"asOfVector,omitempty"`
+	Priority         *uint32          `protobuf:"varint,20,opt,name=priority" json:"priority,omitempty"`
 	XXX_unrecognized []byte           `json:"-"`
 }
 
@@ -429,6 +452,41 @@ func (m *ScanRequest) GetSorted() bool {
 	return false
 }
 
+func (m *ScanRequest) GetWithContinuation() bool {
+	if m != nil && m.WithContinuation != nil {
+		return *m.WithContinuation
+	}
+	return false
+}
+
+func (m *ScanRequest) GetContinuation() []byte {
+	if m != nil {
+		return m.Continuation
+	}
+	return nil
+}
+
+func (m *ScanRequest) GetAsOfTime() int64 {
+	if m != nil && m.AsOfTime != nil {
+		return *m.AsOfTime
+	}
+	return 0
+}
+
+func (m *ScanRequest) GetAsOfVector() *TsConsistency {
+	if m != nil {
+		return m.AsOfVector
+	}
+	return nil
+}
+
+func (m *ScanRequest) GetPriority() uint32 {
+	if m != nil && m.Priority != nil {
+		return *m.Priority
+	}
+	return 0
+}
+
 // Full table scan request from indexer.
 type ScanAllRequest struct {
 	DefnID           *uint64        `protobuf:"varint,1,req,name=defnID" json:"defnID,omitempty"`
@@ -438,6 +496,7 @@ type ScanAllRequest struct {
 	RequestId        *string        `protobuf:"bytes,5,opt,name=requestId" json:"requestId,omitempty"`
 	RollbackTime     *int64         `protobuf:"varint,6,opt,name=rollbackTime" json:"rollbackTime,omitempty"`
 	PartitionIds     []uint64       `protobuf:"varint,7,rep,name=partitionIds" json:"partitionIds,omitempty"`
+	Priority         *uint32        `protobuf:"varint,8,opt,name=priority" json:"priority,omitempty"`
 	XXX_unrecognized []byte         `json:"-"`
 }
 
@@ -494,6 +553,82 @@ func (m *ScanAllRequest) GetPartitionIds() []uint64 {
 	return nil
 }
 
+func (m *ScanAllRequest) GetPriority() uint32 {
+	if m != nil && m.Priority != nil {
+		return *m.Priority
+	}
+	return 0
+}
+
+// Intersect (or union) the document ids of scans on indexes of the
+// same bucket, hosted by the same indexer. Only defnID, span, scans,
+// rollbackTime and partitionIds of the index scans are used. Scans of
+// the same index (e.g. different partitions) are unioned first. Primary
+// keys are returned in sorted order without secondary keys.
+type IntersectScanRequest struct {
+	IndexScans       []*ScanRequest `protobuf:"bytes,1,rep,name=indexScans" json:"indexScans,omitempty"`
+	Union            *bool          `protobuf:"varint,2,req,name=union" json:"union,omitempty"`
+	Cons             *uint32        `protobuf:"varint,3,req,name=cons" json:"cons,omitempty"`
+	Vector           *TsConsistency `protobuf:"bytes,4,opt,name=vector" json:"vector,omitempty"`
+	RequestId        *string        `protobuf:"bytes,5,opt,name=requestId" json:"requestId,omitempty"`
+	Limit            *int64         `protobuf:"varint,6,opt,name=limit" json:"limit,omitempty"`
+	Priority         *uint32        `protobuf:"varint,7,opt,name=priority" json:"priority,omitempty"`
+	XXX_unrecognized []byte         `json:"-"`
+}
+
+func (m *IntersectScanRequest) Reset()         { *m = IntersectScanRequest{} }
+func (m *IntersectScanRequest) String() string { return proto.CompactTextString(m) }
+func (*IntersectScanRequest) ProtoMessage()    {}
+
+func (m *IntersectScanRequest) GetIndexScans() []*ScanRequest {
+	if m != nil {
+		return m.IndexScans
+	}
+	return nil
+}
+
+func (m *IntersectScanRequest) GetUnion() bool {
+	if m != nil && m.Union != nil {
+		return *m.Union
+	}
+	return false
+}
+
+func (m *IntersectScanRequest) GetCons() uint32 {
+	if m != nil && m.Cons != nil {
+		return *m.Cons
+	}
+	return 0
+}
+
+func (m *IntersectScanRequest) GetVector() *TsConsistency {
+	if m != nil {
+		return m.Vector
+	}
+	return nil
+}
+
+func (m *IntersectScanRequest) GetRequestId() string {
+	if m != nil && m.RequestId != nil {
+		return *m.RequestId
+	}
+	return ""
+}
+
+func (m *IntersectScanRequest) GetLimit() int64 {
+	if m != nil && m.Limit != nil {
+		return *m.Limit
+	}
+	return 0
+}
+
+func (m *IntersectScanRequest) GetPriority() uint32 {
+	if m != nil && m.Priority != nil {
+		return *m.Priority
+	}
+	return 0
+}
+
 // Request by client to stop streaming the query results.
 type EndStreamRequest struct {
 	XXX_unrecognized []byte `json:"-"`
@@ -506,6 +641,7 @@ func (*EndStreamRequest) ProtoMessage()    {}
 type ResponseStream struct {
 	IndexEntries     []*IndexEntry `protobuf:"bytes,1,rep,name=indexEntries" json:"indexEntries,omitempty"`
 	Err              *Error        `protobuf:"bytes,2,opt,name=err" json:"err,omitempty"`
+	Continuation     []byte        `protobuf:"bytes,3,opt,name=continuation" json:"continuation,omitempty"`
 	XXX_unrecognized []byte        `json:"-"`
 }
 
@@ -527,6 +663,13 @@ func (m *ResponseStream) GetErr() *Error {
 	return nil
 }
 
+func (m *ResponseStream) GetContinuation() []byte {
+	if m != nil {
+		return m.Continuation
+	}
+	return nil
+}
+
 // Last response packet sent by server to end query results.
 type StreamEndResponse struct {
 	Err              *Error `protobuf:"bytes,1,opt,name=err" json:"err,omitempty"`
@@ -555,6 +698,7 @@ type CountRequest struct {
 	Scans            []*Scan        `protobuf:"bytes,7,rep,name=scans" json:"scans,omitempty"`
 	RollbackTime     *int64         `protobuf:"varint,8,opt,name=rollbackTime" json:"rollbackTime,omitempty"`
 	PartitionIds     []uint64       `protobuf:"varint,9,rep,name=partitionIds" json:"partitionIds,omitempty"`
+	Priority         *uint32        `protobuf:"varint,10,opt,name=priority" json:"priority,omitempty"`
 	XXX_unrecognized []byte         `json:"-"`
 }
 
@@ -625,6 +769,13 @@ func (m *CountRequest) GetPartitionIds() []uint64 {
 	return nil
 }
 
+func (m *CountRequest) GetPriority() uint32 {
+	if m != nil && m.Priority != nil {
+		return *m.Priority
+	}
+	return 0
+}
+
 // total number of entries in index.
 type CountResponse struct {
 	Count            *int64 `protobuf:"varint,1,req,name=count" json:"count,omitempty"`
@@ -73,7 +73,7 @@ func ParseArgs(arguments []string) (*Command, []string, *flag.FlagSet, error) {
 	fset.StringVar(&cmdOptions.Server, "server", "127.0.0.1:8091", "Cluster server address")
 	fset.StringVar(&cmdOptions.Auth, "auth", "", "Auth user and password")
 	fset.StringVar(&cmdOptions.Bucket, "bucket", "", "Bucket name")
-	fset.StringVar(&cmdOptions.OpType, "type", "", "Command: scan|stats|scanAll|count|nodes|create|build|move|drop|list|config")
+	fset.StringVar(&cmdOptions.OpType, "type", "", "Command: scan|stats|scanAll|count|nodes|create|build|move|drop|list|config|checkReplicas")
 	fset.StringVar(&cmdOptions.IndexName, "index", "", "Index name")
 	// options for create-index
 	fset.StringVar(&cmdOptions.WhereStr, "where", "", "where clause for create index")
@@ -376,6 +376,17 @@ func HandleCommand(
 			}
 		}
 
+	case "checkReplicas":
+		index, ok := GetIndex(client, cmd.Bucket, cmd.IndexName)
+		if !ok {
+			return fmt.Errorf("invalid index specified : %v", cmd.IndexName)
+		}
+		report, err := client.CheckReplicas(uint64(index.Definition.DefnId))
+		if err != nil {
+			return err
+		}
+		printReplicaCheckReport(w, report)
+
 	case "config":
 		nodes, err := client.Nodes()
 		if err != nil {
@@ -466,6 +477,27 @@ func printIndexInfo(w io.Writer, index *mclient.IndexMetadata) {
 	}
 }
 
+func printReplicaCheckReport(w io.Writer, report *c.ReplicaCheckReport) {
+	fmt.Fprintf(w, "Index:%s/%s, Id:%v, Replicas:%v, Partitions:%v\n",
+		report.Bucket, report.Name, report.DefnId, report.Replicas,
+		report.Partitions)
+	for _, skipped := range report.Skipped {
+		fmt.Fprintf(w, "    Skipped: %s\n", skipped)
+	}
+	if report.Consistent {
+		fmt.Fprintln(w, "    Replicas are consistent")
+		return
+	}
+	fmt.Fprintf(w, "    Replicas differ in %v entries:\n", len(report.Diffs))
+	for _, diff := range report.Diffs {
+		fmt.Fprintf(w, "    Partition:%v, Key:%s, DocId:%q, Found in replicas:%v\n",
+			diff.PartnId, diff.Key, diff.DocId, diff.Replicas)
+	}
+	if report.Truncated {
+		fmt.Fprintln(w, "    (more differences not reported)")
+	}
+}
+
 // GetIndex for bucket/indexName.
 func GetIndex(
 	client *qclient.GsiClient,
@@ -591,6 +623,10 @@ func validate(cmd *Command, fset *flag.FlagSet) error {
 		have = []string{"type", "server", "auth", "index", "bucket"}
 		dont = []string{"h", "where", "fields", "primary", "with", "indexes", "ckey", "cval"}
 
+	case "checkReplicas":
+		have = []string{"type", "server", "auth", "index", "bucket"}
+		dont = []string{"h", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "limit", "distinct", "ckey", "cval"}
+
 	case "config":
 		have = []string{"type", "server", "auth"}
 		dont = []string{"h", "index", "bucket", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "limit", "distinct"}
@@ -233,6 +233,14 @@ func (b *cbqClient) GetScanport(
 	return []string{b.queryport}, defnID, nil, []int64{math.MaxInt64}, nil, 0, true
 }
 
+// GetHedgeScanport implement BridgeAccessor{} interface.
+func (b *cbqClient) GetHedgeScanport(
+	defnID uint64, instID uint64, partitions []common.PartitionId) (queryport string,
+	targetInstID uint64, rollbackTime int64, ok bool) {
+
+	return "", 0, 0, false
+}
+
 // GetIndexDefn implements BridgeAccessor{} interface.
 func (b *cbqClient) GetIndexDefn(defnID uint64) *common.IndexDefn {
 	panic("cbqClient does not implement GetIndexDefn")
@@ -243,6 +251,11 @@ func (b *cbqClient) GetIndexInst(instId uint64) *mclient.InstanceDefn {
 	panic("cbqClient does not implement GetIndexInst")
 }
 
+// CheckReplicas implements BridgeAccessor{} interface.
+func (b *cbqClient) CheckReplicas(defnID uint64) (*common.ReplicaCheckReport, error) {
+	panic("cbqClient does not implement CheckReplicas")
+}
+
 // GetIndexReplica implements BridgeAccessor{} interface.
 func (b *cbqClient) GetIndexReplica(defnId uint64) []*mclient.InstanceDefn {
 	panic("cbqClient does not implement GetIndexReplica")
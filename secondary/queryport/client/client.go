@@ -45,6 +45,13 @@ type ResponseReader interface {
 	Error() error
 }
 
+// ContinuationReader is implemented by responses that carry a
+// continuation token, which can be used to resume the scan right
+// after the last entry received.
+type ContinuationReader interface {
+	GetContinuation() []byte
+}
+
 // ResponseSender is responsible for forwarding result to the client
 // after streams from multiple servers/ResponseHandler have been merged.
 // mskey - marshalled sec key (as Value)
@@ -199,6 +206,13 @@ type BridgeAccessor interface {
 		skips map[common.IndexDefnId]bool) (queryport []string, targetDefnID uint64, targetInstID []uint64,
 		rollbackTime []int64, partition [][]common.PartitionId, numPartitions uint32, ok bool)
 
+	// GetHedgeScanport shall fetch queryport address of a replica,
+	// other than `instID`, that hosts all of the given partitions on
+	// a single indexer.  It is used for hedging scan requests.
+	GetHedgeScanport(
+		defnID uint64, instID uint64, partitions []common.PartitionId) (queryport string,
+		targetInstID uint64, rollbackTime int64, ok bool)
+
 	// GetIndexDefn will return the index-definition structure for defnID.
 	GetIndexDefn(defnID uint64) *common.IndexDefn
 
@@ -217,6 +231,10 @@ type BridgeAccessor interface {
 	//Return the number of replica and equivalent indexes
 	NumReplica(defnID uint64) int
 
+	// CheckReplicas compares the replicas of index `defnID` at a
+	// common timestamp and reports the entries that differ.
+	CheckReplicas(defnID uint64) (*common.ReplicaCheckReport, error)
+
 	// Timeit will add `value` to incrementalAvg for index-load.
 	Timeit(instID uint64, partitionId common.PartitionId, value float64)
 
@@ -367,6 +385,7 @@ type GsiClient struct {
 	bucketHash   unsafe.Pointer // map[string]uint64 // bucket -> crc64
 	metaCh       chan bool      // listen to metadata changes
 	settings     *ClientSettings
+	hedger       *scanHedger
 	killch       chan bool
 }
 
@@ -546,6 +565,18 @@ func (c *GsiClient) DropIndex(defnID uint64) error {
 	return err
 }
 
+// CheckReplicas implements BridgeAccessor{} interface.
+func (c *GsiClient) CheckReplicas(defnID uint64) (*common.ReplicaCheckReport, error) {
+	if c.bridge == nil {
+		return nil, ErrorClientUninitialized
+	}
+	begin := time.Now()
+	report, err := c.bridge.CheckReplicas(defnID)
+	fmsg := "CheckReplicas %v - elapsed(%v), err(%v)"
+	logging.Infof(fmsg, defnID, time.Since(begin), err)
+	return report, err
+}
+
 // LookupStatistics for a single secondary-key.
 func (c *GsiClient) LookupStatistics(
 	defnID uint64, requestId string, value common.SecondaryKey) (common.IndexStatistics, error) {
@@ -725,7 +756,8 @@ func (c *GsiClient) ScanAllInternal(
 		if err != nil {
 			return err, false
 		}
-		return qc.ScanAll(uint64(index.DefnId), requestId, broker.GetLimit(), cons, vector, handler, rollbackTime, partitions)
+		return qc.ScanAll(uint64(index.DefnId), requestId, broker.GetLimit(), cons, vector, handler, rollbackTime, partitions,
+			broker.getScanOptions().priority)
 	}
 
 	broker.SetScanRequestHandler(handler)
@@ -848,11 +880,11 @@ func (c *GsiClient) CountLookupInternal(
 			}
 
 			count, err = qc.CountLookupPrimary(
-				uint64(index.DefnId), requestId, equals, cons, vector, rollbackTime, partitions)
+				uint64(index.DefnId), requestId, equals, cons, vector, rollbackTime, partitions, broker.getScanOptions().priority)
 			return count, err, false
 		}
 
-		count, err = qc.CountLookup(uint64(index.DefnId), requestId, values, cons, vector, rollbackTime, partitions)
+		count, err = qc.CountLookup(uint64(index.DefnId), requestId, values, cons, vector, rollbackTime, partitions, broker.getScanOptions().priority)
 		return count, err, false
 	}
 
@@ -917,12 +949,12 @@ func (c *GsiClient) CountRangeInternal(
 				}
 			}
 			count, err = qc.CountRangePrimary(
-				uint64(index.DefnId), requestId, l, h, inclusion, cons, vector, rollbackTime, partitions)
+				uint64(index.DefnId), requestId, l, h, inclusion, cons, vector, rollbackTime, partitions, broker.getScanOptions().priority)
 			return count, err, false
 		}
 
 		count, err = qc.CountRange(
-			uint64(index.DefnId), requestId, low, high, inclusion, cons, vector, rollbackTime, partitions)
+			uint64(index.DefnId), requestId, low, high, inclusion, cons, vector, rollbackTime, partitions, broker.getScanOptions().priority)
 		return count, err, false
 	}
 
@@ -970,12 +1002,12 @@ func (c *GsiClient) MultiScanCountInternal(
 		}
 		if c.bridge.IsPrimary(uint64(index.DefnId)) {
 			count, err = qc.MultiScanCountPrimary(
-				uint64(index.DefnId), requestId, scans, distinct, cons, vector, rollbackTime, partitions)
+				uint64(index.DefnId), requestId, scans, distinct, cons, vector, rollbackTime, partitions, broker.getScanOptions().priority)
 			return count, err, false
 		}
 
 		count, err = qc.MultiScanCount(
-			uint64(index.DefnId), requestId, scans, distinct, cons, vector, rollbackTime, partitions)
+			uint64(index.DefnId), requestId, scans, distinct, cons, vector, rollbackTime, partitions, broker.getScanOptions().priority)
 		return count, err, false
 	}
 
@@ -1000,6 +1032,36 @@ func (c *GsiClient) Scan3(
 		projection, offset, limit, groupAggr, indexOrder, cons, vector, broker)
 }
 
+// Scan3WithContinuation scans the index like Scan3, and keeps track of
+// the continuation token returned with each response.  If continuation
+// is not nil, the scan resumes right after the entry the token was
+// returned for, on the snapshot of the scan that returned it.  Offset
+// and limit apply to the scan as a whole, across resumes.
+//
+// The token of the last response accepted by callb is returned, also
+// when the scan fails, and can be passed to a later call to continue
+// the scan.  The scan is resumed automatically, up to retryScanResume
+// times, if its connection to the indexer is lost.  Continuation is not
+// supported for scans served by more than one indexer node, or with
+// group aggregates.
+func (c *GsiClient) Scan3WithContinuation(
+	defnID uint64, requestId string, scans Scans, reverse,
+	distinct bool, projection *IndexProjection, offset, limit int64,
+	groupAggr *GroupAggr, indexOrder *IndexKeyOrder,
+	cons common.Consistency, vector *TsConsistency,
+	continuation []byte, callb ResponseHandler) (lastContinuation []byte, err error) {
+
+	broker := makeDefaultRequestBroker(callb)
+	broker.SetContinuation(continuation)
+	err = c.Scan3Internal(defnID, requestId, scans, reverse, distinct,
+		projection, offset, limit, groupAggr, indexOrder, cons, vector, broker)
+
+	if lastContinuation = broker.LastContinuation(); lastContinuation == nil {
+		lastContinuation = continuation
+	}
+	return lastContinuation, err
+}
+
 func (c *GsiClient) Scan3Internal(
 	defnID uint64, requestId string, scans Scans, reverse,
 	distinct bool, projection *IndexProjection, offset, limit int64,
@@ -1027,15 +1089,22 @@ func (c *GsiClient) Scan3Internal(
 			return err, false
 		}
 
+		opts := broker.getScanOptions()
+		if opts.withContinuation {
+			handler = broker.trackContinuation(handler)
+		}
+
 		if c.bridge.IsPrimary(uint64(index.DefnId)) {
 			return qc.Scan3Primary(
 				uint64(index.DefnId), requestId, scans, reverse, distinct,
-				projection, broker.GetOffset(), broker.GetLimit(), groupAggr, broker.GetSorted(), cons, vector, handler, rollbackTime, partitions)
+				projection, broker.GetOffset(), broker.GetLimit(), groupAggr, broker.GetSorted(), cons, vector, handler, rollbackTime, partitions,
+				opts)
 		}
 
 		return qc.Scan3(
 			uint64(index.DefnId), requestId, scans, reverse, distinct,
-			projection, broker.GetOffset(), broker.GetLimit(), groupAggr, broker.GetSorted(), cons, vector, handler, rollbackTime, partitions)
+			projection, broker.GetOffset(), broker.GetLimit(), groupAggr, broker.GetSorted(), cons, vector, handler, rollbackTime, partitions,
+			opts)
 	}
 
 	broker.SetScanRequestHandler(handler)
@@ -1090,6 +1159,16 @@ func (c *GsiClient) Close() {
 	close(c.killch)
 }
 
+// HedgeStats returns the number of scan requests hedged to
+// another replica, and the number of times the hedge has responded
+// first.
+func (c *GsiClient) HedgeStats() (fired int64, won int64) {
+	if c.hedger == nil {
+		return 0, 0
+	}
+	return c.hedger.stats()
+}
+
 func (c *GsiClient) updateScanClients() {
 	newclients, staleclients := map[string]bool{}, map[string]bool{}
 	cache := map[string]bool{}
@@ -1210,6 +1289,8 @@ func (c *GsiClient) doScan(defnID uint64, requestId string, broker *RequestBroke
 	var err error
 
 	broker.SetResponseTimer(c.bridge.Timeit)
+	broker.setHedger(c.hedger, c.bridge.GetHedgeScanport)
+	broker.setResumeRetry(c.config["retryScanResume"].Int())
 	skips := make(map[common.IndexDefnId]bool)
 
 	wait := c.config["retryIntervalScanport"].Int()
@@ -1340,6 +1421,11 @@ func (c *GsiClient) getConsistency(
 		} else {
 			vector = nil
 		}
+	} else if cons == common.BoundedStalenessConsistency {
+		if vector == nil || vector.Staleness <= 0 {
+			return nil, ErrorExpectedStaleness
+		}
+		return vector, nil
 	} else if cons == common.AnyConsistency {
 		vector = nil
 	} else {
@@ -1401,6 +1487,7 @@ func makeWithMetaProvider(
 		settings:     NewClientSettings(needRefresh),
 		killch:       make(chan bool, 1),
 	}
+	c.hedger = newScanHedger(c.settings)
 	atomic.StorePointer(&c.bucketHash, (unsafe.Pointer)(new(map[string]uint64)))
 	c.bridge, err = newMetaBridgeClient(cluster, config, c.metaCh, c.settings)
 	if err != nil {
@@ -1431,12 +1518,14 @@ func (c *GsiClient) listenMetaChange(killch chan bool) {
 //
 // Timestamp-vector will be ignored for AnyConsistency, computed
 // locally by scan-coordinator or accepted as scan-arguments for
-// SessionConsistency.
+// SessionConsistency. For BoundedStalenessConsistency only the
+// Staleness is considered.
 type TsConsistency struct {
-	Vbnos   []uint16
-	Seqnos  []uint64
-	Vbuuids []uint64
-	Crc64   uint64
+	Vbnos     []uint16
+	Seqnos    []uint64
+	Vbuuids   []uint64
+	Crc64     uint64
+	Staleness time.Duration
 }
 
 // NewTsConsistency returns a new consistency vector object.
@@ -1446,6 +1535,14 @@ func NewTsConsistency(
 	return &TsConsistency{Vbnos: vbnos, Seqnos: seqnos, Vbuuids: vbuuids}
 }
 
+// NewStalenessConsistency returns a consistency vector object for
+// BoundedStalenessConsistency, scan results will include all the
+// mutations received by the indexer until `staleness` ago.
+func NewStalenessConsistency(staleness time.Duration) *TsConsistency {
+
+	return &TsConsistency{Staleness: staleness}
+}
+
 // Override vbucket's {seqno, vbuuid} in the timestamp-vector,
 // if vbucket is not present in the vector, append them to vector.
 func (ts *TsConsistency) Override(
@@ -1508,6 +1605,16 @@ func isgone(scan_err error) bool {
 	return false
 }
 
+// isConnectionLost returns true if a scan failed because its connection
+// to the indexer was closed or broken.
+func isConnectionLost(scan_err error) bool {
+	if isgone(scan_err) || scan_err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := scan_err.(net.Error)
+	return ok
+}
+
 func getScanError(errMap map[common.PartitionId]map[uint64]error) error {
 
 	if len(errMap) == 0 {
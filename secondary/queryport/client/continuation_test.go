@@ -0,0 +1,257 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+	"github.com/couchbase/indexing/secondary/transport"
+	"github.com/golang/protobuf/proto"
+)
+
+// testContinuationIndexer serves scans over rows, in batches of batchSize
+// rows.  Each batch carries a continuation token, the number of rows
+// returned so far, except the last one.  The connection is dropped after
+// the first batch of the next drops scan requests.
+type testContinuationIndexer struct {
+	lis       net.Listener
+	rows      int
+	batchSize int
+
+	mu            sync.Mutex
+	drops         int
+	continuations [][]byte
+}
+
+func newTestContinuationIndexer(t *testing.T, rows, batchSize, drops int) *testContinuationIndexer {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testContinuationIndexer{lis: lis, rows: rows, batchSize: batchSize, drops: drops}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testContinuationIndexer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	flags := transport.TransportFlag(0).SetProtobuf()
+	rpkt := transport.NewTransportPacket(1024*1024, flags)
+	rpkt.SetDecoder(transport.EncodingProtobuf, protobuf.ProtobufDecode)
+	buf := make([]byte, 1024*1024)
+
+	for {
+		msg, err := rpkt.Receive(conn)
+		if err != nil {
+			return
+		}
+
+		switch req := msg.(type) {
+		case *protobuf.HeloRequest:
+			resp := &protobuf.HeloResponse{Version: proto.Uint32(uint32(protobuf.ProtobufVersion()))}
+			protobuf.EncodeAndWrite(conn, buf, resp)
+
+		case *protobuf.ScanRequest:
+			if !s.scan(conn, buf, req) {
+				return
+			}
+		}
+		transport.SendResponseEnd(conn)
+	}
+}
+
+// scan returns false if the connection is dropped.
+func (s *testContinuationIndexer) scan(conn net.Conn, buf []byte, req *protobuf.ScanRequest) bool {
+	s.mu.Lock()
+	s.continuations = append(s.continuations, req.GetContinuation())
+	drop := s.drops > 0
+	if drop {
+		s.drops--
+	}
+	s.mu.Unlock()
+
+	start := 0
+	if token := req.GetContinuation(); token != nil {
+		start, _ = strconv.Atoi(string(token))
+	}
+
+	for i := start; i < s.rows; i += s.batchSize {
+		end := i + s.batchSize
+		if end > s.rows {
+			end = s.rows
+		}
+
+		resp := &protobuf.ResponseStream{}
+		for j := i; j < end; j++ {
+			resp.IndexEntries = append(resp.IndexEntries, &protobuf.IndexEntry{
+				EntryKey:   []byte(fmt.Sprintf(`["key%v"]`, j)),
+				PrimaryKey: []byte(fmt.Sprintf("doc%v", j)),
+			})
+		}
+		if req.GetWithContinuation() && end < s.rows {
+			resp.Continuation = []byte(strconv.Itoa(end))
+		}
+		protobuf.EncodeAndWrite(conn, buf, resp)
+
+		if drop {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *testContinuationIndexer) requests() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.continuations
+}
+
+// runTestContinuationScan scans the test indexer through a request broker
+// set up as GsiClient.Scan3WithContinuation does.  It returns the primary
+// keys received.
+func runTestContinuationScan(t *testing.T, s *testContinuationIndexer, withContinuation bool,
+	resumeRetry int, stopAt int) ([]string, *RequestBroker, error) {
+
+	config := common.SystemConfig.SectionConfig("queryport.client.", true)
+	qc, err := NewGsiScanClient(s.lis.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client is not closed, as scans return their connection to its
+	// pool asynchronously
+
+	var received []string
+	b := makeDefaultRequestBroker(func(resp ResponseReader) bool {
+		_, pkeys, _ := resp.GetEntries()
+		received = append(received, string(pkeys[0]))
+		return len(received) != stopAt
+	})
+	if withContinuation {
+		b.SetContinuation(nil)
+	}
+	b.setResumeRetry(resumeRetry)
+	b.SetScanRequestHandler(func(qc *GsiScanClient, index *common.IndexDefn, rollback int64,
+		partitions []common.PartitionId, handler ResponseHandler) (error, bool) {
+
+		opts := b.getScanOptions()
+		if opts.withContinuation {
+			handler = b.trackContinuation(handler)
+		}
+		return qc.Scan3(uint64(index.DefnId), "resume", nil, false, false, nil, 0, 0, nil,
+			false, common.AnyConsistency, nil, handler, 0, partitions, opts)
+	})
+
+	b.reset()
+	donech := make(chan *doneStatus, 1)
+	index := &common.IndexDefn{DefnId: 1}
+	b.scanSingleNode(0, qc, index, 1, 0, []common.PartitionId{0}, 1, donech)
+	status := <-donech
+	return received, b, status.err
+}
+
+func testContinuationRows(from, to int) []string {
+	var rows []string
+	for i := from; i < to; i++ {
+		rows = append(rows, fmt.Sprintf("doc%v", i))
+	}
+	return rows
+}
+
+func TestScanResumeAfterConnectionDrop(t *testing.T) {
+	s := newTestContinuationIndexer(t, 10, 3, 2)
+	defer s.lis.Close()
+
+	received, b, err := runTestContinuationScan(t, s, true, 3, 0)
+	if err != nil {
+		t.Fatalf("expected the scan to be resumed, received error %v", err)
+	}
+	if expected := testContinuationRows(0, 10); !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected rows %v, received %v", expected, received)
+	}
+
+	// resumed after the first and the second batch
+	expected := [][]byte{nil, []byte("3"), []byte("6")}
+	if requests := s.requests(); !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected scan requests with continuation %q, received %q", expected, requests)
+	}
+	if last := b.LastContinuation(); string(last) != "9" {
+		t.Errorf("expected last continuation 9, received %q", last)
+	}
+}
+
+func TestScanResumeRetry(t *testing.T) {
+	s := newTestContinuationIndexer(t, 10, 3, 10)
+	defer s.lis.Close()
+
+	received, b, err := runTestContinuationScan(t, s, true, 2, 0)
+	if err != io.EOF {
+		t.Errorf("expected the scan to fail with %v, received %v", io.EOF, err)
+	}
+	if expected := testContinuationRows(0, 9); !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected rows %v, received %v", expected, received)
+	}
+	if n := len(s.requests()); n != 3 {
+		t.Errorf("expected 3 scan requests, received %v", n)
+	}
+	if last := b.LastContinuation(); string(last) != "9" {
+		t.Errorf("expected last continuation 9, received %q", last)
+	}
+}
+
+func TestScanNoResumeWithoutContinuation(t *testing.T) {
+	s := newTestContinuationIndexer(t, 10, 3, 1)
+	defer s.lis.Close()
+
+	received, _, err := runTestContinuationScan(t, s, false, 3, 0)
+	if err != io.EOF {
+		t.Errorf("expected the scan to fail with %v, received %v", io.EOF, err)
+	}
+	if expected := testContinuationRows(0, 3); !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected rows %v, received %v", expected, received)
+	}
+	if n := len(s.requests()); n != 1 {
+		t.Errorf("expected 1 scan request, received %v", n)
+	}
+}
+
+func TestScanContinuationAccepted(t *testing.T) {
+	s := newTestContinuationIndexer(t, 10, 3, 0)
+	defer s.lis.Close()
+
+	// the handler stops in the middle of the second batch, the token of
+	// that batch would skip the rows not accepted
+	received, b, err := runTestContinuationScan(t, s, true, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := testContinuationRows(0, 5); !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected rows %v, received %v", expected, received)
+	}
+	if last := b.LastContinuation(); string(last) != "3" {
+		t.Errorf("expected last continuation 3, received %q", last)
+	}
+}
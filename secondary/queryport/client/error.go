@@ -27,20 +27,39 @@ var ErrorInvalidConsistency = errors.New("queryport.invalidConsistency")
 // ErrorExpectedTimestamp
 var ErrorExpectedTimestamp = errors.New("queryport.expectedTimestamp")
 
+// ErrorExpectedStaleness
+var ErrorExpectedStaleness = errors.New("queryport.expectedStaleness")
+
+// ErrorContinuationUnsupported
+var ErrorContinuationUnsupported = errors.New("queryport.continuationUnsupported")
+
+// ErrorIntersectBucketMismatch
+var ErrorIntersectBucketMismatch = errors.New("queryport.intersectBucketMismatch")
+
 // These error strings need to be in sync with common.ErrIndexNotFound
 // and common.ErrIndexNotReady.
 var ErrIndexNotFound = fmt.Errorf("Index not found")
 var ErrIndexNotReady = fmt.Errorf("Index not ready for serving queries")
 
+// These error strings need to be in sync with common.ErrScanQueueFull
+// and common.ErrScanQueueTimeout.
+var ErrScanQueueFull = fmt.Errorf("Too many index scans queued in indexer. Please retry the request later.")
+var ErrScanQueueTimeout = fmt.Errorf("Index scan timed out waiting in indexer queue. Please retry the request later.")
+
 var errorDescriptions = map[string]string{
-	ErrorProtocol.Error():            "fatal protocol error with server",
-	ErrorNoHost.Error():              "All indexer replica is down or unavailable or unable to process request",
-	ErrorIndexNotFound.Error():       "index deleted or node hosting the index is down",
-	ErrorInstanceNotFound.Error():    "no instance available for the index",
-	ErrorClientUninitialized.Error(): "gsi client is not initialized",
-	ErrorNotImplemented.Error():      "client API not implemented",
-	ErrorInvalidConsistency.Error():  "supplied consistency is invalid",
-	ErrorExpectedTimestamp.Error():   "consistency timestamp is expected",
-	ErrIndexNotFound.Error():         "index is deleted or node hosting index is down",
-	ErrIndexNotReady.Error():         ErrIndexNotReady.Error(),
+	ErrorProtocol.Error():                "fatal protocol error with server",
+	ErrorNoHost.Error():                  "All indexer replica is down or unavailable or unable to process request",
+	ErrorIndexNotFound.Error():           "index deleted or node hosting the index is down",
+	ErrorInstanceNotFound.Error():        "no instance available for the index",
+	ErrorClientUninitialized.Error():     "gsi client is not initialized",
+	ErrorNotImplemented.Error():          "client API not implemented",
+	ErrorInvalidConsistency.Error():      "supplied consistency is invalid",
+	ErrorExpectedTimestamp.Error():       "consistency timestamp is expected",
+	ErrorExpectedStaleness.Error():       "maximum staleness is expected",
+	ErrorContinuationUnsupported.Error(): "continuation is not supported across indexer nodes",
+	ErrorIntersectBucketMismatch.Error(): "intersected indexes must be on the same bucket",
+	ErrIndexNotFound.Error():             "index is deleted or node hosting index is down",
+	ErrIndexNotReady.Error():             ErrIndexNotReady.Error(),
+	ErrScanQueueFull.Error():             "indexer is overloaded, scan is rejected",
+	ErrScanQueueTimeout.Error():          "indexer is overloaded, scan is rejected",
 }
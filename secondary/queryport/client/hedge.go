@@ -0,0 +1,161 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+package client
+
+import (
+	"github.com/couchbase/indexing/secondary/common"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//-----------------------------
+// Hedged scan requests
+//-----------------------------
+
+const (
+	// number of first-response latencies kept per index
+	hedgeWindowSize = 128
+
+	// minimum number of samples before hedging an index
+	hedgeMinSamples = 16
+
+	// maximum number of hedges that can be accumulated by the budget
+	hedgeMaxTokens = 10.0
+)
+
+//
+// hedgeScanportPicker returns a replica, other than instId, that can serve
+// the given partitions from a single indexer node.
+//
+type hedgeScanportPicker func(defnID uint64, instId uint64, partitions []common.PartitionId) (queryport string,
+	targetInstId uint64, rollbackTime int64, ok bool)
+
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+//
+// scanHedger keeps the first-response latency of recent scans of every index
+// and decides when a scan request should be hedged to another replica.
+// The number of hedges is bounded by a budget proportional to the number
+// of scans.
+//
+type scanHedger struct {
+	settings *ClientSettings
+
+	mutex     sync.Mutex
+	latencies map[uint64]*latencyWindow
+	tokens    float64
+
+	// stats
+	numFired int64
+	numWon   int64
+}
+
+func newScanHedger(settings *ClientSettings) *scanHedger {
+
+	return &scanHedger{
+		settings:  settings,
+		latencies: make(map[uint64]*latencyWindow),
+	}
+}
+
+func (h *scanHedger) enabled() bool {
+	return h != nil && h.settings.HedgePercentile() > 0
+}
+
+//
+// Record the time taken for the first response of a scan on index defnID.
+// Every recorded scan also earns budget for hedging.
+//
+func (h *scanHedger) record(defnID uint64, latency time.Duration) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	w, ok := h.latencies[defnID]
+	if !ok {
+		w = &latencyWindow{samples: make([]time.Duration, 0, hedgeWindowSize)}
+		h.latencies[defnID] = w
+	}
+
+	if len(w.samples) < hedgeWindowSize {
+		w.samples = append(w.samples, latency)
+	} else {
+		w.samples[w.next] = latency
+	}
+	w.next = (w.next + 1) % hedgeWindowSize
+
+	h.tokens += h.settings.HedgeBudget() / 100
+	if h.tokens > hedgeMaxTokens {
+		h.tokens = hedgeMaxTokens
+	}
+}
+
+//
+// Return how long to wait for the first response before hedging a scan on
+// index defnID.  Return false if there are not enough samples yet.
+//
+func (h *scanHedger) delay(defnID uint64) (time.Duration, bool) {
+
+	h.mutex.Lock()
+	w, ok := h.latencies[defnID]
+	if !ok || len(w.samples) < hedgeMinSamples {
+		h.mutex.Unlock()
+		return 0, false
+	}
+	samples := make([]float64, len(w.samples))
+	for i, latency := range w.samples {
+		samples[i] = float64(latency)
+	}
+	h.mutex.Unlock()
+
+	sort.Float64s(samples)
+
+	pos := int(float64(len(samples)) * h.settings.HedgePercentile() / 100)
+	if pos >= len(samples) {
+		pos = len(samples) - 1
+	}
+
+	delay := time.Duration(samples[pos])
+	if min := h.settings.HedgeMinDelay(); delay < min {
+		delay = min
+	}
+	return delay, true
+}
+
+//
+// Take a hedge out of the budget.  Return false if the budget is used up.
+//
+func (h *scanHedger) acquire() bool {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+func (h *scanHedger) fired() {
+	atomic.AddInt64(&h.numFired, 1)
+}
+
+func (h *scanHedger) won() {
+	atomic.AddInt64(&h.numWon, 1)
+}
+
+func (h *scanHedger) stats() (fired int64, won int64) {
+	return atomic.LoadInt64(&h.numFired), atomic.LoadInt64(&h.numWon)
+}
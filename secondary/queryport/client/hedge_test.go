@@ -0,0 +1,219 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+package client
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func newTestHedgeSettings(percentile float64, minDelay int64, budget float64) *ClientSettings {
+	return &ClientSettings{
+		hedgePct:      math.Float64bits(percentile),
+		hedgeMinDelay: minDelay,
+		hedgeBudget:   math.Float64bits(budget),
+	}
+}
+
+func TestScanHedgerDelay(t *testing.T) {
+	h := newScanHedger(newTestHedgeSettings(90, 5, 0))
+
+	for i := 1; i < hedgeMinSamples; i++ {
+		h.record(1, time.Duration(i)*time.Millisecond)
+	}
+	if _, ok := h.delay(1); ok {
+		t.Errorf("expected no delay before %v samples", hedgeMinSamples)
+	}
+
+	for i := hedgeMinSamples; i <= 100; i++ {
+		h.record(1, time.Duration(i)*time.Millisecond)
+	}
+
+	// 90th percentile of 1ms .. 100ms
+	delay, ok := h.delay(1)
+	if !ok || delay != 91*time.Millisecond {
+		t.Errorf("expected a delay of 91ms, received %v %v", delay, ok)
+	}
+
+	if _, ok := h.delay(2); ok {
+		t.Errorf("expected no delay for an index without samples")
+	}
+
+	h = newScanHedger(newTestHedgeSettings(90, 50, 0))
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.record(1, time.Millisecond)
+	}
+	if delay, _ := h.delay(1); delay != 50*time.Millisecond {
+		t.Errorf("expected the minimum delay of 50ms, received %v", delay)
+	}
+}
+
+func TestScanHedgerBudget(t *testing.T) {
+	h := newScanHedger(newTestHedgeSettings(90, 0, 10))
+
+	if h.acquire() {
+		t.Errorf("expected no budget before any scan")
+	}
+
+	// 10% of the scans can be hedged
+	for i := 0; i < 25; i++ {
+		h.record(1, time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		if !h.acquire() {
+			t.Errorf("expected hedge %v to be in the budget", i)
+		}
+	}
+	if h.acquire() {
+		t.Errorf("expected the budget to be used up")
+	}
+
+	// unused budget is capped
+	for i := 0; i < 1000; i++ {
+		h.record(1, time.Millisecond)
+	}
+	n := 0
+	for h.acquire() {
+		n++
+	}
+	if n != hedgeMaxTokens {
+		t.Errorf("expected %v hedges, received %v", hedgeMaxTokens, n)
+	}
+}
+
+type testHedgeResponse struct{}
+
+func (r *testHedgeResponse) GetEntries() ([]common.SecondaryKey, [][]byte, error) {
+	return nil, nil, nil
+}
+
+func (r *testHedgeResponse) Error() error {
+	return nil
+}
+
+// testHedgeAttempt is the behaviour of the scan of a replica: it sends a
+// response, or fails with err, after delay.
+type testHedgeAttempt struct {
+	delay time.Duration
+	err   error
+}
+
+func runTestHedgedScan(primary, hedge testHedgeAttempt) (error, uint64, []uint64, *scanHedger) {
+
+	hedger := newScanHedger(newTestHedgeSettings(90, 20, 100))
+	for i := 0; i < hedgeMinSamples; i++ {
+		hedger.record(1, time.Millisecond)
+	}
+
+	primaryClient, hedgeClient := &GsiScanClient{}, &GsiScanClient{}
+	attempts := map[*GsiScanClient]testHedgeAttempt{primaryClient: primary, hedgeClient: hedge}
+
+	var mu sync.Mutex
+	var served []uint64
+
+	b := NewRequestBroker("hedge", 0)
+	b.hedger = hedger
+	b.clientMaker = func(string) *GsiScanClient { return hedgeClient }
+	b.hedgeScanport = func(defnID uint64, instId uint64,
+		partitions []common.PartitionId) (string, uint64, int64, bool) {
+		return "hedge", 2, 0, true
+	}
+	b.factory = func(id ResponseHandlerId, instId uint64, partitions []common.PartitionId) ResponseHandler {
+		return func(resp ResponseReader) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			served = append(served, instId)
+			return true
+		}
+	}
+	b.scan = func(qc *GsiScanClient, index *common.IndexDefn, rollback int64,
+		partitions []common.PartitionId, callb ResponseHandler) (error, bool) {
+
+		attempt := attempts[qc]
+		time.Sleep(attempt.delay)
+		if attempt.err != nil {
+			return attempt.err, false
+		}
+		callb(&testHedgeResponse{})
+		return nil, false
+	}
+
+	index := &common.IndexDefn{DefnId: 1}
+	err, _, instId := b.hedgedScan(0, primaryClient, index, 1, 0, []common.PartitionId{0}, time.Now())
+
+	// let the losing attempt finish
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	return err, instId, served, hedger
+}
+
+func TestHedgedScanWinner(t *testing.T) {
+	errScan := errors.New("scan failed")
+
+	// no response within the delay, the hedge responds first
+	err, instId, served, hedger := runTestHedgedScan(
+		testHedgeAttempt{delay: 100 * time.Millisecond}, testHedgeAttempt{})
+	if err != nil || instId != 2 || len(served) != 1 || served[0] != 2 {
+		t.Errorf("expected the hedge to win, received %v %v %v", err, instId, served)
+	}
+	if fired, won := hedger.stats(); fired != 1 || won != 1 {
+		t.Errorf("expected a hedge fired and won, received %v %v", fired, won)
+	}
+
+	// response within the delay, no hedge
+	err, instId, served, hedger = runTestHedgedScan(
+		testHedgeAttempt{}, testHedgeAttempt{})
+	if err != nil || instId != 1 || len(served) != 1 || served[0] != 1 {
+		t.Errorf("expected the scan to be served without hedge, received %v %v %v", err, instId, served)
+	}
+	if fired, _ := hedger.stats(); fired != 0 {
+		t.Errorf("expected no hedge, received %v", fired)
+	}
+
+	// the hedge fails without any response, the scan falls through to
+	// the first attempt
+	err, instId, served, _ = runTestHedgedScan(
+		testHedgeAttempt{delay: 100 * time.Millisecond}, testHedgeAttempt{err: errScan})
+	if err != nil || instId != 1 || len(served) != 1 || served[0] != 1 {
+		t.Errorf("expected the first attempt to win, received %v %v %v", err, instId, served)
+	}
+
+	// the first attempt fails after the hedge has been sent
+	err, instId, served, _ = runTestHedgedScan(
+		testHedgeAttempt{delay: 50 * time.Millisecond, err: errScan},
+		testHedgeAttempt{delay: 100 * time.Millisecond})
+	if err != nil || instId != 2 || len(served) != 1 || served[0] != 2 {
+		t.Errorf("expected the hedge to win, received %v %v %v", err, instId, served)
+	}
+
+	// the first attempt fails before the delay, no hedge
+	err, instId, served, hedger = runTestHedgedScan(
+		testHedgeAttempt{err: errScan}, testHedgeAttempt{})
+	if err != errScan || instId != 1 || len(served) != 0 {
+		t.Errorf("expected the first attempt to fail, received %v %v %v", err, instId, served)
+	}
+	if fired, _ := hedger.stats(); fired != 0 {
+		t.Errorf("expected no hedge, received %v", fired)
+	}
+
+	// both attempts fail, the last one is returned
+	err, instId, served, _ = runTestHedgedScan(
+		testHedgeAttempt{delay: 100 * time.Millisecond, err: errScan},
+		testHedgeAttempt{err: errors.New("hedge failed")})
+	if err != errScan || instId != 1 || len(served) != 0 {
+		t.Errorf("expected the last attempt to fail, received %v %v %v", err, instId, served)
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/query"
+	"math"
+	"sort"
+	"time"
+)
+
+//--------------------------
+// index intersection
+//--------------------------
+
+// number of primary keys per response, when results are merged by client
+const intersectBatchSize = 256
+
+// IntersectIndexScan is the scan of one index taking part in an
+// intersect scan.
+type IntersectIndexScan struct {
+	DefnID uint64
+	Scans  Scans
+}
+
+// scan of one index, or some of its partitions, on a single indexer
+type intersectTarget struct {
+	defnID       uint64
+	isPrimary    bool
+	scans        Scans
+	rollbackTime int64
+	partitions   []common.PartitionId
+}
+
+// intersect scan request to a single indexer
+type intersectRequest struct {
+	queryport string
+	targets   []*intersectTarget
+	union     bool
+}
+
+//
+// IntersectScan returns the primary keys of documents qualified by the
+// scans of all the given indexes (or any of them, if union is true).
+// Primary keys are returned in sorted order.
+//
+// Indexes hosted by the same indexer are intersected by the indexer, at
+// a common snapshot.  If the indexes are spread across indexer nodes,
+// client merges the results of each indexer, which are consistent per
+// indexer only.  Priority is the admission priority class of the scans
+// on the indexers.
+//
+func (c *GsiClient) IntersectScan(
+	requestId string, indexScans []*IntersectIndexScan, union bool, limit int64,
+	cons common.Consistency, vector *TsConsistency, priority common.ScanPriority,
+	callb ResponseHandler) (err error) {
+
+	if c.bridge == nil {
+		return ErrorClientUninitialized
+	}
+
+	begin := time.Now()
+
+	streams, bucket, err := c.planIntersectScan(indexScans, union)
+	if err != nil {
+		return err
+	}
+
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+
+	// Common case: all indexes are served by one indexer.
+	if len(streams) == 1 && len(streams[0]) == 1 {
+		err = c.doIntersectScan(requestId, streams[0][0], limit, cons, vector, priority, bucket, callb)
+
+		fmsg := "IntersectScan {%v} - elapsed(%v) err(%v)"
+		logging.Verbosef(fmsg, requestId, time.Since(begin), err)
+		return err
+	}
+
+	// Every stream is the union of the results of its requests.
+	results := make([][][]byte, len(streams))
+	for i, requests := range streams {
+		for _, request := range requests {
+			var pkeys [][]byte
+			var collectErr error
+			collect := func(resp ResponseReader) bool {
+				_, keys, err := resp.GetEntries()
+				if err != nil {
+					collectErr = err
+					return false
+				}
+				pkeys = append(pkeys, keys...)
+				return true
+			}
+
+			err = c.doIntersectScan(requestId, request, math.MaxInt64, cons, vector, priority, bucket, collect)
+			if err == nil {
+				err = collectErr
+			}
+			if err != nil {
+				return err
+			}
+			results[i] = unionPrimaryKeys(results[i], pkeys)
+		}
+	}
+
+	var pkeys [][]byte
+	if union {
+		for _, result := range results {
+			pkeys = unionPrimaryKeys(pkeys, result)
+		}
+	} else {
+		pkeys = results[0]
+		for _, result := range results[1:] {
+			pkeys = intersectPrimaryKeys(pkeys, result)
+		}
+	}
+
+	if int64(len(pkeys)) > limit {
+		pkeys = pkeys[:limit]
+	}
+
+	for len(pkeys) > 0 {
+		n := intersectBatchSize
+		if n > len(pkeys) {
+			n = len(pkeys)
+		}
+
+		resp := &protobuf.ResponseStream{IndexEntries: make([]*protobuf.IndexEntry, n)}
+		for i := 0; i < n; i++ {
+			resp.IndexEntries[i] = &protobuf.IndexEntry{PrimaryKey: pkeys[i]}
+		}
+		if !callb(resp) {
+			break
+		}
+		pkeys = pkeys[n:]
+	}
+	callb(&protobuf.StreamEndResponse{})
+
+	fmsg := "IntersectScan {%v} merged results of %v streams - elapsed(%v)"
+	logging.Verbosef(fmsg, requestId, len(streams), time.Since(begin))
+	return nil
+}
+
+//
+// Group the index scans by indexer.  It returns a list of streams, each being a
+// list of requests to be unioned.  The final result is the intersection (or union)
+// of the streams.
+//
+func (c *GsiClient) planIntersectScan(indexScans []*IntersectIndexScan, union bool) ([][]*intersectRequest, string, error) {
+
+	var bucket string
+	var streams [][]*intersectRequest
+
+	nodeRequests := make(map[string]*intersectRequest)
+	var nodes []string
+
+	addToNode := func(queryport string, target *intersectTarget) {
+		request, ok := nodeRequests[queryport]
+		if !ok {
+			request = &intersectRequest{queryport: queryport, union: union}
+			nodeRequests[queryport] = request
+			nodes = append(nodes, queryport)
+		}
+		request.targets = append(request.targets, target)
+	}
+
+	for _, indexScan := range indexScans {
+		queryports, targetDefnID, _, rollbackTimes, partitions, _, ok :=
+			c.bridge.GetScanport(indexScan.DefnID, nil, make(map[common.IndexDefnId]bool))
+		if !ok {
+			return nil, "", ErrorNoHost
+		}
+
+		index := c.bridge.GetIndexDefn(targetDefnID)
+		if index == nil {
+			return nil, "", ErrorIndexNotFound
+		}
+		if bucket == "" {
+			bucket = index.Bucket
+		} else if bucket != index.Bucket {
+			return nil, "", ErrorIntersectBucketMismatch
+		}
+
+		makeTarget := func(i int) *intersectTarget {
+			return &intersectTarget{
+				defnID:       targetDefnID,
+				isPrimary:    index.IsPrimary,
+				scans:        indexScan.Scans,
+				rollbackTime: rollbackTimes[i],
+				partitions:   partitions[i],
+			}
+		}
+
+		local := true
+		for i := range queryports {
+			if queryports[i] != queryports[0] {
+				local = false
+			}
+		}
+
+		if union || local {
+			// Partitions of an index on the same indexer are merged by indexer.
+			for i := range queryports {
+				addToNode(queryports[i], makeTarget(i))
+			}
+			continue
+		}
+
+		// Partitions of the index are spread across indexers.  Each indexer
+		// returns the document ids of its partitions, and they are unioned
+		// by client before intersecting with the other indexes.
+		var requests []*intersectRequest
+		for i := range queryports {
+			requests = append(requests, &intersectRequest{
+				queryport: queryports[i],
+				targets:   []*intersectTarget{makeTarget(i)},
+				union:     true,
+			})
+		}
+		streams = append(streams, requests)
+	}
+
+	if union {
+		var requests []*intersectRequest
+		for _, queryport := range nodes {
+			requests = append(requests, nodeRequests[queryport])
+		}
+		return [][]*intersectRequest{requests}, bucket, nil
+	}
+
+	for _, queryport := range nodes {
+		streams = append(streams, []*intersectRequest{nodeRequests[queryport]})
+	}
+	return streams, bucket, nil
+}
+
+func (c *GsiClient) doIntersectScan(requestId string, request *intersectRequest, limit int64,
+	cons common.Consistency, vector *TsConsistency, priority common.ScanPriority, bucket string,
+	callb ResponseHandler) error {
+
+	qc := c.makeScanClient(request.queryport)
+	if qc == nil {
+		return ErrorNoHost
+	}
+
+	vector, err := c.getConsistency(qc, cons, vector, bucket)
+	if err != nil {
+		return err
+	}
+
+	var scanErr error
+	handler := func(resp ResponseReader) bool {
+		if err := resp.Error(); err != nil {
+			scanErr = err
+			return false
+		}
+		return callb(resp)
+	}
+
+	err, _ = qc.intersectScan(requestId, request.targets, request.union, limit, cons, vector, priority, handler)
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return fmt.Errorf("%v from %v", err, request.queryport)
+	}
+	return nil
+}
+
+//--------------------------
+// merge of primary keys
+//--------------------------
+
+type primaryKeys [][]byte
+
+func (pks primaryKeys) Len() int           { return len(pks) }
+func (pks primaryKeys) Swap(i, j int)      { pks[i], pks[j] = pks[j], pks[i] }
+func (pks primaryKeys) Less(i, j int) bool { return bytes.Compare(pks[i], pks[j]) < 0 }
+
+// union of two lists of primary keys, result is sorted without duplicates
+func unionPrimaryKeys(x, y [][]byte) [][]byte {
+
+	result := make([][]byte, 0, len(x)+len(y))
+	result = append(result, x...)
+	result = append(result, y...)
+	sort.Sort(primaryKeys(result))
+
+	n := 0
+	for i, pk := range result {
+		if i == 0 || !bytes.Equal(pk, result[n-1]) {
+			result[n] = pk
+			n++
+		}
+	}
+	return result[:n]
+}
+
+// intersection of two sorted lists of primary keys
+func intersectPrimaryKeys(x, y [][]byte) [][]byte {
+
+	var result [][]byte
+	for i, j := 0, 0; i < len(x) && j < len(y); {
+		switch cmp := bytes.Compare(x[i], y[j]); {
+		case cmp < 0:
+			i++
+		case cmp > 0:
+			j++
+		default:
+			result = append(result, x[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
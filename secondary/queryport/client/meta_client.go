@@ -17,8 +17,6 @@ import "math"
 import "strconv"
 import "sort"
 
-import "github.com/couchbase/cbauth"
-
 import "github.com/couchbase/indexing/secondary/logging"
 import common "github.com/couchbase/indexing/secondary/common"
 import mclient "github.com/couchbase/indexing/secondary/manager/client"
@@ -386,6 +384,66 @@ func (b *metadataClient) GetScanport(defnID uint64, excludes map[common.IndexDef
 	return qp, targetDefnID, in, rt, pid, numPartitions, true
 }
 
+// GetHedgeScanport implements BridgeAccessor{} interface.
+func (b *metadataClient) GetHedgeScanport(defnID uint64, instID uint64,
+	partitions []common.PartitionId) (qp string, targetInstID uint64, rt int64, ok bool) {
+
+	currmeta := (*indexTopology)(atomic.LoadPointer(&b.indexers))
+
+	if len(partitions) == 0 {
+		return "", 0, 0, false
+	}
+
+	// do not hedge to the indexer serving the original request
+	var origIndexerId common.IndexerId
+	if inst, ok := currmeta.insts[common.IndexInstId(instID)]; ok {
+		origIndexerId = inst.IndexerId[partitions[0]]
+	}
+
+	var replicas []uint64
+	for _, replica := range b.GetIndexReplica(defnID) {
+		if uint64(replica.InstId) != instID {
+			replicas = append(replicas, uint64(replica.InstId))
+		}
+	}
+	if len(replicas) == 0 {
+		return "", 0, 0, false
+	}
+
+	// pick among the replicas that are not falling behind
+	rollbackTimesList := b.pruneStaleReplica(replicas, nil)
+
+	for _, n := range rand.Perm(len(replicas)) {
+		inst, ok := currmeta.insts[common.IndexInstId(replicas[n])]
+		if !ok {
+			continue
+		}
+
+		indexerId, ok := inst.IndexerId[partitions[0]]
+		if !ok || indexerId == origIndexerId {
+			continue
+		}
+
+		found := true
+		for _, partnId := range partitions {
+			rollbackTime, ok := rollbackTimesList[n][partnId]
+			if !ok || rollbackTime == math.MaxInt64 || inst.IndexerId[partnId] != indexerId {
+				found = false
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		if qp, ok = currmeta.queryports[indexerId]; ok {
+			return qp, uint64(inst.InstId), rollbackTimesList[n][partitions[0]], true
+		}
+	}
+
+	return "", 0, 0, false
+}
+
 // Timeit implement BridgeAccessor{} interface.
 func (b *metadataClient) Timeit(instID uint64, partitionId common.PartitionId, value float64) {
 
@@ -515,7 +573,8 @@ func (b *metadataClient) equivalentIndex(
 		d1.PartitionScheme != d2.PartitionScheme ||
 		d1.HashScheme != d2.HashScheme ||
 		d1.WhereExpr != d2.WhereExpr ||
-		d1.RetainDeletedXATTR != d2.RetainDeletedXATTR {
+		d1.RetainDeletedXATTR != d2.RetainDeletedXATTR ||
+		!d1.Collation.Equal(d2.Collation) {
 
 		return false
 	}
@@ -1853,7 +1912,7 @@ func postWithAuth(url string, bodyType string, body io.Reader, timeout time.Dura
 		return nil, err
 	}
 	req.Header.Set("Content-Type", bodyType)
-	err = cbauth.SetRequestAuthVia(req, nil)
+	err = common.SetRequestAuth(req)
 	if err != nil {
 		logging.Errorf("Error setting auth %v", err)
 		return nil, err
@@ -0,0 +1,464 @@
+package client
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "sort"
+import "sync"
+import "sync/atomic"
+import "time"
+
+import "github.com/couchbase/indexing/secondary/logging"
+import common "github.com/couchbase/indexing/secondary/common"
+import mclient "github.com/couchbase/indexing/secondary/manager/client"
+
+// number of sub-ranges a mismatching hash range is split into.
+const replicaCheckFanout = 16
+
+// hash ranges with at most these many entries are compared entry by entry.
+const replicaCheckLeafSize = 256
+
+// maximum number of differing entries reported.
+const replicaCheckMaxDiffs = 1000
+
+// time for every node to flush up to the common timestamp and take a
+// snapshot, after which the flush barrier is dropped.
+const replicaCheckSnapshotTimeout = 60 * time.Second
+
+// number of attempts to get snapshots at a common timestamp, a node may
+// flush past the timestamp before its flush barrier is set.
+const replicaCheckSnapshotRetries = 3
+
+// timeout of a replica check request.
+const replicaCheckRequestTimeout = 5 * time.Minute
+
+// replicaNode is an indexer hosting replicas of the index, with the
+// leases of the snapshots of its index instances.
+type replicaNode struct {
+	httpport string
+	instIds  []common.IndexInstId
+	leaseIds []uint64
+}
+
+func (n *replicaNode) addInst(instId common.IndexInstId) {
+	for _, id := range n.instIds {
+		if id == instId {
+			return
+		}
+	}
+	n.instIds = append(n.instIds, instId)
+}
+
+func (n *replicaNode) leaseId(instId common.IndexInstId) uint64 {
+	for i, id := range n.instIds {
+		if id == instId && i < len(n.leaseIds) {
+			return n.leaseIds[i]
+		}
+	}
+	return 0
+}
+
+// replicaPartition is a partition of a replica, hosted by node.
+type replicaPartition struct {
+	inst *mclient.InstanceDefn
+	node *replicaNode
+}
+
+// CheckReplicas implements BridgeAccessor{} interface.
+func (b *metadataClient) CheckReplicas(defnID uint64) (*common.ReplicaCheckReport, error) {
+	currmeta := (*indexTopology)(atomic.LoadPointer(&b.indexers))
+
+	index, ok := currmeta.defns[common.IndexDefnId(defnID)]
+	if !ok {
+		return nil, ErrorIndexNotFound
+	}
+	defn := index.Definition
+
+	replicas := b.GetIndexReplica(defnID)
+	if len(replicas) < 2 {
+		return nil, fmt.Errorf("Index %v has no replica", defn.Name)
+	}
+
+	report := &common.ReplicaCheckReport{
+		DefnId: defn.DefnId,
+		Bucket: defn.Bucket,
+		Name:   defn.Name,
+	}
+
+	// partitions of every replica, and the nodes hosting them
+	nodes := make(map[common.IndexerId]*replicaNode)
+	partitions := make(map[common.PartitionId][]*replicaPartition)
+	for _, inst := range replicas {
+		if inst.State != common.INDEX_STATE_ACTIVE {
+			return nil, fmt.Errorf("Replica %v of index %v is in state %v",
+				inst.ReplicaId, defn.Name, inst.State)
+		}
+		report.Replicas = append(report.Replicas, int(inst.ReplicaId))
+
+		for partnId, indexerId := range inst.IndexerId {
+			node, ok := nodes[indexerId]
+			if !ok {
+				_, _, httpport, err := b.mdClient.FindServiceForIndexer(indexerId)
+				if err != nil {
+					return nil, err
+				}
+				node = &replicaNode{httpport: httpport}
+				nodes[indexerId] = node
+			}
+			node.addInst(inst.InstId)
+			partitions[partnId] = append(partitions[partnId],
+				&replicaPartition{inst: inst, node: node})
+		}
+	}
+
+	// snapshots of every replica at a common timestamp, their leases
+	// are released even if the check fails
+	ts, err := openReplicaSnapshots(defn.Bucket, nodes)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReplicaSnapshots(defn.Bucket, nodes)
+	report.Ts = ts
+
+	partnIds := make([]int, 0, len(partitions))
+	for partnId := range partitions {
+		partnIds = append(partnIds, int(partnId))
+	}
+	sort.Ints(partnIds)
+
+	for _, id := range partnIds {
+		partnId := common.PartitionId(id)
+		parts := partitions[partnId]
+		if len(parts) < 2 {
+			report.Skipped = append(report.Skipped,
+				fmt.Sprintf("Partition %v has a single replica", partnId))
+			continue
+		}
+
+		maxDiffs := replicaCheckMaxDiffs - len(report.Diffs)
+		diffs, truncated, err := checkReplicaPartition(defn, partnId, parts, maxDiffs)
+		if err != nil {
+			return nil, fmt.Errorf("Partition %v: %v", partnId, err)
+		}
+		report.Partitions++
+		report.Diffs = append(report.Diffs, diffs...)
+		if truncated {
+			report.Truncated = true
+			break
+		}
+	}
+
+	report.Consistent = len(report.Diffs) == 0 && !report.Truncated
+	return report, nil
+}
+
+// checkReplicaPartition compares the digests of the hash ranges of a
+// partition on all its replicas. Mismatching ranges are split until they
+// are small enough to fetch and compare their entries.
+func checkReplicaPartition(defn *common.IndexDefn, partnId common.PartitionId,
+	parts []*replicaPartition, maxDiffs int) ([]common.ReplicaDiff, bool, error) {
+
+	truncated := false
+	ranges := []common.HashRange{common.FullHashRange}
+	leaves := make([]common.HashRange, 0)
+
+	for len(ranges) > 0 {
+		digests := make([][]common.RangeDigest, len(parts))
+		err := forEachReplica(parts, func(i int, part *replicaPartition) error {
+			resp := &common.ReplicaDigestResponse{}
+			err := replicaCheckPost(part.node.httpport, "/replicaCheck/digest",
+				newReplicaDigestRequest(defn, part, partnId, ranges), resp)
+			if err == nil && resp.Error != "" {
+				err = errors.New(resp.Error)
+			}
+			if err == nil && len(resp.Digests) != len(ranges) {
+				err = fmt.Errorf("%v digests received for %v ranges", len(resp.Digests), len(ranges))
+			}
+			if err != nil {
+				return fmt.Errorf("replica %v on %v: %v", part.inst.ReplicaId, part.node.httpport, err)
+			}
+			digests[i] = resp.Digests
+			return nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+
+		next := make([]common.HashRange, 0)
+		for j, r := range ranges {
+			equal := true
+			var maxCount uint64
+			for i := range parts {
+				if digests[i][j] != digests[0][j] {
+					equal = false
+				}
+				if digests[i][j].Count > maxCount {
+					maxCount = digests[i][j].Count
+				}
+			}
+
+			if equal {
+				continue
+			}
+
+			if len(leaves)+len(next) >= maxDiffs {
+				// each mismatching range has at least one diff
+				truncated = true
+				break
+			}
+
+			if maxCount <= replicaCheckLeafSize || r.Low == r.High {
+				leaves = append(leaves, r)
+			} else {
+				next = append(next, common.SplitHashRange(r, replicaCheckFanout)...)
+			}
+		}
+		ranges = next
+	}
+
+	if len(leaves) == 0 {
+		return nil, truncated, nil
+	}
+
+	sort.Sort(hashRanges(leaves))
+
+	entries := make([][]common.ReplicaEntry, len(parts))
+	err := forEachReplica(parts, func(i int, part *replicaPartition) error {
+		resp := &common.ReplicaEntriesResponse{}
+		err := replicaCheckPost(part.node.httpport, "/replicaCheck/entries",
+			newReplicaDigestRequest(defn, part, partnId, leaves), resp)
+		if err == nil && resp.Error != "" {
+			err = errors.New(resp.Error)
+		}
+		if err != nil {
+			return fmt.Errorf("replica %v on %v: %v", part.inst.ReplicaId, part.node.httpport, err)
+		}
+		entries[i] = resp.Entries
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	diffs, more := diffReplicaEntries(partnId, parts, entries, maxDiffs)
+	return diffs, truncated || more, nil
+}
+
+// diffReplicaEntries returns the entries missing from some of the
+// replicas, in the order they are first seen.
+func diffReplicaEntries(partnId common.PartitionId, parts []*replicaPartition,
+	entries [][]common.ReplicaEntry, maxDiffs int) ([]common.ReplicaDiff, bool) {
+
+	var order []string
+	seen := make(map[string]*common.ReplicaDiff)
+	for i, part := range parts {
+		for _, e := range entries[i] {
+			d, ok := seen[string(e.Raw)]
+			if !ok {
+				d = &common.ReplicaDiff{PartnId: partnId, Key: e.Key, DocId: e.DocId}
+				seen[string(e.Raw)] = d
+				order = append(order, string(e.Raw))
+			}
+			d.Replicas = append(d.Replicas, int(part.inst.ReplicaId))
+		}
+	}
+
+	var diffs []common.ReplicaDiff
+	for _, raw := range order {
+		if d := seen[raw]; len(d.Replicas) < len(parts) {
+			if len(diffs) >= maxDiffs {
+				return diffs, true
+			}
+			diffs = append(diffs, *d)
+		}
+	}
+	return diffs, false
+}
+
+// maxReplicaTs returns the timestamp having, for every vbucket, the
+// highest seqno of ts and other.
+func maxReplicaTs(ts, other *common.TsVbuuid) *common.TsVbuuid {
+	if ts == nil {
+		return other.Copy()
+	}
+
+	for i, seqno := range other.Seqnos {
+		if seqno > ts.Seqnos[i] {
+			ts.Seqnos[i] = seqno
+			ts.Vbuuids[i] = other.Vbuuids[i]
+			ts.Snapshots[i] = other.Snapshots[i]
+		}
+	}
+	return ts
+}
+
+// hashRanges sorts hash ranges by their low bound.
+type hashRanges []common.HashRange
+
+func (r hashRanges) Len() int           { return len(r) }
+func (r hashRanges) Less(i, j int) bool { return r[i].Low < r[j].Low }
+func (r hashRanges) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+func newReplicaDigestRequest(defn *common.IndexDefn, part *replicaPartition,
+	partnId common.PartitionId, ranges []common.HashRange) *common.ReplicaDigestRequest {
+
+	return &common.ReplicaDigestRequest{
+		LeaseId: part.node.leaseId(part.inst.InstId),
+		DefnId:  defn.DefnId,
+		InstId:  part.inst.InstId,
+		PartnId: partnId,
+		Ranges:  ranges,
+	}
+}
+
+// forEachReplica calls fn for every replica of a partition in parallel,
+// and returns the first error.
+func forEachReplica(parts []*replicaPartition, fn func(int, *replicaPartition) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(parts))
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part *replicaPartition) {
+			defer wg.Done()
+			errs[i] = fn(i, part)
+		}(i, part)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openReplicaSnapshots leases the snapshots of the index instances of
+// every node at a common timestamp, ahead of the flush of the bucket on
+// all of them, and returns that timestamp.
+func openReplicaSnapshots(bucket string,
+	nodes map[common.IndexerId]*replicaNode) (*common.TsVbuuid, error) {
+
+	for attempt := 1; ; attempt++ {
+		var ts *common.TsVbuuid
+		for _, node := range nodes {
+			req := &common.ReplicaSnapshotRequest{
+				Bucket: bucket,
+				Op:     common.ReplicaSnapshotTs,
+			}
+			resp, err := replicaSnapshot(node.httpport, req)
+			if err == nil && resp.Ts == nil {
+				err = errors.New("missing replica check timestamp")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Failed to get timestamp on %v: %v", node.httpport, err)
+			}
+			ts = maxReplicaTs(ts, resp.Ts)
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var errs []error
+		for _, node := range nodes {
+			wg.Add(1)
+			go func(node *replicaNode) {
+				defer wg.Done()
+
+				req := &common.ReplicaSnapshotRequest{
+					Bucket:  bucket,
+					Op:      common.ReplicaSnapshotOpen,
+					Ts:      ts,
+					InstIds: node.instIds,
+					Timeout: int64(replicaCheckSnapshotTimeout / time.Millisecond),
+				}
+				resp, err := replicaSnapshot(node.httpport, req)
+				if err == nil && len(resp.LeaseIds) != len(node.instIds) {
+					err = fmt.Errorf("%v leases received for %v index instances",
+						len(resp.LeaseIds), len(node.instIds))
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("Failed to get snapshot on %v: %v",
+						node.httpport, err))
+				} else {
+					node.leaseIds = resp.LeaseIds
+				}
+			}(node)
+		}
+		wg.Wait()
+
+		if len(errs) == 0 {
+			return ts, nil
+		}
+
+		closeReplicaSnapshots(bucket, nodes)
+		if attempt >= replicaCheckSnapshotRetries {
+			return nil, errs[0]
+		}
+		logging.Warnf("CheckReplicas: attempt %v to get snapshots at %v failed: %v",
+			attempt, ts, errs[0])
+	}
+}
+
+// closeReplicaSnapshots releases the leases of the snapshots of every
+// node.
+func closeReplicaSnapshots(bucket string, nodes map[common.IndexerId]*replicaNode) {
+	for _, node := range nodes {
+		if node.leaseIds == nil {
+			continue
+		}
+
+		req := &common.ReplicaSnapshotRequest{
+			Bucket:   bucket,
+			Op:       common.ReplicaSnapshotClose,
+			InstIds:  node.instIds,
+			LeaseIds: node.leaseIds,
+		}
+		if _, err := replicaSnapshot(node.httpport, req); err != nil {
+			logging.Errorf("CheckReplicas: failed to release snapshots on %v: %v",
+				node.httpport, err)
+		}
+		node.leaseIds = nil
+	}
+}
+
+func replicaSnapshot(httpport string,
+	req *common.ReplicaSnapshotRequest) (*common.ReplicaSnapshotResponse, error) {
+
+	resp := &common.ReplicaSnapshotResponse{}
+	if err := replicaCheckPost(httpport, "/replicaCheck/snapshot", req, resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+func replicaCheckPost(httpport, url string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	res, err := postWithAuth(httpport+url, "application/json",
+		bytes.NewBuffer(body), replicaCheckRequestTimeout)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(data))
+	}
+	return json.Unmarshal(data, resp)
+}
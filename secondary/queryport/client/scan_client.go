@@ -13,6 +13,7 @@ package client
 import "errors"
 import "fmt"
 import "io"
+import "math"
 import "net"
 import "time"
 import json "github.com/couchbase/indexing/secondary/common/json"
@@ -208,8 +209,7 @@ func (c *GsiScanClient) Lookup(
 		Sorted:       proto.Bool(true),
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 
 	// ---> protobuf.ScanRequest
@@ -287,8 +287,7 @@ func (c *GsiScanClient) Range(
 		Sorted:       proto.Bool(true),
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 	// ---> protobuf.ScanRequest
 	if err := c.sendRequest(conn, pkt, req); err != nil {
@@ -356,8 +355,7 @@ func (c *GsiScanClient) RangePrimary(
 		Sorted:       proto.Bool(true),
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 	// ---> protobuf.ScanRequest
 	if err := c.sendRequest(conn, pkt, req); err != nil {
@@ -385,7 +383,8 @@ func (c *GsiScanClient) RangePrimary(
 func (c *GsiScanClient) ScanAll(
 	defnID uint64, requestId string, limit int64,
 	cons common.Consistency, vector *TsConsistency,
-	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId) (error, bool) {
+	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId,
+	priority common.ScanPriority) (error, bool) {
 
 	connectn, err := c.pool.Get()
 	if err != nil {
@@ -415,10 +414,10 @@ func (c *GsiScanClient) ScanAll(
 		Cons:         proto.Uint32(uint32(cons)),
 		RollbackTime: proto.Int64(rollbackTime),
 		PartitionIds: partnIds,
+		Priority:     protoScanPriority(priority),
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 	if err := c.sendRequest(conn, pkt, req); err != nil {
 		fmsg := "%v ScanAll(%v) request transport failed `%v`\n"
@@ -548,8 +547,7 @@ func (c *GsiScanClient) MultiScan(
 		Sorted:          proto.Bool(true),
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 	// ---> protobuf.ScanRequest
 	if err := c.sendRequest(conn, pkt, req); err != nil {
@@ -685,8 +683,7 @@ func (c *GsiScanClient) MultiScanPrimary(
 		Sorted:          proto.Bool(true),
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 	// ---> protobuf.ScanRequest
 	if err := c.sendRequest(conn, pkt, req); err != nil {
@@ -713,7 +710,8 @@ func (c *GsiScanClient) MultiScanPrimary(
 // CountLookup to count number entries for given set of keys.
 func (c *GsiScanClient) CountLookup(
 	defnID uint64, requestId string, values []common.SecondaryKey,
-	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId) (int64, error) {
+	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId,
+	priority common.ScanPriority) (int64, error) {
 
 	// serialize match value.
 	equals := make([][]byte, 0, len(values))
@@ -737,10 +735,10 @@ func (c *GsiScanClient) CountLookup(
 		Cons:         proto.Uint32(uint32(cons)),
 		RollbackTime: proto.Int64(rollbackTime),
 		PartitionIds: partnIds,
+		Priority:     protoScanPriority(priority),
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 	resp, err := c.doRequestResponse(req, requestId)
 	if err != nil {
@@ -757,7 +755,8 @@ func (c *GsiScanClient) CountLookup(
 // CountLookup to count number entries for given set of keys for primary index
 func (c *GsiScanClient) CountLookupPrimary(
 	defnID uint64, requestId string, values [][]byte,
-	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId) (int64, error) {
+	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId,
+	priority common.ScanPriority) (int64, error) {
 
 	partnIds := make([]uint64, len(partitions))
 	for i, partnId := range partitions {
@@ -771,10 +770,10 @@ func (c *GsiScanClient) CountLookupPrimary(
 		Cons:         proto.Uint32(uint32(cons)),
 		RollbackTime: proto.Int64(rollbackTime),
 		PartitionIds: partnIds,
+		Priority:     protoScanPriority(priority),
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 	resp, err := c.doRequestResponse(req, requestId)
 	if err != nil {
@@ -791,7 +790,8 @@ func (c *GsiScanClient) CountLookupPrimary(
 // CountRange to count number entries in the given range.
 func (c *GsiScanClient) CountRange(
 	defnID uint64, requestId string, low, high common.SecondaryKey, inclusion Inclusion,
-	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId) (int64, error) {
+	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId,
+	priority common.ScanPriority) (int64, error) {
 
 	// serialize low and high values.
 	l, err := json.Marshal(low)
@@ -819,10 +819,10 @@ func (c *GsiScanClient) CountRange(
 		Cons:         proto.Uint32(uint32(cons)),
 		RollbackTime: proto.Int64(rollbackTime),
 		PartitionIds: partnIds,
+		Priority:     protoScanPriority(priority),
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 
 	resp, err := c.doRequestResponse(req, requestId)
@@ -840,7 +840,8 @@ func (c *GsiScanClient) CountRange(
 // CountRange to count number entries in the given range for primary index
 func (c *GsiScanClient) CountRangePrimary(
 	defnID uint64, requestId string, low, high []byte, inclusion Inclusion,
-	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId) (int64, error) {
+	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId,
+	priority common.ScanPriority) (int64, error) {
 
 	partnIds := make([]uint64, len(partitions))
 	for i, partnId := range partitions {
@@ -858,10 +859,10 @@ func (c *GsiScanClient) CountRangePrimary(
 		Cons:         proto.Uint32(uint32(cons)),
 		RollbackTime: proto.Int64(rollbackTime),
 		PartitionIds: partnIds,
+		Priority:     protoScanPriority(priority),
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 
 	resp, err := c.doRequestResponse(req, requestId)
@@ -878,7 +879,8 @@ func (c *GsiScanClient) CountRangePrimary(
 
 func (c *GsiScanClient) MultiScanCount(
 	defnID uint64, requestId string, scans Scans, distinct bool,
-	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId) (int64, error) {
+	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId,
+	priority common.ScanPriority) (int64, error) {
 
 	// serialize scans
 	protoScans := make([]*protobuf.Scan, len(scans))
@@ -948,11 +950,11 @@ func (c *GsiScanClient) MultiScanCount(
 		Cons:         proto.Uint32(uint32(cons)),
 		RollbackTime: proto.Int64(rollbackTime),
 		PartitionIds: partnIds,
+		Priority:     protoScanPriority(priority),
 	}
 
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 
 	resp, err := c.doRequestResponse(req, requestId)
@@ -969,7 +971,8 @@ func (c *GsiScanClient) MultiScanCount(
 
 func (c *GsiScanClient) MultiScanCountPrimary(
 	defnID uint64, requestId string, scans Scans, distinct bool,
-	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId) (int64, error) {
+	cons common.Consistency, vector *TsConsistency, rollbackTime int64, partitions []common.PartitionId,
+	priority common.ScanPriority) (int64, error) {
 
 	var what string
 	// serialize scans
@@ -1046,11 +1049,11 @@ func (c *GsiScanClient) MultiScanCountPrimary(
 		Cons:         proto.Uint32(uint32(cons)),
 		RollbackTime: proto.Int64(rollbackTime),
 		PartitionIds: partnIds,
+		Priority:     protoScanPriority(priority),
 	}
 
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
 	}
 
 	resp, err := c.doRequestResponse(req, requestId)
@@ -1070,58 +1073,12 @@ func (c *GsiScanClient) Scan3(
 	reverse, distinct bool, projection *IndexProjection, offset, limit int64,
 	groupAggr *GroupAggr, sorted bool,
 	cons common.Consistency, vector *TsConsistency,
-	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId) (error, bool) {
-
-	// serialize scans
-	protoScans := make([]*protobuf.Scan, len(scans))
-	for i, scan := range scans {
-		if scan != nil {
-			var equals [][]byte
-			var filters []*protobuf.CompositeElementFilter
-
-			// If Seek is there, then do not marshall Range
-			if len(scan.Seek) > 0 {
-				equals = make([][]byte, len(scan.Seek))
-				for i, seek := range scan.Seek {
-					s, err := json.Marshal(seek)
-					if err != nil {
-						return err, false
-					}
-					equals[i] = s
-				}
-			} else {
-				filters = make([]*protobuf.CompositeElementFilter, len(scan.Filter))
-				if scan.Filter != nil {
-					for j, f := range scan.Filter {
-						var l, h []byte
-						var err error
-						if f.Low != common.MinUnbounded { // Do not encode if unbounded
-							l, err = json.Marshal(f.Low)
-							if err != nil {
-								return err, false
-							}
-						}
-						if f.High != common.MaxUnbounded { // Do not encode if unbounded
-							h, err = json.Marshal(f.High)
-							if err != nil {
-								return err, false
-							}
-						}
+	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId,
+	opts *scanOptions) (error, bool) {
 
-						fl := &protobuf.CompositeElementFilter{
-							Low: l, High: h, Inclusion: proto.Uint32(uint32(f.Inclusion)),
-						}
-
-						filters[j] = fl
-					}
-				}
-			}
-			s := &protobuf.Scan{
-				Filters: filters,
-				Equals:  equals,
-			}
-			protoScans[i] = s
-		}
+	protoScans, err := marshallScans(scans)
+	if err != nil {
+		return err, false
 	}
 
 	//IndexProjection
@@ -1197,23 +1154,31 @@ func (c *GsiScanClient) Scan3(
 		Span: &protobuf.Span{
 			Range: nil,
 		},
-		RequestId:       proto.String(requestId),
-		Distinct:        proto.Bool(distinct),
-		Limit:           proto.Int64(limit),
-		Cons:            proto.Uint32(uint32(cons)),
-		Scans:           protoScans,
-		Indexprojection: protoProjection,
-		Reverse:         proto.Bool(reverse),
-		Offset:          proto.Int64(offset),
-		RollbackTime:    proto.Int64(rollbackTime),
-		PartitionIds:    partnIds,
-		GroupAggr:       protoGroupAggr,
-		Sorted:          proto.Bool(sorted),
+		RequestId:        proto.String(requestId),
+		Distinct:         proto.Bool(distinct),
+		Limit:            proto.Int64(limit),
+		Cons:             proto.Uint32(uint32(cons)),
+		Scans:            protoScans,
+		Indexprojection:  protoProjection,
+		Reverse:          proto.Bool(reverse),
+		Offset:           proto.Int64(offset),
+		RollbackTime:     proto.Int64(rollbackTime),
+		PartitionIds:     partnIds,
+		GroupAggr:        protoGroupAggr,
+		Sorted:           proto.Bool(sorted),
+		WithContinuation: proto.Bool(opts.withContinuation),
+		Continuation:     opts.continuation,
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
+	}
+	if opts.asOfTime != 0 {
+		req.AsOfTime = proto.Int64(opts.asOfTime)
 	}
+	if opts.asOfVector != nil {
+		req.AsOfVector = protoTsConsistency(opts.asOfVector)
+	}
+	req.Priority = protoScanPriority(opts.priority)
 	// ---> protobuf.ScanRequest
 	if err := c.sendRequest(conn, pkt, req); err != nil {
 		fmsg := "%v Range(%v) request transport failed `%v`\n"
@@ -1241,65 +1206,10 @@ func (c *GsiScanClient) Scan3Primary(
 	reverse, distinct bool, projection *IndexProjection, offset, limit int64,
 	groupAggr *GroupAggr, sorted bool,
 	cons common.Consistency, vector *TsConsistency,
-	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId) (error, bool) {
+	callb ResponseHandler, rollbackTime int64, partitions []common.PartitionId,
+	opts *scanOptions) (error, bool) {
 
-	var what string
-	// serialize scans
-	protoScans := make([]*protobuf.Scan, 0)
-	for _, scan := range scans {
-		if scan != nil {
-			var equals [][]byte
-			var filters []*protobuf.CompositeElementFilter
-
-			// If Seek is there, then ignore Range
-			if len(scan.Seek) > 0 {
-				var k []byte
-				key := scan.Seek[0]
-				if k, what = curePrimaryKey(key); what == "after" {
-					continue
-				}
-				equals = [][]byte{k}
-			} else {
-				filters = make([]*protobuf.CompositeElementFilter, 0)
-				skip := false
-				if scan.Filter != nil {
-					for _, f := range scan.Filter {
-						var l, h []byte
-						if f.Low != common.MinUnbounded { // Ignore if unbounded
-							if l, what = curePrimaryKey(f.Low); what == "after" {
-								skip = true
-								break
-							}
-						}
-						if f.High != common.MaxUnbounded { // Ignore if unbounded
-							if h, what = curePrimaryKey(f.High); what == "before" {
-								skip = true
-								break
-							}
-						}
-
-						fl := &protobuf.CompositeElementFilter{
-							Low: l, High: h, Inclusion: proto.Uint32(uint32(f.Inclusion)),
-						}
-
-						filters = append(filters, fl)
-					}
-					if skip {
-						continue
-					}
-				}
-			}
-			s := &protobuf.Scan{
-				Filters: filters,
-				Equals:  equals,
-			}
-			protoScans = append(protoScans, s)
-		}
-	}
-
-	if len(protoScans) == 0 {
-		protoScans = append(protoScans, getEmptySpanForPrimary())
-	}
+	protoScans := marshallPrimaryScans(scans)
 
 	//IndexProjection
 	var protoProjection *protobuf.IndexProjection
@@ -1374,23 +1284,31 @@ func (c *GsiScanClient) Scan3Primary(
 		Span: &protobuf.Span{
 			Range: nil,
 		},
-		RequestId:       proto.String(requestId),
-		Distinct:        proto.Bool(distinct),
-		Limit:           proto.Int64(limit),
-		Cons:            proto.Uint32(uint32(cons)),
-		Scans:           protoScans,
-		Indexprojection: protoProjection,
-		Reverse:         proto.Bool(reverse),
-		Offset:          proto.Int64(offset),
-		RollbackTime:    proto.Int64(rollbackTime),
-		PartitionIds:    partnIds,
-		GroupAggr:       protoGroupAggr,
-		Sorted:          proto.Bool(sorted),
+		RequestId:        proto.String(requestId),
+		Distinct:         proto.Bool(distinct),
+		Limit:            proto.Int64(limit),
+		Cons:             proto.Uint32(uint32(cons)),
+		Scans:            protoScans,
+		Indexprojection:  protoProjection,
+		Reverse:          proto.Bool(reverse),
+		Offset:           proto.Int64(offset),
+		RollbackTime:     proto.Int64(rollbackTime),
+		PartitionIds:     partnIds,
+		GroupAggr:        protoGroupAggr,
+		Sorted:           proto.Bool(sorted),
+		WithContinuation: proto.Bool(opts.withContinuation),
+		Continuation:     opts.continuation,
 	}
 	if vector != nil {
-		req.Vector = protobuf.NewTsConsistency(
-			vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+		req.Vector = protoTsConsistency(vector)
+	}
+	if opts.asOfTime != 0 {
+		req.AsOfTime = proto.Int64(opts.asOfTime)
+	}
+	if opts.asOfVector != nil {
+		req.AsOfVector = protoTsConsistency(opts.asOfVector)
 	}
+	req.Priority = protoScanPriority(opts.priority)
 	// ---> protobuf.ScanRequest
 	if err := c.sendRequest(conn, pkt, req); err != nil {
 		fmsg := "%v Range(%v) request transport failed `%v`\n"
@@ -1413,6 +1331,94 @@ func (c *GsiScanClient) Scan3Primary(
 	return err, partial
 }
 
+// intersectScan sends the scans of indexes hosted by this indexer in a
+// single request. Indexer returns the intersection (or union) of their
+// document ids, in sorted order.
+func (c *GsiScanClient) intersectScan(
+	requestId string, targets []*intersectTarget, union bool, limit int64,
+	cons common.Consistency, vector *TsConsistency, priority common.ScanPriority,
+	callb ResponseHandler) (error, bool) {
+
+	indexScans := make([]*protobuf.ScanRequest, len(targets))
+	for i, target := range targets {
+		var protoScans []*protobuf.Scan
+		if target.isPrimary {
+			protoScans = marshallPrimaryScans(target.scans)
+		} else {
+			var err error
+			if protoScans, err = marshallScans(target.scans); err != nil {
+				return err, false
+			}
+		}
+
+		partnIds := make([]uint64, len(target.partitions))
+		for j, partnId := range target.partitions {
+			partnIds[j] = uint64(partnId)
+		}
+
+		indexScans[i] = &protobuf.ScanRequest{
+			DefnID: proto.Uint64(target.defnID),
+			Span: &protobuf.Span{
+				Range: nil,
+			},
+			Distinct:     proto.Bool(false),
+			Limit:        proto.Int64(math.MaxInt64),
+			Cons:         proto.Uint32(uint32(cons)),
+			Scans:        protoScans,
+			RollbackTime: proto.Int64(target.rollbackTime),
+			PartitionIds: partnIds,
+		}
+	}
+
+	connectn, err := c.pool.Get()
+	if err != nil {
+		return err, false
+	}
+	healthy := true
+	closeStream := false
+	conn, pkt := connectn.conn, connectn.pkt
+	defer func() {
+		go func() {
+			if closeStream {
+				_, healthy = c.closeStream(conn, pkt, requestId)
+			}
+			c.pool.Return(connectn, healthy)
+		}()
+	}()
+
+	req := &protobuf.IntersectScanRequest{
+		IndexScans: indexScans,
+		Union:      proto.Bool(union),
+		Cons:       proto.Uint32(uint32(cons)),
+		RequestId:  proto.String(requestId),
+		Limit:      proto.Int64(limit),
+		Priority:   protoScanPriority(priority),
+	}
+	if vector != nil {
+		req.Vector = protoTsConsistency(vector)
+	}
+	// ---> protobuf.IntersectScanRequest
+	if err := c.sendRequest(conn, pkt, req); err != nil {
+		fmsg := "%v IntersectScan(%v) request transport failed `%v`\n"
+		logging.Errorf(fmsg, c.logPrefix, requestId, err)
+		healthy = false
+		return err, false
+	}
+
+	cont, partial := true, false
+	for cont {
+		// <--- protobuf.ResponseStream
+		cont, healthy, err, closeStream = c.streamResponse(conn, pkt, callb, requestId)
+		if err != nil { // if err, cont should have been set to false
+			fmsg := "%v IntersectScan(%v) response failed `%v`\n"
+			logging.Errorf(fmsg, c.logPrefix, requestId, err)
+		} else { // partial succeeded
+			partial = true
+		}
+	}
+	return err, partial
+}
+
 func (c *GsiScanClient) Close() error {
 	return c.pool.Close()
 }
@@ -1565,9 +1571,154 @@ func (c *GsiScanClient) trySetDeadline(conn net.Conn, deadline time.Duration) {
 	}
 }
 
+// serialize scans of secondary index
+func marshallScans(scans Scans) ([]*protobuf.Scan, error) {
+	protoScans := make([]*protobuf.Scan, len(scans))
+	for i, scan := range scans {
+		if scan != nil {
+			var equals [][]byte
+			var filters []*protobuf.CompositeElementFilter
+
+			// If Seek is there, then do not marshall Range
+			if len(scan.Seek) > 0 {
+				equals = make([][]byte, len(scan.Seek))
+				for i, seek := range scan.Seek {
+					s, err := json.Marshal(seek)
+					if err != nil {
+						return nil, err
+					}
+					equals[i] = s
+				}
+			} else {
+				filters = make([]*protobuf.CompositeElementFilter, len(scan.Filter))
+				if scan.Filter != nil {
+					for j, f := range scan.Filter {
+						var l, h []byte
+						var err error
+						if f.Low != common.MinUnbounded { // Do not encode if unbounded
+							l, err = json.Marshal(f.Low)
+							if err != nil {
+								return nil, err
+							}
+						}
+						if f.High != common.MaxUnbounded { // Do not encode if unbounded
+							h, err = json.Marshal(f.High)
+							if err != nil {
+								return nil, err
+							}
+						}
+
+						fl := &protobuf.CompositeElementFilter{
+							Low: l, High: h, Inclusion: proto.Uint32(uint32(f.Inclusion)),
+						}
+
+						filters[j] = fl
+					}
+				}
+			}
+			s := &protobuf.Scan{
+				Filters: filters,
+				Equals:  equals,
+			}
+			protoScans[i] = s
+		}
+	}
+
+	return protoScans, nil
+}
+
+// serialize scans of primary index
+func marshallPrimaryScans(scans Scans) []*protobuf.Scan {
+	var what string
+	protoScans := make([]*protobuf.Scan, 0)
+	for _, scan := range scans {
+		if scan != nil {
+			var equals [][]byte
+			var filters []*protobuf.CompositeElementFilter
+
+			// If Seek is there, then ignore Range
+			if len(scan.Seek) > 0 {
+				var k []byte
+				key := scan.Seek[0]
+				if k, what = curePrimaryKey(key); what == "after" {
+					continue
+				}
+				equals = [][]byte{k}
+			} else {
+				filters = make([]*protobuf.CompositeElementFilter, 0)
+				skip := false
+				if scan.Filter != nil {
+					for _, f := range scan.Filter {
+						var l, h []byte
+						if f.Low != common.MinUnbounded { // Ignore if unbounded
+							if l, what = curePrimaryKey(f.Low); what == "after" {
+								skip = true
+								break
+							}
+						}
+						if f.High != common.MaxUnbounded { // Ignore if unbounded
+							if h, what = curePrimaryKey(f.High); what == "before" {
+								skip = true
+								break
+							}
+						}
+
+						fl := &protobuf.CompositeElementFilter{
+							Low: l, High: h, Inclusion: proto.Uint32(uint32(f.Inclusion)),
+						}
+
+						filters = append(filters, fl)
+					}
+					if skip {
+						continue
+					}
+				}
+			}
+			s := &protobuf.Scan{
+				Filters: filters,
+				Equals:  equals,
+			}
+			protoScans = append(protoScans, s)
+		}
+	}
+
+	if len(protoScans) == 0 {
+		protoScans = append(protoScans, getEmptySpanForPrimary())
+	}
+
+	return protoScans
+}
+
 func getEmptySpanForPrimary() *protobuf.Scan {
 	fl := &protobuf.CompositeElementFilter{
 		Low: []byte(""), High: []byte(""), Inclusion: proto.Uint32(uint32(0)),
 	}
 	return &protobuf.Scan{Filters: []*protobuf.CompositeElementFilter{fl}}
 }
+
+// scanOptions carries the optional parameters of Scan3 requests.
+type scanOptions struct {
+	withContinuation bool
+	continuation     []byte
+	asOfTime         int64
+	asOfVector       *TsConsistency
+	priority         common.ScanPriority
+}
+
+// protoScanPriority leaves the priority of a normal scan unset, for
+// indexers which do not know about scan priority.
+func protoScanPriority(priority common.ScanPriority) *uint32 {
+	if priority == common.NormalScanPriority {
+		return nil
+	}
+	return proto.Uint32(uint32(priority))
+}
+
+func protoTsConsistency(vector *TsConsistency) *protobuf.TsConsistency {
+	ts := protobuf.NewTsConsistency(
+		vector.Vbnos, vector.Seqnos, vector.Vbuuids, vector.Crc64)
+	if vector.Staleness > 0 {
+		ts.Staleness = proto.Int64(int64(vector.Staleness / time.Millisecond))
+	}
+	return ts
+}
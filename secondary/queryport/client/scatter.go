@@ -82,6 +82,25 @@ type RequestBroker struct {
 	indexOrder     *IndexKeyOrder
 	projDesc       []bool
 	distinct       bool
+	collation      *collatejson.Collation
+
+	// continuation
+	withContinuation bool
+	continuation     []byte
+	lastContinuation []byte
+	resumeRetry      int
+
+	// time travel
+	asOfTime   int64
+	asOfVector *TsConsistency
+
+	// admission priority on the indexer
+	priority common.ScanPriority
+
+	// hedging
+	clientMaker   scanClientMaker
+	hedger        *scanHedger
+	hedgeScanport hedgeScanportPicker
 
 	// stats
 	sendCount    int64
@@ -250,6 +269,128 @@ func (b *RequestBroker) SetIndexOrder(indexOrder *IndexKeyOrder) {
 	b.indexOrder = indexOrder
 }
 
+//
+// Enable continuation tokens in scan responses
+//
+func (b *RequestBroker) EnableContinuation() {
+
+	b.withContinuation = true
+}
+
+//
+// Resume the scan from a continuation token returned by an
+// earlier scan over the same index.
+//
+func (b *RequestBroker) SetContinuation(token []byte) {
+
+	b.withContinuation = true
+	b.continuation = token
+}
+
+//
+// Get continuation settings to be sent with the scan request
+//
+func (b *RequestBroker) GetContinuation() (bool, []byte) {
+
+	return b.withContinuation, b.continuation
+}
+
+//
+// Get the continuation token of the last response accepted by the
+// response handler.  Returns nil if no response has been accepted.
+//
+func (b *RequestBroker) LastContinuation() []byte {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.lastContinuation
+}
+
+//
+// Scan the index as it was at the given time.  Index must be
+// created with snapshot retention.  Retained snapshots are kept in
+// the memory of the indexer, they do not survive an indexer restart.
+//
+func (b *RequestBroker) SetAsOfTime(t time.Time) {
+
+	b.asOfTime = t.UnixNano()
+}
+
+//
+// Scan the index as it was at the given seqnos.  Index must be
+// created with snapshot retention.  Retained snapshots are kept in
+// the memory of the indexer, they do not survive an indexer restart.
+//
+func (b *RequestBroker) SetAsOfVector(vector *TsConsistency) {
+
+	b.asOfVector = vector
+}
+
+//
+// Priority class of the scan.  When the indexer queues scans for
+// admission, scans of a higher priority class are admitted first.
+//
+func (b *RequestBroker) SetPriority(priority common.ScanPriority) {
+
+	b.priority = priority
+}
+
+//
+// Get optional parameters for Scan3 requests
+//
+func (b *RequestBroker) getScanOptions() *scanOptions {
+
+	return &scanOptions{
+		withContinuation: b.withContinuation,
+		continuation:     b.continuation,
+		asOfTime:         b.asOfTime,
+		asOfVector:       b.asOfVector,
+		priority:         b.priority,
+	}
+}
+
+//
+// Wrap the response handler to record continuation tokens.  A token is
+// only recorded if the handler has accepted all the rows of the response,
+// so that resuming from it does not skip any row.
+//
+func (b *RequestBroker) trackContinuation(handler ResponseHandler) ResponseHandler {
+
+	return func(resp ResponseReader) bool {
+		cont := handler(resp)
+		if !cont {
+			return false
+		}
+		if reader, ok := resp.(ContinuationReader); ok {
+			if token := reader.GetContinuation(); token != nil {
+				b.mutex.Lock()
+				b.lastContinuation = token
+				b.mutex.Unlock()
+			}
+		}
+		return cont
+	}
+}
+
+//
+// Enable hedging of scan requests to other replicas
+//
+func (b *RequestBroker) setHedger(hedger *scanHedger, picker hedgeScanportPicker) {
+
+	b.hedger = hedger
+	b.hedgeScanport = picker
+}
+
+//
+// Set the number of times a scan with continuation is resumed after
+// losing its connection
+//
+func (b *RequestBroker) setResumeRetry(retry int) {
+
+	b.resumeRetry = retry
+}
+
 //
 // Close the broker on error
 //
@@ -440,6 +581,7 @@ func (b *RequestBroker) reset() {
 	b.pushdownOffset = b.offset
 	b.pushdownSorted = b.sorted
 	b.projDesc = nil
+	b.collation = nil
 }
 
 //--------------------------
@@ -461,6 +603,14 @@ func (c *RequestBroker) scatter(clientMaker scanClientMaker, index *common.Index
 	c.reset()
 	c.SetNumIndexers(len(partition))
 	c.defn = index
+	c.clientMaker = clientMaker
+
+	if coll := index.Collation; coll != nil {
+		var e error
+		if c.collation, e = collatejson.GetCollation(coll.Locale, coll.Strength, coll.CaseLevel); e != nil {
+			logging.Warnf("scatter: requestId %v invalid collation %v: %v", c.requestId, coll, e)
+		}
+	}
 
 	var ok bool
 	var client []*GsiScanClient
@@ -471,6 +621,11 @@ func (c *RequestBroker) scatter(clientMaker scanClientMaker, index *common.Index
 		return 0, nil, false, true
 	}
 
+	// continuation token refers to a snapshot on a single indexer node
+	if c.withContinuation && len(client) > 1 {
+		return 0, c.makeErrorMap(targetInstId, partition, ErrorContinuationUnsupported), false, false
+	}
+
 	c.analyzeOrderBy(partition, numPartition, index)
 	c.analyzeProjection(partition, numPartition, index)
 	c.changePushdownParams(partition, numPartition, index)
@@ -1023,7 +1178,7 @@ func (c *RequestBroker) compareKey(key1, key2 []value.Value) int {
 
 	for i := 0; i < ln; i++ {
 
-		if r := key1[i].Collate(key2[i]); r != 0 {
+		if r := c.collateValue(key1[i], key2[i]); r != 0 {
 
 			// default: ascending
 			if i >= len(c.projDesc) {
@@ -1043,6 +1198,37 @@ func (c *RequestBroker) compareKey(key1, key2 []value.Value) int {
 	return len(key1) - len(key2)
 }
 
+//
+// Strings of an index with collation are ordered by their collation key,
+// and then by their bytes, same as they are encoded by indexer.
+//
+func (c *RequestBroker) collateValue(v1, v2 value.Value) int {
+
+	if c.collation == nil {
+		return v1.Collate(v2)
+	}
+
+	switch {
+	case v1.Type() == value.STRING && v2.Type() == value.STRING:
+		s1, s2 := []byte(v1.Actual().(string)), []byte(v2.Actual().(string))
+		if r := bytes.Compare(c.collation.Key(s1), c.collation.Key(s2)); r != 0 {
+			return r
+		}
+		return bytes.Compare(s1, s2)
+
+	case v1.Type() == value.ARRAY && v2.Type() == value.ARRAY:
+		a1, a2 := v1.Actual().([]interface{}), v2.Actual().([]interface{})
+		for i := 0; i < len(a1) && i < len(a2); i++ {
+			if r := c.collateValue(value.NewValue(a1[i]), value.NewValue(a2[i])); r != 0 {
+				return r
+			}
+		}
+		return len(a1) - len(a2)
+	}
+
+	return v1.Collate(v2)
+}
+
 // This function compares the primary key.
 // Returns –int, 0 or +int depending on if key1
 // sorts less than, equal to, or greater than key2.
@@ -1068,7 +1254,16 @@ func (c *RequestBroker) scanSingleNode(id ResponseHandlerId, client *GsiScanClie
 	}
 
 	begin := time.Now()
-	err, partial := c.scan(client, index, rollback, partition, c.factory(id, instId, partition))
+
+	var err error
+	var partial bool
+	if c.canHedge() {
+		err, partial, instId = c.hedgedScan(id, client, index, instId, rollback, partition, begin)
+	} else {
+		err, partial = c.scan(client, index, rollback, partition, c.factory(id, instId, partition))
+		err, partial = c.resumeScan(id, client, index, instId, rollback, partition, err, partial)
+	}
+
 	if err != nil {
 		// If there is any error, then stop the broker.
 		// This will force other go-routine to terminate.
@@ -1089,6 +1284,159 @@ func (c *RequestBroker) scanSingleNode(id ResponseHandlerId, client *GsiScanClie
 	donech <- &doneStatus{err: err, partial: partial}
 }
 
+//
+// Resume a scan with continuation that has lost its connection, from the
+// continuation token of the last response accepted.  The scan is resumed on
+// the same indexer node, which holds the snapshot lease of the token, so
+// the rows received after resuming are from the same snapshot.
+//
+func (c *RequestBroker) resumeScan(id ResponseHandlerId, client *GsiScanClient, index *common.IndexDefn, instId uint64,
+	rollback int64, partition []common.PartitionId, err error, partial bool) (error, bool) {
+
+	for retry := 0; retry < c.resumeRetry && c.canResume(err); retry++ {
+		logging.Warnf("scanSingleNode: requestId %v inst %v partition %v resuming scan (%v) after error %v",
+			c.requestId, instId, partition, retry+1, err)
+
+		c.continuation = c.LastContinuation()
+
+		var resumed bool
+		err, resumed = c.scan(client, index, rollback, partition, c.factory(id, instId, partition))
+		partial = partial || resumed
+	}
+
+	return err, partial
+}
+
+func (c *RequestBroker) canResume(err error) bool {
+
+	return err != nil && c.withContinuation && !c.isClose() &&
+		isConnectionLost(err) && c.LastContinuation() != nil
+}
+
+//
+// A hedged scan could be answered by a different indexer node. A continuation
+// token is only valid on the node holding its snapshot lease.
+//
+func (c *RequestBroker) canHedge() bool {
+
+	return c.hedger.enabled() && c.hedgeScanport != nil && c.clientMaker != nil && !c.withContinuation
+}
+
+type hedgeStatus struct {
+	attempt int32
+	err     error
+	partial bool
+	instId  uint64
+}
+
+//
+// This function makes a scan request through a single connection.  If there is no
+// response within the hedging delay, the same request is sent to another replica.
+// The first attempt to respond wins and the response handler of the other attempt
+// returns false on its first response, which will close its stream.  An attempt
+// failing without any response does not win while the other attempt is still
+// outstanding.  It returns the instance that has served the scan.
+//
+func (c *RequestBroker) hedgedScan(id ResponseHandlerId, client *GsiScanClient, index *common.IndexDefn, instId uint64,
+	rollback int64, partition []common.PartitionId, begin time.Time) (error, bool, uint64) {
+
+	defnId := uint64(index.DefnId)
+
+	winner := int32(-1)
+	donech := make(chan *hedgeStatus, 2)
+
+	claim := func(attempt int32) bool {
+		if atomic.CompareAndSwapInt32(&winner, -1, attempt) {
+			c.hedger.record(defnId, time.Since(begin))
+			return true
+		}
+		return atomic.LoadInt32(&winner) == attempt
+	}
+
+	run := func(attempt int32, client *GsiScanClient, instId uint64, rollback int64) {
+		handler := c.factory(id, instId, partition)
+		gated := func(resp ResponseReader) bool {
+			if !claim(attempt) {
+				return false
+			}
+			return handler(resp)
+		}
+
+		err, partial := c.scan(client, index, rollback, partition, gated)
+		donech <- &hedgeStatus{attempt: attempt, err: err, partial: partial, instId: instId}
+	}
+
+	go run(0, client, instId, rollback)
+	outstanding := 1
+
+	var timeoutch <-chan time.Time
+	if delay, ok := c.hedger.delay(defnId); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeoutch = timer.C
+	}
+
+	for {
+		select {
+		case <-timeoutch:
+			timeoutch = nil
+			if atomic.LoadInt32(&winner) == -1 && c.hedge(defnId, instId, partition, run) {
+				outstanding++
+			}
+
+		case status := <-donech:
+			outstanding--
+
+			// the last outstanding attempt wins if no attempt has responded
+			if outstanding == 0 {
+				atomic.CompareAndSwapInt32(&winner, -1, status.attempt)
+			}
+
+			if status.attempt == atomic.LoadInt32(&winner) {
+				if status.attempt != 0 {
+					c.hedger.won()
+					logging.Debugf("hedgedScan: requestId %v hedge to inst %v won over inst %v", c.requestId, status.instId, instId)
+				}
+				return status.err, status.partial, status.instId
+			}
+
+			if status.err != nil {
+				logging.Debugf("hedgedScan: requestId %v inst %v failed without response, waiting for "+
+					"the other attempt: %v", c.requestId, status.instId, status.err)
+			}
+		}
+	}
+}
+
+//
+// Send the scan request to another replica, if there is one and the hedging budget allows.
+// Return true if the request has been sent.
+//
+func (c *RequestBroker) hedge(defnId uint64, instId uint64, partition []common.PartitionId,
+	run func(int32, *GsiScanClient, uint64, int64)) bool {
+
+	queryport, hedgeInstId, rollback, ok := c.hedgeScanport(defnId, instId, partition)
+	if !ok {
+		return false
+	}
+
+	client := c.clientMaker(queryport)
+	if client == nil {
+		return false
+	}
+
+	if !c.hedger.acquire() {
+		return false
+	}
+
+	c.hedger.fired()
+	logging.Debugf("hedgedScan: requestId %v inst %v partition %v hedged to inst %v at %v",
+		c.requestId, instId, partition, hedgeInstId, queryport)
+
+	go run(1, client, hedgeInstId, rollback)
+	return true
+}
+
 //
 // This function makes a count request through a single connection.
 //
@@ -1281,7 +1629,7 @@ func (c *RequestBroker) filterPartitions(index *common.IndexDefn, partitions [][
 //
 func partitionKeyPos(defn *common.IndexDefn) []int {
 
-	if defn.PartitionScheme == common.SINGLE {
+	if defn.PartitionScheme == common.SINGLE || defn.IsJavaScript() {
 		return nil
 	}
 
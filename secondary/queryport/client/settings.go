@@ -10,8 +10,8 @@
 package client
 
 import (
-	"github.com/couchbase/cbauth/metakv"
 	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/common/metakv"
 	"github.com/couchbase/indexing/secondary/logging"
 	"math"
 	"sync"
@@ -28,6 +28,9 @@ type ClientSettings struct {
 	prune_replica  int32
 	queueSize      uint64
 	concurrency    uint32
+	hedgePct       uint64
+	hedgeMinDelay  int64
+	hedgeBudget    uint64
 	config         common.Config
 	cancelCh       chan struct{}
 
@@ -158,6 +161,27 @@ func (s *ClientSettings) handleSettings(config common.Config) {
 		logging.Errorf("ClientSettings: invalid setting value for max_concurrency=%v", concurrency)
 	}
 
+	hedgePct := config["queryport.client.scan.hedge_percentile"].Float64()
+	if hedgePct >= 0 && hedgePct <= 100 {
+		atomic.StoreUint64(&s.hedgePct, math.Float64bits(hedgePct))
+	} else {
+		logging.Errorf("ClientSettings: invalid setting value for hedge_percentile=%v", hedgePct)
+	}
+
+	hedgeMinDelay := config["queryport.client.scan.hedge_min_delay"].Int()
+	if hedgeMinDelay >= 0 {
+		atomic.StoreInt64(&s.hedgeMinDelay, int64(hedgeMinDelay))
+	} else {
+		logging.Errorf("ClientSettings: invalid setting value for hedge_min_delay=%v", hedgeMinDelay)
+	}
+
+	hedgeBudget := config["queryport.client.scan.hedge_budget"].Float64()
+	if hedgeBudget >= 0 {
+		atomic.StoreUint64(&s.hedgeBudget, math.Float64bits(hedgeBudget))
+	} else {
+		logging.Errorf("ClientSettings: invalid setting value for hedge_budget=%v", hedgeBudget)
+	}
+
 	storageMode := config["indexer.settings.storage_mode"].String()
 	if len(storageMode) != 0 {
 		func() {
@@ -217,3 +241,17 @@ func (s *ClientSettings) ScanQueueSize() uint64 {
 func (s *ClientSettings) MaxConcurrency() uint32 {
 	return atomic.LoadUint32(&s.concurrency)
 }
+
+func (s *ClientSettings) HedgePercentile() float64 {
+	bits := atomic.LoadUint64(&s.hedgePct)
+	return math.Float64frombits(bits)
+}
+
+func (s *ClientSettings) HedgeMinDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.hedgeMinDelay)) * time.Millisecond
+}
+
+func (s *ClientSettings) HedgeBudget() float64 {
+	bits := atomic.LoadUint64(&s.hedgeBudget)
+	return math.Float64frombits(bits)
+}
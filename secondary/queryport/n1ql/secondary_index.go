@@ -496,6 +496,11 @@ func (gsi *gsiKeyspace) Refresh() errors.Error {
 		for _, index := range indexes {
 			if index.Definition.Bucket != gsi.keyspace {
 				continue
+			} else if index.Definition.IsJavaScript() {
+				// N1QL cannot match its expressions with a query,
+				// JavaScript indexes are only scanned with the GSI
+				// client or the REST API.
+				continue
 			}
 			si, err := newSecondaryIndexFromMetaData(gsi, clusterVersion, index)
 			if err != nil {
@@ -790,8 +795,9 @@ func (si *secondaryIndex) Count(span *datastore.Span,
 
 	if span.Seek != nil {
 		seek := values2SKey(span.Seek)
+		gsicons, gsivector := n1ql2GsiCons(cons, vector)
 		count, e := client.CountLookup(si.defnID, "", []c.SecondaryKey{seek},
-			n1ql2GsiConsistency[cons], vector2ts(vector))
+			gsicons, gsivector)
 		if e != nil {
 			return 0, n1qlError(client, e)
 		}
@@ -800,8 +806,9 @@ func (si *secondaryIndex) Count(span *datastore.Span,
 	}
 	low, high := values2SKey(span.Range.Low), values2SKey(span.Range.High)
 	incl := n1ql2GsiInclusion[span.Range.Inclusion]
+	gsicons, gsivector := n1ql2GsiCons(cons, vector)
 	count, e := client.CountRange(si.defnID, "", low, high, incl,
-		n1ql2GsiConsistency[cons], vector2ts(vector))
+		gsicons, gsivector)
 	if e != nil {
 		return 0, n1qlError(client, e)
 	}
@@ -863,9 +870,10 @@ func (si *secondaryIndex) Scan(
 	if span.Seek != nil {
 		seek := values2SKey(span.Seek)
 		broker = makeRequestBroker(requestId, si, client, conn, cnf, &waitGroup, &backfillSync, cap(entryChannel))
+		gsicons, gsivector := n1ql2GsiCons(cons, vector)
 		err := client.LookupInternal(
 			si.defnID, requestId, []c.SecondaryKey{seek}, distinct, limit,
-			n1ql2GsiConsistency[cons], vector2ts(vector), broker)
+			gsicons, gsivector, broker)
 		if err != nil {
 			conn.Error(n1qlError(client, err))
 		}
@@ -873,9 +881,10 @@ func (si *secondaryIndex) Scan(
 		low, high := values2SKey(span.Range.Low), values2SKey(span.Range.High)
 		incl := n1ql2GsiInclusion[span.Range.Inclusion]
 		broker = makeRequestBroker(requestId, si, client, conn, cnf, &waitGroup, &backfillSync, cap(entryChannel))
+		gsicons, gsivector := n1ql2GsiCons(cons, vector)
 		err := client.RangeInternal(
 			si.defnID, requestId, low, high, incl, distinct, limit,
-			n1ql2GsiConsistency[cons], vector2ts(vector), broker)
+			gsicons, gsivector, broker)
 		if err != nil {
 			conn.Error(n1qlError(client, err))
 		}
@@ -908,9 +917,10 @@ func (si *secondaryIndex) ScanEntries(
 
 	client, cnf := si.gsi.gsiClient, si.gsi.config
 	broker = makeRequestBroker(requestId, si, client, conn, cnf, &waitGroup, &backfillSync, cap(entryChannel))
+	gsicons, gsivector := n1ql2GsiCons(cons, vector)
 	err := client.ScanAllInternal(
 		si.defnID, requestId, limit,
-		n1ql2GsiConsistency[cons], vector2ts(vector), broker)
+		gsicons, gsivector, broker)
 	if err != nil {
 		conn.Error(n1qlError(client, err))
 	}
@@ -961,10 +971,11 @@ func (si *secondaryIndex2) Scan2(
 	gsiscans := n1qlspanstogsi(spans)
 	gsiprojection := n1qlprojectiontogsi(projection)
 	broker = makeRequestBroker(requestId, &si.secondaryIndex, client, conn, cnf, &waitGroup, &backfillSync, cap(entryChannel))
+	gsicons, gsivector := n1ql2GsiCons(cons, vector)
 	err := client.MultiScanInternal(
 		si.defnID, requestId, gsiscans, reverse, distinct,
 		gsiprojection, offset, limit,
-		n1ql2GsiConsistency[cons], vector2ts(vector),
+		gsicons, gsivector,
 		broker)
 	if err != nil {
 		conn.Error(n1qlError(client, err))
@@ -1008,8 +1019,9 @@ func (si *secondaryIndex2) Count2(requestId string, spans datastore.Spans2,
 
 	gsiscans := n1qlspanstogsi(spans)
 
+	gsicons, gsivector := n1ql2GsiCons(cons, vector)
 	count, e := client.MultiScanCount(si.defnID, requestId, gsiscans, false,
-		n1ql2GsiConsistency[cons], vector2ts(vector))
+		gsicons, gsivector)
 	if e != nil {
 		return 0, n1qlError(client, e)
 	}
@@ -1032,8 +1044,9 @@ func (si *secondaryIndex2) CountDistinct(requestId string, spans datastore.Spans
 
 	gsiscans := n1qlspanstogsi(spans)
 
+	gsicons, gsivector := n1ql2GsiCons(cons, vector)
 	count, e := client.MultiScanCount(si.defnID, requestId, gsiscans, true,
-		n1ql2GsiConsistency[cons], vector2ts(vector))
+		gsicons, gsivector)
 	if e != nil {
 		return 0, n1qlError(client, e)
 	}
@@ -1118,10 +1131,11 @@ func (si *secondaryIndex3) Scan3(
 	gsigroupaggr := n1qlgroupaggrtogsi(groupAggs)
 	indexorder := n1qlindexordertogsi(indexOrders)
 	broker = makeRequestBroker(requestId, &si.secondaryIndex, client, conn, cnf, &waitGroup, &backfillSync, cap(entryChannel))
+	gsicons, gsivector := n1ql2GsiCons(cons, vector)
 	err := client.Scan3Internal(
 		si.defnID, requestId, gsiscans, reverse, distinctAfterProjection,
 		gsiprojection, offset, limit, gsigroupaggr, indexorder,
-		n1ql2GsiConsistency[cons], vector2ts(vector),
+		gsicons, gsivector,
 		broker)
 	if err != nil {
 		conn.Error(n1qlError(client, err))
@@ -1614,6 +1628,20 @@ func string2defnID(id string) uint64 {
 	return defnID
 }
 
+// n1ql2GsiCons maps scan consistency and vector to GSI. If a maximum
+// staleness is configured, unbounded scans use BoundedStalenessConsistency.
+func n1ql2GsiCons(cons datastore.ScanConsistency,
+	vector timestamp.Vector) (c.Consistency, *qclient.TsConsistency) {
+
+	if cons == datastore.UNBOUNDED {
+		if staleness := gIndexConfig.getMaxStaleness(); staleness > 0 {
+			return c.BoundedStalenessConsistency,
+				qclient.NewStalenessConsistency(staleness)
+		}
+	}
+	return n1ql2GsiConsistency[cons], vector2ts(vector)
+}
+
 func vector2ts(vector timestamp.Vector) *qclient.TsConsistency {
 	if vector == nil {
 		return nil
@@ -1904,6 +1932,7 @@ func n1qlaggrtypetogsi(aggrType datastore.AggregateType) c.AggrFuncType {
 
 const gConfigKeyTmpSpaceDir = "query_tmpspace_dir"
 const gConfigKeyTmpSpaceLimit = "query_tmpspace_limit"
+const gConfigKeyMaxStaleness = "query_max_staleness" // in milliseconds
 
 var gIndexConfig indexConfig
 
@@ -1979,6 +2008,14 @@ func (c *indexConfig) validateConfig(conf map[string]interface{}) errors.Error {
 		}
 	}
 
+	if v, ok := conf[gConfigKeyMaxStaleness]; ok {
+		if ms, ok1 := v.(int64); !ok1 || ms < 0 {
+			err := fmt.Errorf("GSI Invalid Config Key %v Value %v", gConfigKeyMaxStaleness, v)
+			l.Errorf(err.Error())
+			return errors.NewError(err, err.Error())
+		}
+	}
+
 	return nil
 }
 
@@ -2048,6 +2085,19 @@ func (c *indexConfig) getConfig() map[string]interface{} {
 
 }
 
+func (c *indexConfig) getMaxStaleness() time.Duration {
+
+	conf := c.getConfig()
+	if conf == nil {
+		return 0
+	}
+
+	if v, ok := conf[gConfigKeyMaxStaleness]; ok {
+		return time.Duration(v.(int64)) * time.Millisecond
+	}
+	return 0
+}
+
 func (gsi *gsiKeyspace) getTmpSpaceDir() string {
 
 	conf := gIndexConfig.getConfig()
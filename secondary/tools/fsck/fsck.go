@@ -0,0 +1,128 @@
+package main
+
+import "encoding/json"
+import "flag"
+import "fmt"
+import "log"
+import "os"
+import "strconv"
+import "strings"
+
+import "github.com/couchbase/indexing/secondary/common"
+import "github.com/couchbase/indexing/secondary/common/queryutil"
+import "github.com/couchbase/indexing/secondary/encryption"
+import "github.com/couchbase/indexing/secondary/indexer"
+
+var options struct {
+	storage string
+	exprs   string
+	desc    string
+	primary bool
+	repair  bool
+	keyfile string
+}
+
+func argParse() string {
+	flag.StringVar(&options.storage, "storage", "forestdb",
+		"storage of the slice: memdb or forestdb")
+	flag.StringVar(&options.exprs, "exprs", "",
+		`secondary expressions of the index, as a JSON array of strings`)
+	flag.StringVar(&options.desc, "desc", "",
+		"comma separated descending order of the index keys, eg. false,true")
+	flag.BoolVar(&options.primary, "primary", false,
+		"the index is a primary index")
+	flag.BoolVar(&options.repair, "repair", false,
+		"rewrite inconsistent back index entries (forestdb only)")
+	flag.StringVar(&options.keyfile, "keyfile", "",
+		"encryption key file of the indexer")
+
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		usage()
+		os.Exit(1)
+	}
+	return args[0]
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage : %s [OPTIONS] <path> \n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  <path> is the directory of a forestdb slice, or of a memdb snapshot\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	path := argParse()
+
+	if options.keyfile != "" {
+		provider, err := encryption.NewFileKeyProvider(options.keyfile)
+		if err != nil {
+			log.Fatalf("Failed to read key file %v: %v", options.keyfile, err)
+		}
+		encryption.SetKeyProvider(provider)
+	}
+
+	defn, err := indexDefn()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var report *indexer.FsckReport
+	switch options.storage {
+	case "forestdb":
+		report, err = indexer.FsckForestDBFile(path, defn, options.repair)
+	case "memdb":
+		if options.repair {
+			log.Fatal("Repair is not supported for memdb snapshots")
+		}
+		report, err = indexer.FsckMemDBSnapshot(path, defn)
+	default:
+		log.Fatalf("Unknown storage %v", options.storage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(data))
+
+	if !report.IsConsistent() {
+		os.Exit(1)
+	}
+}
+
+func indexDefn() (common.IndexDefn, error) {
+	defn := common.IndexDefn{IsPrimary: options.primary}
+	if options.primary {
+		return defn, nil
+	}
+
+	if options.exprs == "" {
+		return defn, fmt.Errorf("Missing -exprs of the secondary index")
+	}
+	if err := json.Unmarshal([]byte(options.exprs), &defn.SecExprs); err != nil {
+		return defn, fmt.Errorf("Invalid -exprs: %v", err)
+	}
+
+	if options.desc != "" {
+		for _, s := range strings.Split(options.desc, ",") {
+			d, err := strconv.ParseBool(strings.TrimSpace(s))
+			if err != nil {
+				return defn, fmt.Errorf("Invalid -desc: %v", err)
+			}
+			defn.Desc = append(defn.Desc, d)
+		}
+		if len(defn.Desc) != len(defn.SecExprs) {
+			return defn, fmt.Errorf("-desc has %v values for %v expressions",
+				len(defn.Desc), len(defn.SecExprs))
+		}
+	}
+
+	var err error
+	defn.IsArrayIndex, _, _, err = queryutil.GetArrayExpressionPosition(defn.SecExprs)
+	return defn, err
+}